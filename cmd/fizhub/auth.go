@@ -0,0 +1,198 @@
+package fizhub
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// API scopes. A key may hold several; admin allows every route.
+const (
+	// scopeRead allows reading status, devices, events and metrics
+	scopeRead = "read"
+	// scopeTap allows injecting taps and committing bonds
+	scopeTap = "tap"
+	// scopeAdmin allows managing readers, firmware and log levels
+	scopeAdmin = "admin"
+	// scopePublic routes need no key
+	scopePublic = ""
+)
+
+// minAPIKeyLength keeps keys long enough not to be guessed
+const minAPIKeyLength = 16
+
+// APIKey grants a caller access to the REST API
+type APIKey struct {
+	// Name identifies the caller in logs
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+}
+
+// apiKey is a configured key, kept only as a hash
+type apiKey struct {
+	name   string
+	hash   [sha256.Size]byte
+	scopes map[string]bool
+}
+
+// callerKey is the context key of the *string that receives the name of
+// the authenticated caller for the request log
+type callerKey struct{}
+
+// readAPIKeyFile reads a JSON list of keys in the format of
+// server.api_keys
+func readAPIKeyFile(path string) ([]APIKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API key file: %w", err)
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode API key file: %w", err)
+	}
+	return keys, nil
+}
+
+// validateAPIKeys reports keys without a unique name, with a short key or
+// with unknown scopes. names collects the names seen so far.
+func validateAPIKeys(keys []APIKey, source string, names map[string]bool, problems *configError) {
+	for i, key := range keys {
+		path := fmt.Sprintf("%s[%d]", source, i)
+		if key.Name == "" {
+			problems.add(path+".name", "must not be empty")
+		} else if names[key.Name] {
+			problems.add(path+".name", "duplicate name %q", key.Name)
+		}
+		names[key.Name] = true
+		if len(key.Key) < minAPIKeyLength {
+			problems.add(path+".key", "must be at least %d characters", minAPIKeyLength)
+		}
+		if len(key.Scopes) == 0 {
+			problems.add(path+".scopes", "must not be empty")
+		}
+		for _, scope := range key.Scopes {
+			checkOneOf(problems, path+".scopes", scope, scopeRead, scopeTap, scopeAdmin)
+		}
+	}
+}
+
+// setupAuth requires API keys on the routes when any are configured
+func (app *Application) setupAuth() error {
+	fileKeys, err := readAPIKeyFile(app.config.Server.APIKeyFile)
+	if err != nil {
+		return err
+	}
+	keys := append(append([]APIKey{}, app.config.Server.APIKeys...), fileKeys...)
+	if len(keys) == 0 {
+		httpLogger.Warn("No API keys configured, the REST API is open to everyone on the network")
+		return nil
+	}
+
+	for _, key := range keys {
+		k := apiKey{
+			name:   key.Name,
+			hash:   sha256.Sum256([]byte(key.Key)),
+			scopes: make(map[string]bool),
+		}
+		for _, scope := range key.Scopes {
+			k.scopes[scope] = true
+		}
+		app.apiKeys = append(app.apiKeys, k)
+	}
+	app.router.Use(app.authenticate)
+	httpLogger.Info("API authentication enabled", "keys", len(app.apiKeys))
+	return nil
+}
+
+// authenticate checks the caller's key against the scope of the route
+func (app *Application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := routeScope(r)
+		if scope == scopePublic {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := app.findAPIKey(requestKey(r))
+		if !ok {
+			httpLogger.Warn("Unauthorized request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fizhub"`)
+			http.Error(w, "missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if caller, ok := r.Context().Value(callerKey{}).(*string); ok {
+			*caller = key.name
+		}
+		if !key.scopes[scope] && !key.scopes[scopeAdmin] {
+			httpLogger.Warn("Forbidden request", "method", r.Method, "path", r.URL.Path, "caller", key.name, "scope", scope)
+			http.Error(w, fmt.Sprintf("API key lacks the %s scope", scope), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeScope returns the scope needed for the matched route. Reads need
+// read, taps and commits need tap, and every other change needs admin.
+// Readers download firmware images without a key.
+func routeScope(r *http.Request) string {
+	template := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			template = t
+		}
+	}
+
+	switch {
+	case template == "/api/firmware/{version}/image":
+		return scopePublic
+	case template == "/api/receive_uid", template == "/api/session/commit":
+		return scopeTap
+	case strings.HasPrefix(template, "/api/admin/"):
+		return scopeAdmin
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		return scopeRead
+	default:
+		return scopeAdmin
+	}
+}
+
+// requestKey returns the key from an "Authorization: Bearer" or X-API-Key
+// header
+func requestKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// findAPIKey returns the configured key matching s
+func (app *Application) findAPIKey(s string) (apiKey, bool) {
+	if s == "" {
+		return apiKey{}, false
+	}
+	hash := sha256.Sum256([]byte(s))
+	for _, key := range app.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], key.hash[:]) == 1 {
+			return key, true
+		}
+	}
+	return apiKey{}, false
+}
+
+// withCaller adds a slot for the authenticated caller to the request
+func withCaller(r *http.Request) (*http.Request, *string) {
+	caller := new(string)
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)), caller
+}
@@ -0,0 +1,295 @@
+package fizhub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fizhub/internal/network"
+	"github.com/gorilla/mux"
+)
+
+// Keys of the test API, one per scope
+const (
+	readKey  = "read-key-0123456789"
+	tapKey   = "tap-key-0123456789"
+	adminKey = "admin-key-0123456789"
+)
+
+var testAPIKeys = []APIKey{
+	{Name: "dashboard", Key: readKey, Scopes: []string{scopeRead}},
+	{Name: "kiosk", Key: tapKey, Scopes: []string{scopeTap}},
+	{Name: "operator", Key: adminKey, Scopes: []string{scopeAdmin}},
+}
+
+// newAuthApp returns an application with keys and a route of each scope
+// that answers "ok"
+func newAuthApp(t *testing.T, keys []APIKey, keyFile string) *Application {
+	t.Helper()
+	app := &Application{router: mux.NewRouter()}
+	app.config.Server.APIKeys = keys
+	app.config.Server.APIKeyFile = keyFile
+	if err := app.setupAuth(); err != nil {
+		t.Fatal(err)
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	app.router.HandleFunc("/api/status", ok).Methods("GET")
+	app.router.HandleFunc("/api/receive_uid", ok).Methods("POST")
+	app.router.HandleFunc("/api/session/commit", ok).Methods("POST")
+	app.router.HandleFunc("/api/devices/{id}", ok).Methods("PUT")
+	app.router.HandleFunc("/api/admin/log-level", ok).Methods("GET")
+	app.router.HandleFunc("/api/firmware/{version}/image", ok).Methods("GET")
+	app.server = &http.Server{Handler: logRequests(app.router)}
+	return app
+}
+
+// newAuthServer serves newAuthApp over plain HTTP
+func newAuthServer(t *testing.T, keys []APIKey, keyFile string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(newAuthApp(t, keys, keyFile).server.Handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// doAuthRequest sends a request with key in header, either Authorization
+// or X-API-Key, and returns the status code
+func doAuthRequest(t *testing.T, client *http.Client, method, url, header, key string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch header {
+	case "Authorization":
+		req.Header.Set(header, "Bearer "+key)
+	case "X-API-Key":
+		req.Header.Set(header, key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	server := newAuthServer(t, testAPIKeys, "")
+	routes := []struct {
+		method, path string
+		scope        string
+	}{
+		{"GET", "/api/status", scopeRead},
+		{"POST", "/api/receive_uid", scopeTap},
+		{"POST", "/api/session/commit", scopeTap},
+		{"PUT", "/api/devices/FIZR001", scopeAdmin},
+		{"GET", "/api/admin/log-level", scopeAdmin},
+		{"GET", "/api/firmware/1.0.0/image", scopePublic},
+	}
+	keys := map[string]string{scopeRead: readKey, scopeTap: tapKey, scopeAdmin: adminKey}
+
+	for _, route := range routes {
+		for _, scope := range []string{"", scopeRead, scopeTap, scopeAdmin, "wrong"} {
+			key := keys[scope]
+			if scope == "wrong" {
+				key = "wrong-key-0123456789"
+			}
+			want := http.StatusOK
+			switch {
+			case route.scope == scopePublic, scope == scopeAdmin, scope == route.scope:
+			case key == "" || scope == "wrong":
+				want = http.StatusUnauthorized
+			default:
+				want = http.StatusForbidden
+			}
+
+			name := route.method + " " + route.path + " with " + scope + " key"
+			t.Run(name, func(t *testing.T) {
+				if got := doAuthRequest(t, http.DefaultClient, route.method, server.URL+route.path, "Authorization", key); got != want {
+					t.Fatalf("status %d, want %d", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestAPIKeyHeaders(t *testing.T) {
+	server := newAuthServer(t, testAPIKeys, "")
+	tests := []struct {
+		name   string
+		header string
+		key    string
+		want   int
+	}{
+		{"bearer", "Authorization", readKey, http.StatusOK},
+		{"x-api-key", "X-API-Key", readKey, http.StatusOK},
+		{"no key", "", "", http.StatusUnauthorized},
+		{"empty bearer", "Authorization", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := doAuthRequest(t, http.DefaultClient, "GET", server.URL+"/api/status", tt.header, tt.key); got != tt.want {
+				t.Fatalf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// A refused caller is told how to authenticate
+	resp, err := http.Get(server.URL + "/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("WWW-Authenticate"); got != `Bearer realm="fizhub"` {
+		t.Fatalf("WWW-Authenticate %q", got)
+	}
+}
+
+func TestNoAPIKeysLeavesAPIOpen(t *testing.T) {
+	server := newAuthServer(t, nil, "")
+	if got := doAuthRequest(t, http.DefaultClient, "PUT", server.URL+"/api/devices/FIZR001", "", ""); got != http.StatusOK {
+		t.Fatalf("status %d", got)
+	}
+}
+
+func TestAPIKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-keys.json")
+	data, err := json.Marshal([]APIKey{{Name: "kiosk", Key: tapKey, Scopes: []string{scopeTap}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys from the file work alongside those in the configuration
+	server := newAuthServer(t, testAPIKeys[:1], path)
+	if got := doAuthRequest(t, http.DefaultClient, "POST", server.URL+"/api/receive_uid", "Authorization", tapKey); got != http.StatusOK {
+		t.Fatalf("file key gave status %d", got)
+	}
+	if got := doAuthRequest(t, http.DefaultClient, "GET", server.URL+"/api/status", "Authorization", readKey); got != http.StatusOK {
+		t.Fatalf("configured key gave status %d", got)
+	}
+
+	bad := filepath.Join(t.TempDir(), "api-keys.json")
+	if err := os.WriteFile(bad, []byte(`{"name": "kiosk"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, keyFile := range []string{bad, filepath.Join(t.TempDir(), "missing.json")} {
+		app := &Application{router: mux.NewRouter()}
+		app.config.Server.APIKeyFile = keyFile
+		if err := app.setupAuth(); err == nil {
+			t.Errorf("setupAuth with %s succeeded", keyFile)
+		}
+	}
+}
+
+func TestValidateAPIKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		key  APIKey
+		want string
+	}{
+		{"no name", APIKey{Key: adminKey, Scopes: []string{scopeAdmin}}, "keys[1].name"},
+		{"duplicate name", APIKey{Name: "dashboard", Key: adminKey, Scopes: []string{scopeAdmin}}, "keys[1].name"},
+		{"short key", APIKey{Name: "kiosk", Key: "short", Scopes: []string{scopeTap}}, "keys[1].key"},
+		{"no scopes", APIKey{Name: "kiosk", Key: tapKey}, "keys[1].scopes"},
+		{"unknown scope", APIKey{Name: "kiosk", Key: tapKey, Scopes: []string{"write"}}, "keys[1].scopes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := &configError{source: "test"}
+			validateAPIKeys([]APIKey{testAPIKeys[0], tt.key}, "keys", make(map[string]bool), problems)
+			if len(problems.problems) != 1 || !hasProblem(problems, tt.want) {
+				t.Fatalf("problems %q, want one with %s", problems.problems, tt.want)
+			}
+		})
+	}
+
+	problems := &configError{source: "test"}
+	validateAPIKeys(testAPIKeys, "keys", make(map[string]bool), problems)
+	if len(problems.problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+func TestRequestsAreLogged(t *testing.T) {
+	logs := captureLogs(t)
+	server := newAuthServer(t, testAPIKeys, "")
+
+	doAuthRequest(t, http.DefaultClient, "GET", server.URL+"/api/status", "Authorization", readKey)
+	doAuthRequest(t, http.DefaultClient, "GET", server.URL+"/api/status", "Authorization", "wrong-key-0123456789")
+	doAuthRequest(t, http.DefaultClient, "PUT", server.URL+"/api/devices/FIZR001", "Authorization", tapKey)
+	doAuthRequest(t, http.DefaultClient, "GET", server.URL+"/api/firmware/1.0.0/image", "", "")
+
+	lines := strings.Split(strings.TrimSpace(logs()), "\n")
+	var requests []string
+	for _, line := range lines {
+		if strings.Contains(line, "component=http msg=Request") || strings.Contains(line, `component=http msg="Request failed"`) {
+			requests = append(requests, line)
+		}
+	}
+	want := []string{
+		"level=INFO component=http msg=Request method=GET path=/api/status status=200",
+		`level=INFO component=http msg="Request failed" method=GET path=/api/status status=401`,
+		`level=INFO component=http msg="Request failed" method=PUT path=/api/devices/FIZR001 status=403`,
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("logged requests %q", requests)
+	}
+	for i := range want {
+		if !strings.Contains(requests[i], want[i]) {
+			t.Errorf("line %d is %q, want %q", i, requests[i], want[i])
+		}
+	}
+	for i, caller := range []string{"dashboard", `""`, "kiosk"} {
+		if !strings.HasSuffix(requests[i], "caller="+caller) {
+			t.Errorf("line %d is %q, want caller %s", i, requests[i], caller)
+		}
+	}
+}
+
+func TestServeHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := network.NewCertificateAuthority(dir, "FizHub Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.IssueServerCertificate(dir, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	app := newAuthApp(t, testAPIKeys, "")
+	app.config.Server.TLS.CertFile = filepath.Join(dir, network.HubCertFile)
+	app.config.Server.TLS.KeyFile = filepath.Join(dir, network.HubKeyFile)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.serveHTTP(l)
+	t.Cleanup(func() { app.server.Close() })
+	addr := l.Addr().String()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	t.Cleanup(client.CloseIdleConnections)
+	if got := doAuthRequest(t, client, "GET", "https://"+addr+"/api/status", "Authorization", readKey); got != http.StatusOK {
+		t.Fatalf("status %d over HTTPS", got)
+	}
+	if got := doAuthRequest(t, client, "GET", "https://"+addr+"/api/status", "", ""); got != http.StatusUnauthorized {
+		t.Fatalf("status %d over HTTPS without a key", got)
+	}
+
+	// Plain HTTP is answered with an error, not served
+	if got := doAuthRequest(t, http.DefaultClient, "GET", "http://"+addr+"/api/status", "Authorization", readKey); got != http.StatusBadRequest {
+		t.Fatalf("status %d over plain HTTP", got)
+	}
+}
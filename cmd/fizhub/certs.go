@@ -0,0 +1,97 @@
+package fizhub
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"fizhub/internal/network"
+)
+
+// defaultCertDir is where "fizhub certs" keeps the hub CA and certificates
+const defaultCertDir = "data/certs"
+
+const certsUsage = `usage:
+  fizhub certs init [--dir path] [--hosts name,...]  create the hub CA and server certificate
+  fizhub certs hub [--dir path] [--hosts name,...]   reissue the server certificate
+  fizhub certs reader [--dir path] <device_id>...    issue reader client certificates`
+
+// runCertsCommand runs "fizhub certs", which creates the CA, server and
+// reader certificates for MQTT over TLS
+func runCertsCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(certsUsage)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("certs "+command, flag.ContinueOnError)
+	dir := flags.String("dir", defaultCertDir, "certificate directory")
+	hosts := flags.String("hosts", hubHostname(), "comma-separated host names and IP addresses of the hub")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch command {
+	case "init":
+		ca, err := network.NewCertificateAuthority(*dir, "FizHub CA")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created CA %s\n", filepath.Join(*dir, network.CACertFile))
+		return issueHubCertificate(ca, *dir, *hosts)
+
+	case "hub":
+		ca, err := network.LoadCertificateAuthority(*dir)
+		if err != nil {
+			return err
+		}
+		return issueHubCertificate(ca, *dir, *hosts)
+
+	case "reader":
+		if flags.NArg() == 0 {
+			return errors.New("at least one device ID is required")
+		}
+		ca, err := network.LoadCertificateAuthority(*dir)
+		if err != nil {
+			return err
+		}
+		for _, deviceID := range flags.Args() {
+			certFile, keyFile, err := ca.IssueReaderCertificate(*dir, deviceID)
+			if err != nil {
+				return fmt.Errorf("%s: %w", deviceID, err)
+			}
+			fmt.Printf("Issued %s: %s %s\n", deviceID, certFile, keyFile)
+		}
+		fmt.Printf("Flash each reader with its certificate, key and %s\n", filepath.Join(*dir, network.CACertFile))
+		return nil
+
+	default:
+		return errors.New(certsUsage)
+	}
+}
+
+// issueHubCertificate writes the server certificate and prints the MQTT
+// settings that use it
+func issueHubCertificate(ca *network.CertificateAuthority, dir, hosts string) error {
+	var names []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			names = append(names, host)
+		}
+	}
+	if err := ca.IssueServerCertificate(dir, names); err != nil {
+		return err
+	}
+	fmt.Printf("Issued server certificate for %s\n", strings.Join(names, ", "))
+	fmt.Printf(`Set in the mqtt section of the configuration:
+  "tls": {
+    "port": 8883,
+    "cert_file": %q,
+    "key_file": %q,
+    "ca_file": %q,
+    "require_client_cert": true
+  }
+`, filepath.Join(dir, network.HubCertFile), filepath.Join(dir, network.HubKeyFile), filepath.Join(dir, network.CACertFile))
+	return nil
+}
@@ -0,0 +1,762 @@
+package fizhub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fizhub/internal/audio"
+	"fizhub/internal/led"
+	"fizhub/internal/logging"
+	"fizhub/internal/network"
+	"fizhub/internal/nfc"
+	"fizhub/internal/state"
+)
+
+// defaultConfigPath is read when no configuration file is given
+const defaultConfigPath = "configs/config.json"
+
+// envPrefix starts every environment variable that overrides a setting
+const envPrefix = "FIZHUB_"
+
+// configPathEnv names the configuration file when --config is not given
+const configPathEnv = envPrefix + "CONFIG"
+
+type Config struct {
+	DataDir string `json:"data_dir"`
+	Server  struct {
+		Port string `json:"port"`
+		// TLS serves the REST API over HTTPS when both files are set
+		TLS struct {
+			CertFile string `json:"cert_file"`
+			KeyFile  string `json:"key_file"`
+		} `json:"tls"`
+		// APIKeys and the keys in APIKeyFile are required on every route
+		// when there are any
+		APIKeys    []APIKey `json:"api_keys"`
+		APIKeyFile string   `json:"api_key_file"`
+	} `json:"server"`
+	Cursive struct {
+		URL     string   `json:"url"`
+		Timeout Duration `json:"timeout"`
+		// RetryCount is how many times a failed request is sent again
+		// straight away, RetryDelay apart, before it is queued
+		RetryCount int      `json:"retry_count"`
+		RetryDelay Duration `json:"retry_delay"`
+		MinBackoff Duration `json:"retry_min_backoff"`
+		MaxBackoff Duration `json:"retry_max_backoff"`
+		MaxAge     Duration `json:"retry_max_age"`
+		// UploadChunkSize is the size in bytes of each recording upload request
+		UploadChunkSize int64    `json:"upload_chunk_size"`
+		UploadMaxAge    Duration `json:"upload_max_age"`
+	} `json:"cursive"`
+	MQTT struct {
+		Port           int      `json:"port"`
+		Username       string   `json:"username"`
+		Password       string   `json:"password"`
+		CommandTimeout Duration `json:"command_timeout"`
+		TapHoldOff     Duration `json:"tap_hold_off"`
+		TapMaxAge      Duration `json:"tap_max_age"`
+		// RequireSignedTaps rejects unsigned taps even from readers
+		// without a signing key
+		RequireSignedTaps bool     `json:"require_signed_taps"`
+		SignatureWindow   Duration `json:"signature_window"`
+		Provisioning      bool     `json:"provisioning"`
+		PairingTimeout    Duration `json:"pairing_timeout"`
+		// HeartbeatInterval is sent to readers on fiz/config
+		HeartbeatInterval Duration `json:"heartbeat_interval"`
+		StaleAfter        Duration `json:"stale_after"`
+		OfflineAfter      Duration `json:"offline_after"`
+		// TLS serves readers on ssl://. Port above may be 0 to only
+		// accept TLS.
+		TLS struct {
+			Port              int    `json:"port"`
+			CertFile          string `json:"cert_file"`
+			KeyFile           string `json:"key_file"`
+			CAFile            string `json:"ca_file"`
+			RequireClientCert bool   `json:"require_client_cert"`
+		} `json:"tls"`
+	} `json:"mqtt"`
+	LED struct {
+		Driver     string `json:"driver"`
+		Device     string `json:"device"`
+		Count      int    `json:"count"`
+		Order      string `json:"order"`
+		Brightness int    `json:"brightness"`
+		FrameRate  int    `json:"frame_rate"`
+	} `json:"led"`
+	NFC struct {
+		PowerTimeout Duration `json:"power_timeout"`
+		Transport    string   `json:"transport"`
+		Device       string   `json:"device"`
+		Address      int      `json:"address"`
+		Speed        int      `json:"speed"`
+		PollInterval Duration `json:"poll_interval"`
+	} `json:"nfc"`
+	Power struct {
+		IdleTimeout    Duration `json:"idle_timeout"`
+		DeepSleepDelay Duration `json:"deep_sleep_delay"`
+	} `json:"power"`
+	Session struct {
+		MinBondSize       int      `json:"min_bond_size"`
+		MaxBondSize       int      `json:"max_bond_size"`
+		CollectingTimeout Duration `json:"collecting_timeout"`
+		ValidatingTimeout Duration `json:"validating_timeout"`
+		RecordingTimeout  Duration `json:"recording_timeout"`
+		CompleteCooldown  Duration `json:"complete_cooldown"`
+	} `json:"session"`
+	Firmware struct {
+		// BaseURL is the hub address readers download firmware from,
+		// http://<hostname>.local:<server.port> when empty
+		BaseURL       string   `json:"base_url"`
+		MaxSize       int64    `json:"max_size"`
+		MaxConcurrent int      `json:"max_concurrent"`
+		UpdateTimeout Duration `json:"update_timeout"`
+	} `json:"firmware"`
+	Audio struct {
+		Format      audio.Format `json:"format"`
+		MaxDuration Duration     `json:"max_duration"`
+		DeviceID    string       `json:"device_id"`
+		Source      string       `json:"source"`
+		SourcePath  string       `json:"source_path"`
+		// OutputDir is <data_dir>/recordings when empty
+		OutputDir   string `json:"output_dir"`
+		Encoding    string `json:"encoding"`
+		OpusBitrate int    `json:"opus_bitrate"`
+	} `json:"audio"`
+	// SUN checks the SUN data of NTAG 424 DNA tags
+	SUN struct {
+		// Verify is "local" to check taps with the keys in KeyFile,
+		// "cursive" to leave it to Cursive, or empty to pass SUN data on
+		// unchecked
+		Verify  string `json:"verify"`
+		KeyFile string `json:"key_file"`
+		// Require rejects taps without SUN data
+		Require bool `json:"require"`
+	} `json:"sun"`
+	Log logging.Config `json:"log"`
+	// Sessions splits the readers into groups that bond independently. A
+	// single session that takes every reader is used when empty.
+	Sessions []SessionConfig `json:"sessions"`
+}
+
+// Duration is a wrapper around time.Duration for JSON unmarshaling. It
+// accepts Go duration strings such as "90s" and plain numbers of seconds.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case string:
+		return d.set(value)
+	case float64:
+		d.Duration = time.Duration(value * float64(time.Second))
+		return nil
+	default:
+		return errors.New(`invalid duration, use a string such as "30s" or a number of seconds`)
+	}
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// set parses a duration string or a number of seconds
+func (d *Duration) set(s string) error {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		d.Duration = time.Duration(seconds * float64(time.Second))
+		return nil
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf(`invalid duration %q, use a value such as "30s" or "5m"`, s)
+	}
+	d.Duration = duration
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration{})
+
+// configError lists every problem found in a configuration
+type configError struct {
+	source   string
+	problems []string
+}
+
+func (e *configError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid configuration in %s:", e.source)
+	for _, problem := range e.problems {
+		b.WriteString("\n  - ")
+		b.WriteString(problem)
+	}
+	return b.String()
+}
+
+// add records a problem with the setting at path
+func (e *configError) add(path, format string, args ...interface{}) {
+	e.problems = append(e.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// configPath returns the file to load and whether it was chosen explicitly
+func configPath(flagPath string) (string, bool) {
+	if flagPath != "" {
+		return flagPath, true
+	}
+	if path := os.Getenv(configPathEnv); path != "" {
+		return path, true
+	}
+	return defaultConfigPath, false
+}
+
+// loadConfig reads the configuration file over the defaults, applies
+// FIZHUB_* environment variables and validates the result. A missing file
+// is only allowed when it was not given explicitly.
+func loadConfig(flagPath string) (Config, error) {
+	path, explicit := configPath(flagPath)
+	appLogger.Info("Loading configuration", "path", path)
+	config := getDefaultConfig()
+	problems := &configError{source: path}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+		appLogger.Info("Configuration file not found, using defaults", "path", path)
+		problems.source = "defaults"
+	case err != nil:
+		return Config{}, fmt.Errorf("failed to read config: %w", err)
+	default:
+		if err := decodeConfig(data, &config, problems); err != nil {
+			return Config{}, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	overridden := applyEnv(&config, os.Environ(), problems)
+	if len(overridden) > 0 {
+		problems.source += " and environment"
+	}
+	config.validate(problems)
+	if len(problems.problems) > 0 {
+		return Config{}, problems
+	}
+	appLogger.Info("Configuration loaded successfully", "overrides", overridden)
+	return config, nil
+}
+
+// decodeConfig strictly decodes data into config. Unknown fields and
+// values of the wrong type are all added to problems and left out, so the
+// rest can still be validated. Only malformed JSON is returned as an error.
+func decodeConfig(data []byte, config *Config, problems *configError) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	if !checkValue(raw, reflect.TypeOf(*config), "", problems) {
+		return nil
+	}
+
+	cleaned, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(cleaned, config)
+}
+
+// checkValue reports fields of a decoded JSON value that are unknown to t
+// or have the wrong type, and removes them. It returns false when the value
+// itself has the wrong type.
+func checkValue(value interface{}, t reflect.Type, path string, problems *configError) bool {
+	if value == nil {
+		return true
+	}
+	if t == durationType {
+		switch v := value.(type) {
+		case string:
+			var d Duration
+			if err := d.set(v); err != nil {
+				problems.add(path, "%v", err)
+				return false
+			}
+		case json.Number:
+		default:
+			problems.add(path, `must be a duration such as "30s" or a number of seconds`)
+			return false
+		}
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			problems.add(path, "must be an object")
+			return false
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(object) {
+			field, ok := fields[key]
+			if !ok {
+				problems.add(joinPath(path, key), "unknown field")
+				delete(object, key)
+				continue
+			}
+			if !checkValue(object[key], field.Type, joinPath(path, key), problems) {
+				delete(object, key)
+			}
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			problems.add(path, "must be an object")
+			return false
+		}
+		for _, key := range sortedKeys(object) {
+			if !checkValue(object[key], t.Elem(), joinPath(path, key), problems) {
+				delete(object, key)
+			}
+		}
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			problems.add(path, "must be a list")
+			return false
+		}
+		valid := true
+		for i, item := range list {
+			valid = checkValue(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), problems) && valid
+		}
+		return valid
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			problems.add(path, "must be a string")
+			return false
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			problems.add(path, "must be true or false")
+			return false
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(json.Number)
+		if !ok {
+			problems.add(path, "must be a number")
+			return false
+		}
+		if _, err := strconv.ParseInt(n.String(), 10, t.Bits()); err != nil {
+			problems.add(path, "must be a whole number, got %s", n)
+			return false
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(json.Number); !ok {
+			problems.add(path, "must be a number")
+			return false
+		}
+	}
+	return true
+}
+
+// jsonFields maps the JSON names of a struct's fields to the fields
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// envName returns the environment variable that overrides the setting at
+// a dotted JSON path, so mqtt.password is FIZHUB_MQTT_PASSWORD
+func envName(path string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// applyEnv overrides settings with FIZHUB_* variables from environ and
+// returns the names of the variables used. Lists and maps such as
+// FIZHUB_SESSIONS take JSON.
+func applyEnv(config *Config, environ []string, problems *configError) []string {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(name, envPrefix) && name != configPathEnv {
+			env[name] = strings.TrimPrefix(kv, name+"=")
+		}
+	}
+
+	var used []string
+	setFromEnv(reflect.ValueOf(config).Elem(), "", env, &used, problems)
+	sort.Strings(used)
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !containsString(used, name) {
+			problems.add(name, "unknown environment variable")
+		}
+	}
+	return used
+}
+
+// setFromEnv walks the settings below v and sets those that have a value
+// in env
+func setFromEnv(v reflect.Value, path string, env map[string]string, used *[]string, problems *configError) {
+	if v.Kind() == reflect.Struct && v.Type() != durationType {
+		for name, field := range jsonFields(v.Type()) {
+			setFromEnv(v.FieldByIndex(field.Index), joinPath(path, name), env, used, problems)
+		}
+		return
+	}
+
+	name := envName(path)
+	s, ok := env[name]
+	if !ok {
+		return
+	}
+	*used = append(*used, name)
+
+	if v.Type() == durationType {
+		var d Duration
+		if err := d.set(s); err != nil {
+			problems.add(name, "%v", err)
+			return
+		}
+		v.Set(reflect.ValueOf(d))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			problems.add(name, "must be true or false, got %q", s)
+			return
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			problems.add(name, "must be a whole number, got %q", s)
+			return
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			problems.add(name, "must be a number, got %q", s)
+			return
+		}
+		v.SetFloat(f)
+	case reflect.Slice, reflect.Map:
+		value := reflect.New(v.Type())
+		if err := json.Unmarshal([]byte(s), value.Interface()); err != nil {
+			problems.add(name, "must be JSON: %v", err)
+			return
+		}
+		v.Set(value.Elem())
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks settings that decoded but make no sense
+func (c Config) validate(problems *configError) {
+	if c.DataDir == "" {
+		problems.add("data_dir", "must not be empty")
+	}
+
+	serverPort, err := strconv.Atoi(c.Server.Port)
+	if err != nil || serverPort < 1 || serverPort > 65535 {
+		problems.add("server.port", "must be a port between 1 and 65535, got %q", c.Server.Port)
+	}
+	if c.Server.TLS.CertFile != "" || c.Server.TLS.KeyFile != "" {
+		checkFile(problems, "server.tls.cert_file", c.Server.TLS.CertFile)
+		checkFile(problems, "server.tls.key_file", c.Server.TLS.KeyFile)
+	}
+	names := make(map[string]bool)
+	validateAPIKeys(c.Server.APIKeys, "server.api_keys", names, problems)
+	if fileKeys, err := readAPIKeyFile(c.Server.APIKeyFile); err != nil {
+		problems.add("server.api_key_file", "%v", err)
+	} else {
+		validateAPIKeys(fileKeys, c.Server.APIKeyFile, names, problems)
+	}
+
+	tls := c.MQTT.TLS
+	if c.MQTT.Port == 0 && tls.Port == 0 {
+		problems.add("mqtt.port", "must be set unless mqtt.tls.port is")
+	}
+	checkPort(problems, "mqtt.port", c.MQTT.Port, serverPort)
+	checkPort(problems, "mqtt.tls.port", tls.Port, serverPort)
+	if tls.Port != 0 && tls.Port == c.MQTT.Port {
+		problems.add("mqtt.tls.port", "must differ from mqtt.port")
+	}
+	if tls.Port != 0 {
+		checkFile(problems, "mqtt.tls.cert_file", tls.CertFile)
+		checkFile(problems, "mqtt.tls.key_file", tls.KeyFile)
+	}
+	if tls.CAFile != "" {
+		checkFile(problems, "mqtt.tls.ca_file", tls.CAFile)
+	}
+	if tls.RequireClientCert {
+		if tls.Port == 0 {
+			problems.add("mqtt.tls.require_client_cert", "needs mqtt.tls.port")
+		}
+		if tls.CAFile == "" {
+			problems.add("mqtt.tls.ca_file", "must be set when mqtt.tls.require_client_cert is")
+		}
+	}
+
+	checkURL(problems, "cursive.url", c.Cursive.URL, true)
+	checkURL(problems, "firmware.base_url", c.Firmware.BaseURL, false)
+	checkDurations(reflect.ValueOf(c), "", problems)
+
+	if c.Cursive.RetryCount < 0 {
+		problems.add("cursive.retry_count", "must not be negative")
+	}
+	if c.Cursive.UploadChunkSize < 0 {
+		problems.add("cursive.upload_chunk_size", "must not be negative")
+	}
+	if c.MQTT.Username != "" && c.MQTT.Password == "" {
+		problems.add("mqtt.password", "must be set when mqtt.username is, for example with %s", envName("mqtt.password"))
+	}
+	if c.MQTT.Provisioning && c.MQTT.Username == "" {
+		problems.add("mqtt.username", "must be set when mqtt.provisioning is enabled")
+	}
+	if c.MQTT.StaleAfter.Duration > 0 && c.MQTT.OfflineAfter.Duration > 0 && c.MQTT.OfflineAfter.Duration < c.MQTT.StaleAfter.Duration {
+		problems.add("mqtt.offline_after", "must not be shorter than mqtt.stale_after")
+	}
+
+	checkOneOf(problems, "led.driver", c.LED.Driver, led.DriverSPI, led.DriverCapture)
+	checkOneOf(problems, "led.order", c.LED.Order, led.OrderGRB, led.OrderGRBW)
+	if c.LED.Count < 0 {
+		problems.add("led.count", "must not be negative")
+	}
+	if c.LED.Brightness < 0 || c.LED.Brightness > 255 {
+		problems.add("led.brightness", "must be between 0 and 255, got %d", c.LED.Brightness)
+	}
+	if c.LED.FrameRate < 0 {
+		problems.add("led.frame_rate", "must not be negative")
+	}
+
+	checkOneOf(problems, "nfc.transport", c.NFC.Transport, nfc.TransportI2C, nfc.TransportSPI, nfc.TransportUART, nfc.TransportReplay)
+	if c.NFC.Address < 0 || c.NFC.Address > 0x7f {
+		problems.add("nfc.address", "must be a 7-bit I2C address, got %d", c.NFC.Address)
+	}
+	if c.NFC.Speed < 0 {
+		problems.add("nfc.speed", "must not be negative")
+	}
+
+	checkOneOf(problems, "sun.verify", c.SUN.Verify, network.SUNVerifyLocal, network.SUNVerifyCursive)
+	if c.SUN.Verify == network.SUNVerifyLocal {
+		if c.SUN.KeyFile == "" {
+			problems.add("sun.key_file", "must be set when sun.verify is local")
+		} else if _, err := network.ReadTagKeys(c.SUN.KeyFile); err != nil {
+			problems.add("sun.key_file", "%v", err)
+		}
+	}
+	if c.SUN.Require && c.SUN.Verify == network.SUNVerifyOff {
+		problems.add("sun.require", "needs sun.verify")
+	}
+
+	if c.Session.MinBondSize < 0 {
+		problems.add("session.min_bond_size", "must not be negative")
+	}
+	if c.Session.MaxBondSize < 0 {
+		problems.add("session.max_bond_size", "must not be negative")
+	}
+
+	if c.Firmware.MaxSize < 0 {
+		problems.add("firmware.max_size", "must not be negative")
+	}
+	if c.Firmware.MaxConcurrent < 0 {
+		problems.add("firmware.max_concurrent", "must not be negative")
+	}
+
+	if c.Audio.MaxDuration.Duration <= 0 {
+		problems.add("audio.max_duration", "must be positive")
+	}
+	if err := c.Audio.Format.Validate(); err != nil {
+		problems.add("audio.format", "%v", err)
+	}
+	checkOneOf(problems, "audio.source", c.Audio.Source, audio.SourceALSA, audio.SourceFile, audio.SourceGenerator)
+	if c.Audio.Source == audio.SourceFile && c.Audio.SourcePath == "" {
+		problems.add("audio.source_path", "must be set for the file source")
+	}
+	checkOneOf(problems, "audio.encoding", c.Audio.Encoding, audio.EncodingWAV, audio.EncodingOpus)
+	if c.Audio.OpusBitrate < 0 {
+		problems.add("audio.opus_bitrate", "must not be negative")
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		problems.add("log.level", "%v", err)
+	}
+	checkOneOf(problems, "log.format", c.Log.Format, logging.FormatText, logging.FormatJSON)
+	for component, level := range c.Log.Components {
+		if _, err := logging.ParseLevel(level); err != nil {
+			problems.add("log.components."+component, "%v", err)
+		}
+	}
+}
+
+// checkPort reports an optional port that is out of range or taken by
+// the HTTP server
+func checkPort(problems *configError, path string, port, serverPort int) {
+	switch {
+	case port == 0:
+	case port < 1 || port > 65535:
+		problems.add(path, "must be a port between 1 and 65535, got %d", port)
+	case port == serverPort:
+		problems.add(path, "must differ from server.port")
+	}
+}
+
+// checkFile reports a required file that is not set or cannot be read
+func checkFile(problems *configError, path, file string) {
+	if file == "" {
+		problems.add(path, "must be set")
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		problems.add(path, "%v", err)
+	}
+}
+
+// checkURL reports a URL that is not absolute http or https
+func checkURL(problems *configError, path, s string, required bool) {
+	if s == "" {
+		if required {
+			problems.add(path, "must not be empty")
+		}
+		return
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems.add(path, "must be an http or https URL, got %q", s)
+	}
+}
+
+// checkOneOf reports a value that is neither empty nor one of allowed
+func checkOneOf(problems *configError, path, value string, allowed ...string) {
+	if value == "" || containsString(allowed, value) {
+		return
+	}
+	problems.add(path, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+// checkDurations reports negative durations anywhere below v
+func checkDurations(v reflect.Value, path string, problems *configError) {
+	if v.Type() == durationType {
+		if v.Interface().(Duration).Duration < 0 {
+			problems.add(path, "must not be negative")
+		}
+		return
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	fields := jsonFields(v.Type())
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checkDurations(v.FieldByIndex(fields[name].Index), joinPath(path, name), problems)
+	}
+}
+
+// audioConfig returns the recorder configuration
+func (c Config) audioConfig() audio.Config {
+	return audio.Config{
+		Format:      c.Audio.Format,
+		MaxDuration: c.Audio.MaxDuration.Duration,
+		DeviceID:    c.Audio.DeviceID,
+		Source:      c.Audio.Source,
+		SourcePath:  c.Audio.SourcePath,
+		OutputDir:   c.Audio.OutputDir,
+		Encoding:    c.Audio.Encoding,
+		OpusBitrate: c.Audio.OpusBitrate,
+	}
+}
+
+// getDefaultConfig returns the settings used for anything the
+// configuration file leaves out. There is no default MQTT account, so
+// readers connect anonymously until one is set.
+func getDefaultConfig() Config {
+	config := Config{}
+	config.DataDir = "data"
+	config.Server.Port = "8080"
+	config.Cursive.URL = "http://nfc.cursive.team"
+	config.Cursive.Timeout = Duration{30 * time.Second}
+	config.Cursive.RetryCount = 2
+	config.Cursive.RetryDelay = Duration{time.Second}
+	config.MQTT.Port = 1883
+	config.NFC.PowerTimeout = Duration{30 * time.Second}
+	config.Power.IdleTimeout = Duration{5 * time.Minute}
+	config.Power.DeepSleepDelay = Duration{10 * time.Minute}
+	config.Session.MinBondSize = state.DefaultBondSize
+	config.Session.MaxBondSize = state.DefaultBondSize
+	config.Session.CollectingTimeout = Duration{time.Minute}
+	config.Session.ValidatingTimeout = Duration{2 * time.Minute}
+	config.Session.RecordingTimeout = Duration{4 * time.Minute}
+	config.Session.CompleteCooldown = Duration{10 * time.Second}
+
+	defaults := audio.DefaultConfig()
+	config.Audio.Format = defaults.Format
+	config.Audio.MaxDuration = Duration{defaults.MaxDuration}
+	config.Audio.DeviceID = defaults.DeviceID
+	config.Audio.Source = defaults.Source
+	config.Audio.Encoding = defaults.Encoding
+	config.Audio.OpusBitrate = defaults.OpusBitrate
+	return config
+}
@@ -0,0 +1,212 @@
+package fizhub
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hasProblem reports whether problems lists one for the setting at path
+func hasProblem(problems *configError, path string) bool {
+	for _, problem := range problems.problems {
+		if strings.HasPrefix(problem, path+": ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	problems := &configError{source: "defaults"}
+	getDefaultConfig().validate(problems)
+	if len(problems.problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+func TestSampleConfigIsValid(t *testing.T) {
+	data, err := ioutil.ReadFile("../../configs/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := getDefaultConfig()
+	problems := &configError{source: "configs/config.json"}
+	if err := decodeConfig(data, &config, problems); err != nil {
+		t.Fatal(err)
+	}
+	config.validate(problems)
+	if len(problems.problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"username without password", func(c *Config) { c.MQTT.Username = "fizhub" }, "mqtt.password"},
+		{"provisioning without username", func(c *Config) { c.MQTT.Provisioning = true }, "mqtt.username"},
+		{"no data dir", func(c *Config) { c.DataDir = "" }, "data_dir"},
+		{"bad server port", func(c *Config) { c.Server.Port = "http" }, "server.port"},
+		{"mqtt port out of range", func(c *Config) { c.MQTT.Port = 70000 }, "mqtt.port"},
+		{"mqtt port clash", func(c *Config) { c.MQTT.Port = 8080 }, "mqtt.port"},
+		{"no mqtt port", func(c *Config) { c.MQTT.Port = 0 }, "mqtt.port"},
+		{"tls port clash", func(c *Config) { c.MQTT.TLS.Port = c.MQTT.Port }, "mqtt.tls.port"},
+		{"client certs without ca", func(c *Config) { c.MQTT.TLS.RequireClientCert = true }, "mqtt.tls.ca_file"},
+		{"negative duration", func(c *Config) { c.MQTT.TapHoldOff.Duration = -time.Second }, "mqtt.tap_hold_off"},
+		{"offline before stale", func(c *Config) {
+			c.MQTT.StaleAfter.Duration = time.Minute
+			c.MQTT.OfflineAfter.Duration = time.Second
+		}, "mqtt.offline_after"},
+		{"negative retry count", func(c *Config) { c.Cursive.RetryCount = -1 }, "cursive.retry_count"},
+		{"relative cursive url", func(c *Config) { c.Cursive.URL = "nfc.cursive.team" }, "cursive.url"},
+		{"bad led driver", func(c *Config) { c.LED.Driver = "pwm" }, "led.driver"},
+		{"led too bright", func(c *Config) { c.LED.Brightness = 256 }, "led.brightness"},
+		{"bad nfc address", func(c *Config) { c.NFC.Address = 0x80 }, "nfc.address"},
+		{"local sun without keys", func(c *Config) { c.SUN.Verify = "local" }, "sun.key_file"},
+		{"bad log level", func(c *Config) { c.Log.Components = map[string]string{"mqtt": "loud"} }, "log.components.mqtt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := getDefaultConfig()
+			tt.change(&config)
+			problems := &configError{source: "test"}
+			config.validate(problems)
+			if !hasProblem(problems, tt.want) {
+				t.Fatalf("no problem with %s in %v", tt.want, problems.problems)
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsPassword(t *testing.T) {
+	config := getDefaultConfig()
+	config.MQTT.Username = "fizhub"
+	config.MQTT.Password = "secret"
+	config.MQTT.Provisioning = true
+	problems := &configError{source: "test"}
+	config.validate(problems)
+	if len(problems.problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	config := getDefaultConfig()
+	problems := &configError{source: "test"}
+	used := applyEnv(&config, []string{
+		"HOME=/root",
+		"FIZHUB_CONFIG=other.json",
+		"FIZHUB_MQTT_PASSWORD=a=b",
+		"FIZHUB_MQTT_PORT=1884",
+		"FIZHUB_MQTT_PROVISIONING=true",
+		"FIZHUB_MQTT_TAP_HOLD_OFF=2s",
+		"FIZHUB_CURSIVE_TIMEOUT=1.5",
+		`FIZHUB_SESSIONS=[{"name":"hall","readers":["FIZR001"]}]`,
+		`FIZHUB_LOG_COMPONENTS={"mqtt":"debug"}`,
+	}, problems)
+
+	if len(problems.problems) > 0 {
+		t.Fatal(problems)
+	}
+	want := "FIZHUB_CURSIVE_TIMEOUT FIZHUB_LOG_COMPONENTS FIZHUB_MQTT_PASSWORD FIZHUB_MQTT_PORT FIZHUB_MQTT_PROVISIONING FIZHUB_MQTT_TAP_HOLD_OFF FIZHUB_SESSIONS"
+	if got := strings.Join(used, " "); got != want {
+		t.Fatalf("used %s", got)
+	}
+	switch {
+	case config.MQTT.Password != "a=b":
+		t.Fatalf("password %q", config.MQTT.Password)
+	case config.MQTT.Port != 1884 || !config.MQTT.Provisioning:
+		t.Fatalf("port %d, provisioning %v", config.MQTT.Port, config.MQTT.Provisioning)
+	case config.MQTT.TapHoldOff.Duration != 2*time.Second || config.Cursive.Timeout.Duration != 1500*time.Millisecond:
+		t.Fatalf("durations %v %v", config.MQTT.TapHoldOff, config.Cursive.Timeout)
+	case len(config.Sessions) != 1 || config.Sessions[0].Name != "hall" || config.Sessions[0].Readers[0] != "FIZR001":
+		t.Fatalf("sessions %+v", config.Sessions)
+	case config.Log.Components["mqtt"] != "debug":
+		t.Fatalf("log components %v", config.Log.Components)
+	}
+}
+
+func TestApplyEnvRejectsBadValues(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"FIZHUB_MQTT_PORT=mqtt", "FIZHUB_MQTT_PORT"},
+		{"FIZHUB_MQTT_PROVISIONING=maybe", "FIZHUB_MQTT_PROVISIONING"},
+		{"FIZHUB_MQTT_TAP_HOLD_OFF=soon", "FIZHUB_MQTT_TAP_HOLD_OFF"},
+		{"FIZHUB_SESSIONS=hall", "FIZHUB_SESSIONS"},
+		{"FIZHUB_MQTT_PASWORD=secret", "FIZHUB_MQTT_PASWORD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			config := getDefaultConfig()
+			problems := &configError{source: "test"}
+			applyEnv(&config, []string{tt.env}, problems)
+			if !hasProblem(problems, tt.want) {
+				t.Fatalf("no problem with %s in %v", tt.want, problems.problems)
+			}
+		})
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	data := []byte(`{
+		"data_dir": "/var/lib/fizhub",
+		"mqtt": {"port": "1883", "username": "fizhub", "pasword": "secret", "tap_hold_off": "soon"},
+		"led": {"count": 1.5, "brightness": 64},
+		"sessions": [{"name": "hall", "readers": "FIZR001"}],
+		"extra": true
+	}`)
+	config := getDefaultConfig()
+	problems := &configError{source: "test"}
+	if err := decodeConfig(data, &config, problems); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"extra", "led.count", "mqtt.pasword", "mqtt.port", "mqtt.tap_hold_off", "sessions[0].readers"}
+	if len(problems.problems) != len(want) {
+		t.Fatalf("problems %q", problems.problems)
+	}
+	for _, path := range want {
+		if !hasProblem(problems, path) {
+			t.Errorf("no problem with %s in %q", path, problems.problems)
+		}
+	}
+
+	// The valid settings are kept and the rejected ones keep their defaults
+	defaults := getDefaultConfig()
+	switch {
+	case config.DataDir != "/var/lib/fizhub" || config.MQTT.Username != "fizhub" || config.LED.Brightness != 64:
+		t.Fatalf("valid settings dropped: %s %q %d", config.DataDir, config.MQTT.Username, config.LED.Brightness)
+	case config.MQTT.Port != defaults.MQTT.Port || config.MQTT.TapHoldOff != defaults.MQTT.TapHoldOff || config.LED.Count != defaults.LED.Count:
+		t.Fatalf("rejected settings applied: %d %v %d", config.MQTT.Port, config.MQTT.TapHoldOff, config.LED.Count)
+	case len(config.Sessions) != 1 || config.Sessions[0].Name != "hall" || len(config.Sessions[0].Readers) != 0:
+		t.Fatalf("sessions %+v, want hall without its bad readers", config.Sessions)
+	}
+}
+
+func TestDecodeConfigRejectsMalformedJSON(t *testing.T) {
+	tests := []string{`{"data_dir": "data",}`, `{"mqtt": {"port": 1883}`, ``}
+	for _, data := range tests {
+		config := getDefaultConfig()
+		problems := &configError{source: "test"}
+		if err := decodeConfig([]byte(data), &config, problems); err == nil {
+			t.Errorf("decodeConfig(%q) succeeded", data)
+		}
+	}
+}
+
+func TestDecodeConfigWrongTopLevelType(t *testing.T) {
+	config := getDefaultConfig()
+	problems := &configError{source: "test"}
+	if err := decodeConfig([]byte(`["data"]`), &config, problems); err != nil {
+		t.Fatal(err)
+	}
+	if len(problems.problems) != 1 || config.DataDir != "data" {
+		t.Fatalf("problems %q, data dir %q", problems.problems, config.DataDir)
+	}
+}
@@ -0,0 +1,200 @@
+package fizhub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"fizhub/internal/network"
+	"github.com/gorilla/mux"
+)
+
+// defaultFirmwareMaxSize is used when firmware.max_size is unset. It fits
+// the 4 MB flash of the ESP8266 readers.
+const defaultFirmwareMaxSize = 4 << 20
+
+// setupFirmware registers the firmware and rollout routes
+func (app *Application) setupFirmware() {
+	app.router.HandleFunc("/api/firmware", app.handleFirmwareList).Methods("GET")
+	app.router.HandleFunc("/api/firmware", app.handleFirmwareUpload).Methods("POST")
+	app.router.HandleFunc("/api/firmware/rollout", app.handleRolloutStatus).Methods("GET")
+	app.router.HandleFunc("/api/firmware/rollout", app.handleStartRollout).Methods("POST")
+	app.router.HandleFunc("/api/firmware/rollout", app.handleCancelRollout).Methods("DELETE")
+	app.router.HandleFunc("/api/firmware/{version}/image", app.handleFirmwareImage).Methods("GET")
+	app.router.HandleFunc("/api/firmware/{version}", app.handleFirmwareDelete).Methods("DELETE")
+}
+
+// firmwareURL returns the base URL readers download images from. Without
+// firmware.base_url it is the hub's mDNS name and HTTP port.
+func firmwareURL(config Config) string {
+	if config.Firmware.BaseURL != "" {
+		return config.Firmware.BaseURL
+	}
+	scheme := "http"
+	if config.Server.TLS.CertFile != "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%s", scheme, hubHostname(), config.Server.Port)
+}
+
+// hubHostname returns the hub's mDNS name, which readers connect to
+func hubHostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "fiznode"
+	}
+	if !strings.Contains(host, ".") {
+		host += ".local"
+	}
+	return host
+}
+
+func (app *Application) handleFirmwareList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(app.firmware.List()); err != nil {
+		httpLogger.Error("Error encoding firmware response", "error", err)
+	}
+}
+
+// handleFirmwareUpload stores an image sent as a multipart form with the
+// file in image and its version, device_type, notes and optional sha256
+func (app *Application) handleFirmwareUpload(w http.ResponseWriter, r *http.Request) {
+	maxSize := app.config.Firmware.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultFirmwareMaxSize
+	}
+	// Leave room for the other form fields
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<16)
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		httpLogger.Info("Invalid firmware upload", "error", err)
+		http.Error(w, "image file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	image := network.FirmwareImage{
+		Version:    r.FormValue("version"),
+		DeviceType: r.FormValue("device_type"),
+		Notes:      r.FormValue("notes"),
+	}
+	image, err = app.firmware.Add(image, file, r.FormValue("sha256"))
+	if err != nil {
+		httpLogger.Info("Error storing firmware", "version", image.Version, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if image.Size > maxSize {
+		app.firmware.Delete(image.Version)
+		http.Error(w, "firmware image is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	httpLogger.Info("Firmware uploaded", "version", image.Version, "size", image.Size, "sha256", image.SHA256)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(image); err != nil {
+		httpLogger.Error("Error encoding firmware response", "error", err)
+	}
+}
+
+// handleFirmwareImage serves an image to readers, with its checksum in the
+// X-Checksum-SHA256 header
+func (app *Application) handleFirmwareImage(w http.ResponseWriter, r *http.Request) {
+	version := mux.Vars(r)["version"]
+	file, image, err := app.firmware.Open(version)
+	switch {
+	case errors.Is(err, network.ErrUnknownFirmware):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		httpLogger.Error("Error opening firmware", "version", version, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	httpLogger.Info("Serving firmware", "version", version, "remote_addr", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Checksum-SHA256", image.SHA256)
+	http.ServeContent(w, r, version+".bin", image.UploadedAt, file)
+}
+
+func (app *Application) handleFirmwareDelete(w http.ResponseWriter, r *http.Request) {
+	version := mux.Vars(r)["version"]
+	if rollout, ok := app.mqttBroker.GetRollout(); ok && rollout.Version == version && rollout.FinishedAt.IsZero() {
+		http.Error(w, "firmware is being rolled out", http.StatusConflict)
+		return
+	}
+	err := app.firmware.Delete(version)
+	switch {
+	case errors.Is(err, network.ErrUnknownFirmware):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		httpLogger.Error("Error deleting firmware", "version", version, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *Application) handleStartRollout(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Version       string   `json:"version"`
+		Devices       []string `json:"devices"`
+		MaxConcurrent int      `json:"max_concurrent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		httpLogger.Info("Invalid request payload", "path", r.URL.Path, "error", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if payload.MaxConcurrent <= 0 {
+		payload.MaxConcurrent = app.config.Firmware.MaxConcurrent
+	}
+
+	rollout, err := app.mqttBroker.StartRollout(payload.Version, payload.Devices, payload.MaxConcurrent)
+	switch {
+	case errors.Is(err, network.ErrUnknownFirmware), errors.Is(err, network.ErrUnknownDevice):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, network.ErrRolloutActive):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		httpLogger.Error("Error starting firmware rollout", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(rollout); err != nil {
+		httpLogger.Error("Error encoding rollout response", "error", err)
+	}
+}
+
+func (app *Application) handleRolloutStatus(w http.ResponseWriter, r *http.Request) {
+	rollout, ok := app.mqttBroker.GetRollout()
+	if !ok {
+		http.Error(w, "no firmware rollout", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rollout); err != nil {
+		httpLogger.Error("Error encoding rollout response", "error", err)
+	}
+}
+
+func (app *Application) handleCancelRollout(w http.ResponseWriter, r *http.Request) {
+	if err := app.mqttBroker.CancelRollout(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,119 @@
+package fizhub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fizhub/internal/network"
+	"github.com/gorilla/mux"
+)
+
+// newFirmwareServer serves the firmware routes with images limited to
+// maxSize bytes
+func newFirmwareServer(t *testing.T, maxSize int64) (*Application, *httptest.Server) {
+	t.Helper()
+	store, err := network.NewFirmwareStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &Application{firmware: store, router: mux.NewRouter()}
+	app.config.Firmware.MaxSize = maxSize
+	app.setupFirmware()
+	server := httptest.NewServer(app.router)
+	t.Cleanup(server.Close)
+	return app, server
+}
+
+// uploadFirmware posts image as version with an optional checksum
+func uploadFirmware(t *testing.T, url, version string, image []byte, checksum string) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("version", version)
+	if checksum != "" {
+		form.WriteField("sha256", checksum)
+	}
+	part, err := form.CreateFormFile("image", "firmware.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(image)
+	form.Close()
+
+	resp, err := http.Post(url+"/api/firmware", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestFirmwareUpload(t *testing.T) {
+	image := bytes.Repeat([]byte{0xe9}, 1024)
+	sum := sha256.Sum256(image)
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		image    []byte
+		checksum string
+		want     int
+	}{
+		{"valid", image, "", http.StatusCreated},
+		{"valid checksum", image, checksum, http.StatusCreated},
+		{"checksum mismatch", image, checksum[1:] + "0", http.StatusBadRequest},
+		{"at max size", bytes.Repeat([]byte{0xe9}, 2048), "", http.StatusCreated},
+		{"over max size", bytes.Repeat([]byte{0xe9}, 2049), "", http.StatusRequestEntityTooLarge},
+		{"far over max size", bytes.Repeat([]byte{0xe9}, 1<<20), "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, server := newFirmwareServer(t, 2048)
+			resp := uploadFirmware(t, server.URL, "1.0.0", tt.image, tt.checksum)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			stored := len(app.firmware.List()) == 1
+			if stored != (tt.want == http.StatusCreated) {
+				t.Fatalf("image stored: %v", stored)
+			}
+		})
+	}
+}
+
+func TestFirmwareDownload(t *testing.T) {
+	_, server := newFirmwareServer(t, 0)
+	image := []byte("firmware image")
+	if resp := uploadFirmware(t, server.URL, "1.0.0", image, ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status %d", resp.StatusCode)
+	}
+
+	resp, err := http.Get(server.URL + "/api/firmware/1.0.0/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(image)
+	if !bytes.Equal(data, image) || resp.Header.Get("X-Checksum-SHA256") != hex.EncodeToString(sum[:]) {
+		t.Fatalf("downloaded %q with checksum %s", data, resp.Header.Get("X-Checksum-SHA256"))
+	}
+
+	missing, err := http.Get(server.URL + "/api/firmware/2.0.0/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing.Body.Close()
+	if missing.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown version gave status %d", missing.StatusCode)
+	}
+}
@@ -0,0 +1,119 @@
+package fizhub
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"fizhub/internal/logging"
+)
+
+// Component loggers of the application and its HTTP server
+var (
+	appLogger  = logging.For("app")
+	httpLogger = logging.For("http")
+)
+
+// setupLogging applies the log configuration and sends output of the
+// standard library logger through the app logger
+func setupLogging(config logging.Config) error {
+	if err := logging.Setup(config); err != nil {
+		return err
+	}
+	log.SetFlags(0)
+	log.SetOutput(appLogger.Writer(logging.LevelInfo))
+	return nil
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets event streams flush through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logRequests logs every request with the caller's API key name.
+// Authenticated requests, changes and failures are logged at info level,
+// and reads without a key, such as firmware downloads, at debug.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r, caller := withCaller(r)
+		next.ServeHTTP(recorder, r)
+
+		kv := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration", time.Since(started).Round(time.Microsecond),
+			"remote_addr", r.RemoteAddr,
+			"caller", *caller,
+		}
+		switch {
+		case recorder.status >= http.StatusBadRequest:
+			httpLogger.Info("Request failed", kv...)
+		case *caller != "", r.Method != http.MethodGet && r.Method != http.MethodHead:
+			httpLogger.Info("Request", kv...)
+		default:
+			httpLogger.Debug("Request", kv...)
+		}
+	})
+}
+
+// handleLogLevels lists the log level of every component
+func (app *Application) handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(logging.Levels()); err != nil {
+		httpLogger.Error("Error encoding log levels", "error", err)
+	}
+}
+
+// handleSetLogLevel changes the log level of one component, or of every
+// component when none is given
+func (app *Application) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Component string `json:"component"`
+		Level     string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		httpLogger.Info("Invalid request payload", "path", r.URL.Path, "error", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	level, err := logging.ParseLevel(payload.Level)
+	if err != nil || payload.Level == "" {
+		http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+		return
+	}
+	if payload.Component != "" && !knownComponent(payload.Component) {
+		http.Error(w, "unknown component", http.StatusNotFound)
+		return
+	}
+
+	logging.SetLevel(payload.Component, level)
+	httpLogger.Info("Log level changed", "logger", payload.Component, "level", level)
+	app.handleLogLevels(w, r)
+}
+
+// knownComponent reports whether a component has a logger
+func knownComponent(component string) bool {
+	for _, c := range logging.Components() {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package fizhub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fizhub/internal/logging"
+	"github.com/gorilla/mux"
+)
+
+// captureLogs logs to a file until the test ends and returns a function
+// that reads what was logged
+func captureLogs(t *testing.T) func() string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fizhub.log")
+	if err := logging.Setup(logging.Config{Output: path}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logging.Setup(logging.Config{}) })
+	return func() string {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+}
+
+func TestLogLevelEndpoint(t *testing.T) {
+	captureLogs(t)
+	app := &Application{}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/log-level", app.handleLogLevels).Methods("GET")
+	router.HandleFunc("/api/admin/log-level", app.handleSetLogLevel).Methods("PUT")
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	levels := func(resp *http.Response) map[string]string {
+		t.Helper()
+		var levels map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&levels); err != nil {
+			t.Fatal(err)
+		}
+		return levels
+	}
+
+	resp := doRequest(t, "GET", server.URL+"/api/admin/log-level", "")
+	if got := levels(resp); got["default"] != "info" || got["http"] != "info" {
+		t.Fatalf("levels %v", got)
+	}
+
+	resp = doRequest(t, "PUT", server.URL+"/api/admin/log-level", `{"component":"http","level":"debug"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if got := levels(resp); got["default"] != "info" || got["http"] != "debug" {
+		t.Fatalf("levels %v after raising http", got)
+	}
+	if !httpLogger.Enabled(logging.LevelDebug) {
+		t.Fatal("http logger level not changed")
+	}
+
+	resp = doRequest(t, "PUT", server.URL+"/api/admin/log-level", `{"level":"error"}`)
+	if got := levels(resp); got["default"] != "error" || got["http"] != "error" {
+		t.Fatalf("levels %v after setting the default", got)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"unknown component", `{"component":"nope","level":"debug"}`, http.StatusNotFound},
+		{"bad level", `{"component":"http","level":"loud"}`, http.StatusBadRequest},
+		{"no level", `{"component":"http"}`, http.StatusBadRequest},
+		{"bad payload", `{"level":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := doRequest(t, "PUT", server.URL+"/api/admin/log-level", tt.body); resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidTapURLIsNotLogged(t *testing.T) {
+	logs := captureLogs(t)
+	app := &Application{}
+	body := `{"url":"https://nfc.cursive.team/%zz?uid=04a1b2c3d4e5f6&picc_data=ef963ff7828658a599f3041510671e88&cmac=94eed9ee65337086"}`
+	rec := httptest.NewRecorder()
+	app.handleReceiveUID(rec, httptest.NewRequest("POST", "/api/receive_uid", strings.NewReader(body)))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d", rec.Code)
+	}
+	logged := logs()
+	if !strings.Contains(logged, "Invalid tap URL") {
+		t.Fatalf("rejection not logged: %q", logged)
+	}
+	for _, secret := range []string{"04a1b2c3d4e5f6", "ef963ff7828658a599f3041510671e88", "94eed9ee65337086"} {
+		if strings.Contains(logged, secret) || strings.Contains(rec.Body.String(), secret) {
+			t.Fatalf("%s leaked: %q %q", secret, logged, rec.Body.String())
+		}
+	}
+}
@@ -4,16 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"fizhub/internal/audio"
+	"fizhub/internal/events"
 	"fizhub/internal/led"
+	"fizhub/internal/logging"
 	"fizhub/internal/network"
 	"fizhub/internal/nfc"
 	"fizhub/internal/power"
@@ -21,144 +28,187 @@ import (
 	"github.com/gorilla/mux"
 )
 
-type Config struct {
-	Server struct {
-		Port string `json:"port"`
-	} `json:"server"`
-	Cursive struct {
-		URL     string   `json:"url"`
-		Timeout Duration `json:"timeout"`
-	} `json:"cursive"`
-	MQTT struct {
-		Port     int    `json:"port"`
-		Username string `json:"username"`
-		Password string `json:"password"`
-	} `json:"mqtt"`
-	NFC struct {
-		PowerTimeout Duration `json:"power_timeout"`
-	} `json:"nfc"`
-	Power struct {
-		IdleTimeout    Duration `json:"idle_timeout"`
-		DeepSleepDelay Duration `json:"deep_sleep_delay"`
-	} `json:"power"`
-	Audio audio.Config `json:"audio"`
-}
-
-type Application struct {
-	config     Config
-	router     *mux.Router
-	server     *http.Server
-	nfcReader  *nfc.Reader
-	ledCtrl    *led.Controller
-	powerMgr   *power.Manager
-	stateMgr   *state.Manager
-	recorder   *audio.Recorder
-	client     *network.Client
-	mqttBroker *network.MQTTBroker
-}
-
-// Duration is a wrapper around time.Duration for JSON unmarshaling
-type Duration struct {
-	time.Duration
-}
+// errorDisplayTime is how long the LED ring shows an error
+const errorDisplayTime = 3 * time.Second
 
-func (d *Duration) UnmarshalJSON(b []byte) error {
-	var v interface{}
-	if err := json.Unmarshal(b, &v); err != nil {
-		return err
-	}
-	switch value := v.(type) {
-	case string:
-		var err error
-		d.Duration, err = time.ParseDuration(value)
-		if err != nil {
-			return err
-		}
-		return nil
-	default:
-		return fmt.Errorf("invalid duration")
-	}
-}
-
-func loadConfig() (Config, error) {
-	log.Println("Loading configuration...")
-	var config Config
-	file, err := os.Open("configs/config.json")
-	if err != nil {
-		log.Println("Configuration file not found, using default configuration")
-		return getDefaultConfig(), nil
-	}
-	defer file.Close()
-
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		return Config{}, fmt.Errorf("failed to decode config: %w", err)
-	}
-	log.Println("Configuration loaded successfully")
-	return config, nil
-}
+// Reader IDs for taps that did not come from a Fiz Reader
+const (
+	localReaderID = "local"
+	httpReaderID  = "http"
+)
 
-func getDefaultConfig() Config {
-	config := Config{}
-	config.Server.Port = "8080"
-	config.Cursive.URL = "http://nfc.cursive.team"
-	config.Cursive.Timeout = Duration{30 * time.Second}
-	config.MQTT.Port = 1883
-	config.MQTT.Username = "fizhub"
-	config.MQTT.Password = "fizpassword"
-	config.NFC.PowerTimeout = Duration{30 * time.Second}
-	config.Power.IdleTimeout = Duration{5 * time.Minute}
-	config.Power.DeepSleepDelay = Duration{10 * time.Minute}
-	config.Audio = audio.DefaultConfig()
-	return config
+type Application struct {
+	config    Config
+	router    *mux.Router
+	server    *http.Server
+	nfcReader *nfc.Reader
+	ledCtrl   *led.Controller
+	powerMgr  *power.Manager
+	sessions  []*Session
+	// sessionsByReader maps assigned reader IDs to their session
+	sessionsByReader map[string]*Session
+	// catchAllSession takes taps from readers not assigned to a session
+	catchAllSession *Session
+	client          *network.Client
+	queue           *network.ValidationQueue
+	outbox          *network.UploadOutbox
+	devices         *network.DeviceStore
+	firmware        *network.FirmwareStore
+	tags            *network.TagVerifier
+	mqttBroker      *network.MQTTBroker
+	apiKeys         []apiKey
+	metrics         *appMetrics
+	events          *events.Bus
+	// closing is closed on shutdown to end open event streams
+	closing chan struct{}
 }
 
-func NewApplication(config Config) *Application {
-	log.Println("Initializing FizHub application...")
+func NewApplication(config Config) (*Application, error) {
+	appLogger.Info("Initializing FizHub application")
 	app := &Application{
-		config: config,
-		router: mux.NewRouter(),
+		config:  config,
+		router:  mux.NewRouter(),
+		metrics: newAppMetrics(),
+		closing: make(chan struct{}),
 	}
 
 	// Initialize components
-	log.Println("Initializing NFC reader...")
+	appLogger.Debug("Initializing NFC reader")
 	app.nfcReader = nfc.NewReader(nfc.Config{
 		PowerTimeout: config.NFC.PowerTimeout.Duration,
+		Transport:    config.NFC.Transport,
+		Device:       config.NFC.Device,
+		Address:      config.NFC.Address,
+		Speed:        config.NFC.Speed,
+		PollInterval: config.NFC.PollInterval.Duration,
 	})
 
-	log.Println("Initializing LED controller...")
-	app.ledCtrl = led.NewController()
+	appLogger.Debug("Initializing LED controller")
+	app.ledCtrl = led.NewController(led.Config{
+		Driver:     config.LED.Driver,
+		Device:     config.LED.Device,
+		Count:      config.LED.Count,
+		Order:      config.LED.Order,
+		Brightness: config.LED.Brightness,
+		FrameRate:  config.LED.FrameRate,
+	})
 
-	log.Println("Initializing power manager...")
+	appLogger.Debug("Initializing power manager")
 	app.powerMgr = power.NewManager(power.Config{
 		IdleTimeout:    config.Power.IdleTimeout.Duration,
 		DeepSleepDelay: config.Power.DeepSleepDelay.Duration,
 	})
 
-	log.Println("Initializing state manager...")
-	app.stateMgr = state.NewManager()
-
-	log.Println("Initializing audio recorder...")
-	app.recorder = audio.NewRecorder(config.Audio)
+	appLogger.Debug("Initializing bond sessions")
+	if config.Audio.OutputDir == "" {
+		config.Audio.OutputDir = filepath.Join(config.DataDir, "recordings")
+	}
+	if err := app.newSessions(config); err != nil {
+		return nil, fmt.Errorf("failed to initialize sessions: %w", err)
+	}
 
-	log.Println("Initializing network client...")
+	appLogger.Debug("Initializing network client")
 	app.client = network.NewClient(network.ClientConfig{
-		BaseURL: config.Cursive.URL,
-		Timeout: config.Cursive.Timeout.Duration,
+		BaseURL:         config.Cursive.URL,
+		Timeout:         config.Cursive.Timeout.Duration,
+		RetryCount:      config.Cursive.RetryCount,
+		RetryDelay:      config.Cursive.RetryDelay.Duration,
+		UploadChunkSize: config.Cursive.UploadChunkSize,
+	})
+	app.client.SetRetryHandler(func(path string, err error) {
+		app.metrics.cursiveRetries.Inc(path)
+	})
+
+	appLogger.Debug("Initializing validation queue")
+	queue, err := network.NewValidationQueue(app.client, network.QueueConfig{
+		Dir:        config.DataDir,
+		MinBackoff: config.Cursive.MinBackoff.Duration,
+		MaxBackoff: config.Cursive.MaxBackoff.Duration,
+		MaxAge:     config.Cursive.MaxAge.Duration,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize validation queue: %w", err)
+	}
+	app.queue = queue
+
+	appLogger.Debug("Initializing upload outbox")
+	outbox, err := network.NewUploadOutbox(app.client, network.QueueConfig{
+		Dir:        config.DataDir,
+		MinBackoff: config.Cursive.MinBackoff.Duration,
+		MaxBackoff: config.Cursive.MaxBackoff.Duration,
+		MaxAge:     config.Cursive.UploadMaxAge.Duration,
 	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize upload outbox: %w", err)
+	}
+	app.outbox = outbox
 
-	log.Println("Initializing MQTT broker...")
+	appLogger.Debug("Initializing MQTT broker")
 	app.mqttBroker = network.NewMQTTBroker(network.MQTTConfig{
-		Port:     config.MQTT.Port,
-		Username: config.MQTT.Username,
-		Password: config.MQTT.Password,
+		Port:                 config.MQTT.Port,
+		Username:             config.MQTT.Username,
+		Password:             config.MQTT.Password,
+		CommandTimeout:       config.MQTT.CommandTimeout.Duration,
+		TapHoldOff:           config.MQTT.TapHoldOff.Duration,
+		TapMaxAge:            config.MQTT.TapMaxAge.Duration,
+		RequireSignedTaps:    config.MQTT.RequireSignedTaps,
+		SignatureWindow:      config.MQTT.SignatureWindow.Duration,
+		Provisioning:         config.MQTT.Provisioning,
+		HeartbeatInterval:    config.MQTT.HeartbeatInterval.Duration,
+		StaleAfter:           config.MQTT.StaleAfter.Duration,
+		OfflineAfter:         config.MQTT.OfflineAfter.Duration,
+		FirmwareURL:          firmwareURL(config),
+		MaxConcurrentUpdates: config.Firmware.MaxConcurrent,
+		UpdateTimeout:        config.Firmware.UpdateTimeout.Duration,
+		TLSPort:              config.MQTT.TLS.Port,
+		CertFile:             config.MQTT.TLS.CertFile,
+		KeyFile:              config.MQTT.TLS.KeyFile,
+		CAFile:               config.MQTT.TLS.CAFile,
+		RequireClientCert:    config.MQTT.TLS.RequireClientCert,
 	})
 
-	return app
+	appLogger.Debug("Initializing device store")
+	devices, err := network.NewDeviceStore(config.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize device store: %w", err)
+	}
+	app.devices = devices
+	app.mqttBroker.SetDeviceStore(devices)
+
+	appLogger.Debug("Initializing firmware store")
+	firmware, err := network.NewFirmwareStore(config.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize firmware store: %w", err)
+	}
+	app.firmware = firmware
+	app.mqttBroker.SetFirmwareStore(firmware)
+
+	appLogger.Debug("Initializing tag verifier")
+	tags, err := network.NewTagVerifier(network.TagVerifierConfig{
+		Mode:    config.SUN.Verify,
+		KeyFile: config.SUN.KeyFile,
+		Require: config.SUN.Require,
+		Dir:     config.DataDir,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize tag verifier: %w", err)
+	}
+	app.tags = tags
+
+	appLogger.Debug("Initializing event bus")
+	app.events = events.NewBus(events.Config{})
+	for _, session := range app.sessions {
+		session.stateMgr.SetEventBus(app.events)
+	}
+	app.powerMgr.SetEventBus(app.events)
+	app.mqttBroker.SetEventBus(app.events)
+
+	return app, nil
 }
 
 func (app *Application) Start(ctx context.Context) error {
-	log.Println("Starting FizHub components...")
-	
+	appLogger.Info("Starting FizHub components")
+
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -169,64 +219,88 @@ func (app *Application) Start(ctx context.Context) error {
 	}
 
 	// Set up HTTP server
+	if err := app.setupAuth(); err != nil {
+		return fmt.Errorf("failed to set up API authentication: %w", err)
+	}
 	app.setupRoutes()
 	app.server = &http.Server{
-		Addr:    ":" + app.config.Server.Port,
-		Handler: app.router,
+		Addr:     ":" + app.config.Server.Port,
+		Handler:  logRequests(app.router),
+		ErrorLog: log.New(httpLogger.Writer(logging.LevelWarn), "", 0),
 	}
 
 	// Start HTTP server
-	log.Printf("Starting HTTP server on port %s...", app.config.Server.Port)
+	httpLogger.Info("Starting HTTP server", "port", app.config.Server.Port, "tls", app.config.Server.TLS.CertFile != "")
 	go func() {
-		if err := app.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("HTTP server error: %v", err)
+		l, err := net.Listen("tcp", app.server.Addr)
+		if err == nil {
+			err = app.serveHTTP(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			httpLogger.Error("HTTP server error", "error", err)
 		}
 	}()
-	log.Printf("HTTP server is running on port %s", app.config.Server.Port)
 
 	// Wait for shutdown signal
 	select {
 	case <-ctx.Done():
-		log.Println("Context cancelled, shutting down...")
+		appLogger.Info("Context cancelled, shutting down")
 	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down...", sig)
+		appLogger.Info("Received signal, shutting down", "signal", sig)
 	}
 
 	return app.Shutdown()
 }
 
+// serveHTTP serves the REST API on l, over HTTPS when a certificate is
+// configured
+func (app *Application) serveHTTP(l net.Listener) error {
+	tls := app.config.Server.TLS
+	if tls.CertFile != "" {
+		return app.server.ServeTLS(l, tls.CertFile, tls.KeyFile)
+	}
+	return app.server.Serve(l)
+}
+
 func (app *Application) initializeComponents(ctx context.Context) error {
-	log.Println("Starting LED controller...")
+	appLogger.Debug("Starting LED controller")
 	if err := app.ledCtrl.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start LED controller: %w", err)
 	}
 
-	log.Println("Starting NFC reader...")
+	appLogger.Debug("Starting NFC reader")
 	if err := app.nfcReader.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start NFC reader: %w", err)
 	}
 
-	log.Println("Starting power manager...")
+	appLogger.Debug("Starting power manager")
 	if err := app.powerMgr.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start power manager: %w", err)
 	}
 
-	log.Println("Starting state manager...")
-	if err := app.stateMgr.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start state manager: %w", err)
-	}
-
-	log.Println("Starting audio recorder...")
-	if err := app.recorder.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start audio recorder: %w", err)
+	for _, session := range app.sessions {
+		appLogger.Info("Starting session", "session", session.name)
+		if err := session.Start(ctx); err != nil {
+			return err
+		}
 	}
 
-	log.Println("Starting MQTT broker...")
+	appLogger.Debug("Starting MQTT broker")
 	if err := app.mqttBroker.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start MQTT broker: %w", err)
 	}
 
-	log.Println("Setting up component interactions...")
+	appLogger.Debug("Starting validation queue")
+	if err := app.queue.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start validation queue: %w", err)
+	}
+
+	appLogger.Debug("Starting upload outbox")
+	if err := app.outbox.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start upload outbox: %w", err)
+	}
+
+	appLogger.Info("Setting up component interactions")
 	app.setupComponentInteractions()
 
 	return nil
@@ -234,35 +308,43 @@ func (app *Application) initializeComponents(ctx context.Context) error {
 
 func (app *Application) setupComponentInteractions() {
 	// Handle NFC tap events from local reader
-	app.nfcReader.SetTapHandler(func(uid string) error {
-		log.Printf("NFC tap detected: %s", uid)
+	app.nfcReader.SetTapHandler(func(tap nfc.Tap) error {
+		appLogger.Info("NFC tap detected", "uid", tap.UID, "tag_type", tap.TagType, "sun", tap.SUN.Present())
 		app.powerMgr.RecordActivity()
-		return app.stateMgr.HandleEvent(state.EventNFCTap, uid)
+		tap.ReaderID = localReaderID
+		_, err := app.handleTap(tapSourceLocal, tap)
+		return err
 	})
 
 	// Handle NFC tap events from remote readers
 	app.mqttBroker.SetUIDHandler(func(msg network.UIDMessage) {
-		log.Printf("Received UID from device %s: %s", msg.DeviceID, msg.UID)
-		app.stateMgr.HandleEvent(state.EventNFCTap, msg.UID)
+		tap := msg.Tap(time.Now())
+		appLogger.Info("Received UID", "device_id", msg.DeviceID, "uid", msg.UID, "tag_type", tap.TagType, "rssi", tap.RSSI, "sun", msg.SUN.Present())
+		result, err := app.handleTap(tapSourceMQTT, tap)
+		if err != nil {
+			appLogger.Info("Tap refused", "device_id", msg.DeviceID, "uid", msg.UID, "result", result, "error", err)
+		}
+		app.sendTapResult(msg, result, err)
 	})
 
-	// Handle state changes
-	app.stateMgr.Subscribe(state.PhaseValidating, func(phase state.Phase) {
-		log.Println("Validating UIDs...")
-		app.ledCtrl.SetState(led.StateWaiting)
-		uids := app.stateMgr.GetCollectedUIDs()
-		go app.validateUIDs(uids)
+	// Handle long-press commits from remote readers
+	app.mqttBroker.SetCommitHandler(func(deviceID string) {
+		appLogger.Info("Commit requested", "device_id", deviceID)
+		session, err := app.sessionFor(deviceID)
+		if err == nil {
+			err = session.stateMgr.HandleEvent(state.EventCommit, nil)
+		}
+		if err != nil {
+			appLogger.Info("Commit refused", "device_id", deviceID, "error", err)
+		}
 	})
 
-	app.stateMgr.Subscribe(state.PhaseRecordingMessage, func(phase state.Phase) {
-		log.Println("Starting message recording...")
-		app.ledCtrl.SetState(led.StateSuccess)
-		app.recorder.StartRecording()
-	})
+	for _, session := range app.sessions {
+		session.setupInteractions()
+	}
 
 	// Handle power state changes
 	app.powerMgr.SetOnStateChange(func(powerState power.State) {
-		log.Printf("Power state changed to: %v", powerState)
 		switch powerState {
 		case power.StateDeepSleep:
 			app.ledCtrl.SetState(led.StateOff)
@@ -271,36 +353,140 @@ func (app *Application) setupComponentInteractions() {
 		}
 	})
 
-	// Handle recording state changes
-	app.recorder.SetOnStateChange(func(recState audio.State) {
-		log.Printf("Recording state changed to: %v", recState)
-		if recState == audio.StateFinished {
-			app.stateMgr.HandleEvent(state.EventRecordingComplete, nil)
+	// Record the outcome of validations that were retried from the queue
+	app.queue.SetResultHandler(func(audit network.ValidationAudit) {
+		switch {
+		case audit.Expired:
+			appLogger.Warn("Queued validation expired", "id", audit.ID, "uids", audit.Request.UIDs)
+			return
+		case audit.Dropped:
+			appLogger.Warn("Queued validation refused by Cursive", "id", audit.ID, "uids", audit.Request.UIDs, "error", audit.LastError)
+			return
+		case audit.Response.Valid:
+			appLogger.Info("Queued validation succeeded", "id", audit.ID, "uids", audit.Request.UIDs, "accounts", audit.Response.Accounts)
+		default:
+			appLogger.Info("Queued validation rejected", "id", audit.ID, "uids", audit.Request.UIDs, "reason", audit.Response.Reason)
 		}
+		app.events.Publish(events.TypeValidation, events.ValidationData{
+			UIDs:     audit.Request.UIDs,
+			Valid:    audit.Response.Valid,
+			Accounts: audit.Response.Accounts,
+			Reason:   audit.Response.Reason,
+			Queued:   true,
+		})
 	})
+
+}
+
+// handleTap verifies the tag's SUN data, then passes the tap to the
+// session of its reader and counts it by source
+func (app *Application) handleTap(source string, tap nfc.Tap) (state.TapResult, error) {
+	app.metrics.taps.Inc(source)
+	uid, err := app.tags.Verify(tap.UID, tap.SUN)
+	if err != nil {
+		app.metrics.tapsRejected.Inc(source, tapRejectReason(err))
+		return state.TapRejected, err
+	}
+	tap.UID = uid
+	session, err := app.sessionFor(tap.ReaderID)
+	if err != nil {
+		app.metrics.tapsRejected.Inc(source, tapRejectReason(err))
+		return state.TapRejected, err
+	}
+	result, err := session.stateMgr.HandleTap(tap)
+	if err != nil {
+		app.metrics.tapsRejected.Inc(source, tapRejectReason(err))
+	}
+	return result, err
+}
+
+// sendTapResult echoes the result of a tap to the reader it came from
+func (app *Application) sendTapResult(msg network.UIDMessage, result state.TapResult, err error) {
+	feedback := network.TapFeedback{
+		UID:       msg.UID,
+		Timestamp: msg.Timestamp,
+		Result:    string(result),
+	}
+	if session, serr := app.sessionFor(msg.DeviceID); serr == nil {
+		_, feedback.BondSize = session.stateMgr.GetBondSize()
+		feedback.Collected = len(session.stateMgr.GetCollectedUIDs())
+	}
+	if err != nil {
+		feedback.Reason = err.Error()
+	}
+	if err := app.mqttBroker.SendTapResult(msg.DeviceID, feedback); err != nil {
+		appLogger.Warn("Failed to send tap result", "device_id", msg.DeviceID, "error", err)
+	}
 }
 
 func (app *Application) setupRoutes() {
-	log.Println("Setting up HTTP routes...")
 	app.router.HandleFunc("/api/receive_uid", app.handleReceiveUID).Methods("POST")
+	app.router.HandleFunc("/api/session/commit", app.handleCommit).Methods("POST")
 	app.router.HandleFunc("/api/status", app.handleStatus).Methods("GET")
 	app.router.HandleFunc("/api/devices", app.handleDevices).Methods("GET")
+	app.router.HandleFunc("/api/devices/{id}", app.handleUpdateDevice).Methods("PUT")
+	app.router.HandleFunc("/api/devices/{id}", app.handleForgetDevice).Methods("DELETE")
+	app.router.HandleFunc("/api/events", app.handleEvents).Methods("GET")
+	app.router.HandleFunc("/api/devices/{id}/commands", app.handleDeviceCommand).Methods("POST")
+	app.setupProvisioning()
+	app.setupFirmware()
+	app.router.HandleFunc("/api/admin/log-level", app.handleLogLevels).Methods("GET")
+	app.router.HandleFunc("/api/admin/log-level", app.handleSetLogLevel).Methods("PUT")
+	app.metrics.registry.OnScrape(app.collectMetrics)
+	app.router.Handle("/metrics", app.metrics.registry.Handler()).Methods("GET")
 }
 
 func (app *Application) handleReceiveUID(w http.ResponseWriter, r *http.Request) {
+	// The tap's reader ID and time are set by the hub
 	var payload struct {
-		UID string `json:"uid"`
+		nfc.Tap
+		DeviceID string `json:"device_id"`
+		// URL is a scanned tap URL, which sets the UID and SUN data
+		URL string `json:"url"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		log.Printf("Invalid request payload: %v", err)
+		httpLogger.Info("Invalid request payload", "path", r.URL.Path, "error", err)
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	if payload.URL != "" {
+		uid, sun, err := nfc.ParseTapURL(payload.URL)
+		if err != nil {
+			// The URL holds the tag's UID and SUN data, so it is not logged
+			httpLogger.Info("Invalid tap URL", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload.UID, payload.SUN = uid, sun
+	}
+
+	httpLogger.Info("Received UID", "uid", payload.UID, "device_id", payload.DeviceID, "tag_type", payload.TagType, "sun", payload.SUN.Present())
+	tap := payload.Tap
+	tap.ReaderID = payload.DeviceID
+	if tap.ReaderID == "" {
+		tap.ReaderID = httpReaderID
+	}
+	tap.Time = time.Now()
+	if _, err := app.handleTap(tapSourceHTTP, tap); err != nil {
+		httpLogger.Info("Tap refused", "uid", payload.UID, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
 
-	log.Printf("Received UID: %s", payload.UID)
-	if err := app.stateMgr.HandleEvent(state.EventNFCTap, payload.UID); err != nil {
-		log.Printf("Error handling UID: %v", err)
+func (app *Application) handleCommit(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("session")
+	httpLogger.Info("Commit requested", "session", name)
+	session, err := app.sessionByName(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := session.stateMgr.HandleEvent(state.EventCommit, nil); err != nil {
+		httpLogger.Info("Commit refused", "session", name, "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -309,102 +495,340 @@ func (app *Application) handleReceiveUID(w http.ResponseWriter, r *http.Request)
 }
 
 func (app *Application) handleStatus(w http.ResponseWriter, r *http.Request) {
-	log.Println("Status request received")
+	sessions := make([]sessionStatus, 0, len(app.sessions))
+	for _, session := range app.sessions {
+		sessions = append(sessions, session.status())
+	}
+	// The top-level phase, UIDs and bond ID are the first session's, for
+	// clients written before sessions existed
 	status := struct {
-		Phase        state.Phase  `json:"phase"`
-		PowerState   power.State  `json:"power_state"`
-		UIDs         []string     `json:"uids"`
-		BondID       string       `json:"bond_id,omitempty"`
-		LastActivity time.Time    `json:"last_activity"`
+		Phase        state.Phase     `json:"phase"`
+		PowerState   power.State     `json:"power_state"`
+		UIDs         []string        `json:"uids"`
+		BondID       string          `json:"bond_id,omitempty"`
+		LastActivity time.Time       `json:"last_activity"`
+		Sessions     []sessionStatus `json:"sessions"`
+		// DroppedTaps counts reader UID messages dropped as redelivered,
+		// held or stale, or rejected as unsigned, wrongly signed or expired
+		DroppedTaps map[string]uint64 `json:"dropped_taps"`
 	}{
-		Phase:        app.stateMgr.GetPhase(),
+		Phase:        sessions[0].Phase,
 		PowerState:   app.powerMgr.GetState(),
-		UIDs:         app.stateMgr.GetCollectedUIDs(),
-		BondID:       app.stateMgr.GetBondID(),
+		UIDs:         sessions[0].UIDs,
+		BondID:       sessions[0].BondID,
 		LastActivity: app.powerMgr.GetLastActivity(),
+		Sessions:     sessions,
+		DroppedTaps:  app.mqttBroker.GetDroppedTaps(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(status); err != nil {
-		log.Printf("Error encoding status response: %v", err)
+		httpLogger.Error("Error encoding status response", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 }
 
+// handleDeviceCommand sends a command to a reader. Unless wait is false
+// the response is the reader's acknowledgement.
+func (app *Application) handleDeviceCommand(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	var payload struct {
+		Command string          `json:"command"`
+		Args    json.RawMessage `json:"args"`
+		Wait    *bool           `json:"wait"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		httpLogger.Info("Invalid request payload", "path", r.URL.Path, "error", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if payload.Command == "" {
+		http.Error(w, "command is required", http.StatusBadRequest)
+		return
+	}
+
+	cmd := network.Command{Name: payload.Command, Args: payload.Args}
+	httpLogger.Info("Sending command", "command", cmd.Name, "device_id", deviceID)
+
+	var ack *network.CommandAck
+	var err error
+	if payload.Wait != nil && !*payload.Wait {
+		err = app.mqttBroker.NotifyDevice(deviceID, cmd)
+	} else {
+		ack, err = app.mqttBroker.SendCommand(r.Context(), deviceID, cmd)
+	}
+	switch {
+	case errors.Is(err, network.ErrUnknownDevice):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, network.ErrDeviceOffline):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, network.ErrCommandTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		httpLogger.Error("Error sending command", "device_id", deviceID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ack == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ack); err != nil {
+		httpLogger.Error("Error encoding command acknowledgement", "error", err)
+	}
+}
+
+// sseKeepAlive is how often an idle event stream sends a comment so
+// proxies keep the connection open
+const sseKeepAlive = 15 * time.Second
+
+// handleEvents streams hub events as Server-Sent Events. The optional
+// types query parameter is a comma separated list of event types. Clients
+// that reconnect with Last-Event-ID receive the events they missed.
+func (app *Application) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var types map[string]bool
+	if list := r.URL.Query().Get("types"); list != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(list, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	var lastID uint64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		lastID, _ = strconv.ParseUint(id, 10, 64)
+	}
+
+	sub := app.events.Subscribe(lastID)
+	defer sub.Close()
+	httpLogger.Debug("Event stream opened", "remote_addr", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			httpLogger.Debug("Event stream closed", "remote_addr", r.RemoteAddr)
+			return
+		case <-app.closing:
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-sub.Events():
+			if !ok {
+				// Dropped for falling behind, the client reconnects with
+				// Last-Event-ID and catches up from the history
+				httpLogger.Warn("Event stream fell behind, closing", "remote_addr", r.RemoteAddr)
+				return
+			}
+			if types != nil && !types[event.Type] {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				httpLogger.Error("Error encoding event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 func (app *Application) handleDevices(w http.ResponseWriter, r *http.Request) {
-	log.Println("Devices request received")
 	devices := app.mqttBroker.GetDevices()
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(devices); err != nil {
-		log.Printf("Error encoding devices response: %v", err)
+		httpLogger.Error("Error encoding devices response", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 }
 
-func (app *Application) validateUIDs(uids []string) {
-	log.Printf("Validating UIDs: %v", uids)
-	ctx := context.Background()
-	resp, err := app.client.ValidateUIDs(ctx, uids)
-	if err != nil {
-		log.Printf("UID validation error: %v", err)
-		app.stateMgr.HandleEvent(state.EventError, err)
+func (app *Application) handleUpdateDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	var payload struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		httpLogger.Info("Invalid request payload", "path", r.URL.Path, "error", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	if resp.Valid {
-		log.Printf("UIDs validated successfully: %v", resp.Accounts)
-		app.stateMgr.HandleEvent(state.EventUIDValidated, resp.Accounts)
-	} else {
-		log.Printf("UID validation failed: %s", resp.Reason)
-		app.stateMgr.HandleEvent(state.EventError, errors.New(resp.Reason))
+	device, err := app.mqttBroker.UpdateDevice(deviceID, payload.Name, payload.Labels)
+	switch {
+	case errors.Is(err, network.ErrUnknownDevice):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		httpLogger.Error("Error updating device", "device_id", deviceID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(device); err != nil {
+		httpLogger.Error("Error encoding device response", "error", err)
 	}
 }
 
+func (app *Application) handleForgetDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	err := app.mqttBroker.ForgetDevice(deviceID)
+	switch {
+	case errors.Is(err, network.ErrUnknownDevice):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		httpLogger.Error("Error forgetting device", "device_id", deviceID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newValidationRequest builds a Cursive validation request from taps
+func newValidationRequest(taps []nfc.Tap) network.ValidationRequest {
+	req := network.ValidationRequest{
+		UIDs:      make([]string, len(taps)),
+		TapURLs:   make([]string, len(taps)),
+		Taps:      taps,
+		ReaderIDs: make([]string, len(taps)),
+		TappedAt:  make([]time.Time, len(taps)),
+	}
+	for i, tap := range taps {
+		req.UIDs[i] = tap.UID
+		req.TapURLs[i] = network.FormatTapURL(tap.UID, tap.SUN)
+		req.ReaderIDs[i] = tap.ReaderID
+		req.TappedAt[i] = tap.Time
+	}
+	return req
+}
+
 func (app *Application) Shutdown() error {
-	log.Println("Initiating graceful shutdown...")
-	
+	appLogger.Info("Initiating graceful shutdown")
+
 	// Create shutdown context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	// Shutdown HTTP server
-	log.Println("Shutting down HTTP server...")
+	appLogger.Info("Shutting down HTTP server")
+	close(app.closing)
 	if err := app.server.Shutdown(ctx); err != nil {
-		log.Printf("HTTP server shutdown error: %v", err)
+		httpLogger.Error("HTTP server shutdown error", "error", err)
 	}
 
 	// Stop components
-	log.Println("Stopping NFC reader...")
+	appLogger.Info("Stopping NFC reader")
 	app.nfcReader.Stop()
-	
-	log.Println("Stopping LED controller...")
+
+	appLogger.Info("Stopping LED controller")
 	app.ledCtrl.Stop()
-	
-	log.Println("Stopping power manager...")
+
+	appLogger.Info("Stopping power manager")
 	app.powerMgr.Stop()
-	
-	log.Println("Stopping audio recorder...")
-	app.recorder.StopRecording()
 
-	log.Println("Stopping MQTT broker...")
+	appLogger.Info("Stopping audio recorders")
+	for _, session := range app.sessions {
+		session.recorder.StopRecording()
+	}
+
+	appLogger.Info("Stopping MQTT broker")
 	app.mqttBroker.Stop()
 
-	log.Println("Shutdown complete")
+	appLogger.Info("Shutdown complete")
 	return nil
 }
 
-// Run starts the FizHub application
-func Run() error {
-	config, err := loadConfig()
+// Run starts the hub, or runs the subcommand named in args:
+//
+//	fizhub [--config path]
+//	fizhub config check [--config path]
+//	fizhub certs init|hub|reader ...
+func Run(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "config":
+			return runConfigCommand(args[1:])
+		case "certs":
+			return runCertsCommand(args[1:])
+		}
+	}
+
+	flags := flag.NewFlagSet("fizhub", flag.ContinueOnError)
+	configFlag := flags.String("config", "", "configuration file (default $"+configPathEnv+" or "+defaultConfigPath+")")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unknown command: %s", flags.Arg(0))
+	}
+
+	config, err := loadConfig(*configFlag)
 	if err != nil {
 		return fmt.Errorf("failed to load configuration: %w", err)
 	}
+	if err := setupLogging(config.Log); err != nil {
+		return fmt.Errorf("failed to set up logging: %w", err)
+	}
 
-	app := NewApplication(config)
+	app, err := NewApplication(config)
+	if err != nil {
+		return err
+	}
 	ctx := context.Background()
 
 	return app.Start(ctx)
 }
+
+// runConfigCommand runs "fizhub config check", which loads and validates
+// the configuration without starting the hub
+func runConfigCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: fizhub config check [--config path]")
+	}
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	configFlag := flags.String("config", "", "configuration file (default $"+configPathEnv+" or "+defaultConfigPath+")")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	logging.SetLevel("", logging.LevelWarn)
+	if _, err := loadConfig(*configFlag); err != nil {
+		return err
+	}
+	path, _ := configPath(*configFlag)
+	if _, err := os.Stat(path); err != nil {
+		path = "defaults"
+	}
+	fmt.Printf("%s: configuration is valid\n", path)
+	return nil
+}
@@ -0,0 +1,235 @@
+package fizhub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fizhub/internal/events"
+	"fizhub/internal/network"
+	"github.com/gorilla/mux"
+)
+
+// sseStream reads messages from an event stream
+type sseStream struct {
+	t       *testing.T
+	resp    *http.Response
+	scanner *bufio.Scanner
+}
+
+// openStream requests the event stream at url
+func openStream(t *testing.T, url string, header http.Header) *sseStream {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	// The handler subscribes before it sends the headers, so events
+	// published from here on reach the stream
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return &sseStream{t: t, resp: resp, scanner: bufio.NewScanner(resp.Body)}
+}
+
+// next returns the fields of the next message
+func (s *sseStream) next() map[string]string {
+	s.t.Helper()
+	message := make(map[string]string)
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if line == "" {
+			if len(message) > 0 {
+				return message
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		message[parts[0]] = parts[1]
+	}
+	s.t.Fatalf("stream ended: %v", s.scanner.Err())
+	return nil
+}
+
+// newEventsServer serves the event stream of a bus
+func newEventsServer(t *testing.T) (*Application, *httptest.Server) {
+	t.Helper()
+	app := &Application{events: events.NewBus(events.Config{}), closing: make(chan struct{})}
+	server := httptest.NewServer(http.HandlerFunc(app.handleEvents))
+	t.Cleanup(server.Close)
+	return app, server
+}
+
+func TestEventStream(t *testing.T) {
+	app, server := newEventsServer(t)
+	stream := openStream(t, server.URL, nil)
+
+	app.events.Publish(events.TypeTap, events.TapData{UID: "04a1", ReaderID: "FIZR001", Accepted: true, Result: "accepted"})
+	message := stream.next()
+	if message["id"] != "1" || message["event"] != events.TypeTap {
+		t.Fatalf("unexpected message %v", message)
+	}
+	if !strings.Contains(message["data"], `"reader_id":"FIZR001"`) || !strings.Contains(message["data"], `"type":"tap"`) {
+		t.Fatalf("unexpected data %s", message["data"])
+	}
+}
+
+func TestEventStreamFiltersTypes(t *testing.T) {
+	app, server := newEventsServer(t)
+	stream := openStream(t, server.URL+"?types=phase,reader", nil)
+
+	app.events.Publish(events.TypeTap, events.TapData{UID: "04a1"})
+	app.events.Publish(events.TypeReader, events.ReaderData{DeviceID: "FIZR001", Status: "online"})
+	if message := stream.next(); message["event"] != events.TypeReader || message["id"] != "2" {
+		t.Fatalf("unexpected message %v", message)
+	}
+}
+
+func TestEventStreamResumes(t *testing.T) {
+	app, server := newEventsServer(t)
+	for i := 0; i < 3; i++ {
+		app.events.Publish(events.TypePhase, events.PhaseData{Phase: "collecting_uids"})
+	}
+
+	stream := openStream(t, server.URL, http.Header{"Last-Event-ID": {"1"}})
+	for _, want := range []string{"2", "3"} {
+		if message := stream.next(); message["id"] != want {
+			t.Fatalf("replayed %v, want id %s", message, want)
+		}
+	}
+}
+
+func TestEventStreamEndsOnShutdown(t *testing.T) {
+	app, server := newEventsServer(t)
+	stream := openStream(t, server.URL, nil)
+	close(app.closing)
+
+	done := make(chan bool)
+	go func() { done <- stream.scanner.Scan() }()
+	select {
+	case more := <-done:
+		if more {
+			t.Fatal("stream sent data after shutdown")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream still open after shutdown")
+	}
+}
+
+// newDevicesServer serves the device routes of a broker whose store knows
+// FIZR001
+func newDevicesServer(t *testing.T) (*network.MQTTBroker, *httptest.Server) {
+	t.Helper()
+	store, err := network.NewDeviceStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Seen(network.ReaderDevice{DeviceID: "FIZR001", Firmware: "1.0.0", LastSeen: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	broker := network.NewMQTTBroker(network.MQTTConfig{Port: port})
+	broker.SetDeviceStore(store)
+	if err := broker.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Stop() })
+
+	app := &Application{mqttBroker: broker}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/devices/{id}", app.handleUpdateDevice).Methods("PUT")
+	router.HandleFunc("/api/devices/{id}", app.handleForgetDevice).Methods("DELETE")
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return broker, server
+}
+
+// doRequest sends a request with an optional body and returns the response
+func doRequest(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestUpdateDevice(t *testing.T) {
+	broker, server := newDevicesServer(t)
+
+	resp := doRequest(t, "PUT", server.URL+"/api/devices/FIZR001", `{"name":"Front door","labels":{"room":"hall"}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	var device network.ReaderDevice
+	if err := json.NewDecoder(resp.Body).Decode(&device); err != nil {
+		t.Fatal(err)
+	}
+	if device.DeviceID != "FIZR001" || device.Name != "Front door" || device.Labels["room"] != "hall" {
+		t.Fatalf("response %+v", device)
+	}
+	devices := broker.GetDevices()
+	if len(devices) != 1 || devices[0].Name != "Front door" {
+		t.Fatalf("devices %+v", devices)
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		body string
+		want int
+	}{
+		{"unknown device", "/api/devices/FIZR404", `{"name":"Nowhere"}`, http.StatusNotFound},
+		{"bad payload", "/api/devices/FIZR001", `{"name":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := doRequest(t, "PUT", server.URL+tt.url, tt.body); resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestForgetDevice(t *testing.T) {
+	broker, server := newDevicesServer(t)
+
+	if resp := doRequest(t, "DELETE", server.URL+"/api/devices/FIZR001", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if devices := broker.GetDevices(); len(devices) != 0 {
+		t.Fatalf("devices %+v after forgetting", devices)
+	}
+	if resp := doRequest(t, "DELETE", server.URL+"/api/devices/FIZR001", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("forgetting twice gave status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,109 @@
+package fizhub
+
+import (
+	"errors"
+
+	"fizhub/internal/metrics"
+	"fizhub/internal/network"
+	"fizhub/internal/power"
+	"fizhub/internal/state"
+)
+
+// Tap sources used as metric labels
+const (
+	tapSourceLocal = "local"
+	tapSourceMQTT  = "mqtt"
+	tapSourceHTTP  = "http"
+)
+
+// appMetrics holds the metrics served on /metrics
+type appMetrics struct {
+	registry           *metrics.Registry
+	taps               *metrics.CounterVec
+	tapsRejected       *metrics.CounterVec
+	validations        *metrics.CounterVec
+	validationDuration *metrics.HistogramVec
+	cursiveRetries     *metrics.CounterVec
+	readers            *metrics.GaugeVec
+	readerRSSI         *metrics.GaugeVec
+	powerState         *metrics.GaugeVec
+	phase              *metrics.GaugeVec
+	pendingValidations *metrics.GaugeVec
+	pendingUploads     *metrics.GaugeVec
+}
+
+func newAppMetrics() *appMetrics {
+	r := metrics.NewRegistry()
+	return &appMetrics{
+		registry:           r,
+		taps:               r.NewCounterVec("fizhub_taps_total", "NFC taps received, by source.", "source"),
+		tapsRejected:       r.NewCounterVec("fizhub_taps_rejected_total", "NFC taps that were not added to a bond, by source and reason.", "source", "reason"),
+		validations:        r.NewCounterVec("fizhub_validations_total", "Cursive validation requests, by outcome.", "outcome"),
+		validationDuration: r.NewHistogramVec("fizhub_validation_duration_seconds", "Cursive validation latency including retries.", metrics.DefaultBuckets, "outcome"),
+		cursiveRetries:     r.NewCounterVec("fizhub_cursive_retries_total", "Cursive API requests retried after a failed attempt, by path.", "path"),
+		readers:            r.NewGaugeVec("fizhub_readers", "Registered Fiz Readers, by status.", "status"),
+		readerRSSI:         r.NewGaugeVec("fizhub_reader_rssi_dbm", "Last Wi-Fi signal strength reported by each reader.", "device_id"),
+		powerState:         r.NewGaugeVec("fizhub_power_state", "Current power state, 1 for the active state.", "state"),
+		phase:              r.NewGaugeVec("fizhub_session_phase", "Current phase of each bond session, 1 for the active phase.", "session", "phase"),
+		pendingValidations: r.NewGaugeVec("fizhub_pending_validations", "Validations waiting in the offline queue."),
+		pendingUploads:     r.NewGaugeVec("fizhub_pending_uploads", "Recordings waiting in the upload outbox."),
+	}
+}
+
+// tapRejectReason maps a state manager error to a metric label
+func tapRejectReason(err error) string {
+	switch {
+	case errors.Is(err, state.ErrDuplicateUID):
+		return "duplicate"
+	case errors.Is(err, state.ErrNotCollecting):
+		return "wrong_phase"
+	case errors.Is(err, errUnassignedReader):
+		return "unassigned"
+	case errors.Is(err, network.ErrSUNRequired):
+		return "unverified"
+	case errors.Is(err, network.ErrSUNInvalid):
+		return "not_genuine"
+	case errors.Is(err, network.ErrSUNReplayed):
+		return "replayed"
+	default:
+		return "invalid"
+	}
+}
+
+// collectMetrics refreshes the gauges that are read from other components
+func (app *Application) collectMetrics() {
+	m := app.metrics
+
+	m.readers.Reset()
+	m.readerRSSI.Reset()
+	counts := map[string]int{network.StatusOnline: 0, network.StatusStale: 0, network.StatusOffline: 0}
+	for _, device := range app.mqttBroker.GetDevices() {
+		counts[device.Status]++
+		m.readerRSSI.Set(float64(device.RSSI), device.DeviceID)
+	}
+	for status, count := range counts {
+		m.readers.Set(float64(count), status)
+	}
+
+	current := app.powerMgr.GetState()
+	for _, s := range []power.State{power.StateActive, power.StateIdle, power.StateDeepSleep} {
+		m.powerState.Set(boolValue(s == current), s.String())
+	}
+
+	for _, session := range app.sessions {
+		phase := session.stateMgr.GetPhase()
+		for _, p := range []state.Phase{state.PhaseInitial, state.PhaseCollectingUIDs, state.PhaseValidating, state.PhaseRecordingMessage, state.PhaseComplete} {
+			m.phase.Set(boolValue(p == phase), session.name, p.String())
+		}
+	}
+
+	m.pendingValidations.Set(float64(len(app.queue.Pending())))
+	m.pendingUploads.Set(float64(len(app.outbox.Pending())))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package fizhub
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"fizhub/internal/led"
+	"fizhub/internal/network"
+	"github.com/gorilla/mux"
+)
+
+// defaultPairingTimeout is used when mqtt.pairing_timeout is unset
+const defaultPairingTimeout = 2 * time.Minute
+
+// setupProvisioning shows pairing on the LED ring and registers the
+// provisioning routes
+func (app *Application) setupProvisioning() {
+	app.mqttBroker.SetPairingHandler(func(deviceID string) {
+		if app.ledCtrl.GetState() != led.StatePairing {
+			return
+		}
+		if deviceID == "" {
+			app.ledCtrl.SetState(led.StateError)
+			time.AfterFunc(errorDisplayTime, func() {
+				if app.ledCtrl.GetState() == led.StateError {
+					app.ledCtrl.SetState(led.StateIdle)
+				}
+			})
+			return
+		}
+		app.ledCtrl.SetState(led.StateIdle)
+	})
+
+	app.router.HandleFunc("/api/provisioning/devices", app.handleProvisionedDevices).Methods("GET")
+	app.router.HandleFunc("/api/provisioning/pairing", app.handleStartPairing).Methods("POST")
+	app.router.HandleFunc("/api/devices/{id}/approve", app.handleApproveDevice).Methods("POST")
+	app.router.HandleFunc("/api/devices/{id}/revoke", app.handleRevokeDevice).Methods("POST")
+	app.router.HandleFunc("/api/devices/{id}/signing-key", app.handleIssueSigningKey).Methods("POST")
+	app.router.HandleFunc("/api/devices/{id}/signing-key", app.handleRemoveSigningKey).Methods("DELETE")
+}
+
+func (app *Application) handleProvisionedDevices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(app.devices.List()); err != nil {
+		httpLogger.Error("Error encoding provisioning response", "error", err)
+	}
+}
+
+func (app *Application) handleStartPairing(w http.ResponseWriter, r *http.Request) {
+	ttl := app.config.MQTT.PairingTimeout.Duration
+	if ttl <= 0 {
+		ttl = defaultPairingTimeout
+	}
+
+	code, expires, err := app.mqttBroker.StartPairing(ttl)
+	switch {
+	case errors.Is(err, network.ErrPairingActive):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	httpLogger.Info("Pairing started, showing code on the LED ring", "expires", expires)
+	app.ledCtrl.SetPairingCode(code)
+	app.ledCtrl.SetState(led.StatePairing)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := struct {
+		Code      string    `json:"code"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{code, expires}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		httpLogger.Error("Error encoding pairing response", "error", err)
+	}
+}
+
+func (app *Application) handleApproveDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	token, err := app.mqttBroker.ApproveDevice(deviceID)
+	if err != nil {
+		httpLogger.Error("Error approving device", "device_id", deviceID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := struct {
+		DeviceID string `json:"device_id"`
+		Token    string `json:"token"`
+	}{deviceID, token}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		httpLogger.Error("Error encoding approval response", "error", err)
+	}
+}
+
+func (app *Application) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	err := app.mqttBroker.RevokeDevice(deviceID)
+	switch {
+	case errors.Is(err, network.ErrUnknownDevice):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		httpLogger.Error("Error revoking device", "device_id", deviceID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleIssueSigningKey gives a reader a new key to sign its taps with. The
+// key is only shown in this response.
+func (app *Application) handleIssueSigningKey(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	key, err := app.devices.IssueSigningKey(deviceID)
+	if err != nil {
+		httpLogger.Error("Error issuing signing key", "device_id", deviceID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpLogger.Info("Signing key issued", "device_id", deviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := struct {
+		DeviceID   string `json:"device_id"`
+		SigningKey string `json:"signing_key"`
+	}{deviceID, key}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		httpLogger.Error("Error encoding signing key response", "error", err)
+	}
+}
+
+func (app *Application) handleRemoveSigningKey(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	err := app.devices.RemoveSigningKey(deviceID)
+	switch {
+	case errors.Is(err, network.ErrUnknownDevice):
+		http.Error(w, "device has no signing key", http.StatusNotFound)
+		return
+	case err != nil:
+		httpLogger.Error("Error removing signing key", "device_id", deviceID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpLogger.Info("Signing key removed", "device_id", deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
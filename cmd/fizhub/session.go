@@ -0,0 +1,375 @@
+package fizhub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"fizhub/internal/audio"
+	"fizhub/internal/events"
+	"fizhub/internal/led"
+	"fizhub/internal/logging"
+	"fizhub/internal/network"
+	"fizhub/internal/nfc"
+	"fizhub/internal/state"
+)
+
+// SessionConfig assigns a group of readers to an independent bond session
+type SessionConfig struct {
+	Name string `json:"name"`
+	// Readers lists the device IDs whose taps belong to the session. The
+	// hub's own reader is "local" and HTTP taps without a device ID come
+	// from "http". A session without readers takes every reader that is
+	// not assigned to another session.
+	Readers []string `json:"readers"`
+	// LED gives the session the hub's LED ring
+	LED bool `json:"led"`
+	// AudioDevice overrides audio.device_id for the session's recordings
+	AudioDevice string `json:"audio_device"`
+}
+
+// defaultSessionName is used when no sessions are configured
+const defaultSessionName = "default"
+
+// errUnassignedReader is returned for taps from readers without a session
+var errUnassignedReader = errors.New("reader is not assigned to a session")
+
+// sessionLogger is the parent of every session's logger
+var sessionLogger = logging.For("session")
+
+// Session is a bond session with its own phase, collected UIDs, bond ID
+// and recorder
+type Session struct {
+	name     string
+	readers  []string
+	app      *Application
+	stateMgr *state.Manager
+	recorder *audio.Recorder
+	// ledCtrl is nil unless the session owns the hub's LED ring
+	ledCtrl *led.Controller
+	logger  *logging.Logger
+}
+
+// newSessions creates the configured sessions, or a single default session
+// that owns the LED ring and takes every reader
+func (app *Application) newSessions(config Config) error {
+	configs := config.Sessions
+	if len(configs) == 0 {
+		configs = []SessionConfig{{Name: defaultSessionName, LED: true}}
+	}
+
+	app.sessionsByReader = make(map[string]*Session)
+	names := make(map[string]bool)
+	ledOwner := ""
+	for _, sc := range configs {
+		if sc.Name == "" || filepath.Base(sc.Name) != sc.Name || sc.Name == "." || sc.Name == ".." {
+			return fmt.Errorf("invalid session name: %q", sc.Name)
+		}
+		if names[sc.Name] {
+			return fmt.Errorf("duplicate session name: %q", sc.Name)
+		}
+		names[sc.Name] = true
+
+		if sc.LED {
+			if ledOwner != "" {
+				return fmt.Errorf("sessions %q and %q both claim the LED ring", ledOwner, sc.Name)
+			}
+			ledOwner = sc.Name
+		}
+
+		audioConfig := config.audioConfig()
+		if sc.AudioDevice != "" {
+			audioConfig.DeviceID = sc.AudioDevice
+		}
+		if len(configs) > 1 {
+			audioConfig.OutputDir = filepath.Join(audioConfig.OutputDir, sc.Name)
+		}
+
+		session := &Session{
+			name:    sc.Name,
+			readers: sc.Readers,
+			app:     app,
+			stateMgr: state.NewManager(state.Config{
+				Name:              sc.Name,
+				MinBondSize:       config.Session.MinBondSize,
+				MaxBondSize:       config.Session.MaxBondSize,
+				CollectingTimeout: config.Session.CollectingTimeout.Duration,
+				ValidatingTimeout: config.Session.ValidatingTimeout.Duration,
+				RecordingTimeout:  config.Session.RecordingTimeout.Duration,
+				CompleteCooldown:  config.Session.CompleteCooldown.Duration,
+			}),
+			recorder: audio.NewRecorder(audioConfig),
+			logger:   sessionLogger.With("session", sc.Name),
+		}
+		if sc.LED {
+			session.ledCtrl = app.ledCtrl
+		}
+
+		if len(sc.Readers) == 0 {
+			if app.catchAllSession != nil {
+				return fmt.Errorf("sessions %q and %q both have no readers", app.catchAllSession.name, sc.Name)
+			}
+			app.catchAllSession = session
+		}
+		for _, reader := range sc.Readers {
+			if other, ok := app.sessionsByReader[reader]; ok {
+				return fmt.Errorf("reader %q is assigned to sessions %q and %q", reader, other.name, sc.Name)
+			}
+			app.sessionsByReader[reader] = session
+		}
+
+		app.sessions = append(app.sessions, session)
+	}
+	return nil
+}
+
+// sessionFor returns the session that taps from readerID belong to
+func (app *Application) sessionFor(readerID string) (*Session, error) {
+	if session, ok := app.sessionsByReader[readerID]; ok {
+		return session, nil
+	}
+	if app.catchAllSession != nil {
+		return app.catchAllSession, nil
+	}
+	return nil, errUnassignedReader
+}
+
+// sessionByName returns the named session, or the first session for an
+// empty name
+func (app *Application) sessionByName(name string) (*Session, error) {
+	if name == "" {
+		return app.sessions[0], nil
+	}
+	for _, session := range app.sessions {
+		if session.name == name {
+			return session, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown session: %q", name)
+}
+
+// Start starts the session's state manager and recorder
+func (s *Session) Start(ctx context.Context) error {
+	if err := s.stateMgr.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start state manager for session %s: %w", s.name, err)
+	}
+	if err := s.recorder.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start audio recorder for session %s: %w", s.name, err)
+	}
+	return nil
+}
+
+// setupInteractions connects the session's state manager, recorder and
+// LED ring
+func (s *Session) setupInteractions() {
+	s.stateMgr.Subscribe(state.PhaseValidating, func(phase state.Phase) {
+		s.setLED(led.StateWaiting)
+	})
+
+	s.stateMgr.SubscribeValidation(func(round state.Round, taps []nfc.Tap) {
+		go s.validateTaps(round, taps)
+	})
+
+	s.stateMgr.Subscribe(state.PhaseRecordingMessage, func(phase state.Phase) {
+		s.setLED(led.StateSuccess)
+		if err := s.recorder.StartRecording(); err != nil {
+			s.logger.Error("Failed to start recording", "error", err)
+			s.stateMgr.Reset()
+			s.showError()
+		}
+	})
+
+	s.stateMgr.Subscribe(state.PhaseComplete, func(phase state.Phase) {
+		s.logger.Info("Bond complete, queueing message upload", "bond_id", s.stateMgr.GetBondID())
+		s.queueRecordingUpload()
+	})
+
+	s.stateMgr.Subscribe(state.PhaseCollectingUIDs, func(phase state.Phase) {
+		s.setProgress(0)
+		s.setLED(led.StateIdle)
+	})
+
+	// Show how much of the bond has been collected on the LED ring
+	s.stateMgr.SubscribeTap(func(tap nfc.Tap, collected int) {
+		s.setProgress(collected)
+	})
+
+	// Handle sessions reset by a phase timeout
+	s.stateMgr.SubscribeTimeout(func(timeout state.Timeout) {
+		s.logger.Warn("Session reset", "phase", timeout.Phase, "after", timeout.After, "reason", timeout.Reason())
+		switch timeout.Phase {
+		case state.PhaseRecordingMessage:
+			s.recorder.StopRecording()
+			s.showError()
+		case state.PhaseCollectingUIDs, state.PhaseValidating:
+			s.showError()
+		}
+	})
+
+	// Handle recording state changes
+	s.recorder.SetOnStateChange(func(recState audio.State) {
+		s.logger.Debug("Recording state changed", "state", recState)
+		switch recState {
+		case audio.StateRecording:
+			s.app.events.Publish(events.TypeRecording, events.RecordingData{Session: s.name, State: "recording"})
+			s.stateMgr.HandleEvent(state.EventRecordingStarted, nil)
+		case audio.StateFinished:
+			s.app.events.Publish(events.TypeRecording, events.RecordingData{
+				Session: s.name,
+				State:   "finished",
+				Path:    s.recorder.LastRecording(),
+			})
+			s.stateMgr.HandleEvent(state.EventRecordingComplete, nil)
+		case audio.StateFailed:
+			s.app.events.Publish(events.TypeRecording, events.RecordingData{Session: s.name, State: "failed"})
+			if s.stateMgr.HandleEvent(state.EventRecordingFailed, nil) == nil {
+				s.showError()
+			}
+		}
+	})
+}
+
+// setLED changes the LED ring if the session owns it
+func (s *Session) setLED(state led.State) {
+	if s.ledCtrl != nil {
+		s.ledCtrl.SetState(state)
+	}
+}
+
+// setProgress shows collected taps on the LED ring if the session owns it
+func (s *Session) setProgress(collected int) {
+	if s.ledCtrl != nil {
+		_, maxBond := s.stateMgr.GetBondSize()
+		s.ledCtrl.SetProgress(collected, maxBond)
+	}
+}
+
+// showError shows the error state briefly before returning to idle
+func (s *Session) showError() {
+	if s.ledCtrl == nil {
+		return
+	}
+	s.ledCtrl.SetState(led.StateError)
+	time.AfterFunc(errorDisplayTime, func() {
+		if s.ledCtrl.GetState() == led.StateError {
+			s.ledCtrl.SetState(led.StateIdle)
+		}
+	})
+}
+
+// queueRecordingUpload hands the finished bond message to the upload outbox
+func (s *Session) queueRecordingUpload() {
+	path := s.recorder.LastRecording()
+	if path == "" {
+		s.logger.Warn("No recording to upload")
+		return
+	}
+
+	_, err := s.app.outbox.Enqueue(path, network.RecordingUpload{
+		BondID:   s.stateMgr.GetBondID(),
+		Accounts: s.stateMgr.GetValidAccounts(),
+		UIDs:     s.stateMgr.GetCollectedUIDs(),
+	})
+	if err != nil {
+		s.logger.Error("Failed to queue recording upload", "error", err)
+	}
+}
+
+// validateTaps sends the taps of a group to Cursive and advances the
+// session, unless it has moved on from the group while Cursive answered
+func (s *Session) validateTaps(round state.Round, taps []nfc.Tap) {
+	app := s.app
+	req := newValidationRequest(taps)
+	req.MinBondSize, req.MaxBondSize = s.stateMgr.GetBondSize()
+	s.logger.Info("Validating UIDs", "uids", req.UIDs)
+	ctx := context.Background()
+	started := time.Now()
+	resp, err := app.client.Validate(ctx, req)
+	outcome := "error"
+	switch {
+	case err != nil:
+	case resp.Valid:
+		outcome = "valid"
+	default:
+		outcome = "invalid"
+	}
+	app.metrics.validations.Inc(outcome)
+	app.metrics.validationDuration.Observe(time.Since(started).Seconds(), outcome)
+	result := events.ValidationData{Session: s.name, UIDs: req.UIDs}
+	if err != nil {
+		result.Error = err.Error()
+		result.Queued = network.IsRetryable(err)
+	} else {
+		result.Valid = resp.Valid
+		result.Accounts = resp.Accounts
+		result.Reason = resp.Reason
+	}
+	app.events.Publish(events.TypeValidation, result)
+	if err != nil {
+		s.logger.Warn("UID validation error", "uids", req.UIDs, "error", err)
+
+		// Keep the taps so nobody has to tap again, and free the session
+		// for the next group while the queue retries in the background. A
+		// refused request would be refused again, so only outages are
+		// queued.
+		if result.Queued {
+			if _, qerr := app.queue.Enqueue(req); qerr != nil {
+				s.logger.Error("Failed to queue validation", "error", qerr)
+				return
+			}
+		}
+		s.failValidation(round, err)
+		return
+	}
+
+	// Cursive is reachable again, flush anything left from an outage
+	app.queue.RetryNow()
+
+	if !resp.Valid {
+		s.logger.Info("UID validation failed", "uids", req.UIDs, "reason", resp.Reason)
+		reason := resp.Reason
+		if reason == "" {
+			reason = "bond rejected"
+		}
+		s.failValidation(round, errors.New(reason))
+		return
+	}
+
+	s.logger.Info("UIDs validated", "uids", req.UIDs, "accounts", resp.Accounts)
+	err = s.stateMgr.HandleEvent(state.EventUIDValidated, state.ValidationResult{Round: round, Accounts: resp.Accounts})
+	if errors.Is(err, state.ErrStaleRound) {
+		s.logger.Warn("Validation answered after the session moved on, ignoring it", "uids", req.UIDs)
+	}
+}
+
+// failValidation resets the session after a failed validation and shows
+// the error, unless the session has already moved on from the group
+func (s *Session) failValidation(round state.Round, err error) {
+	if s.stateMgr.HandleEvent(state.EventError, state.ValidationResult{Round: round, Err: err}) == nil {
+		s.showError()
+	}
+}
+
+// sessionStatus is a session's entry in /api/status
+type sessionStatus struct {
+	Name    string      `json:"name"`
+	Readers []string    `json:"readers,omitempty"`
+	Phase   state.Phase `json:"phase"`
+	UIDs    []string    `json:"uids"`
+	BondID  string      `json:"bond_id,omitempty"`
+	LED     bool        `json:"led"`
+}
+
+// status returns the session's current state
+func (s *Session) status() sessionStatus {
+	return sessionStatus{
+		Name:    s.name,
+		Readers: s.readers,
+		Phase:   s.stateMgr.GetPhase(),
+		UIDs:    s.stateMgr.GetCollectedUIDs(),
+		BondID:  s.stateMgr.GetBondID(),
+		LED:     s.ledCtrl != nil,
+	}
+}
@@ -0,0 +1,155 @@
+package fizhub
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"fizhub/internal/nfc"
+)
+
+// newSessionApp returns an application with the given sessions configured
+func newSessionApp(t *testing.T, sessions ...SessionConfig) (*Application, error) {
+	t.Helper()
+	config := getDefaultConfig()
+	config.Audio.OutputDir = t.TempDir()
+	config.Sessions = sessions
+	app := &Application{}
+	return app, app.newSessions(config)
+}
+
+func TestNewSessionsRejectsBadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions []SessionConfig
+		want     string
+	}{
+		{"empty name", []SessionConfig{{Name: ""}}, "invalid session name"},
+		{"path name", []SessionConfig{{Name: "a/b"}}, "invalid session name"},
+		{"parent name", []SessionConfig{{Name: ".."}}, "invalid session name"},
+		{"duplicate name", []SessionConfig{{Name: "hall", Readers: []string{"FIZR001"}}, {Name: "hall", Readers: []string{"FIZR002"}}}, "duplicate session name"},
+		{"LED claimed twice", []SessionConfig{{Name: "hall", LED: true}, {Name: "bar", Readers: []string{"FIZR002"}, LED: true}}, "both claim the LED ring"},
+		{"two catch-alls", []SessionConfig{{Name: "hall"}, {Name: "bar"}}, "both have no readers"},
+		{"reader in two sessions", []SessionConfig{{Name: "hall", Readers: []string{"FIZR001"}}, {Name: "bar", Readers: []string{"FIZR002", "FIZR001"}}}, `reader "FIZR001" is assigned to sessions "hall" and "bar"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSessionApp(t, tt.sessions...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultSession(t *testing.T) {
+	app, err := newSessionApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(app.sessions) != 1 || app.sessions[0].name != defaultSessionName {
+		t.Fatalf("got %d sessions, want only %q", len(app.sessions), defaultSessionName)
+	}
+	for _, reader := range []string{"FIZR001", "local", "http"} {
+		if session, err := app.sessionFor(reader); err != nil || session != app.sessions[0] {
+			t.Fatalf("%s: session %v, error %v", reader, session, err)
+		}
+	}
+}
+
+func TestSessionFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions []SessionConfig
+		routes   map[string]string
+	}{
+		{
+			name: "catch-all",
+			sessions: []SessionConfig{
+				{Name: "hall", Readers: []string{"FIZR001", "FIZR002"}},
+				{Name: "bar"},
+			},
+			routes: map[string]string{"FIZR001": "hall", "FIZR002": "hall", "FIZR003": "bar", "local": "bar"},
+		},
+		{
+			name: "no catch-all",
+			sessions: []SessionConfig{
+				{Name: "hall", Readers: []string{"FIZR001", "local"}},
+				{Name: "bar", Readers: []string{"FIZR002", "http"}},
+			},
+			routes: map[string]string{"FIZR001": "hall", "local": "hall", "FIZR002": "bar", "http": "bar", "FIZR003": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, err := newSessionApp(t, tt.sessions...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for reader, want := range tt.routes {
+				session, err := app.sessionFor(reader)
+				if want == "" {
+					if err != errUnassignedReader {
+						t.Errorf("%s: error %v, want %v", reader, err, errUnassignedReader)
+					}
+					continue
+				}
+				if err != nil || session.name != want {
+					t.Errorf("%s: session %v, error %v, want %s", reader, session, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionByName(t *testing.T) {
+	app, err := newSessionApp(t,
+		SessionConfig{Name: "hall", Readers: []string{"FIZR001"}},
+		SessionConfig{Name: "bar", Readers: []string{"FIZR002"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session, err := app.sessionByName(""); err != nil || session.name != "hall" {
+		t.Fatalf("empty name gave %v, error %v, want the first session", session, err)
+	}
+	if session, err := app.sessionByName("bar"); err != nil || session.name != "bar" {
+		t.Fatalf("got %v, error %v", session, err)
+	}
+	if _, err := app.sessionByName("kitchen"); err == nil {
+		t.Fatal("unknown session was found")
+	}
+}
+
+func TestSessionsBondIndependently(t *testing.T) {
+	app, err := newSessionApp(t,
+		SessionConfig{Name: "hall", Readers: []string{"FIZR001"}},
+		SessionConfig{Name: "bar", Readers: []string{"FIZR002"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hall, bar := app.sessions[0], app.sessions[1]
+	for _, s := range app.sessions {
+		if err := s.stateMgr.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same tag may be collected by both sessions at once
+	for _, reader := range []string{"FIZR001", "FIZR002"} {
+		session, _ := app.sessionFor(reader)
+		if _, err := session.stateMgr.HandleTap(nfc.Tap{UID: "04A1B2C3", ReaderID: reader}); err != nil {
+			t.Fatalf("%s: %v", reader, err)
+		}
+	}
+	if _, err := bar.stateMgr.HandleTap(nfc.Tap{UID: "04D4E5F6", ReaderID: "FIZR002"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(hall.stateMgr.GetCollectedUIDs()); got != 1 {
+		t.Fatalf("hall collected %d taps, want 1", got)
+	}
+	if got := len(bar.stateMgr.GetCollectedUIDs()); got != 2 {
+		t.Fatalf("bar collected %d taps, want 2", got)
+	}
+}
@@ -48,6 +48,11 @@ ssh $REMOTE_USER@$REMOTE_HOST "cd $REMOTE_DIR && \
         sudo apt-get update
         sudo apt-get install -y golang
     fi && \
+    # Install audio tools if not already installed
+    if ! command -v arecord &> /dev/null || ! command -v opusenc &> /dev/null; then
+        echo 'Installing audio tools...'
+        sudo apt-get install -y alsa-utils opus-tools
+    fi && \
     # Build the application
     go build -o fizhub cmd/fizhub/main.go && \
     # Create systemd service
@@ -60,6 +65,8 @@ After=network.target
 Type=simple
 User=fiz
 WorkingDirectory=$REMOTE_DIR
+# Secrets such as FIZHUB_MQTT_PASSWORD go here, the file is optional
+EnvironmentFile=-/etc/fizhub/env
 ExecStart=$REMOTE_DIR/fizhub
 Restart=always
 RestartSec=5
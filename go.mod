@@ -3,7 +3,6 @@ module fizhub
 go 1.16
 
 require (
-	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/gorilla/mux v1.8.1
 	github.com/pkg/errors v0.9.1
 )
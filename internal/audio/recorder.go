@@ -1,6 +1,23 @@
 package audio
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fizhub/internal/logging"
+)
+
+// logger is the audio component logger
+var logger = logging.For("audio")
 
 // State represents the recorder state
 type State int
@@ -9,23 +26,72 @@ const (
 	StateIdle State = iota
 	StateRecording
 	StateFinished
+	// StateFailed ends a recording that captured no audio
+	StateFailed
+)
+
+// ErrEmptyRecording is logged when the source ends before producing any
+// audio, for example when arecord cannot open the device
+var ErrEmptyRecording = errors.New("recording captured no audio")
+
+// Format describes the PCM sample format
+type Format struct {
+	SampleRate int `json:"sample_rate"`
+	Channels   int `json:"channels"`
+	BitDepth   int `json:"bit_depth"`
+}
+
+// bytesPerSecond returns the PCM data rate of the format
+func (f Format) bytesPerSecond() int64 {
+	return int64(f.SampleRate) * int64(f.Channels) * int64(f.BitDepth/8)
+}
+
+// Validate checks that the format can be recorded
+func (f Format) Validate() error {
+	if _, err := alsaSampleFormat(f.BitDepth); err != nil {
+		return err
+	}
+	if f.SampleRate <= 0 || f.Channels <= 0 {
+		return errors.New("sample rate and channels must be positive")
+	}
+	return nil
+}
+
+// Output encodings accepted in Config.Encoding
+const (
+	EncodingWAV  = "wav"
+	EncodingOpus = "opus"
 )
 
 // Config holds audio recorder configuration
 type Config struct {
-	Format struct {
-		SampleRate int `json:"sample_rate"`
-		Channels   int `json:"channels"`
-		BitDepth   int `json:"bit_depth"`
-	} `json:"format"`
-	MaxDuration string `json:"max_duration"`
-	DeviceID    string `json:"device_id"`
+	Format Format
+	// MaxDuration ends a recording that is not stopped earlier
+	MaxDuration time.Duration
+	DeviceID    string
+	// Source selects "alsa" (default), "file" or "generator"
+	Source string
+	// SourcePath is the WAV or raw PCM file used by the file source
+	SourcePath string
+	// OutputDir is where finished recordings are written
+	OutputDir string
+	// Encoding is "wav" or "opus". Opus output requires opusenc.
+	Encoding string
+	// OpusBitrate is the Opus bitrate in kbit/s
+	OpusBitrate int
 }
 
 // Recorder handles audio recording functionality
 type Recorder struct {
-	config Config
-	state  State
+	config        Config
+	source        Source
+	maxDuration   time.Duration
+	mutex         sync.Mutex
+	state         State
+	onStateChange func(State)
+	stop          chan struct{}
+	done          chan struct{}
+	lastRecording string
 }
 
 // DefaultConfig returns default audio configuration
@@ -34,8 +100,12 @@ func DefaultConfig() Config {
 	config.Format.SampleRate = 44100
 	config.Format.Channels = 1
 	config.Format.BitDepth = 16
-	config.MaxDuration = "3m"
+	config.MaxDuration = 3 * time.Minute
 	config.DeviceID = "default"
+	config.Source = SourceALSA
+	config.OutputDir = "data/recordings"
+	config.Encoding = EncodingWAV
+	config.OpusBitrate = 32
 	return config
 }
 
@@ -47,27 +117,236 @@ func NewRecorder(config Config) *Recorder {
 	}
 }
 
+// SetSource overrides the source selected in the configuration
+func (r *Recorder) SetSource(source Source) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.source = source
+}
+
 // Start initializes the recorder
 func (r *Recorder) Start(ctx context.Context) error {
-	// TODO: Implement actual audio recording initialization
+	maxDuration := r.config.MaxDuration
+	if maxDuration <= 0 {
+		return errors.New("max duration must be positive")
+	}
+	r.maxDuration = maxDuration
+
+	if err := r.config.Format.Validate(); err != nil {
+		return err
+	}
+
+	switch r.config.Encoding {
+	case "", EncodingWAV:
+	case EncodingOpus:
+		if _, err := exec.LookPath("opusenc"); err != nil {
+			logger.Warn("opusenc not found, recordings will be kept as WAV")
+		}
+	default:
+		return fmt.Errorf("unknown audio encoding: %q", r.config.Encoding)
+	}
+
+	if err := os.MkdirAll(r.config.OutputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.source == nil {
+		source, err := NewSource(r.config)
+		if err != nil {
+			return err
+		}
+		r.source = source
+	}
+	if _, ok := r.source.(ALSASource); ok {
+		if _, err := exec.LookPath("arecord"); err != nil {
+			logger.Warn("arecord not found, install alsa-utils to record audio")
+		}
+	}
 	return nil
 }
 
-// StartRecording begins recording audio
+// StartRecording begins recording audio. The recording ends after
+// MaxDuration, when the source runs out or when StopRecording is called.
 func (r *Recorder) StartRecording() error {
-	// TODO: Implement actual recording
+	r.mutex.Lock()
+	if r.state == StateRecording {
+		r.mutex.Unlock()
+		return errors.New("already recording")
+	}
+	if r.source == nil {
+		r.mutex.Unlock()
+		return errors.New("recorder not started")
+	}
+
+	stream, err := r.source.Open(r.config.Format)
+	if err != nil {
+		r.mutex.Unlock()
+		return fmt.Errorf("failed to open audio source: %w", err)
+	}
+
+	path := filepath.Join(r.config.OutputDir, fmt.Sprintf("message-%s.wav", time.Now().UTC().Format("20060102-150405.000")))
+	wav, err := createWAV(path, r.config.Format)
+	if err != nil {
+		stream.Close()
+		r.mutex.Unlock()
+		return fmt.Errorf("failed to create recording file: %w", err)
+	}
+
 	r.state = StateRecording
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	handler := r.onStateChange
+	go r.record(stream, wav, path, r.stop, r.done)
+	r.mutex.Unlock()
+
+	logger.Info("Recording started", "path", path)
+	if handler != nil {
+		handler(StateRecording)
+	}
 	return nil
 }
 
-// StopRecording stops the current recording
+// StopRecording stops the current recording and waits for the file to be
+// written. It does nothing when no recording is in progress.
 func (r *Recorder) StopRecording() error {
-	// TODO: Implement actual recording stop
-	r.state = StateFinished
+	r.mutex.Lock()
+	if r.state != StateRecording {
+		r.mutex.Unlock()
+		return nil
+	}
+	stop, done := r.stop, r.done
+	select {
+	case <-stop:
+	default:
+		close(stop)
+	}
+	r.mutex.Unlock()
+
+	<-done
 	return nil
 }
 
 // SetOnStateChange sets the callback for state changes
 func (r *Recorder) SetOnStateChange(callback func(State)) {
-	// TODO: Implement state change notifications
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.onStateChange = callback
+}
+
+// GetState returns the current recorder state
+func (r *Recorder) GetState() State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.state
+}
+
+// LastRecording returns the path of the most recently finished recording
+func (r *Recorder) LastRecording() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lastRecording
+}
+
+// record copies audio from stream into wav until the limit, the end of
+// the stream or a stop request
+func (r *Recorder) record(stream io.ReadCloser, wav *wavWriter, path string, stop, done chan struct{}) {
+	defer close(done)
+
+	limit := int64(r.maxDuration.Seconds() * float64(r.config.Format.bytesPerSecond()))
+	blockAlign := int64(r.config.Format.Channels * r.config.Format.BitDepth / 8)
+	limit -= limit % blockAlign
+
+	var written int64
+	buf := make([]byte, 32*1024)
+	var readErr error
+loop:
+	for written < limit {
+		select {
+		case <-stop:
+			break loop
+		default:
+		}
+
+		chunk := buf
+		if remaining := limit - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := stream.Read(chunk)
+		if n > 0 {
+			if _, werr := wav.Write(chunk[:n]); werr != nil {
+				readErr = werr
+				break
+			}
+			written += int64(n)
+		}
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+	}
+
+	stream.Close()
+	if err := wav.Close(); err != nil && readErr == nil {
+		readErr = err
+	}
+	if readErr != nil {
+		logger.Error("Recording error", "error", readErr)
+	}
+	if written == 0 {
+		logger.Error("Recording failed", "error", ErrEmptyRecording)
+		os.Remove(path)
+		r.finish(StateFailed, "")
+		return
+	}
+
+	duration := time.Duration(float64(written) / float64(r.config.Format.bytesPerSecond()) * float64(time.Second))
+	logger.Info("Recording finished", "duration", duration.Round(time.Millisecond))
+
+	if r.config.Encoding == EncodingOpus {
+		path = r.encodeOpus(path)
+	}
+
+	r.finish(StateFinished, path)
+}
+
+// finish ends the recording in state and reports it. path is the finished
+// recording, empty when it failed.
+func (r *Recorder) finish(state State, path string) {
+	r.mutex.Lock()
+	r.state = state
+	if path != "" {
+		r.lastRecording = path
+	}
+	handler := r.onStateChange
+	r.mutex.Unlock()
+
+	if handler != nil {
+		handler(state)
+	}
+}
+
+// encodeOpus converts a WAV recording to Ogg Opus and returns the path of
+// the file to keep. The WAV file is kept if encoding fails.
+func (r *Recorder) encodeOpus(wavPath string) string {
+	bitrate := r.config.OpusBitrate
+	if bitrate <= 0 {
+		bitrate = 32
+	}
+
+	opusPath := strings.TrimSuffix(wavPath, filepath.Ext(wavPath)) + ".opus"
+	cmd := exec.Command("opusenc", "--quiet",
+		"--bitrate", strconv.Itoa(bitrate),
+		wavPath, opusPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		logger.Warn("Opus encoding failed, keeping WAV", "error", err, "output", strings.TrimSpace(string(output)))
+		os.Remove(opusPath)
+		return wavPath
+	}
+
+	os.Remove(wavPath)
+	return opusPath
 }
@@ -0,0 +1,197 @@
+package audio
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFormat keeps recordings small: 8 kHz mono 16-bit is 16000 bytes/s
+var testFormat = Format{SampleRate: 8000, Channels: 1, BitDepth: 16}
+
+// stateRecorder collects the states a recorder reports
+type stateRecorder struct {
+	mutex  sync.Mutex
+	states []State
+	done   chan struct{}
+}
+
+func (s *stateRecorder) onStateChange(state State) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.states = append(s.states, state)
+	if state == StateFinished || state == StateFailed {
+		close(s.done)
+	}
+}
+
+// wait returns the reported states once the recording has ended
+func (s *stateRecorder) wait(t *testing.T) []State {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording did not end")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]State{}, s.states...)
+}
+
+// startRecorder starts a recorder reading from source
+func startRecorder(t *testing.T, source Source, maxDuration time.Duration) (*Recorder, *stateRecorder) {
+	t.Helper()
+	r := NewRecorder(Config{
+		Format:      testFormat,
+		MaxDuration: maxDuration,
+		OutputDir:   t.TempDir(),
+		Encoding:    EncodingWAV,
+	})
+	r.SetSource(source)
+	states := &stateRecorder{done: make(chan struct{})}
+	r.SetOnStateChange(states.onStateChange)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return r, states
+}
+
+// wavHeader is the canonical header written by wavWriter
+type wavHeader struct {
+	RIFF          [4]byte
+	ChunkSize     uint32
+	WAVE          [4]byte
+	Fmt           [4]byte
+	FmtSize       uint32
+	AudioFormat   uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	Data          [4]byte
+	DataSize      uint32
+}
+
+// readWAV returns the header of a recording and the size of its file
+func readWAV(t *testing.T, path string) (wavHeader, int64) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var header wavHeader
+	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, info.Size()
+}
+
+func TestRecordGenerator(t *testing.T) {
+	r, states := startRecorder(t, GeneratorSource{Frequency: 440}, 250*time.Millisecond)
+	if got := r.GetState(); got != StateIdle {
+		t.Fatalf("state %d before recording, want idle", got)
+	}
+
+	if err := r.StartRecording(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.StartRecording(); err == nil {
+		t.Fatal("second StartRecording succeeded while recording")
+	}
+
+	got := states.wait(t)
+	if len(got) != 2 || got[0] != StateRecording || got[1] != StateFinished {
+		t.Fatalf("states %v, want [recording finished]", got)
+	}
+	if r.GetState() != StateFinished {
+		t.Fatalf("state %d after recording, want finished", r.GetState())
+	}
+
+	// A quarter of a second of 8 kHz mono 16-bit audio
+	const dataSize = 4000
+	header, size := readWAV(t, r.LastRecording())
+	want := wavHeader{
+		RIFF:          [4]byte{'R', 'I', 'F', 'F'},
+		ChunkSize:     wavHeaderSize - 8 + dataSize,
+		WAVE:          [4]byte{'W', 'A', 'V', 'E'},
+		Fmt:           [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		AudioFormat:   1,
+		Channels:      1,
+		SampleRate:    8000,
+		ByteRate:      16000,
+		BlockAlign:    2,
+		BitsPerSample: 16,
+		Data:          [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      dataSize,
+	}
+	if header != want {
+		t.Fatalf("header %+v, want %+v", header, want)
+	}
+	if size != wavHeaderSize+dataSize {
+		t.Fatalf("file is %d bytes, want %d", size, wavHeaderSize+dataSize)
+	}
+}
+
+func TestStopRecording(t *testing.T) {
+	r, states := startRecorder(t, GeneratorSource{Frequency: 440, Realtime: true}, time.Minute)
+	if err := r.StartRecording(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := r.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := states.wait(t); got[len(got)-1] != StateFinished {
+		t.Fatalf("states %v, want to finish", got)
+	}
+	header, size := readWAV(t, r.LastRecording())
+	if header.DataSize == 0 || header.DataSize%2 != 0 || header.DataSize >= 16000*60 {
+		t.Fatalf("stopped recording has %d bytes of audio", header.DataSize)
+	}
+	if size != wavHeaderSize+int64(header.DataSize) {
+		t.Fatalf("file is %d bytes for %d bytes of audio", size, header.DataSize)
+	}
+}
+
+// emptySource ends immediately, like arecord failing to open its device
+type emptySource struct{}
+
+func (emptySource) Open(format Format) (io.ReadCloser, error) {
+	return ioutil.NopCloser(&io.LimitedReader{N: 0}), nil
+}
+
+func TestEmptyRecordingFails(t *testing.T) {
+	r, states := startRecorder(t, emptySource{}, time.Minute)
+	if err := r.StartRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := states.wait(t)
+	if len(got) != 2 || got[0] != StateRecording || got[1] != StateFailed {
+		t.Fatalf("states %v, want [recording failed]", got)
+	}
+	if path := r.LastRecording(); path != "" {
+		t.Fatalf("empty recording kept as %s", path)
+	}
+	files, err := ioutil.ReadDir(r.config.OutputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("empty recording left %d files behind", len(files))
+	}
+}
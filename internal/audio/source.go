@@ -0,0 +1,236 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Source produces raw little-endian PCM in the requested format
+type Source interface {
+	Open(format Format) (io.ReadCloser, error)
+}
+
+// Source names accepted in Config.Source
+const (
+	SourceALSA      = "alsa"
+	SourceFile      = "file"
+	SourceGenerator = "generator"
+)
+
+// NewSource creates the source selected in config
+func NewSource(config Config) (Source, error) {
+	switch config.Source {
+	case "", SourceALSA:
+		return ALSASource{Device: config.DeviceID}, nil
+	case SourceFile:
+		return FileSource{Path: config.SourcePath}, nil
+	case SourceGenerator:
+		return GeneratorSource{Frequency: 440, Realtime: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown audio source: %q", config.Source)
+	}
+}
+
+// ALSASource captures from an ALSA device using arecord
+type ALSASource struct {
+	Device string
+}
+
+// Open starts arecord writing raw PCM to a pipe
+func (s ALSASource) Open(format Format) (io.ReadCloser, error) {
+	sampleFormat, err := alsaSampleFormat(format.BitDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	device := s.Device
+	if device == "" {
+		device = "default"
+	}
+
+	cmd := exec.Command("arecord", "-q",
+		"-D", device,
+		"-f", sampleFormat,
+		"-r", strconv.Itoa(format.SampleRate),
+		"-c", strconv.Itoa(format.Channels),
+		"-t", "raw")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start arecord: %w", err)
+	}
+	return &processReader{cmd: cmd, stdout: stdout, stderr: &stderr}, nil
+}
+
+// alsaSampleFormat maps a bit depth to an arecord sample format
+func alsaSampleFormat(bitDepth int) (string, error) {
+	switch bitDepth {
+	case 8:
+		return "U8", nil
+	case 16:
+		return "S16_LE", nil
+	case 24:
+		return "S24_3LE", nil
+	case 32:
+		return "S32_LE", nil
+	default:
+		return "", fmt.Errorf("unsupported bit depth: %d", bitDepth)
+	}
+}
+
+// processReader reads a child process's stdout and stops it on Close
+type processReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr *bytes.Buffer
+}
+
+func (r *processReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF && r.stderr.Len() > 0 {
+		return n, fmt.Errorf("arecord: %s", bytes.TrimSpace(r.stderr.Bytes()))
+	}
+	return n, err
+}
+
+func (r *processReader) Close() error {
+	r.cmd.Process.Signal(os.Interrupt)
+	r.stdout.Close()
+	r.cmd.Wait()
+	return nil
+}
+
+// FileSource replays PCM from a WAV file or a raw PCM file. The data must
+// already be in the configured format.
+type FileSource struct {
+	Path string
+}
+
+// Open opens the file and skips a WAV header if there is one
+func (s FileSource) Open(format Format) (io.ReadCloser, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio source: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	if header, err := reader.Peek(12); err == nil && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE" {
+		if err := skipToWAVData(reader); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, file}, nil
+}
+
+// skipToWAVData advances r to the start of the data chunk
+func skipToWAVData(r *bufio.Reader) error {
+	if _, err := r.Discard(12); err != nil {
+		return err
+	}
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			return fmt.Errorf("no data chunk in WAV file: %w", err)
+		}
+		if string(chunk.ID[:]) == "data" {
+			return nil
+		}
+		// Chunks are padded to an even size
+		if _, err := r.Discard(int(chunk.Size + chunk.Size%2)); err != nil {
+			return err
+		}
+	}
+}
+
+// GeneratorSource synthesizes a sine tone, for running without a sound card
+type GeneratorSource struct {
+	Frequency float64
+	// Realtime paces output at the sample rate instead of as fast as possible
+	Realtime bool
+}
+
+// Open returns an endless stream of the tone
+func (s GeneratorSource) Open(format Format) (io.ReadCloser, error) {
+	if _, err := alsaSampleFormat(format.BitDepth); err != nil {
+		return nil, err
+	}
+	return &toneReader{source: s, format: format, started: time.Now()}, nil
+}
+
+// toneReader generates sine samples on demand
+type toneReader struct {
+	source  GeneratorSource
+	format  Format
+	frame   int64
+	started time.Time
+	pending []byte
+	closed  bool
+}
+
+func (r *toneReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, io.EOF
+	}
+
+	for len(r.pending) == 0 {
+		// Generate 20ms at a time
+		frames := int64(r.format.SampleRate / 50)
+		if r.source.Realtime {
+			due := r.started.Add(time.Duration(r.frame) * time.Second / time.Duration(r.format.SampleRate))
+			time.Sleep(time.Until(due))
+		}
+		for i := int64(0); i < frames; i++ {
+			t := float64(r.frame+i) / float64(r.format.SampleRate)
+			value := 0.5 * math.Sin(2*math.Pi*r.source.Frequency*t)
+			for c := 0; c < r.format.Channels; c++ {
+				r.pending = appendSample(r.pending, value, r.format.BitDepth)
+			}
+		}
+		r.frame += frames
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *toneReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+// appendSample encodes value in [-1, 1] as a little-endian PCM sample
+func appendSample(buf []byte, value float64, bitDepth int) []byte {
+	switch bitDepth {
+	case 8:
+		return append(buf, byte(128+int(value*127)))
+	case 16:
+		v := int16(value * math.MaxInt16)
+		return append(buf, byte(v), byte(v>>8))
+	case 24:
+		v := int32(value * (1<<23 - 1))
+		return append(buf, byte(v), byte(v>>8), byte(v>>16))
+	default:
+		v := int32(value * math.MaxInt32)
+		return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	}
+}
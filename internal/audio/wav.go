@@ -0,0 +1,87 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// wavHeaderSize is the size of a canonical PCM WAV header
+const wavHeaderSize = 44
+
+// wavWriter writes PCM data to a WAV file, filling in the sizes on Close
+type wavWriter struct {
+	file   *os.File
+	format Format
+	size   uint32
+}
+
+// createWAV creates path and reserves space for the header
+func createWAV(path string, format Format) (*wavWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wavWriter{file: file, format: format}
+	if err := w.writeHeader(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wavWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.size += uint32(n)
+	return n, err
+}
+
+// Close rewrites the header with the final sizes and closes the file
+func (w *wavWriter) Close() error {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.writeHeader(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// writeHeader writes the RIFF, fmt and data chunk headers
+func (w *wavWriter) writeHeader() error {
+	blockAlign := uint16(w.format.Channels * w.format.BitDepth / 8)
+	header := struct {
+		RIFF          [4]byte
+		ChunkSize     uint32
+		WAVE          [4]byte
+		Fmt           [4]byte
+		FmtSize       uint32
+		AudioFormat   uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Data          [4]byte
+		DataSize      uint32
+	}{
+		RIFF:          [4]byte{'R', 'I', 'F', 'F'},
+		ChunkSize:     wavHeaderSize - 8 + w.size,
+		WAVE:          [4]byte{'W', 'A', 'V', 'E'},
+		Fmt:           [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		AudioFormat:   1,
+		Channels:      uint16(w.format.Channels),
+		SampleRate:    uint32(w.format.SampleRate),
+		ByteRate:      uint32(w.format.SampleRate) * uint32(blockAlign),
+		BlockAlign:    blockAlign,
+		BitsPerSample: uint16(w.format.BitDepth),
+		Data:          [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      w.size,
+	}
+	return binary.Write(w.file, binary.LittleEndian, header)
+}
@@ -0,0 +1,231 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published on the bus
+const (
+	TypePhase      = "phase"
+	TypeTap        = "tap"
+	TypeTimeout    = "session_timeout"
+	TypeValidation = "validation"
+	TypeRecording  = "recording"
+	TypePower      = "power"
+	TypeReader     = "reader"
+	TypeFirmware   = "firmware"
+)
+
+// Event is a single hub event
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// Config holds event bus configuration
+type Config struct {
+	// History is the number of recent events kept for subscribers that
+	// reconnect
+	History int
+	// Buffer is the number of events a subscriber may fall behind before
+	// it is dropped
+	Buffer int
+}
+
+const (
+	defaultHistory = 256
+	defaultBuffer  = 64
+)
+
+// Bus fans events out to subscribers. Publishing never blocks: a
+// subscriber that falls more than Buffer events behind is closed so it can
+// reconnect and catch up from the history.
+type Bus struct {
+	config      Config
+	mutex       sync.Mutex
+	nextID      uint64
+	history     []Event
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives events from a Bus
+type Subscription struct {
+	bus    *Bus
+	events chan Event
+	closed bool
+}
+
+// NewBus creates a new event bus
+func NewBus(config Config) *Bus {
+	if config.History <= 0 {
+		config.History = defaultHistory
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	return &Bus{
+		config:      config,
+		nextID:      1,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends an event of the given type to every subscriber. A nil bus
+// discards the event, so components work without one.
+func (b *Bus) Publish(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	event := Event{
+		ID:   b.nextID,
+		Type: eventType,
+		Time: time.Now(),
+		Data: data,
+	}
+	b.nextID++
+
+	if len(b.history) == b.config.History {
+		b.history = append(b.history[:0], b.history[1:]...)
+	}
+	b.history = append(b.history, event)
+
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			b.remove(sub)
+		}
+	}
+}
+
+// Subscribe returns a subscription that first replays the kept events
+// newer than lastID. Pass 0 to receive only new events.
+func (b *Bus) Subscribe(lastID uint64) *Subscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var replay []Event
+	if lastID > 0 {
+		for _, event := range b.history {
+			if event.ID > lastID {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	sub := &Subscription{
+		bus:    b,
+		events: make(chan Event, b.config.Buffer+len(replay)),
+	}
+	for _, event := range replay {
+		sub.events <- event
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// remove closes sub. Callers must hold the mutex.
+func (b *Bus) remove(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(b.subscribers, sub)
+	close(sub.events)
+}
+
+// Events returns the channel of events. It is closed when the
+// subscription is closed or dropped for falling behind.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+	s.bus.remove(s)
+}
+
+// PhaseData is published when the bond session changes phase
+type PhaseData struct {
+	Session  string `json:"session,omitempty"`
+	Phase    string `json:"phase"`
+	Previous string `json:"previous"`
+	BondID   string `json:"bond_id,omitempty"`
+	Taps     int    `json:"taps"`
+	// Reason explains why the session was reset, such as Cursive's reason
+	// for rejecting the bond
+	Reason string `json:"reason,omitempty"`
+}
+
+// TapData is published for every tap handed to the state manager
+type TapData struct {
+	Session   string    `json:"session,omitempty"`
+	UID       string    `json:"uid"`
+	TagType   string    `json:"tag_type,omitempty"`
+	ReaderID  string    `json:"reader_id"`
+	RSSI      int       `json:"rssi,omitempty"`
+	TappedAt  time.Time `json:"tapped_at"`
+	Accepted  bool      `json:"accepted"`
+	Result    string    `json:"result"`
+	Reason    string    `json:"reason,omitempty"`
+	Collected int       `json:"collected"`
+}
+
+// TimeoutData is published when a phase timeout resets the session
+type TimeoutData struct {
+	Session string   `json:"session,omitempty"`
+	Phase   string   `json:"phase"`
+	After   string   `json:"after"`
+	UIDs    []string `json:"uids"`
+}
+
+// ValidationData is published when Cursive answers a validation request
+// or cannot be reached
+type ValidationData struct {
+	Session  string   `json:"session,omitempty"`
+	UIDs     []string `json:"uids"`
+	Valid    bool     `json:"valid"`
+	Accounts []string `json:"accounts,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Queued   bool     `json:"queued,omitempty"`
+}
+
+// RecordingData is published when the recorder starts or finishes
+type RecordingData struct {
+	Session string `json:"session,omitempty"`
+	State   string `json:"state"`
+	Path    string `json:"path,omitempty"`
+}
+
+// PowerData is published when the power state changes
+type PowerData struct {
+	State    string `json:"state"`
+	Previous string `json:"previous"`
+}
+
+// ReaderData is published when a reader registers or changes status
+type ReaderData struct {
+	DeviceID string `json:"device_id"`
+	Status   string `json:"status"`
+	Previous string `json:"previous,omitempty"`
+	RSSI     int    `json:"rssi"`
+}
+
+// FirmwareData is published when a reader's firmware update changes status
+type FirmwareData struct {
+	DeviceID string `json:"device_id"`
+	Version  string `json:"version"`
+	Status   string `json:"status"`
+	Progress int    `json:"progress"`
+	Error    string `json:"error,omitempty"`
+}
@@ -0,0 +1,127 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+// next returns the next event of sub, failing the test if none arrives
+func next(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case event, ok := <-sub.Events():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+// expectNone fails the test if sub has an event waiting
+func expectNone(t *testing.T, sub *Subscription) {
+	t.Helper()
+	select {
+	case event := <-sub.Events():
+		t.Fatalf("unexpected event %+v", event)
+	default:
+	}
+}
+
+func TestPublishFansOut(t *testing.T) {
+	bus := NewBus(Config{})
+	first, second := bus.Subscribe(0), bus.Subscribe(0)
+
+	bus.Publish(TypePhase, PhaseData{Phase: "validating"})
+	bus.Publish(TypeTap, TapData{UID: "04a1"})
+
+	for _, sub := range []*Subscription{first, second} {
+		phase := next(t, sub)
+		if phase.ID != 1 || phase.Type != TypePhase || phase.Data.(PhaseData).Phase != "validating" || phase.Time.IsZero() {
+			t.Fatalf("unexpected first event %+v", phase)
+		}
+		if tap := next(t, sub); tap.ID != 2 || tap.Type != TypeTap {
+			t.Fatalf("unexpected second event %+v", tap)
+		}
+	}
+}
+
+func TestSubscribeOnlyGetsNewEvents(t *testing.T) {
+	bus := NewBus(Config{})
+	bus.Publish(TypePhase, nil)
+	sub := bus.Subscribe(0)
+	expectNone(t, sub)
+
+	bus.Publish(TypeTap, nil)
+	if event := next(t, sub); event.ID != 2 {
+		t.Fatalf("got event %d, want 2", event.ID)
+	}
+}
+
+func TestSubscribeReplaysHistory(t *testing.T) {
+	bus := NewBus(Config{History: 3})
+	for i := 0; i < 5; i++ {
+		bus.Publish(TypeTap, i)
+	}
+
+	// Events 1 and 2 have left the history
+	sub := bus.Subscribe(1)
+	for _, want := range []uint64{3, 4, 5} {
+		if event := next(t, sub); event.ID != want {
+			t.Fatalf("replayed event %d, want %d", event.ID, want)
+		}
+	}
+	expectNone(t, sub)
+
+	caughtUp := bus.Subscribe(4)
+	if event := next(t, caughtUp); event.ID != 5 {
+		t.Fatalf("replayed event %d, want 5", event.ID)
+	}
+	expectNone(t, caughtUp)
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	bus := NewBus(Config{Buffer: 2})
+	slow, fast := bus.Subscribe(0), bus.Subscribe(0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			bus.Publish(TypeTap, i)
+			next(t, fast)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+
+	// The slow subscriber keeps what fit in its buffer, then is closed
+	for i := 0; i < 2; i++ {
+		next(t, slow)
+	}
+	if _, ok := <-slow.Events(); ok {
+		t.Fatal("slow subscriber was not closed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	bus := NewBus(Config{})
+	sub := bus.Subscribe(0)
+	sub.Close()
+	sub.Close()
+
+	bus.Publish(TypeTap, nil)
+	if _, ok := <-sub.Events(); ok {
+		t.Fatal("closed subscription received an event")
+	}
+}
+
+func TestNilBus(t *testing.T) {
+	var bus *Bus
+	bus.Publish(TypeTap, nil)
+}
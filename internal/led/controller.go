@@ -1,6 +1,15 @@
 package led
 
-import "context"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"fizhub/internal/logging"
+)
+
+// logger is the led component logger
+var logger = logging.For("led")
 
 // State represents the LED state
 type State int
@@ -11,41 +20,210 @@ const (
 	StateWaiting
 	StateSuccess
 	StateError
+	// StatePairing shows the pairing code set with SetPairingCode
+	StatePairing
+)
+
+// Config holds LED ring configuration
+type Config struct {
+	// Driver selects the LED backend: "spi" or "capture". An empty driver
+	// keeps track of the state without driving any LEDs.
+	Driver string
+	// Device is the spidev node the ring's data line is wired to
+	Device string
+	// Count is the number of LEDs on the ring
+	Count int
+	// Order is the byte order of the LEDs, "grb" for WS2812 or "grbw" for
+	// SK6812 RGBW
+	Order string
+	// Brightness scales every frame, from 1 to 255
+	Brightness int
+	// FrameRate is the number of animation frames per second
+	FrameRate int
+}
+
+const (
+	defaultLEDCount   = 12
+	defaultBrightness = 128
+	defaultFrameRate  = 30
 )
 
 // Controller manages LED ring visual feedback
 type Controller struct {
+	config       Config
+	mutex        sync.Mutex
 	currentState State
+	stateSince   time.Time
+	collected    int
+	bondSize     int
+	pairingCode  string
+	driver       Driver
+	stop         chan struct{}
+	done         chan struct{}
 }
 
 // NewController creates a new LED controller instance
-func NewController() *Controller {
+func NewController(config Config) *Controller {
+	if config.Count <= 0 {
+		config.Count = defaultLEDCount
+	}
+	if config.Brightness <= 0 || config.Brightness > 255 {
+		config.Brightness = defaultBrightness
+	}
+	if config.FrameRate <= 0 {
+		config.FrameRate = defaultFrameRate
+	}
+	if config.Order == "" {
+		config.Order = OrderGRB
+	}
 	return &Controller{
+		config:       config,
 		currentState: StateOff,
+		stateSince:   time.Now(),
 	}
 }
 
 // Start initializes the LED controller
 func (c *Controller) Start(ctx context.Context) error {
-	// TODO: Implement actual LED hardware initialization
+	if c.config.Driver == "" {
+		logger.Info("No LED driver configured, LED ring disabled")
+		return nil
+	}
+
+	driver, err := OpenDriver(c.config)
+	if err != nil {
+		return err
+	}
+	return c.StartWithDriver(ctx, driver)
+}
+
+// StartWithDriver begins animating the ring on driver
+func (c *Controller) StartWithDriver(ctx context.Context, driver Driver) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.driver = driver
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.run(ctx, driver, c.stop, c.done)
 	return nil
 }
 
 // Stop shuts down the LED controller
 func (c *Controller) Stop() error {
-	// TODO: Implement actual LED hardware shutdown
+	c.mutex.Lock()
 	c.currentState = StateOff
-	return nil
+	driver, stop, done := c.driver, c.stop, c.done
+	c.driver = nil
+	c.mutex.Unlock()
+
+	if driver == nil {
+		return nil
+	}
+	close(stop)
+	<-done
+
+	// Leave the ring dark
+	if err := driver.Render(make([]Color, c.config.Count)); err != nil {
+		logger.Warn("Failed to turn off LED ring", "error", err)
+	}
+	return driver.Close()
 }
 
 // SetState updates the LED state and visual feedback
 func (c *Controller) SetState(state State) error {
-	c.currentState = state
-	// TODO: Implement actual LED state changes
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if state != c.currentState {
+		c.currentState = state
+		c.stateSince = time.Now()
+	}
 	return nil
 }
 
 // GetState returns the current LED state
 func (c *Controller) GetState() State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.currentState
 }
+
+// SetProgress shows collected out of bondSize taps on the idle animation
+func (c *Controller) SetProgress(collected, bondSize int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.collected = collected
+	c.bondSize = bondSize
+}
+
+// SetPairingCode sets the digits shown in StatePairing
+func (c *Controller) SetPairingCode(code string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pairingCode = code
+}
+
+// run renders animation frames until stopped
+func (c *Controller) run(ctx context.Context, driver Driver, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(time.Second / time.Duration(c.config.FrameRate))
+	defer ticker.Stop()
+
+	var previous []Color
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mutex.Lock()
+		animation := animation{
+			state:       c.currentState,
+			elapsed:     time.Since(c.stateSince),
+			collected:   c.collected,
+			bondSize:    c.bondSize,
+			pairingCode: c.pairingCode,
+		}
+		c.mutex.Unlock()
+
+		frame := make([]Color, c.config.Count)
+		animation.render(frame)
+		for i := range frame {
+			frame[i] = frame[i].scale(float64(c.config.Brightness) / 255)
+		}
+
+		// Static patterns only need to be sent once
+		if equalFrames(frame, previous) {
+			continue
+		}
+
+		if err := driver.Render(frame); err != nil {
+			if !failing {
+				logger.Error("Failed to update LED ring", "error", err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		previous = frame
+	}
+}
+
+// equalFrames reports whether a and b show the same colors
+func equalFrames(a, b []Color) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
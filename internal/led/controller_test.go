@@ -0,0 +1,249 @@
+package led
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testCount is the number of LEDs on the test ring
+const testCount = 12
+
+var dark = Color{}
+
+// renderAt returns the frame of animation a on a test ring
+func renderAt(a animation) []Color {
+	frame := make([]Color, testCount)
+	a.render(frame)
+	return frame
+}
+
+// expectFrame fails the test unless frame matches want LED by LED
+func expectFrame(t *testing.T, name string, frame, want []Color) {
+	t.Helper()
+	for i := range want {
+		if frame[i] != want[i] {
+			t.Fatalf("%s: LED %d is %+v, want %+v", name, i, frame[i], want[i])
+		}
+	}
+}
+
+// solid returns a frame with every LED set to c
+func solid(c Color) []Color {
+	frame := make([]Color, testCount)
+	fill(frame, c)
+	return frame
+}
+
+func TestRenderIdle(t *testing.T) {
+	// Breathing runs from 10% to full brightness
+	expectFrame(t, "idle start", renderAt(animation{state: StateIdle}), solid(Color{B: 26}))
+	expectFrame(t, "idle peak", renderAt(animation{state: StateIdle, elapsed: breathePeriod / 2}), solid(colorIdle))
+}
+
+func TestRenderProgress(t *testing.T) {
+	tests := []struct {
+		collected, bondSize, lit int
+	}{
+		{0, 3, 0},
+		{1, 3, 4},
+		{2, 3, 8},
+		{3, 3, 12},
+		{5, 3, 12},
+		{1, 5, 2},
+	}
+	for _, tt := range tests {
+		frame := renderAt(animation{state: StateIdle, elapsed: breathePeriod / 2, collected: tt.collected, bondSize: tt.bondSize})
+		want := solid(colorIdle)
+		for i := 0; i < tt.lit; i++ {
+			want[i] = colorProgress
+		}
+		expectFrame(t, "progress", frame, want)
+	}
+}
+
+func TestRenderWaiting(t *testing.T) {
+	// The head is on the first LED with a tail of a third of the ring
+	// behind it
+	want := solid(dark)
+	want[0] = colorWaiting
+	want[11] = colorWaiting.scale(0.75)
+	want[10] = colorWaiting.scale(0.5)
+	want[9] = colorWaiting.scale(0.25)
+	expectFrame(t, "spinner start", renderAt(animation{state: StateWaiting}), want)
+
+	// A quarter turn later the head has moved three LEDs on
+	frame := renderAt(animation{state: StateWaiting, elapsed: spinnerPeriod / 4})
+	if frame[3] != colorWaiting || frame[0] != colorWaiting.scale(0.25) || frame[11] != dark {
+		t.Fatalf("spinner did not advance: %+v", frame)
+	}
+}
+
+func TestRenderSuccess(t *testing.T) {
+	tests := []struct {
+		elapsed time.Duration
+		want    Color
+	}{
+		{0, colorSuccess},
+		{flashOn, dark},
+		{flashOn + flashOff, colorSuccess},
+		{2*flashOn + flashOff, dark},
+		// Steady green after the flashes
+		{successFlashes * (flashOn + flashOff), colorSuccess},
+		{time.Minute + flashOn, colorSuccess},
+	}
+	for _, tt := range tests {
+		expectFrame(t, "success at "+tt.elapsed.String(), renderAt(animation{state: StateSuccess, elapsed: tt.elapsed}), solid(tt.want))
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	tests := []struct {
+		elapsed time.Duration
+		want    Color
+	}{
+		{0, colorError},
+		{errorBlink, dark},
+		{2 * errorBlink, colorError},
+		{3*errorBlink + errorBlink/2, dark},
+	}
+	for _, tt := range tests {
+		expectFrame(t, "error at "+tt.elapsed.String(), renderAt(animation{state: StateError, elapsed: tt.elapsed}), solid(tt.want))
+	}
+}
+
+func TestRenderOff(t *testing.T) {
+	expectFrame(t, "off", renderAt(animation{state: StateOff, collected: 2, bondSize: 3}), solid(dark))
+}
+
+// startRing animates a test ring on a capture driver
+func startRing(t *testing.T) (*Controller, *CaptureDriver) {
+	t.Helper()
+	c := NewController(Config{Count: testCount, Brightness: 255, FrameRate: 200})
+	driver := NewCaptureDriver()
+	if err := c.StartWithDriver(context.Background(), driver); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Stop() })
+	return c, driver
+}
+
+// waitForFrame waits until the driver captures a frame that matches
+func waitForFrame(t *testing.T, driver *CaptureDriver, name string, match func([]Color) bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if frame := driver.Last(); frame != nil && match(frame) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s: no matching frame, last was %+v", name, driver.Last())
+}
+
+// isSolid reports whether every LED of frame is c
+func isSolid(c Color) func([]Color) bool {
+	return func(frame []Color) bool {
+		for _, pixel := range frame {
+			if pixel != c {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestCapturedStates(t *testing.T) {
+	c, driver := startRing(t)
+
+	c.SetState(StateIdle)
+	waitForFrame(t, driver, "idle", func(frame []Color) bool {
+		for _, pixel := range frame {
+			if pixel.R != 0 || pixel.G != 0 || pixel.B == 0 || pixel != frame[0] {
+				return false
+			}
+		}
+		return true
+	})
+
+	c.SetState(StateWaiting)
+	waitForFrame(t, driver, "waiting", func(frame []Color) bool {
+		lit := 0
+		for _, pixel := range frame {
+			if pixel != dark {
+				lit++
+			}
+		}
+		return frame[0].R == 0 && lit > 0 && lit < testCount
+	})
+
+	c.SetState(StateSuccess)
+	waitForFrame(t, driver, "success", isSolid(colorSuccess))
+
+	c.SetState(StateError)
+	waitForFrame(t, driver, "error on", isSolid(colorError))
+	waitForFrame(t, driver, "error off", isSolid(dark))
+	waitForFrame(t, driver, "error on again", isSolid(colorError))
+}
+
+func TestCapturedProgress(t *testing.T) {
+	c, driver := startRing(t)
+	c.SetState(StateIdle)
+	c.SetProgress(2, 3)
+
+	waitForFrame(t, driver, "progress", func(frame []Color) bool {
+		for i, pixel := range frame {
+			if (i < 8) != (pixel == colorProgress) {
+				return false
+			}
+		}
+		return frame[8].B > 0
+	})
+
+	c.SetProgress(0, 3)
+	waitForFrame(t, driver, "progress cleared", func(frame []Color) bool {
+		return frame[0] != colorProgress && frame[0].B > 0
+	})
+}
+
+func TestCaptureSkipsUnchangedFrames(t *testing.T) {
+	c, driver := startRing(t)
+	c.SetState(StateSuccess)
+	waitForFrame(t, driver, "success", isSolid(colorSuccess))
+
+	// Once steady, the static pattern is not sent again
+	time.Sleep(successFlashes*(flashOn+flashOff) + 50*time.Millisecond)
+	before := len(driver.Frames())
+	time.Sleep(50 * time.Millisecond)
+	if after := len(driver.Frames()); after != before {
+		t.Fatalf("%d identical frames sent", after-before)
+	}
+}
+
+func TestStopLeavesRingDark(t *testing.T) {
+	c := NewController(Config{Count: testCount, Brightness: 255, FrameRate: 200})
+	driver := NewCaptureDriver()
+	c.StartWithDriver(context.Background(), driver)
+	c.SetState(StateSuccess)
+	waitForFrame(t, driver, "success", isSolid(colorSuccess))
+
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if !isSolid(dark)(driver.Last()) {
+		t.Fatalf("ring left lit: %+v", driver.Last())
+	}
+	if err := driver.Render(solid(colorError)); err == nil {
+		t.Fatal("driver still accepts frames after Stop")
+	}
+}
+
+func TestBrightnessScalesFrames(t *testing.T) {
+	c := NewController(Config{Count: testCount, Brightness: 51, FrameRate: 200})
+	driver := NewCaptureDriver()
+	c.StartWithDriver(context.Background(), driver)
+	defer c.Stop()
+
+	c.SetState(StateSuccess)
+	waitForFrame(t, driver, "dimmed success", isSolid(Color{G: 51}))
+}
@@ -0,0 +1,145 @@
+package led
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Driver sends frames to an LED ring
+type Driver interface {
+	// Render shows pixels, one color per LED starting at the first LED
+	Render(pixels []Color) error
+	// Close releases the hardware
+	Close() error
+}
+
+// Driver names accepted in Config.Driver
+const (
+	DriverSPI     = "spi"
+	DriverCapture = "capture"
+)
+
+// LED byte orders accepted in Config.Order
+const (
+	OrderGRB  = "grb"
+	OrderGRBW = "grbw"
+)
+
+// OpenDriver opens the driver selected in config
+func OpenDriver(config Config) (Driver, error) {
+	switch config.Order {
+	case OrderGRB, OrderGRBW:
+	default:
+		return nil, fmt.Errorf("unknown LED order: %q", config.Order)
+	}
+
+	switch config.Driver {
+	case DriverSPI:
+		return openSPI(config.Device, config.Order)
+	case DriverCapture:
+		return NewCaptureDriver(), nil
+	default:
+		return nil, fmt.Errorf("unknown LED driver: %q", config.Driver)
+	}
+}
+
+// WS2812 timing over SPI. At 2.4 MHz each SPI bit lasts about 417ns, so
+// every data bit is sent as three SPI bits: 110 for a one and 100 for a
+// zero. The trailing zero bytes hold the line low long enough to latch.
+const (
+	ws2812SPISpeed   = 2400000
+	ws2812ResetBytes = 100
+)
+
+// encodeWS2812 converts pixels to the SPI bit stream for the LED order
+func encodeWS2812(pixels []Color, order string) []byte {
+	channels := 3
+	if order == OrderGRBW {
+		channels = 4
+	}
+
+	buf := make([]byte, 0, len(pixels)*channels*3+ws2812ResetBytes+1)
+	// A leading zero byte keeps MOSI low before the first bit
+	buf = append(buf, 0)
+	for _, pixel := range pixels {
+		values := []byte{pixel.G, pixel.R, pixel.B, pixel.W}[:channels]
+		for _, value := range values {
+			var bits uint32
+			for i := 7; i >= 0; i-- {
+				if value&(1<<uint(i)) != 0 {
+					bits = bits<<3 | 0x6
+				} else {
+					bits = bits<<3 | 0x4
+				}
+			}
+			buf = append(buf, byte(bits>>16), byte(bits>>8), byte(bits))
+		}
+	}
+	return append(buf, make([]byte, ws2812ResetBytes)...)
+}
+
+// Frame is a frame recorded by a CaptureDriver
+type Frame struct {
+	Time   time.Time
+	Pixels []Color
+}
+
+// maxCapturedFrames bounds the memory used by a CaptureDriver
+const maxCapturedFrames = 1024
+
+// CaptureDriver records frames in memory instead of driving LEDs. It lets
+// animations run and be inspected without hardware.
+type CaptureDriver struct {
+	mutex  sync.Mutex
+	frames []Frame
+	closed bool
+}
+
+// NewCaptureDriver creates an empty capture driver
+func NewCaptureDriver() *CaptureDriver {
+	return &CaptureDriver{}
+}
+
+// Render records a copy of pixels
+func (d *CaptureDriver) Render(pixels []Color) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return fmt.Errorf("capture driver closed")
+	}
+	if len(d.frames) == maxCapturedFrames {
+		d.frames = append(d.frames[:0], d.frames[1:]...)
+	}
+	d.frames = append(d.frames, Frame{
+		Time:   time.Now(),
+		Pixels: append([]Color{}, pixels...),
+	})
+	return nil
+}
+
+// Close marks the driver closed
+func (d *CaptureDriver) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.closed = true
+	return nil
+}
+
+// Frames returns the recorded frames, oldest first
+func (d *CaptureDriver) Frames() []Frame {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]Frame{}, d.frames...)
+}
+
+// Last returns the most recent frame, or nil if nothing was rendered
+func (d *CaptureDriver) Last() []Color {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.frames) == 0 {
+		return nil
+	}
+	return d.frames[len(d.frames)-1].Pixels
+}
@@ -0,0 +1,81 @@
+package led
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Linux ioctl requests for spidev
+const (
+	spiIOCWrMode        = 0x40016b01
+	spiIOCWrBitsPerWord = 0x40016b03
+	spiIOCWrMaxSpeedHz  = 0x40046b04
+)
+
+const defaultSPIDevice = "/dev/spidev0.0"
+
+// spiDriver drives a WS2812 or SK6812 ring from the SPI MOSI pin
+type spiDriver struct {
+	file  *os.File
+	order string
+}
+
+func openSPI(device, order string) (Driver, error) {
+	if device == "" {
+		device = defaultSPIDevice
+	}
+
+	file, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", device, err)
+	}
+
+	mode := uint8(0)
+	if err := ioctlPtr(file, spiIOCWrMode, unsafe.Pointer(&mode)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to set SPI mode: %w", err)
+	}
+	bits := uint8(8)
+	if err := ioctlPtr(file, spiIOCWrBitsPerWord, unsafe.Pointer(&bits)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to set SPI word size: %w", err)
+	}
+	speed := uint32(ws2812SPISpeed)
+	if err := ioctlPtr(file, spiIOCWrMaxSpeedHz, unsafe.Pointer(&speed)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to set SPI speed: %w", err)
+	}
+	return &spiDriver{file: file, order: order}, nil
+}
+
+func (d *spiDriver) Render(pixels []Color) error {
+	// spidev sends a single write as one transfer, so the frame is not
+	// interrupted by a chip select change
+	_, err := d.file.Write(encodeWS2812(pixels, d.order))
+	return err
+}
+
+func (d *spiDriver) Close() error {
+	return d.file.Close()
+}
+
+// ioctlPtr issues an ioctl whose argument points to a kernel structure
+func ioctlPtr(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package led
+
+import "fmt"
+
+func openSPI(device, order string) (Driver, error) {
+	return nil, fmt.Errorf("LED driver %s is only supported on Linux", DriverSPI)
+}
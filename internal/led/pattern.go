@@ -0,0 +1,162 @@
+package led
+
+import (
+	"math"
+	"time"
+)
+
+// Color is the value of a single LED. W is only used by RGBW rings.
+type Color struct {
+	R, G, B, W uint8
+}
+
+// Colors used by the animations
+var (
+	colorIdle     = Color{B: 255}
+	colorProgress = Color{R: 255, G: 140}
+	colorWaiting  = Color{G: 160, B: 255}
+	colorSuccess  = Color{G: 255}
+	colorError    = Color{R: 255}
+	colorPairing  = Color{R: 180, B: 255}
+)
+
+// Animation timing
+const (
+	breathePeriod  = 4 * time.Second
+	spinnerPeriod  = time.Second
+	flashOn        = 150 * time.Millisecond
+	flashOff       = 100 * time.Millisecond
+	successFlashes = 2
+	errorBlink     = 250 * time.Millisecond
+	pairingDigit   = time.Second
+	pairingGap     = 300 * time.Millisecond
+	pairingPause   = 1500 * time.Millisecond
+)
+
+// scale dims c by level in [0, 1]
+func (c Color) scale(level float64) Color {
+	return Color{
+		R: uint8(float64(c.R)*level + 0.5),
+		G: uint8(float64(c.G)*level + 0.5),
+		B: uint8(float64(c.B)*level + 0.5),
+		W: uint8(float64(c.W)*level + 0.5),
+	}
+}
+
+// animation is a snapshot of everything that determines a frame
+type animation struct {
+	state       State
+	elapsed     time.Duration
+	collected   int
+	bondSize    int
+	pairingCode string
+}
+
+// render fills frame with the pattern for the state at elapsed time
+func (a animation) render(frame []Color) {
+	switch a.state {
+	case StateIdle:
+		a.renderIdle(frame)
+	case StateWaiting:
+		renderSpinner(frame, a.elapsed)
+	case StateSuccess:
+		renderSuccess(frame, a.elapsed)
+	case StateError:
+		renderBlink(frame, a.elapsed)
+	case StatePairing:
+		renderPairing(frame, a.pairingCode, a.elapsed)
+	default:
+		fill(frame, Color{})
+	}
+}
+
+// renderIdle breathes in blue and lights one segment of the ring per
+// collected tap
+func (a animation) renderIdle(frame []Color) {
+	level := 0.1 + 0.9*(1-math.Cos(2*math.Pi*phase(a.elapsed, breathePeriod)))/2
+	fill(frame, colorIdle.scale(level))
+
+	if a.collected <= 0 || a.bondSize <= 0 {
+		return
+	}
+	collected := a.collected
+	if collected > a.bondSize {
+		collected = a.bondSize
+	}
+	lit := len(frame) * collected / a.bondSize
+	for i := 0; i < lit; i++ {
+		frame[i] = colorProgress
+	}
+}
+
+// renderSpinner draws a bright head with a fading tail going round the ring
+func renderSpinner(frame []Color, elapsed time.Duration) {
+	count := len(frame)
+	if count == 0 {
+		return
+	}
+	head := phase(elapsed, spinnerPeriod) * float64(count)
+	tail := float64(count) / 3
+	for i := range frame {
+		distance := math.Mod(head-float64(i)+float64(count), float64(count))
+		level := 1 - distance/tail
+		if level < 0 {
+			level = 0
+		}
+		frame[i] = colorWaiting.scale(level)
+	}
+}
+
+// renderSuccess flashes green a few times and then stays green
+func renderSuccess(frame []Color, elapsed time.Duration) {
+	cycle := flashOn + flashOff
+	if elapsed < successFlashes*cycle && elapsed%cycle >= flashOn {
+		fill(frame, Color{})
+		return
+	}
+	fill(frame, colorSuccess)
+}
+
+// renderBlink blinks the whole ring red
+func renderBlink(frame []Color, elapsed time.Duration) {
+	if (elapsed/errorBlink)%2 == 1 {
+		fill(frame, Color{})
+		return
+	}
+	fill(frame, colorError)
+}
+
+// renderPairing shows the code one digit at a time, lighting as many LEDs
+// as the digit's value, then pauses before repeating it
+func renderPairing(frame []Color, code string, elapsed time.Duration) {
+	fill(frame, Color{})
+	if code == "" {
+		return
+	}
+	slot := pairingDigit + pairingGap
+	cycle := time.Duration(len(code))*slot + pairingPause
+	position := elapsed % cycle
+	index := int(position / slot)
+	if index >= len(code) || position%slot >= pairingDigit {
+		return
+	}
+	lit := int(code[index] - '0')
+	if lit > len(frame) {
+		lit = len(frame)
+	}
+	for i := 0; i < lit; i++ {
+		frame[i] = colorPairing
+	}
+}
+
+// phase returns how far elapsed is into the current period, in [0, 1)
+func phase(elapsed, period time.Duration) float64 {
+	return float64(elapsed%period) / float64(period)
+}
+
+// fill sets every LED in frame to c
+func fill(frame []Color, c Color) {
+	for i := range frame {
+		frame[i] = c
+	}
+}
@@ -0,0 +1,450 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels, from most to least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config holds logging configuration
+type Config struct {
+	// Level is the default level of every component
+	Level string `json:"level"`
+	// Format is text (logfmt) or json
+	Format string `json:"format"`
+	// Output is stderr, stdout or the path of a file to append to
+	Output string `json:"output"`
+	// RedactUIDs replaces the values of uid and uids fields with a salted
+	// hash, so entries of the same tag can still be matched up
+	RedactUIDs bool `json:"redact_uids"`
+	// Components overrides the level of single components
+	Components map[string]string `json:"components"`
+}
+
+// sink is where every logger writes. Its level settings change at runtime.
+type sink struct {
+	mutex    sync.RWMutex
+	out      io.Writer
+	closer   io.Closer
+	format   string
+	redact   bool
+	salt     []byte
+	level    Level
+	levels   map[string]Level
+	loggers  map[string]bool
+	writeMux sync.Mutex
+}
+
+// std is the sink used by loggers from For. It writes text to stderr at
+// info level until Setup is called.
+var std = &sink{
+	out:     os.Stderr,
+	format:  FormatText,
+	level:   LevelInfo,
+	levels:  make(map[string]Level),
+	loggers: make(map[string]bool),
+}
+
+// Setup applies config to every logger, including those created earlier
+func Setup(config Config) error {
+	level, err := ParseLevel(config.Level)
+	if err != nil {
+		return err
+	}
+	levels := make(map[string]Level, len(config.Components))
+	for component, s := range config.Components {
+		l, err := ParseLevel(s)
+		if err != nil {
+			return fmt.Errorf("component %s: %w", component, err)
+		}
+		levels[component] = l
+	}
+
+	format := strings.ToLower(config.Format)
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q", config.Format)
+	}
+
+	var out io.Writer
+	var closer io.Closer
+	switch config.Output {
+	case "", "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		file, err := os.OpenFile(config.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		out, closer = file, file
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate redaction salt: %w", err)
+	}
+
+	std.mutex.Lock()
+	previous := std.closer
+	std.out = out
+	std.closer = closer
+	std.format = format
+	std.redact = config.RedactUIDs
+	std.salt = salt
+	std.level = level
+	std.levels = levels
+	std.mutex.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// SetLevel changes the level of a component. An empty component sets the
+// default level and drops every override.
+func SetLevel(component string, level Level) {
+	std.mutex.Lock()
+	defer std.mutex.Unlock()
+
+	if component == "" {
+		std.level = level
+		std.levels = make(map[string]Level)
+		return
+	}
+	std.levels[component] = level
+}
+
+// Levels returns the level of every component that has a logger, and the
+// default level under "default"
+func Levels() map[string]string {
+	std.mutex.RLock()
+	defer std.mutex.RUnlock()
+
+	levels := map[string]string{"default": std.level.String()}
+	for component := range std.loggers {
+		levels[component] = std.levelOf(component).String()
+	}
+	for component, level := range std.levels {
+		levels[component] = level.String()
+	}
+	return levels
+}
+
+// Components returns the names of the components that have a logger
+func Components() []string {
+	std.mutex.RLock()
+	defer std.mutex.RUnlock()
+
+	components := make([]string, 0, len(std.loggers))
+	for component := range std.loggers {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	return components
+}
+
+// levelOf returns the level of a component. Callers must hold the mutex.
+func (s *sink) levelOf(component string) Level {
+	if level, ok := s.levels[component]; ok {
+		return level
+	}
+	return s.level
+}
+
+// Logger writes entries for one component with a fixed set of fields
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+// For returns the logger of a component
+func For(component string) *Logger {
+	std.mutex.Lock()
+	std.loggers[component] = true
+	std.mutex.Unlock()
+	return &Logger{component: component}
+}
+
+// With returns a logger that adds the given key-value pairs to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{component: l.component, fields: fields}
+}
+
+// Enabled reports whether entries at level are written
+func (l *Logger) Enabled(level Level) bool {
+	std.mutex.RLock()
+	defer std.mutex.RUnlock()
+	return level >= std.levelOf(l.component)
+}
+
+// Debug logs msg with alternating keys and values
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info logs msg with alternating keys and values
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn logs msg with alternating keys and values
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error logs msg with alternating keys and values
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// log formats and writes one entry
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	std.mutex.RLock()
+	if level < std.levelOf(l.component) {
+		std.mutex.RUnlock()
+		return
+	}
+	out, format, redact, salt := std.out, std.format, std.redact, std.salt
+	std.mutex.RUnlock()
+
+	fields := make([]field, 0, 4+(len(l.fields)+len(kv))/2)
+	fields = append(fields,
+		field{"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")},
+		field{"level", strings.ToUpper(level.String())},
+		field{"component", l.component},
+		field{"msg", msg},
+	)
+	fields = appendFields(fields, l.fields, redact, salt)
+	fields = appendFields(fields, kv, redact, salt)
+
+	var buf bytes.Buffer
+	if format == FormatJSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeText(&buf, fields)
+	}
+
+	std.writeMux.Lock()
+	out.Write(buf.Bytes())
+	std.writeMux.Unlock()
+}
+
+// field is a key and its value
+type field struct {
+	key   string
+	value interface{}
+}
+
+// appendFields pairs up kv, redacting UIDs. A key without a value is logged
+// under "!BADKEY" so the mistake shows.
+func appendFields(fields []field, kv []interface{}, redact bool, salt []byte) []field {
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 == len(kv) {
+			fields = append(fields, field{"!BADKEY", kv[i]})
+			break
+		}
+		key := fmt.Sprint(kv[i])
+		value := kv[i+1]
+		if redact && (key == "uid" || key == "uids") {
+			value = redactUIDs(value, salt)
+		}
+		fields = append(fields, field{key, value})
+	}
+	return fields
+}
+
+// redactUIDs replaces a UID, or a slice of them, with salted hashes
+func redactUIDs(value interface{}, salt []byte) interface{} {
+	switch v := value.(type) {
+	case string:
+		return RedactUID(v, salt)
+	case []string:
+		redacted := make([]string, len(v))
+		for i, uid := range v {
+			redacted[i] = RedactUID(uid, salt)
+		}
+		return redacted
+	default:
+		return RedactUID(fmt.Sprint(v), salt)
+	}
+}
+
+// RedactUID returns a short salted hash of uid that stands in for it in
+// logs
+func RedactUID(uid string, salt []byte) string {
+	if uid == "" {
+		return ""
+	}
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(strings.ToLower(uid)))
+	return "uid-" + hex.EncodeToString(hash.Sum(nil)[:4])
+}
+
+// writeText writes fields as one logfmt line
+func writeText(buf *bytes.Buffer, fields []field) {
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.key)
+		buf.WriteByte('=')
+		s := textValue(f.value)
+		if needsQuoting(s) {
+			buf.WriteString(strconv.Quote(s))
+		} else {
+			buf.WriteString(s)
+		}
+	}
+	buf.WriteByte('\n')
+}
+
+// textValue formats a value for logfmt
+func textValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// needsQuoting reports whether a logfmt value must be quoted
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes fields as one JSON object, in order
+func writeJSON(buf *bytes.Buffer, fields []field) {
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(jsonValue(f.value))
+	}
+	buf.WriteString("}\n")
+}
+
+// jsonValue encodes a value, falling back to its text form
+func jsonValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	case fmt.Stringer:
+		if _, ok := v.(json.Marshaler); !ok {
+			value = v.String()
+		}
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return data
+}
+
+// Writer returns a writer that logs each line written to it at level. It
+// lets the standard library logger and http.Server report through a
+// component logger.
+func (l *Logger) Writer(level Level) io.Writer {
+	return lineWriter{logger: l, level: level}
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			w.logger.log(w.level, line, nil)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,223 @@
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// logTo sets up logging to a file until the test ends and returns a
+// function that reads the lines written so far
+func logTo(t *testing.T, config Config) func() []string {
+	t.Helper()
+	config.Output = filepath.Join(t.TempDir(), "fizhub.log")
+	if err := Setup(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Setup(Config{}) })
+
+	return func() []string {
+		t.Helper()
+		data, err := ioutil.ReadFile(config.Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := strings.TrimSuffix(string(data), "\n")
+		if text == "" {
+			return nil
+		}
+		return strings.Split(text, "\n")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Level
+		wantErr bool
+	}{
+		{"debug", LevelDebug, false},
+		{"", LevelInfo, false},
+		{" INFO ", LevelInfo, false},
+		{"warning", LevelWarn, false},
+		{"error", LevelError, false},
+		{"trace", LevelInfo, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.s)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestSetupRejectsBadConfig(t *testing.T) {
+	tests := []Config{
+		{Level: "loud"},
+		{Format: "xml"},
+		{Components: map[string]string{"mqtt": "loud"}},
+		{Output: filepath.Join(t.TempDir(), "missing", "fizhub.log")},
+	}
+	for _, config := range tests {
+		if err := Setup(config); err == nil {
+			t.Errorf("Setup(%+v) succeeded", config)
+		}
+	}
+}
+
+func TestLevelFiltering(t *testing.T) {
+	lines := logTo(t, Config{Level: "warn"})
+	logger := For("test")
+
+	logger.Debug("debug entry")
+	logger.Info("info entry")
+	logger.Warn("warn entry")
+	logger.Error("error entry")
+	got := lines()
+	if len(got) != 2 || !strings.Contains(got[0], "level=WARN") || !strings.Contains(got[1], "level=ERROR") {
+		t.Fatalf("logged %q", got)
+	}
+	if logger.Enabled(LevelInfo) || !logger.Enabled(LevelWarn) {
+		t.Fatal("Enabled does not follow the level")
+	}
+}
+
+func TestComponentLevels(t *testing.T) {
+	lines := logTo(t, Config{Level: "info", Components: map[string]string{"test-chatty": "debug", "test-quiet": "error"}})
+	chatty, quiet, plain := For("test-chatty"), For("test-quiet"), For("test-plain")
+
+	for _, logger := range []*Logger{chatty, quiet, plain} {
+		logger.Debug("debug entry")
+		logger.Warn("warn entry")
+	}
+	want := []string{"component=test-chatty msg=\"debug entry\"", "component=test-chatty msg=\"warn entry\"", "component=test-plain msg=\"warn entry\""}
+	got := lines()
+	if len(got) != len(want) {
+		t.Fatalf("logged %q", got)
+	}
+	for i := range want {
+		if !strings.Contains(got[i], want[i]) {
+			t.Errorf("line %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	levels := Levels()
+	if levels["default"] != "info" || levels["test-chatty"] != "debug" || levels["test-quiet"] != "error" || levels["test-plain"] != "info" {
+		t.Fatalf("levels %v", levels)
+	}
+
+	// Changing the default level drops the overrides
+	SetLevel("test-plain", LevelError)
+	if plain.Enabled(LevelWarn) {
+		t.Fatal("component level not applied")
+	}
+	SetLevel("", LevelWarn)
+	if chatty.Enabled(LevelInfo) || !quiet.Enabled(LevelWarn) || !plain.Enabled(LevelWarn) {
+		t.Fatal("overrides kept after setting the default level")
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	lines := logTo(t, Config{})
+	For("test").With("session", "hall").Info("Tap received", "reader", "FIZR001", "note", "two words", "quote", `a"b`, "empty", "", "taps", []string{"a", "b"}, "dangling")
+
+	got := lines()
+	if len(got) != 1 {
+		t.Fatalf("logged %q", got)
+	}
+	want := `level=INFO component=test msg="Tap received" session=hall reader=FIZR001 note="two words" quote="a\"b" empty="" taps=a,b !BADKEY=dangling`
+	if !strings.HasPrefix(got[0], "time=") || !strings.HasSuffix(got[0], want) {
+		t.Fatalf("logged %q\nwant suffix %q", got[0], want)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	lines := logTo(t, Config{Format: "json"})
+	For("test").Warn("Upload failed", "attempt", 2, "retry", true, "error", errTest("offline"))
+
+	got := lines()
+	if len(got) != 1 {
+		t.Fatalf("logged %q", got)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(got[0]), &entry); err != nil {
+		t.Fatalf("not JSON: %q", got[0])
+	}
+	want := map[string]interface{}{"level": "WARN", "component": "test", "msg": "Upload failed", "attempt": 2.0, "retry": true, "error": "offline"}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s is %v, want %v", key, entry[key], value)
+		}
+	}
+	if !strings.HasPrefix(got[0], `{"time":`) {
+		t.Fatalf("fields out of order: %s", got[0])
+	}
+}
+
+type errTest string
+
+func (e errTest) Error() string { return string(e) }
+
+func TestRedactUIDs(t *testing.T) {
+	lines := logTo(t, Config{RedactUIDs: true, Format: "json"})
+	logger := For("test")
+	logger.Info("Tap", "uid", "04A1B2C3", "device_id", "FIZR001")
+	logger.Info("Bond", "uids", []string{"04a1b2c3", "04d4e5f6"})
+
+	var tap, bond struct {
+		UID      string   `json:"uid"`
+		UIDs     []string `json:"uids"`
+		DeviceID string   `json:"device_id"`
+	}
+	got := lines()
+	if len(got) != 2 {
+		t.Fatalf("logged %q", got)
+	}
+	json.Unmarshal([]byte(got[0]), &tap)
+	json.Unmarshal([]byte(got[1]), &bond)
+
+	if strings.Contains(strings.ToLower(strings.Join(got, "")), "04a1b2c3") {
+		t.Fatalf("UID in log: %q", got)
+	}
+	if !strings.HasPrefix(tap.UID, "uid-") || tap.DeviceID != "FIZR001" {
+		t.Fatalf("tap logged as %+v", tap)
+	}
+	// The same tag redacts to the same value whatever its case
+	if len(bond.UIDs) != 2 || bond.UIDs[0] != tap.UID || bond.UIDs[1] == tap.UID {
+		t.Fatalf("bond logged as %+v, tap as %s", bond, tap.UID)
+	}
+}
+
+func TestRedactionIsOptional(t *testing.T) {
+	lines := logTo(t, Config{})
+	For("test").Info("Tap", "uid", "04a1b2c3")
+	if got := lines(); len(got) != 1 || !strings.HasSuffix(got[0], "uid=04a1b2c3") {
+		t.Fatalf("logged %q", got)
+	}
+}
+
+func TestRedactUIDSalt(t *testing.T) {
+	a := RedactUID("04a1b2c3", []byte("salt a"))
+	if a != RedactUID("04A1B2C3", []byte("salt a")) {
+		t.Fatal("redaction depends on case")
+	}
+	if a == RedactUID("04a1b2c3", []byte("salt b")) {
+		t.Fatal("redaction does not depend on the salt")
+	}
+	if RedactUID("", []byte("salt a")) != "" {
+		t.Fatal("empty UID redacted")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	lines := logTo(t, Config{})
+	w := For("test").Writer(LevelWarn)
+	w.Write([]byte("first line\nsecond line\n\n"))
+
+	got := lines()
+	if len(got) != 2 || !strings.HasSuffix(got[0], `level=WARN component=test msg="first line"`) || !strings.HasSuffix(got[1], `msg="second line"`) {
+		t.Fatalf("logged %q", got)
+	}
+}
@@ -0,0 +1,799 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"fizhub/internal/logging"
+)
+
+// logger is the mqtt component logger
+var logger = logging.For("mqtt")
+
+// Message is an application message routed by the server
+type Message struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retain   bool
+	ClientID string
+	// Username is the authenticated username of the publishing client
+	Username string
+	// CommonName is the subject common name of the publishing client's
+	// verified TLS certificate, empty without one
+	CommonName string
+}
+
+// Handler receives messages for an in-process subscription
+type Handler func(Message)
+
+// Config holds MQTT server configuration
+type Config struct {
+	// Auth validates the credentials of a connecting client. commonName is
+	// the subject common name of its verified TLS client certificate, empty
+	// for plain connections and TLS clients without one. A nil Auth accepts
+	// every client.
+	Auth func(clientID, username, password, commonName string) bool
+	// AuthorizePublish decides whether an authenticated client may publish
+	// to topic, including its last will. Refused messages are dropped. A
+	// nil AuthorizePublish allows every topic.
+	AuthorizePublish func(clientID, username, topic string) bool
+	// AuthorizeSubscribe decides whether an authenticated client may
+	// subscribe to filter. A nil AuthorizeSubscribe allows every filter.
+	AuthorizeSubscribe func(clientID, username, filter string) bool
+	// OnConnect is called after a client has been accepted
+	OnConnect func(clientID string)
+	// OnDisconnect is called when a client connection ends. err is nil
+	// for a clean DISCONNECT.
+	OnDisconnect func(clientID string, err error)
+	// MaxPacketSize limits the size of incoming packets
+	MaxPacketSize int
+	// ConnectTimeout bounds the wait for the initial CONNECT packet
+	ConnectTimeout time.Duration
+}
+
+// Server is an in-process MQTT 3.1.1 broker. It supports QoS 0 and 1
+// delivery, retained messages, wildcard subscriptions and last will
+// messages. Sessions are always treated as clean.
+type Server struct {
+	config    Config
+	mutex     sync.RWMutex
+	listeners map[net.Listener]struct{}
+	clients   map[string]*client
+	retained  map[string]Message
+	handlers  []subscription
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// subscription binds an in-process handler to a topic filter
+type subscription struct {
+	filter  string
+	handler Handler
+}
+
+// ErrServerClosed is returned by Serve after Close has been called
+var ErrServerClosed = errors.New("mqtt: server closed")
+
+const (
+	defaultMaxPacketSize  = 1 << 20
+	defaultConnectTimeout = 10 * time.Second
+	outboundQueueSize     = 256
+)
+
+// NewServer creates a new MQTT server instance
+func NewServer(config Config) *Server {
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = defaultMaxPacketSize
+	}
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = defaultConnectTimeout
+	}
+	return &Server{
+		config:    config,
+		listeners: make(map[net.Listener]struct{}),
+		clients:   make(map[string]*client),
+		retained:  make(map[string]Message),
+	}
+}
+
+// Serve accepts client connections on l until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mutex.RLock()
+			closed := s.closed
+			s.mutex.RUnlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops all listeners and disconnects every client
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mutex.Unlock()
+
+	for _, c := range clients {
+		c.close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// Subscribe registers an in-process handler for messages matching filter
+func (s *Server) Subscribe(filter string, handler Handler) error {
+	if !validFilter(filter) {
+		return fmt.Errorf("invalid topic filter: %q", filter)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers = append(s.handlers, subscription{filter: filter, handler: handler})
+	return nil
+}
+
+// Publish sends a message from the hub itself to all matching subscribers
+func (s *Server) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if !validTopic(topic) {
+		return fmt.Errorf("invalid topic: %q", topic)
+	}
+	if qos > 1 {
+		qos = 1
+	}
+	s.route(Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain})
+	return nil
+}
+
+// Clients returns the IDs of all connected clients
+func (s *Server) Clients() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ids := make([]string, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Disconnect closes the connection of the client with the given ID without
+// publishing its last will. It reports whether the client was connected.
+func (s *Server) Disconnect(clientID string) bool {
+	s.mutex.RLock()
+	c, ok := s.clients[clientID]
+	s.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+
+	c.mutex.Lock()
+	c.will = nil
+	c.mutex.Unlock()
+	c.close()
+	return true
+}
+
+// route stores retained messages and delivers msg to every subscriber
+func (s *Server) route(msg Message) {
+	s.mutex.Lock()
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(s.retained, msg.Topic)
+		} else {
+			s.retained[msg.Topic] = msg
+		}
+	}
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	var handlers []Handler
+	for _, sub := range s.handlers {
+		if matchTopic(sub.filter, msg.Topic) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	s.mutex.Unlock()
+
+	// Established subscriptions always receive RETAIN=0
+	msg.Retain = false
+	for _, c := range clients {
+		if qos, ok := c.matchQoS(msg.Topic); ok {
+			c.deliver(msg, qos)
+		}
+	}
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+// register adds a client, disconnecting any existing client with the same ID
+func (s *Server) register(c *client) bool {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return false
+	}
+	old := s.clients[c.id]
+	s.clients[c.id] = c
+	s.mutex.Unlock()
+
+	if old != nil {
+		logger.Info("Client reconnected, closing previous connection", "client_id", c.id)
+		old.mutex.Lock()
+		old.takenOver = true
+		old.mutex.Unlock()
+		old.close()
+	}
+	return true
+}
+
+// unregister removes a client if it is still the active one for its ID
+func (s *Server) unregister(c *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.clients[c.id] == c {
+		delete(s.clients, c.id)
+	}
+}
+
+// retainedFor returns retained messages matching filter
+func (s *Server) retainedFor(filter string) []Message {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var msgs []Message
+	for topic, msg := range s.retained {
+		if matchTopic(filter, topic) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// serveConn runs the protocol for a single network connection
+func (s *Server) serveConn(conn net.Conn) {
+	c := &client{
+		server:   s,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		subs:     make(map[string]byte),
+		inflight: make(map[uint16]struct{}),
+		outbound: make(chan []byte, outboundQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	conn.SetDeadline(time.Now().Add(s.config.ConnectTimeout))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warn("TLS handshake failed", "remote_addr", conn.RemoteAddr(), "error", err)
+			conn.Close()
+			return
+		}
+		if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			c.commonName = chains[0][0].Subject.CommonName
+		}
+	}
+	if err := c.handshake(); err != nil {
+		logger.Warn("Connection rejected", "remote_addr", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	if !s.register(c) {
+		conn.Close()
+		return
+	}
+
+	go c.writeLoop()
+	c.send(encodePacket(packetConnack, 0, []byte{0, connackAccepted}))
+	if s.config.OnConnect != nil {
+		s.config.OnConnect(c.id)
+	}
+
+	err := c.readLoop()
+	c.close()
+	s.unregister(c)
+
+	c.mutex.Lock()
+	will := c.will
+	if c.takenOver {
+		will = nil
+	}
+	c.mutex.Unlock()
+	if err != nil && will != nil && c.mayPublish(will.Topic) {
+		s.route(*will)
+	}
+	if s.config.OnDisconnect != nil {
+		s.config.OnDisconnect(c.id, err)
+	}
+}
+
+// client is a connected MQTT client
+type client struct {
+	server   *Server
+	conn     net.Conn
+	reader   *bufio.Reader
+	id       string
+	username string
+	// commonName is taken from the verified TLS client certificate
+	commonName string
+	keepAlive  time.Duration
+	will       *Message
+	takenOver  bool
+
+	mutex    sync.Mutex
+	subs     map[string]byte
+	inflight map[uint16]struct{}
+	nextID   uint16
+
+	outbound  chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// handshake reads and validates the CONNECT packet
+func (c *client) handshake() error {
+	p, err := readPacket(c.reader, c.server.config.MaxPacketSize)
+	if err != nil {
+		return err
+	}
+	if p.kind != packetConnect {
+		return errors.New("first packet was not CONNECT")
+	}
+
+	d := &decoder{buf: p.body}
+	protocol := d.string()
+	level := d.uint8()
+	flags := d.uint8()
+	keepAlive := d.uint16()
+	if d.err != nil {
+		return d.err
+	}
+
+	if !(protocol == "MQTT" && level == 4) && !(protocol == "MQIsdp" && level == 3) {
+		c.conn.Write(encodePacket(packetConnack, 0, []byte{0, connackBadProtocolVersion}))
+		return fmt.Errorf("unsupported protocol %s level %d", protocol, level)
+	}
+	if flags&0x01 != 0 {
+		return errMalformedPacket
+	}
+
+	cleanSession := flags&0x02 != 0
+	c.id = d.string()
+	if flags&0x04 != 0 {
+		will := &Message{
+			Topic:  d.string(),
+			QoS:    (flags >> 3) & 0x03,
+			Retain: flags&0x20 != 0,
+		}
+		will.Payload = append([]byte{}, d.bytes()...)
+		if will.QoS > 1 {
+			will.QoS = 1
+		}
+		c.will = will
+	}
+	var password string
+	if flags&0x80 != 0 {
+		c.username = d.string()
+	}
+	if flags&0x40 != 0 {
+		password = d.string()
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	if c.id == "" {
+		if !cleanSession {
+			c.conn.Write(encodePacket(packetConnack, 0, []byte{0, connackIdentifierRejected}))
+			return errors.New("empty client ID without clean session")
+		}
+		c.id = generateClientID()
+	}
+	if c.will != nil {
+		c.will.ClientID = c.id
+		c.will.Username = c.username
+		c.will.CommonName = c.commonName
+		if !validTopic(c.will.Topic) {
+			return fmt.Errorf("invalid will topic: %q", c.will.Topic)
+		}
+	}
+
+	if auth := c.server.config.Auth; auth != nil && !auth(c.id, c.username, password, c.commonName) {
+		code := connackBadCredentials
+		if c.username == "" {
+			code = connackNotAuthorized
+		}
+		c.conn.Write(encodePacket(packetConnack, 0, []byte{0, code}))
+		return fmt.Errorf("authentication failed for client %s", c.id)
+	}
+
+	c.keepAlive = time.Duration(keepAlive) * time.Second
+	return nil
+}
+
+// readLoop processes packets until the connection ends. It returns nil
+// only when the client sent DISCONNECT.
+func (c *client) readLoop() error {
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := readPacket(c.reader, c.server.config.MaxPacketSize)
+		if err != nil {
+			return err
+		}
+
+		switch p.kind {
+		case packetPublish:
+			err = c.handlePublish(p)
+		case packetPuback, packetPubcomp:
+			// Outbound QoS 1 messages are not redelivered, nothing to track
+		case packetPubrel:
+			err = c.handlePubrel(p)
+		case packetSubscribe:
+			err = c.handleSubscribe(p)
+		case packetUnsubscribe:
+			err = c.handleUnsubscribe(p)
+		case packetPingreq:
+			c.send(encodePacket(packetPingresp, 0, nil))
+		case packetDisconnect:
+			c.mutex.Lock()
+			c.will = nil
+			c.mutex.Unlock()
+			return nil
+		default:
+			err = fmt.Errorf("unexpected packet type %d", p.kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handlePublish routes an incoming PUBLISH and acknowledges it
+func (c *client) handlePublish(p packet) error {
+	qos := (p.flags >> 1) & 0x03
+	d := &decoder{buf: p.body}
+	topic := d.string()
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	payload := append([]byte{}, d.rest()...)
+	if d.err != nil {
+		return d.err
+	}
+	if qos > 2 {
+		return errMalformedPacket
+	}
+	if !validTopic(topic) {
+		return fmt.Errorf("invalid publish topic: %q", topic)
+	}
+
+	msg := Message{
+		Topic:      topic,
+		Payload:    payload,
+		QoS:        qos,
+		Retain:     p.flags&0x01 != 0,
+		ClientID:   c.id,
+		Username:   c.username,
+		CommonName: c.commonName,
+	}
+	if msg.QoS > 1 {
+		msg.QoS = 1
+	}
+
+	// MQTT 3.1.1 has no way to refuse a PUBLISH, so unauthorized messages
+	// are acknowledged and dropped
+	if !c.mayPublish(topic) {
+		logger.Warn("Client not allowed to publish", "client_id", c.id, "topic", topic)
+		if qos > 0 {
+			c.send(encodePacket(ackFor(qos), 0, appendUint16(nil, id)))
+		}
+		return nil
+	}
+
+	switch qos {
+	case 0:
+		c.server.route(msg)
+	case 1:
+		c.server.route(msg)
+		c.send(encodePacket(packetPuback, 0, appendUint16(nil, id)))
+	case 2:
+		// Route on first receipt only, the packet ID is released by PUBREL
+		c.mutex.Lock()
+		_, seen := c.inflight[id]
+		c.inflight[id] = struct{}{}
+		c.mutex.Unlock()
+		if !seen {
+			c.server.route(msg)
+		}
+		c.send(encodePacket(packetPubrec, 0, appendUint16(nil, id)))
+	}
+	return nil
+}
+
+// mayPublish reports whether the client is allowed to publish to topic
+func (c *client) mayPublish(topic string) bool {
+	authorize := c.server.config.AuthorizePublish
+	return authorize == nil || authorize(c.id, c.username, topic)
+}
+
+// ackFor returns the packet that acknowledges a PUBLISH of the given QoS
+func ackFor(qos byte) byte {
+	if qos == 2 {
+		return packetPubrec
+	}
+	return packetPuback
+}
+
+// handlePubrel completes an incoming QoS 2 flow
+func (c *client) handlePubrel(p packet) error {
+	d := &decoder{buf: p.body}
+	id := d.uint16()
+	if d.err != nil {
+		return d.err
+	}
+
+	c.mutex.Lock()
+	delete(c.inflight, id)
+	c.mutex.Unlock()
+
+	c.send(encodePacket(packetPubcomp, 0, appendUint16(nil, id)))
+	return nil
+}
+
+// handleSubscribe adds subscriptions and sends matching retained messages
+func (c *client) handleSubscribe(p packet) error {
+	d := &decoder{buf: p.body}
+	id := d.uint16()
+
+	var filters []string
+	var granted []byte
+	for d.err == nil && len(d.buf) > 0 {
+		filter := d.string()
+		qos := d.uint8()
+		if d.err != nil {
+			break
+		}
+		if !validFilter(filter) || qos > 2 {
+			granted = append(granted, 0x80)
+			continue
+		}
+		if authorize := c.server.config.AuthorizeSubscribe; authorize != nil && !authorize(c.id, c.username, filter) {
+			logger.Warn("Client not allowed to subscribe", "client_id", c.id, "filter", filter)
+			granted = append(granted, 0x80)
+			continue
+		}
+		if qos > 1 {
+			qos = 1
+		}
+		filters = append(filters, filter)
+		granted = append(granted, qos)
+
+		c.mutex.Lock()
+		c.subs[filter] = qos
+		c.mutex.Unlock()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(granted) == 0 {
+		return errMalformedPacket
+	}
+
+	c.send(encodePacket(packetSuback, 0, append(appendUint16(nil, id), granted...)))
+
+	for i, filter := range filters {
+		for _, msg := range c.server.retainedFor(filter) {
+			qos := msg.QoS
+			if granted[i] < qos {
+				qos = granted[i]
+			}
+			c.deliver(msg, qos)
+		}
+	}
+	return nil
+}
+
+// handleUnsubscribe removes subscriptions
+func (c *client) handleUnsubscribe(p packet) error {
+	d := &decoder{buf: p.body}
+	id := d.uint16()
+	for d.err == nil && len(d.buf) > 0 {
+		filter := d.string()
+		c.mutex.Lock()
+		delete(c.subs, filter)
+		c.mutex.Unlock()
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	c.send(encodePacket(packetUnsuback, 0, appendUint16(nil, id)))
+	return nil
+}
+
+// matchQoS reports whether the client is subscribed to topic and the
+// highest QoS granted across its matching subscriptions
+func (c *client) matchQoS(topic string) (byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var qos byte
+	matched := false
+	for filter, granted := range c.subs {
+		if matchTopic(filter, topic) {
+			matched = true
+			if granted > qos {
+				qos = granted
+			}
+		}
+	}
+	return qos, matched
+}
+
+// deliver queues a PUBLISH for the client at the given maximum QoS
+func (c *client) deliver(msg Message, maxQoS byte) {
+	qos := msg.QoS
+	if maxQoS < qos {
+		qos = maxQoS
+	}
+
+	var flags byte
+	if msg.Retain {
+		flags |= 0x01
+	}
+	flags |= qos << 1
+
+	body := appendString(nil, msg.Topic)
+	if qos > 0 {
+		c.mutex.Lock()
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		body = appendUint16(body, c.nextID)
+		c.mutex.Unlock()
+	}
+	body = append(body, msg.Payload...)
+
+	c.send(encodePacket(packetPublish, flags, body))
+}
+
+// send queues an encoded packet, dropping the client if it cannot keep up
+func (c *client) send(data []byte) {
+	select {
+	case <-c.done:
+	case c.outbound <- data:
+	default:
+		logger.Warn("Client not keeping up, disconnecting", "client_id", c.id)
+		c.close()
+	}
+}
+
+// writeLoop writes queued packets to the connection
+func (c *client) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.outbound:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := c.conn.Write(data); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close terminates the client connection
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// generateClientID creates an identifier for clients that did not send one
+func generateClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "fizhub-" + hex.EncodeToString(b)
+}
+
+// validTopic reports whether topic may be used in a PUBLISH
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// validFilter reports whether filter is a well-formed subscription filter
+func validFilter(filter string) bool {
+	if filter == "" || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTopic reports whether topic matches the subscription filter
+func matchTopic(filter, topic string) bool {
+	// Wildcards at the first level never match system topics
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
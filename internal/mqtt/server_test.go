@@ -0,0 +1,454 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait for a packet or callback
+const testTimeout = 2 * time.Second
+
+// startServer runs a server on a loopback port until the test ends
+func startServer(t *testing.T, config Config) (*Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(config)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String()
+}
+
+// testClient speaks raw MQTT to the server under test
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// connectOptions are the optional fields of a CONNECT packet
+type connectOptions struct {
+	username    string
+	password    string
+	willTopic   string
+	willPayload string
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// connect sends CONNECT and returns the CONNACK return code
+func (c *testClient) connect(clientID string, opts connectOptions) byte {
+	c.t.Helper()
+	flags := byte(0x02)
+	if opts.willTopic != "" {
+		flags |= 0x04
+	}
+	if opts.username != "" {
+		flags |= 0x80
+	}
+	if opts.password != "" {
+		flags |= 0x40
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = appendUint16(body, 60)
+	body = appendString(body, clientID)
+	if opts.willTopic != "" {
+		body = appendString(body, opts.willTopic)
+		body = appendString(body, opts.willPayload)
+	}
+	if opts.username != "" {
+		body = appendString(body, opts.username)
+	}
+	if opts.password != "" {
+		body = appendString(body, opts.password)
+	}
+	c.write(packetConnect, 0, body)
+
+	p := c.read()
+	if p.kind != packetConnack || len(p.body) != 2 {
+		c.t.Fatalf("expected CONNACK, got type %d % x", p.kind, p.body)
+	}
+	return p.body[1]
+}
+
+func (c *testClient) write(kind, flags byte, body []byte) {
+	c.t.Helper()
+	if _, err := c.conn.Write(encodePacket(kind, flags, body)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) read() packet {
+	c.t.Helper()
+	p, err := c.tryRead(testTimeout)
+	if err != nil {
+		c.t.Fatalf("failed to read packet: %v", err)
+	}
+	return p
+}
+
+func (c *testClient) tryRead(timeout time.Duration) (packet, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	return readPacket(c.reader, 0)
+}
+
+// subscribe subscribes to filters at QoS 1 and returns the granted codes
+func (c *testClient) subscribe(id uint16, filters ...string) []byte {
+	c.t.Helper()
+	body := appendUint16(nil, id)
+	for _, filter := range filters {
+		body = appendString(body, filter)
+		body = append(body, 1)
+	}
+	c.write(packetSubscribe, 0x02, body)
+
+	p := c.read()
+	if p.kind != packetSuback {
+		c.t.Fatalf("expected SUBACK, got type %d", p.kind)
+	}
+	d := &decoder{buf: p.body}
+	if got := d.uint16(); got != id {
+		c.t.Fatalf("SUBACK for packet %d, want %d", got, id)
+	}
+	return d.rest()
+}
+
+// readPublish reads a PUBLISH and returns its topic and payload
+func (c *testClient) readPublish() (packet, string, string) {
+	c.t.Helper()
+	p := c.read()
+	if p.kind != packetPublish {
+		c.t.Fatalf("expected PUBLISH, got type %d", p.kind)
+	}
+	d := &decoder{buf: p.body}
+	topic := d.string()
+	if (p.flags>>1)&0x03 > 0 {
+		d.uint16()
+	}
+	return p, topic, string(d.rest())
+}
+
+// expectClosed waits for the server to close the connection
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	if p, err := c.tryRead(testTimeout); err == nil {
+		c.t.Fatalf("expected connection to close, got packet type %d", p.kind)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		c.t.Fatal("connection was not closed")
+	}
+}
+
+// expectNothing checks that no packet arrives for a short while
+func (c *testClient) expectNothing() {
+	c.t.Helper()
+	if p, err := c.tryRead(100 * time.Millisecond); err == nil {
+		c.t.Fatalf("unexpected packet type %d", p.kind)
+	}
+}
+
+func TestConnectAuth(t *testing.T) {
+	_, addr := startServer(t, Config{
+		Auth: func(clientID, username, password, commonName string) bool {
+			return username == "FIZR001" && password == "secret"
+		},
+	})
+
+	tests := []struct {
+		name string
+		opts connectOptions
+		want byte
+	}{
+		{"valid", connectOptions{username: "FIZR001", password: "secret"}, connackAccepted},
+		{"wrong password", connectOptions{username: "FIZR001", password: "guess"}, connackBadCredentials},
+		{"anonymous", connectOptions{}, connackNotAuthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, addr)
+			if got := c.connect("FIZR001", tt.opts); got != tt.want {
+				t.Fatalf("CONNACK code %d, want %d", got, tt.want)
+			}
+			if tt.want != connackAccepted {
+				c.expectClosed()
+			}
+		})
+	}
+}
+
+func TestConnectRejectsBadProtocol(t *testing.T) {
+	_, addr := startServer(t, Config{})
+	c := dial(t, addr)
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 5, 0x02)
+	body = appendUint16(body, 60)
+	body = appendString(body, "FIZR001")
+	c.write(packetConnect, 0, body)
+
+	p := c.read()
+	if p.kind != packetConnack || p.body[1] != connackBadProtocolVersion {
+		t.Fatalf("expected bad protocol CONNACK, got type %d % x", p.kind, p.body)
+	}
+	c.expectClosed()
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"fiz/uid", "fiz/uid", true},
+		{"fiz/uid", "fiz/uid/extra", false},
+		{"fiz/+/status", "fiz/FIZR001/status", true},
+		{"fiz/+/status", "fiz/FIZR001/other", false},
+		{"fiz/+", "fiz/a/b", false},
+		{"fiz/#", "fiz", true},
+		{"fiz/#", "fiz/a/b", true},
+		{"#", "fiz/uid", true},
+		{"+/+", "/fiz", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, tt := range tests {
+		if got := matchTopic(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestSubscribeWildcards(t *testing.T) {
+	s, addr := startServer(t, Config{})
+	c := dial(t, addr)
+	if code := c.connect("dashboard", connectOptions{}); code != connackAccepted {
+		t.Fatalf("CONNACK code %d", code)
+	}
+
+	granted := c.subscribe(1, "fiz/+/status", "fiz/cmd/#", "fiz/#/bad")
+	if want := []byte{1, 1, 0x80}; string(granted) != string(want) {
+		t.Fatalf("granted % x, want % x", granted, want)
+	}
+
+	for _, topic := range []string{"fiz/uid", "fiz/FIZR001/status", "fiz/cmd/FIZR001/led", "fiz/FIZR001/other"} {
+		if err := s.Publish(topic, []byte(topic), 0, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"fiz/FIZR001/status", "fiz/cmd/FIZR001/led"} {
+		if _, topic, _ := c.readPublish(); topic != want {
+			t.Fatalf("received %q, want %q", topic, want)
+		}
+	}
+	c.expectNothing()
+}
+
+func TestRetainedMessages(t *testing.T) {
+	s, addr := startServer(t, Config{})
+	if err := s.Publish("fiz/config", []byte("v1"), 1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(t, addr)
+	c.connect("reader-a", connectOptions{})
+	c.subscribe(1, "fiz/+")
+	p, topic, payload := c.readPublish()
+	if topic != "fiz/config" || payload != "v1" {
+		t.Fatalf("received %q %q, want retained fiz/config v1", topic, payload)
+	}
+	if p.flags&0x01 == 0 {
+		t.Fatal("retained message delivered without RETAIN flag")
+	}
+
+	// Live messages are delivered with RETAIN cleared
+	s.Publish("fiz/config", []byte("v2"), 1, true)
+	p, _, payload = c.readPublish()
+	if payload != "v2" || p.flags&0x01 != 0 {
+		t.Fatalf("live message %q with flags %x", payload, p.flags)
+	}
+
+	// An empty retained payload clears the topic
+	s.Publish("fiz/config", nil, 0, true)
+	c.readPublish()
+	c2 := dial(t, addr)
+	c2.connect("reader-b", connectOptions{})
+	c2.subscribe(1, "fiz/config")
+	c2.expectNothing()
+}
+
+func TestQoS1Puback(t *testing.T) {
+	s, addr := startServer(t, Config{})
+	received := make(chan Message, 1)
+	s.Subscribe("fiz/uid", func(msg Message) { received <- msg })
+
+	sub := dial(t, addr)
+	sub.connect("dashboard", connectOptions{})
+	sub.subscribe(1, "fiz/uid")
+
+	c := dial(t, addr)
+	c.connect("FIZR001", connectOptions{username: "FIZR001"})
+	body := appendString(nil, "fiz/uid")
+	body = appendUint16(body, 42)
+	body = append(body, `{"uid":"04a1"}`...)
+	c.write(packetPublish, 1<<1, body)
+
+	p := c.read()
+	if p.kind != packetPuback {
+		t.Fatalf("expected PUBACK, got type %d", p.kind)
+	}
+	if d := (&decoder{buf: p.body}); d.uint16() != 42 {
+		t.Fatalf("PUBACK for wrong packet: % x", p.body)
+	}
+
+	select {
+	case msg := <-received:
+		if msg.ClientID != "FIZR001" || msg.Username != "FIZR001" || msg.QoS != 1 {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("handler did not receive the message")
+	}
+
+	// Subscribers granted QoS 1 receive it with a packet ID
+	p, _, payload := sub.readPublish()
+	if (p.flags>>1)&0x03 != 1 || payload != `{"uid":"04a1"}` {
+		t.Fatalf("subscriber got flags %x payload %q", p.flags, payload)
+	}
+}
+
+func TestUnauthorizedPublishIsDropped(t *testing.T) {
+	s, addr := startServer(t, Config{
+		AuthorizePublish: func(clientID, username, topic string) bool { return topic != "fiz/cmd" },
+	})
+	received := make(chan Message, 1)
+	s.Subscribe("#", func(msg Message) { received <- msg })
+
+	c := dial(t, addr)
+	c.connect("FIZR001", connectOptions{})
+	body := appendString(nil, "fiz/cmd")
+	body = appendUint16(body, 1)
+	c.write(packetPublish, 1<<1, body)
+
+	// Still acknowledged, since MQTT 3.1.1 cannot refuse a PUBLISH
+	if p := c.read(); p.kind != packetPuback {
+		t.Fatalf("expected PUBACK, got type %d", p.kind)
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("unauthorized message routed: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// willServer starts a server that reports will messages and disconnects
+func willServer(t *testing.T) (*Server, string, chan Message, chan error) {
+	t.Helper()
+	disconnects := make(chan error, 4)
+	s, addr := startServer(t, Config{
+		OnDisconnect: func(clientID string, err error) { disconnects <- err },
+	})
+	wills := make(chan Message, 4)
+	s.Subscribe("fiz/status/+", func(msg Message) { wills <- msg })
+	return s, addr, wills, disconnects
+}
+
+// waitDisconnect waits for OnDisconnect, which runs after any will is routed
+func waitDisconnect(t *testing.T, disconnects chan error) error {
+	t.Helper()
+	select {
+	case err := <-disconnects:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatal("client did not disconnect")
+		return nil
+	}
+}
+
+func TestWillOnAbnormalClose(t *testing.T) {
+	_, addr, wills, disconnects := willServer(t)
+	c := dial(t, addr)
+	c.connect("FIZR001", connectOptions{willTopic: "fiz/status/FIZR001", willPayload: "offline"})
+	c.conn.Close()
+
+	if err := waitDisconnect(t, disconnects); err == nil {
+		t.Fatal("abnormal close reported as clean DISCONNECT")
+	}
+	select {
+	case msg := <-wills:
+		if msg.Topic != "fiz/status/FIZR001" || string(msg.Payload) != "offline" || msg.ClientID != "FIZR001" {
+			t.Fatalf("unexpected will %+v", msg)
+		}
+	default:
+		t.Fatal("will was not published")
+	}
+}
+
+func TestNoWillAfterDisconnect(t *testing.T) {
+	s, addr, wills, disconnects := willServer(t)
+
+	// A clean DISCONNECT discards the will
+	c := dial(t, addr)
+	c.connect("FIZR001", connectOptions{willTopic: "fiz/status/FIZR001", willPayload: "offline"})
+	c.write(packetDisconnect, 0, nil)
+	if err := waitDisconnect(t, disconnects); err != nil {
+		t.Fatalf("clean DISCONNECT reported error %v", err)
+	}
+
+	// So does the hub disconnecting the client
+	c = dial(t, addr)
+	c.connect("FIZR002", connectOptions{willTopic: "fiz/status/FIZR002", willPayload: "offline"})
+	if !s.Disconnect("FIZR002") {
+		t.Fatal("Disconnect did not find the client")
+	}
+	waitDisconnect(t, disconnects)
+
+	select {
+	case msg := <-wills:
+		t.Fatalf("unexpected will %+v", msg)
+	default:
+	}
+}
+
+func TestSessionTakeover(t *testing.T) {
+	s, addr, wills, disconnects := willServer(t)
+	first := dial(t, addr)
+	first.connect("FIZR001", connectOptions{willTopic: "fiz/status/FIZR001", willPayload: "offline"})
+
+	second := dial(t, addr)
+	if code := second.connect("FIZR001", connectOptions{}); code != connackAccepted {
+		t.Fatalf("CONNACK code %d", code)
+	}
+	first.expectClosed()
+	waitDisconnect(t, disconnects)
+
+	// The replaced connection's will is not published
+	select {
+	case msg := <-wills:
+		t.Fatalf("taken over client published its will: %+v", msg)
+	default:
+	}
+
+	if clients := s.Clients(); len(clients) != 1 || clients[0] != "FIZR001" {
+		t.Fatalf("clients %v, want [FIZR001]", clients)
+	}
+
+	// The new connection is the one that stays registered
+	second.subscribe(1, "fiz/uid")
+	s.Publish("fiz/uid", []byte("tap"), 0, false)
+	if _, _, payload := second.readPublish(); payload != "tap" {
+		t.Fatalf("received %q", payload)
+	}
+}
@@ -0,0 +1,308 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait for a packet or callback
+const testTimeout = 2 * time.Second
+
+// startTestBroker serves b on a loopback port until the test ends and
+// returns its address
+func startTestBroker(t *testing.T, b *MQTTBroker) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := b.serve(ctx, []net.Listener{l}); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		b.Stop()
+	})
+	return l.Addr().String()
+}
+
+// testReader speaks just enough MQTT 3.1.1 to act as a Fiz Reader
+type testReader struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID uint16
+	// queued holds the PUBLISH packets that arrived while waiting for an
+	// acknowledgement
+	queued []queuedPacket
+}
+
+type queuedPacket struct {
+	flags byte
+	body  []byte
+}
+
+// dialReader connects to the broker at addr
+func dialReader(t *testing.T, addr string) *testReader {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestReader(t, conn)
+}
+
+func newTestReader(t *testing.T, conn net.Conn) *testReader {
+	t.Cleanup(func() { conn.Close() })
+	return &testReader{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// connect sends CONNECT with a will on fiz/lwt/<clientID> and returns the
+// CONNACK return code
+func (r *testReader) connect(clientID, username, password string) byte {
+	r.t.Helper()
+	flags := byte(0x02 | 0x04 | 0x08)
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags, 0, 60)
+	body = appendString(body, clientID)
+	body = appendString(body, lwtTopicPrefix+clientID)
+	body = appendString(body, "offline")
+	if username != "" {
+		body = appendString(body, username)
+	}
+	if password != "" {
+		body = appendString(body, password)
+	}
+	r.write(1, 0, body)
+
+	kind, _, reply, err := r.read(testTimeout)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0xff
+		}
+		r.t.Fatalf("failed to read CONNACK: %v", err)
+	}
+	if kind != 2 || len(reply) != 2 {
+		r.t.Fatalf("expected CONNACK, got type %d % x", kind, reply)
+	}
+	return reply[1]
+}
+
+// mustConnect connects and fails the test unless the broker accepts
+func (r *testReader) mustConnect(clientID, username, password string) *testReader {
+	r.t.Helper()
+	if code := r.connect(clientID, username, password); code != 0 {
+		r.t.Fatalf("CONNACK code %d for %s", code, clientID)
+	}
+	return r
+}
+
+// subscribe subscribes to filter and reports whether it was granted
+func (r *testReader) subscribe(filter string) bool {
+	r.t.Helper()
+	r.nextID++
+	body := appendString(appendUint16(nil, r.nextID), filter)
+	r.write(8, 0x02, append(body, 1))
+
+	kind, _, reply := r.mustRead()
+	if kind != 9 || len(reply) != 3 {
+		r.t.Fatalf("expected SUBACK, got type %d % x", kind, reply)
+	}
+	return reply[2] != 0x80
+}
+
+// publish publishes payload to topic at QoS 1 and waits for the PUBACK.
+// Messages the reader is not allowed to publish are acknowledged as well.
+func (r *testReader) publish(topic string, payload interface{}) {
+	r.t.Helper()
+	data, ok := payload.([]byte)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	r.nextID++
+	body := appendUint16(appendString(nil, topic), r.nextID)
+	r.write(3, 0x02, append(body, data...))
+
+	for {
+		kind, flags, reply := r.mustRead()
+		if kind == 4 && binary.BigEndian.Uint16(reply) == r.nextID {
+			return
+		}
+		if kind != 3 {
+			r.t.Fatalf("expected PUBACK, got type %d", kind)
+		}
+		r.queued = append(r.queued, queuedPacket{flags: flags, body: reply})
+	}
+}
+
+// readPublish waits for a PUBLISH and returns its topic and payload
+func (r *testReader) readPublish() (string, []byte) {
+	r.t.Helper()
+	var flags byte
+	var body []byte
+	if len(r.queued) > 0 {
+		flags, body = r.queued[0].flags, r.queued[0].body
+		r.queued = r.queued[1:]
+	} else {
+		var kind byte
+		kind, flags, body = r.mustRead()
+		if kind != 3 {
+			r.t.Fatalf("expected PUBLISH, got type %d", kind)
+		}
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	topic := string(body[2 : 2+n])
+	body = body[2+n:]
+	if (flags>>1)&0x03 > 0 {
+		r.write(4, 0, body[:2])
+		body = body[2:]
+	}
+	return topic, body
+}
+
+// readCommand waits for a command on the reader's command topic
+func (r *testReader) readCommand() Command {
+	r.t.Helper()
+	topic, payload := r.readPublish()
+	var cmd Command
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		r.t.Fatalf("bad command on %s: %v", topic, err)
+	}
+	return cmd
+}
+
+// expectNothing checks that no packet arrives for a short while
+func (r *testReader) expectNothing() {
+	r.t.Helper()
+	if len(r.queued) > 0 {
+		r.t.Fatalf("unexpected message: %s", r.queued[0].body)
+	}
+	if kind, _, body, err := r.read(100 * time.Millisecond); err == nil {
+		r.t.Fatalf("unexpected packet type %d: %s", kind, body)
+	}
+}
+
+// expectClosed waits for the broker to close the connection
+func (r *testReader) expectClosed() {
+	r.t.Helper()
+	if kind, _, _, err := r.read(testTimeout); err == nil {
+		r.t.Fatalf("expected connection to close, got packet type %d", kind)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		r.t.Fatal("connection was not closed")
+	}
+}
+
+func (r *testReader) write(kind, flags byte, body []byte) {
+	r.t.Helper()
+	packet := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	if _, err := r.conn.Write(append(packet, body...)); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testReader) mustRead() (byte, byte, []byte) {
+	r.t.Helper()
+	kind, flags, body, err := r.read(testTimeout)
+	if err != nil {
+		r.t.Fatalf("failed to read packet: %v", err)
+	}
+	return kind, flags, body
+}
+
+func (r *testReader) read(timeout time.Duration) (byte, byte, []byte, error) {
+	r.conn.SetReadDeadline(time.Now().Add(timeout))
+	header, err := r.reader.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUint16(buf, uint16(len(s))), s...)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(testTimeout); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// deviceStatus returns the status of a registered reader, or "" if unknown
+func deviceStatus(b *MQTTBroker, deviceID string) string {
+	b.devicesMux.RLock()
+	defer b.devicesMux.RUnlock()
+	if device, ok := b.devices[deviceID]; ok {
+		return device.Status
+	}
+	return ""
+}
+
+// registerReader connects a reader, registers it and subscribes to its
+// commands
+func registerReader(t *testing.T, b *MQTTBroker, addr, deviceID string) *testReader {
+	t.Helper()
+	r := dialReader(t, addr).mustConnect(deviceID, b.config.Username, b.config.Password)
+	if !r.subscribe(commandTopicPrefix + deviceID) {
+		t.Fatalf("%s may not subscribe to its commands", deviceID)
+	}
+	r.publish("fiz/register", ReaderDevice{DeviceID: deviceID, Type: "fiz_reader", Firmware: "1.0.0"})
+	waitFor(t, deviceID+" to register", func() bool { return deviceStatus(b, deviceID) == StatusOnline })
+	return r
+}
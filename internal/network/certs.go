@@ -0,0 +1,222 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Validity of certificates made by the hub. Readers rarely get reflashed,
+// so their certificates outlive several events.
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 5 * 365 * 24 * time.Hour
+)
+
+// File names of the hub CA and server certificate in a certificate
+// directory
+const (
+	CACertFile  = "ca.pem"
+	CAKeyFile   = "ca-key.pem"
+	HubCertFile = "hub.pem"
+	HubKeyFile  = "hub-key.pem"
+)
+
+// ReaderCertFiles returns the certificate and key file names of a reader
+func ReaderCertFiles(deviceID string) (string, string) {
+	return filepath.Join("readers", deviceID+".pem"), filepath.Join("readers", deviceID+"-key.pem")
+}
+
+// loadTLSConfig builds the TLS configuration of the ssl:// listener. With
+// a CA file, client certificates are verified against it, and required
+// when requireClientCert is set.
+func loadTLSConfig(certFile, keyFile, caFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile == "" {
+		if requireClientCert {
+			return nil, errors.New("client certificates require a CA file")
+		}
+		return config, nil
+	}
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// CertificateAuthority signs the hub and reader certificates
+type CertificateAuthority struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// NewCertificateAuthority creates a self-signed CA and writes it to dir
+func NewCertificateAuthority(dir, name string) (*CertificateAuthority, error) {
+	if _, err := os.Stat(filepath.Join(dir, CAKeyFile)); err == nil {
+		return nil, fmt.Errorf("%s already exists", filepath.Join(dir, CAKeyFile))
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certTemplate(name, caValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCertificate(dir, CACertFile, CAKeyFile, der, key); err != nil {
+		return nil, err
+	}
+	return &CertificateAuthority{Cert: cert, Key: key}, nil
+}
+
+// LoadCertificateAuthority reads the CA written by NewCertificateAuthority
+func LoadCertificateAuthority(dir string) (*CertificateAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, CACertFile), filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CA key is not an ECDSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+	return &CertificateAuthority{Cert: cert, Key: key}, nil
+}
+
+// IssueServerCertificate writes the hub's certificate for hosts, which
+// are host names or IP addresses readers connect to
+func (ca *CertificateAuthority) IssueServerCertificate(dir string, hosts []string) error {
+	if len(hosts) == 0 {
+		return errors.New("at least one host is required")
+	}
+	template, err := certTemplate(hosts[0], certValidity)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return ca.issue(dir, HubCertFile, HubKeyFile, template)
+}
+
+// IssueReaderCertificate writes a client certificate whose common name is
+// the reader's device ID
+func (ca *CertificateAuthority) IssueReaderCertificate(dir, deviceID string) (string, string, error) {
+	if deviceID == "" {
+		return "", "", errors.New("device ID is required")
+	}
+	if filepath.Base(deviceID) != deviceID || deviceID == "." || deviceID == ".." {
+		return "", "", fmt.Errorf("invalid device ID: %q", deviceID)
+	}
+	template, err := certTemplate(deviceID, certValidity)
+	if err != nil {
+		return "", "", err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	certFile, keyFile := ReaderCertFiles(deviceID)
+	if err := ca.issue(dir, certFile, keyFile, template); err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, certFile), filepath.Join(dir, keyFile), nil
+}
+
+// issue signs template with a new key and writes both to dir
+func (ca *CertificateAuthority) issue(dir, certFile, keyFile string, template *x509.Certificate) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return writeCertificate(dir, certFile, keyFile, der, key)
+}
+
+// certTemplate returns the fields shared by every certificate
+func certTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"FizHub"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// writeCertificate writes a PEM certificate and its private key. Like every
+// file from writeFileAtomic, only the owner may read them.
+func writeCertificate(dir, certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(dir, certFile)
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, keyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return err
+	}
+	return writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
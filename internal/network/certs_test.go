@@ -0,0 +1,216 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestCA writes a CA and a hub certificate for 127.0.0.1 to a new
+// directory and returns it
+func newTestCA(t *testing.T) (string, *CertificateAuthority) {
+	t.Helper()
+	dir := t.TempDir()
+	ca, err := NewCertificateAuthority(dir, "FizHub Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.IssueServerCertificate(dir, []string{"127.0.0.1", "fiznode.local"}); err != nil {
+		t.Fatal(err)
+	}
+	return dir, ca
+}
+
+// startTLSBroker starts b with its TLS listener on a free loopback port
+// and the hub certificate in dir, and returns the listener's address
+func startTLSBroker(t *testing.T, b *MQTTBroker, dir string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	b.config.TLSPort = port
+	b.config.CertFile = filepath.Join(dir, HubCertFile)
+	b.config.KeyFile = filepath.Join(dir, HubKeyFile)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := b.Start(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		b.Stop()
+	})
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+// dialTLS connects to addr trusting the CA in dir, presenting the given
+// client certificates
+func dialTLS(t *testing.T, addr, dir string, certs ...tls.Certificate) (*tls.Conn, error) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, CACertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(data)
+	dialer := &net.Dialer{Timeout: testTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{RootCAs: pool, ServerName: "fiznode.local", Certificates: certs})
+}
+
+// readerCert issues a certificate for deviceID from ca and loads it
+func readerCert(t *testing.T, ca *CertificateAuthority, deviceID string) tls.Certificate {
+	t.Helper()
+	certFile, keyFile, err := ca.IssueReaderCertificate(t.TempDir(), deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// expectRejected checks that the broker ends a TLS connection during the
+// handshake. Under TLS 1.3 the client only learns of it on its first read.
+func expectRejected(t *testing.T, conn *tls.Conn, err error) {
+	t.Helper()
+	if err != nil {
+		return
+	}
+	r := newTestReader(t, conn)
+	// A CONNECT without credentials, written directly since the write may
+	// fail once the broker has given up on the handshake
+	body := appendString(append(appendString(nil, "MQTT"), 4, 0x02, 0, 60), "FIZR001")
+	conn.Write(append([]byte{1 << 4, byte(len(body))}, body...))
+	if kind, _, _, err := r.read(testTimeout); err == nil {
+		t.Fatalf("connection accepted, got packet type %d", kind)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("connection neither accepted nor closed")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, ca := newTestCA(t)
+	b := NewMQTTBroker(MQTTConfig{CAFile: filepath.Join(dir, CACertFile), RequireClientCert: true})
+	addr := startTLSBroker(t, b, dir)
+
+	t.Run("no certificate", func(t *testing.T) {
+		conn, err := dialTLS(t, addr, dir)
+		expectRejected(t, conn, err)
+	})
+
+	t.Run("certificate from another CA", func(t *testing.T) {
+		_, other := newTestCA(t)
+		conn, err := dialTLS(t, addr, dir, readerCert(t, other, "FIZR001"))
+		expectRejected(t, conn, err)
+	})
+
+	t.Run("valid certificate", func(t *testing.T) {
+		conn, err := dialTLS(t, addr, dir, readerCert(t, ca, "FIZR001"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := newTestReader(t, conn).mustConnect("FIZR001", "", "")
+
+		// The certificate only speaks for its own device ID
+		r.publish("fiz/register", ReaderDevice{DeviceID: "FIZR002", Type: "fiz_reader"})
+		r.publish("fiz/register", ReaderDevice{DeviceID: "FIZR001", Type: "fiz_reader"})
+		waitFor(t, "FIZR001 to register", func() bool { return deviceStatus(b, "FIZR001") == StatusOnline })
+		if got := deviceStatus(b, "FIZR002"); got != "" {
+			t.Fatalf("FIZR002 registered with FIZR001's certificate is %s", got)
+		}
+	})
+}
+
+func TestTLSWithoutClientCerts(t *testing.T) {
+	dir, _ := newTestCA(t)
+	b := NewMQTTBroker(MQTTConfig{})
+	addr := startTLSBroker(t, b, dir)
+
+	conn, err := dialTLS(t, addr, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestReader(t, conn).mustConnect("FIZR001", "", "")
+	r.publish("fiz/register", ReaderDevice{DeviceID: "FIZR001", Type: "fiz_reader"})
+	waitFor(t, "FIZR001 to register", func() bool { return deviceStatus(b, "FIZR001") == StatusOnline })
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir, _ := newTestCA(t)
+	cert, key, ca := filepath.Join(dir, HubCertFile), filepath.Join(dir, HubKeyFile), filepath.Join(dir, CACertFile)
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		certFile, caFile  string
+		requireClientCert bool
+		wantErr           bool
+		wantAuth          tls.ClientAuthType
+	}{
+		{"server only", cert, "", false, false, tls.NoClientCert},
+		{"optional client certs", cert, ca, false, false, tls.VerifyClientCertIfGiven},
+		{"required client certs", cert, ca, true, false, tls.RequireAndVerifyClientCert},
+		{"required client certs without a CA", cert, "", true, true, 0},
+		{"missing certificate", filepath.Join(dir, "missing.pem"), "", false, true, 0},
+		{"missing CA", cert, filepath.Join(dir, "missing.pem"), false, true, 0},
+		{"CA without certificates", cert, empty, false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTLSConfig(tt.certFile, key, tt.caFile, tt.requireClientCert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v", err)
+			}
+			if err == nil && config.ClientAuth != tt.wantAuth {
+				t.Fatalf("client auth %v, want %v", config.ClientAuth, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestCertificateAuthority(t *testing.T) {
+	dir, ca := newTestCA(t)
+	if _, err := NewCertificateAuthority(dir, "Again"); err == nil {
+		t.Fatal("existing CA overwritten")
+	}
+	loaded, err := LoadCertificateAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Cert.Equal(ca.Cert) {
+		t.Fatal("loaded another CA")
+	}
+
+	for _, deviceID := range []string{"", ".", "..", "../FIZR001"} {
+		if _, _, err := ca.IssueReaderCertificate(dir, deviceID); err == nil {
+			t.Errorf("certificate issued for %q", deviceID)
+		}
+	}
+	cert := readerCert(t, ca, "FIZR001")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "FIZR001" {
+		t.Fatalf("common name %q", leaf.Subject.CommonName)
+	}
+}
@@ -4,62 +4,85 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"time"
+
+	"fizhub/internal/logging"
+	"fizhub/internal/nfc"
 )
 
+// cursiveLogger is the component logger of the Cursive client, the
+// validation queue and the upload outbox
+var cursiveLogger = logging.For("cursive")
+
 // Client handles HTTP communication with external services
 type Client struct {
-	httpClient  *http.Client
-	baseURL     string
-	retryCount  int
-	retryDelay  time.Duration
+	httpClient      *http.Client
+	baseURL         string
+	retryCount      int
+	retryDelay      time.Duration
+	uploadChunkSize int64
+	retryHandler    func(path string, err error)
 }
 
 // ClientConfig holds configuration for the HTTP client
 type ClientConfig struct {
-	BaseURL     string
-	Timeout     time.Duration
-	RetryCount  int
-	RetryDelay  time.Duration
+	BaseURL         string
+	Timeout         time.Duration
+	RetryCount      int
+	RetryDelay      time.Duration
+	UploadChunkSize int64
 }
 
+// defaultUploadChunkSize is used when ClientConfig.UploadChunkSize is unset
+const defaultUploadChunkSize = 256 * 1024
+
 // NewClient creates a new HTTP client instance
 func NewClient(config ClientConfig) *Client {
+	chunkSize := config.UploadChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultUploadChunkSize
+	}
 	return &Client{
 		httpClient: &http.Client{
 			Timeout: config.Timeout,
 		},
-		baseURL:    config.BaseURL,
-		retryCount: config.RetryCount,
-		retryDelay: config.RetryDelay,
+		baseURL:         config.BaseURL,
+		retryCount:      config.RetryCount,
+		retryDelay:      config.RetryDelay,
+		uploadChunkSize: chunkSize,
 	}
 }
 
-// formatUID formats a UID into the required URL format
-func formatUID(uid string) string {
-	return fmt.Sprintf("https://nfc.cursive.team/tap?uid=%s", uid)
+// FormatTapURL formats a tap into the Cursive tap URL, keeping the SUN
+// data of NTAG 424 DNA tags so that Cursive can verify them
+func FormatTapURL(uid string, sun nfc.SUN) string {
+	u := "https://nfc.cursive.team/tap?uid=" + url.QueryEscape(uid)
+	if sun.Present() {
+		u += "&picc_data=" + url.QueryEscape(sun.PICCData) + "&cmac=" + url.QueryEscape(sun.CMAC)
+	}
+	return u
 }
 
 // ValidateUIDs sends UIDs to the Cursive server for validation
 func (c *Client) ValidateUIDs(ctx context.Context, uids []string) (*ValidationResponse, error) {
-	// Format UIDs according to the specified format
-	formattedUIDs := make([]string, len(uids))
-	for i, uid := range uids {
-		formattedUIDs[i] = formatUID(uid)
-	}
-
-	// Extract raw UIDs for the payload
-	rawUIDs := make([]string, len(uids))
+	tapURLs := make([]string, len(uids))
 	for i, uid := range uids {
-		rawUIDs[i] = uid
+		tapURLs[i] = FormatTapURL(uid, nfc.SUN{})
 	}
 
-	payload := ValidationRequest{
-		UIDs: rawUIDs,
-	}
+	return c.Validate(ctx, ValidationRequest{
+		UIDs:    uids,
+		TapURLs: tapURLs,
+	})
+}
 
+// Validate sends a complete validation request to the Cursive server
+func (c *Client) Validate(ctx context.Context, payload ValidationRequest) (*ValidationResponse, error) {
 	var response ValidationResponse
 	err := c.doWithRetry(ctx, "POST", "/api/validate_uids", payload, &response)
 	if err != nil {
@@ -69,12 +92,22 @@ func (c *Client) ValidateUIDs(ctx context.Context, uids []string) (*ValidationRe
 	return &response, nil
 }
 
-// doWithRetry performs an HTTP request with retry logic
+// SetRetryHandler sets a callback invoked before each retry with the
+// error of the failed attempt
+func (c *Client) SetRetryHandler(handler func(path string, err error)) {
+	c.retryHandler = handler
+}
+
+// doWithRetry performs an HTTP request with retry logic. Errors that
+// sending again cannot fix are returned at once.
 func (c *Client) doWithRetry(ctx context.Context, method, path string, payload, response interface{}) error {
 	var lastErr error
-	
+
 	for attempt := 0; attempt <= c.retryCount; attempt++ {
 		if attempt > 0 {
+			if c.retryHandler != nil {
+				c.retryHandler(path, lastErr)
+			}
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
@@ -88,6 +121,9 @@ func (c *Client) doWithRetry(ctx context.Context, method, path string, payload,
 		}
 
 		lastErr = err
+		if !IsRetryable(err) {
+			return err
+		}
 	}
 
 	return fmt.Errorf("all retry attempts failed: %w", lastErr)
@@ -102,13 +138,23 @@ func (c *Client) do(ctx context.Context, method, path string, payload, response
 		}
 	}
 
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return c.send(ctx, method, path, &body, header, response)
+}
+
+// send performs a single HTTP request with a raw body and decodes a JSON
+// response
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader, header http.Header, response interface{}) error {
 	url := c.baseURL + path
-	req, err := http.NewRequestWithContext(ctx, method, url, &body)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	for key, values := range header {
+		req.Header[key] = values
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -117,7 +163,7 @@ func (c *Client) do(ctx context.Context, method, path string, payload, response
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	if response != nil {
@@ -129,9 +175,48 @@ func (c *Client) do(ctx context.Context, method, path string, payload, response
 	return nil
 }
 
-// ValidationRequest represents the payload for UID validation
+// StatusError is returned when the server responds with a non-2xx status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// Retryable reports whether the request may succeed if sent again. Client
+// errors other than 408 and 429 mean the request itself was refused.
+func (e *StatusError) Retryable() bool {
+	if e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return e.StatusCode < 400 || e.StatusCode >= 500
+}
+
+// IsRetryable reports whether err from a request is worth retrying.
+// Everything except a refused request is, since network errors and server
+// errors are usually temporary.
+func IsRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Retryable()
+	}
+	return true
+}
+
+// ValidationRequest represents the payload for UID validation. TapURLs,
+// Taps, ReaderIDs and TappedAt are parallel to UIDs.
 type ValidationRequest struct {
 	UIDs []string `json:"uids"`
+	// TapURLs are the tap URLs of the tags, with their SUN data
+	TapURLs []string `json:"tap_urls,omitempty"`
+	// Taps carry each tag's type and metadata, so that Cursive can reject
+	// unsupported tags
+	Taps        []nfc.Tap   `json:"taps,omitempty"`
+	ReaderIDs   []string    `json:"reader_ids,omitempty"`
+	TappedAt    []time.Time `json:"tapped_at,omitempty"`
+	MinBondSize int         `json:"min_bond_size,omitempty"`
+	MaxBondSize int         `json:"max_bond_size,omitempty"`
 }
 
 // ValidationResponse represents the response from the Cursive server
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer answers with each status in turn, then with 200
+func countingServer(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		json.NewEncoder(w).Encode(ValidationResponse{Valid: true})
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryCount int
+		statuses   []int
+		wantErr    bool
+		requests   int32
+		retries    int
+	}{
+		{"succeeds after retries", 2, []int{503, 502}, false, 3, 2},
+		{"gives up", 1, []int{503, 503, 503}, true, 2, 1},
+		{"no retries", 0, []int{500}, true, 1, 0},
+		{"refused is not retried", 2, []int{400}, true, 1, 0},
+		{"too many requests is retried", 2, []int{429}, false, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := countingServer(t, tt.statuses...)
+			client := NewClient(ClientConfig{
+				BaseURL:    server.URL,
+				Timeout:    time.Second,
+				RetryCount: tt.retryCount,
+				RetryDelay: time.Millisecond,
+			})
+			retries := 0
+			client.SetRetryHandler(func(path string, err error) { retries++ })
+
+			_, err := client.Validate(context.Background(), ValidationRequest{UIDs: []string{"04a23b1a5c6180"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(requests); got != tt.requests {
+				t.Errorf("%d requests, want %d", got, tt.requests)
+			}
+			if retries != tt.retries {
+				t.Errorf("%d retries reported, want %d", retries, tt.retries)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Commands understood by the Fiz Reader firmware
+const (
+	CommandBeep      = "beep"
+	CommandFlash     = "flash"
+	CommandSleep     = "sleep"
+	CommandReboot    = "reboot"
+	CommandTapResult = "tap_result"
+)
+
+// Topic prefixes for hub to reader commands and their acknowledgements.
+// The device ID is appended to both.
+const (
+	commandTopicPrefix = "fiz/cmd/"
+	ackTopicPrefix     = "fiz/ack/"
+)
+
+// defaultCommandTimeout is used when MQTTConfig.CommandTimeout is unset
+const defaultCommandTimeout = 5 * time.Second
+
+// Errors returned by SendCommand
+var (
+	ErrUnknownDevice  = errors.New("unknown device")
+	ErrDeviceOffline  = errors.New("device offline")
+	ErrCommandTimeout = errors.New("timed out waiting for command acknowledgement")
+)
+
+// Command is a message sent to a single reader on fiz/cmd/<device_id>
+type Command struct {
+	// ID correlates the command with its acknowledgement. It is generated
+	// when left empty.
+	ID     string          `json:"id"`
+	Name   string          `json:"command"`
+	Args   json.RawMessage `json:"args,omitempty"`
+	SentAt time.Time       `json:"sent_at"`
+}
+
+// CommandAck is a reader's reply on fiz/ack/<device_id>
+type CommandAck struct {
+	ID       string `json:"id"`
+	DeviceID string `json:"device_id"`
+	// Status is "ok" when the command was carried out, otherwise "error"
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ackKey identifies a command awaiting acknowledgement. Command IDs are
+// only unique per device, and a reader may only acknowledge its own.
+type ackKey struct {
+	deviceID  string
+	commandID string
+}
+
+// TapFeedback is sent to a reader as the args of a tap_result command so
+// it can show the outcome of a tap. Timestamp echoes UIDMessage.Timestamp.
+type TapFeedback struct {
+	UID       string `json:"uid"`
+	Timestamp int64  `json:"timestamp"`
+	Result    string `json:"result"`
+	Reason    string `json:"reason,omitempty"`
+	Collected int    `json:"collected"`
+	BondSize  int    `json:"bond_size"`
+}
+
+// SendTapResult tells a reader what happened to one of its taps
+func (b *MQTTBroker) SendTapResult(deviceID string, feedback TapFeedback) error {
+	args, err := json.Marshal(feedback)
+	if err != nil {
+		return fmt.Errorf("failed to encode tap result: %w", err)
+	}
+	return b.NotifyDevice(deviceID, Command{Name: CommandTapResult, Args: args})
+}
+
+// SendCommand publishes cmd to deviceID and waits for its acknowledgement.
+// The wait ends at the context deadline, or after the configured command
+// timeout if the context has none.
+func (b *MQTTBroker) SendCommand(ctx context.Context, deviceID string, cmd Command) (*CommandAck, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.commandTimeout())
+		defer cancel()
+	}
+
+	if cmd.ID == "" {
+		cmd.ID = newQueueID()
+	}
+	key := ackKey{deviceID: deviceID, commandID: cmd.ID}
+	acks := make(chan CommandAck, 1)
+	b.acksMux.Lock()
+	b.pendingAcks[key] = acks
+	b.acksMux.Unlock()
+	defer func() {
+		b.acksMux.Lock()
+		delete(b.pendingAcks, key)
+		b.acksMux.Unlock()
+	}()
+
+	if err := b.publishCommand(deviceID, &cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case ack := <-acks:
+		return &ack, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrCommandTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// NotifyDevice publishes cmd to deviceID without waiting for an
+// acknowledgement
+func (b *MQTTBroker) NotifyDevice(deviceID string, cmd Command) error {
+	if cmd.ID == "" {
+		cmd.ID = newQueueID()
+	}
+	return b.publishCommand(deviceID, &cmd)
+}
+
+// publishCommand checks that deviceID is online and publishes cmd to it
+func (b *MQTTBroker) publishCommand(deviceID string, cmd *Command) error {
+	if cmd.Name == "" {
+		return errors.New("command name is required")
+	}
+
+	b.devicesMux.RLock()
+	device, ok := b.devices[deviceID]
+	online := ok && (device.Status == StatusOnline || device.Status == StatusStale)
+	b.devicesMux.RUnlock()
+	if !ok {
+		return ErrUnknownDevice
+	}
+	if !online {
+		return ErrDeviceOffline
+	}
+
+	cmd.SentAt = time.Now()
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to encode command: %w", err)
+	}
+	if err := b.server.Publish(commandTopicPrefix+deviceID, payload, 1, false); err != nil {
+		return fmt.Errorf("failed to publish command: %w", err)
+	}
+	logger.Debug("Sent command", "command", cmd.Name, "id", cmd.ID, "device_id", deviceID)
+	return nil
+}
+
+// handleAck delivers an acknowledgement to the waiting SendCommand call.
+// Only the device the command was sent to can acknowledge it.
+func (b *MQTTBroker) handleAck(topic string, payload []byte) {
+	var ack CommandAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		logger.Warn("Error unmarshaling command acknowledgement", "error", err)
+		return
+	}
+	deviceID := strings.TrimPrefix(topic, ackTopicPrefix)
+	if ack.DeviceID != "" && ack.DeviceID != deviceID {
+		logger.Warn("Rejecting acknowledgement for another device", "id", ack.ID, "device_id", deviceID, "claimed_device_id", ack.DeviceID)
+		return
+	}
+	ack.DeviceID = deviceID
+
+	b.acksMux.Lock()
+	acks, ok := b.pendingAcks[ackKey{deviceID: deviceID, commandID: ack.ID}]
+	b.acksMux.Unlock()
+	if !ok {
+		logger.Debug("Ignoring acknowledgement", "id", ack.ID, "device_id", ack.DeviceID)
+		return
+	}
+
+	select {
+	case acks <- ack:
+	default:
+	}
+}
+
+// commandTimeout returns the configured acknowledgement timeout
+func (b *MQTTBroker) commandTimeout() time.Duration {
+	if b.config.CommandTimeout > 0 {
+		return b.config.CommandTimeout
+	}
+	return defaultCommandTimeout
+}
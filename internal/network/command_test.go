@@ -0,0 +1,134 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newCommandBroker returns a broker with two online readers
+func newCommandBroker() *MQTTBroker {
+	b := NewMQTTBroker(MQTTConfig{CommandTimeout: 200 * time.Millisecond})
+	for _, id := range []string{"FIZR001", "FIZR002"} {
+		b.devices[id] = &ReaderDevice{DeviceID: id, Status: StatusOnline}
+	}
+	return b
+}
+
+// sendBeep sends a beep to deviceID and returns its outcome once the
+// command is waiting for an acknowledgement
+func sendBeep(t *testing.T, b *MQTTBroker, deviceID, id string) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		ack, err := b.SendCommand(context.Background(), deviceID, Command{ID: id, Name: CommandBeep})
+		if err == nil && ack.DeviceID != deviceID {
+			t.Errorf("ack from %s, want %s", ack.DeviceID, deviceID)
+		}
+		done <- err
+	}()
+
+	key := ackKey{deviceID: deviceID, commandID: id}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		b.acksMux.Lock()
+		_, pending := b.pendingAcks[key]
+		b.acksMux.Unlock()
+		if pending {
+			return done
+		}
+	}
+	t.Fatal("command never sent")
+	return nil
+}
+
+func TestAckFromTargetDevice(t *testing.T) {
+	b := newCommandBroker()
+	done := sendBeep(t, b, "FIZR001", "cmd-1")
+	b.handleAck(ackTopicPrefix+"FIZR001", []byte(`{"id":"cmd-1","status":"ok"}`))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAckFromOtherDeviceIsRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+	}{
+		{"other topic", ackTopicPrefix + "FIZR002", `{"id":"cmd-1","status":"ok"}`},
+		{"claims other device", ackTopicPrefix + "FIZR001", `{"id":"cmd-1","device_id":"FIZR002","status":"ok"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCommandBroker()
+			done := sendBeep(t, b, "FIZR001", "cmd-1")
+			b.handleAck(tt.topic, []byte(tt.payload))
+			if err := <-done; err != ErrCommandTimeout {
+				t.Fatalf("error %v, want %v", err, ErrCommandTimeout)
+			}
+		})
+	}
+}
+
+func TestSameCommandIDOnTwoDevices(t *testing.T) {
+	b := newCommandBroker()
+	first := sendBeep(t, b, "FIZR001", "cmd-1")
+	second := sendBeep(t, b, "FIZR002", "cmd-1")
+
+	b.handleAck(ackTopicPrefix+"FIZR002", []byte(`{"id":"cmd-1","status":"ok"}`))
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	b.handleAck(ackTopicPrefix+"FIZR001", []byte(`{"id":"cmd-1","status":"ok"}`))
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTapResultIsSentToReader(t *testing.T) {
+	b := NewMQTTBroker(MQTTConfig{})
+	b.SetUIDHandler(func(msg UIDMessage) {
+		err := b.SendTapResult(msg.DeviceID, TapFeedback{UID: msg.UID, Timestamp: msg.Timestamp, Result: "accepted", Collected: 1, BondSize: 3})
+		if err != nil {
+			t.Errorf("failed to send tap result: %v", err)
+		}
+	})
+	addr := startTestBroker(t, b)
+	other := registerReader(t, b, addr, "FIZR002")
+	r := registerReader(t, b, addr, "FIZR001")
+
+	r.publish("fiz/uid", UIDMessage{DeviceID: "FIZR001", UID: "04A1B2C3", Timestamp: 1234})
+	cmd := r.readCommand()
+	if cmd.Name != CommandTapResult || cmd.ID == "" {
+		t.Fatalf("got command %q with ID %q", cmd.Name, cmd.ID)
+	}
+	var feedback TapFeedback
+	if err := json.Unmarshal(cmd.Args, &feedback); err != nil {
+		t.Fatal(err)
+	}
+	want := TapFeedback{UID: "04A1B2C3", Timestamp: 1234, Result: "accepted", Collected: 1, BondSize: 3}
+	if feedback != want {
+		t.Fatalf("feedback %+v, want %+v", feedback, want)
+	}
+	other.expectNothing()
+}
+
+func TestTapResultNeedsOnlineReader(t *testing.T) {
+	b := newCommandBroker()
+	b.devices["FIZR002"].Status = StatusOffline
+
+	tests := []struct {
+		deviceID string
+		want     error
+	}{
+		{"FIZR002", ErrDeviceOffline},
+		{"FIZR404", ErrUnknownDevice},
+	}
+	for _, tt := range tests {
+		if err := b.SendTapResult(tt.deviceID, TapFeedback{UID: "04A1B2C3", Result: "accepted"}); err != tt.want {
+			t.Errorf("%s: error %v, want %v", tt.deviceID, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// Reasons a UID message is dropped before reaching the UID handler
+const (
+	// TapDropRedelivered is a message already seen with the same device ID,
+	// UID and timestamp, such as a QoS 1 redelivery
+	TapDropRedelivered = "redelivered"
+	// TapDropHeld is a repeat read of a tag that stayed on the antenna
+	TapDropHeld = "held"
+	// TapDropStale is a message older than TapMaxAge by the reader's clock,
+	// or older than a read of the same tag that was already handled
+	TapDropStale = "stale"
+)
+
+// Defaults used when the MQTTConfig tap settings are unset
+const (
+	defaultTapHoldOff = 1500 * time.Millisecond
+	defaultTapMaxAge  = 10 * time.Second
+)
+
+// tapFilter drops repeated UID messages before they reach the state
+// machine. Timestamps are only compared with others from the same reader
+// in the same clock domain: unsigned messages carry the reader's uptime
+// and signed ones Unix time, both in milliseconds, so a reader that starts
+// or stops signing gets a fresh clock rather than having every tap taken
+// as stale or redelivered. A tag read
+// again within the hold-off of its previous read, with no other tag read in
+// between, is still held on the antenna. After a longer gap, or once another
+// tag has been read, it has been re-presented and is passed on.
+type tapFilter struct {
+	holdOff time.Duration
+	maxAge  time.Duration
+	mutex   sync.Mutex
+	readers map[readerClock]*readerTaps
+	drops   map[string]uint64
+}
+
+// readerClock identifies the timestamps of one reader in one clock domain
+type readerClock struct {
+	deviceID string
+	// unix is set for signed messages, whose timestamps are Unix time
+	unix bool
+}
+
+// clockOf returns the clock that stamped msg
+func clockOf(msg UIDMessage) readerClock {
+	return readerClock{deviceID: msg.DeviceID, unix: msg.Signature != ""}
+}
+
+// readerTaps is what the filter remembers about one reader
+type readerTaps struct {
+	// latest is the newest timestamp from the reader, which arrived at the
+	// hub time received
+	latest   int64
+	received time.Time
+	lastUID  string
+	tags     map[string]*tagRead
+	// seen holds recent (uid, timestamp) pairs for spotting redeliveries
+	seen map[tapKey]time.Time
+}
+
+// tagRead is the last read of a tag by one reader
+type tagRead struct {
+	timestamp int64
+	received  time.Time
+}
+
+type tapKey struct {
+	uid       string
+	timestamp int64
+}
+
+func newTapFilter(holdOff, maxAge time.Duration) *tapFilter {
+	if holdOff <= 0 {
+		holdOff = defaultTapHoldOff
+	}
+	if maxAge <= 0 {
+		maxAge = defaultTapMaxAge
+	}
+	return &tapFilter{
+		holdOff: holdOff,
+		maxAge:  maxAge,
+		readers: make(map[readerClock]*readerTaps),
+		drops: map[string]uint64{
+			TapDropRedelivered:  0,
+			TapDropHeld:         0,
+			TapDropStale:        0,
+			TapDropUnsigned:     0,
+			TapDropBadSignature: 0,
+			TapDropExpired:      0,
+		},
+	}
+}
+
+// check returns the reason to drop msg, or "" to pass it on. Messages
+// without a timestamp are only checked against the hold-off, using the time
+// they arrived.
+func (f *tapFilter) check(msg UIDMessage, now time.Time) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	reason := f.classify(msg, now)
+	if reason != "" {
+		f.drops[reason]++
+	}
+	return reason
+}
+
+// reject counts a message dropped for reason before it reached the filter
+func (f *tapFilter) reject(reason string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.drops[reason]++
+}
+
+// classify does the work of check. Callers must hold the mutex.
+func (f *tapFilter) classify(msg UIDMessage, now time.Time) string {
+	clock := clockOf(msg)
+	reader, ok := f.readers[clock]
+	if !ok {
+		reader = &readerTaps{
+			tags: make(map[string]*tagRead),
+			seen: make(map[tapKey]time.Time),
+		}
+		f.readers[clock] = reader
+	}
+	f.prune(reader, now)
+
+	tag := reader.tags[msg.UID]
+	if msg.Timestamp != 0 {
+		key := tapKey{uid: msg.UID, timestamp: msg.Timestamp}
+		if _, ok := reader.seen[key]; ok {
+			return TapDropRedelivered
+		}
+		reader.seen[key] = now
+
+		if !reader.received.IsZero() {
+			expected := reader.latest + now.Sub(reader.received).Milliseconds()
+			if msg.Timestamp < expected-f.maxAge.Milliseconds() {
+				return TapDropStale
+			}
+		}
+		if tag != nil && msg.Timestamp < tag.timestamp {
+			return TapDropStale
+		}
+		if msg.Timestamp > reader.latest || reader.received.IsZero() {
+			reader.latest = msg.Timestamp
+			reader.received = now
+		}
+	}
+
+	held := false
+	if tag != nil && reader.lastUID == msg.UID {
+		gap := now.Sub(tag.received)
+		if msg.Timestamp != 0 && tag.timestamp != 0 {
+			gap = time.Duration(msg.Timestamp-tag.timestamp) * time.Millisecond
+		}
+		held = gap < f.holdOff
+	}
+
+	// Every read extends the hold-off, so a tag left on the antenna stays
+	// held however long it sits there
+	reader.tags[msg.UID] = &tagRead{timestamp: msg.Timestamp, received: now}
+	reader.lastUID = msg.UID
+	if held {
+		return TapDropHeld
+	}
+	return ""
+}
+
+// prune forgets reads too old to affect any check. Callers must hold the
+// mutex.
+func (f *tapFilter) prune(reader *readerTaps, now time.Time) {
+	window := f.maxAge
+	if f.holdOff > window {
+		window = f.holdOff
+	}
+	window *= 2
+	for key, at := range reader.seen {
+		if now.Sub(at) > window {
+			delete(reader.seen, key)
+		}
+	}
+	for uid, read := range reader.tags {
+		if uid != reader.lastUID && now.Sub(read.received) > window {
+			delete(reader.tags, uid)
+		}
+	}
+}
+
+// restart forgets a reader's clocks and tags when it registers, since its
+// uptime starts again from zero after a reboot. Recent messages are kept so
+// redeliveries after a reconnect are still dropped.
+func (f *tapFilter) restart(deviceID string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, unix := range []bool{false, true} {
+		if reader, ok := f.readers[readerClock{deviceID: deviceID, unix: unix}]; ok {
+			reader.latest = 0
+			reader.received = time.Time{}
+			reader.lastUID = ""
+			reader.tags = make(map[string]*tagRead)
+		}
+	}
+}
+
+// counts returns the number of messages dropped for each reason
+func (f *tapFilter) counts() map[string]uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	counts := make(map[string]uint64, len(f.drops))
+	for reason, count := range f.drops {
+		counts[reason] = count
+	}
+	return counts
+}
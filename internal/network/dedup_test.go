@@ -0,0 +1,108 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// tapStep is a UID message arriving at the filter after a delay
+type tapStep struct {
+	after     time.Duration
+	uid       string
+	timestamp int64
+	signed    bool
+	want      string
+}
+
+func runTapSteps(t *testing.T, steps []tapStep) {
+	t.Helper()
+	f := newTapFilter(1500*time.Millisecond, 10*time.Second)
+	now := time.Unix(1700000000, 0)
+	for i, step := range steps {
+		now = now.Add(step.after)
+		msg := UIDMessage{DeviceID: "FIZR001", UID: step.uid, Timestamp: step.timestamp}
+		if step.signed {
+			msg.Signature = "signed"
+		}
+		if got := f.check(msg, now); got != step.want {
+			t.Fatalf("step %d (%s at %d): got %q, want %q", i, step.uid, step.timestamp, got, step.want)
+		}
+	}
+}
+
+func TestTapFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []tapStep
+	}{
+		{"redelivered", []tapStep{
+			{0, "04a1", 5000, false, ""},
+			{time.Second, "04a1", 5000, false, TapDropRedelivered},
+		}},
+		{"held", []tapStep{
+			{0, "04a1", 5000, false, ""},
+			{time.Second, "04a1", 6000, false, TapDropHeld},
+			{time.Second, "04a1", 7000, false, TapDropHeld},
+		}},
+		{"re-presented", []tapStep{
+			{0, "04a1", 5000, false, ""},
+			{2 * time.Second, "04a1", 7000, false, ""},
+		}},
+		{"stale", []tapStep{
+			{0, "04a1", 50000, false, ""},
+			{time.Second, "04b2", 30000, false, TapDropStale},
+		}},
+		{"signed after unsigned", []tapStep{
+			{0, "04a1", 5000, false, ""},
+			{time.Second, "04b2", 1700000001000, true, ""},
+			{time.Second, "04c3", 7000, false, ""},
+			{time.Second, "04d4", 1700000003000, true, ""},
+		}},
+		{"unsigned taps do not advance the signed clock", []tapStep{
+			{0, "04a1", 1700000000000, true, ""},
+			{time.Second, "04b2", 999999999999999, false, ""},
+			{time.Second, "04c3", 1700000002000, true, ""},
+		}},
+		{"redelivery is per clock", []tapStep{
+			{0, "04a1", 5000, false, ""},
+			{2 * time.Second, "04a1", 5000, true, ""},
+			{time.Second, "04a1", 5000, true, TapDropRedelivered},
+		}},
+		{"signed stale", []tapStep{
+			{0, "04a1", 1700000000000, true, ""},
+			{time.Second, "04b2", 1699999980000, true, TapDropStale},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runTapSteps(t, tt.steps)
+		})
+	}
+}
+
+func TestTapFilterRestart(t *testing.T) {
+	f := newTapFilter(0, 0)
+	now := time.Unix(1700000000, 0)
+	for _, signed := range []bool{false, true} {
+		msg := UIDMessage{DeviceID: "FIZR001", UID: "04a1", Timestamp: 900000}
+		if signed {
+			msg.Signature = "signed"
+		}
+		if got := f.check(msg, now); got != "" {
+			t.Fatalf("first tap dropped as %q", got)
+		}
+	}
+
+	// After a reboot the reader's uptime starts again from zero
+	f.restart("FIZR001")
+	now = now.Add(time.Second)
+	for _, signed := range []bool{false, true} {
+		msg := UIDMessage{DeviceID: "FIZR001", UID: "04b2", Timestamp: 1000}
+		if signed {
+			msg.Signature = "signed"
+		}
+		if got := f.check(msg, now); got != "" {
+			t.Fatalf("tap after restart dropped as %q", got)
+		}
+	}
+}
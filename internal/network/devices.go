@@ -0,0 +1,334 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deviceFileName is the device store file inside the data directory
+const deviceFileName = "devices.json"
+
+// Provisioning states of a reader
+const (
+	// DevicePending readers have asked to join and are quarantined until
+	// an operator approves them or they pair
+	DevicePending = "pending"
+	// DeviceApproved readers hold credentials and are trusted
+	DeviceApproved = "approved"
+	// DeviceRevoked readers had their credentials withdrawn
+	DeviceRevoked = "revoked"
+)
+
+// DeviceRecord is what the hub remembers about a reader across restarts
+type DeviceRecord struct {
+	DeviceID string `json:"device_id"`
+	// State is the provisioning state, empty for readers seen while
+	// provisioning was disabled
+	State string `json:"state,omitempty"`
+	// TokenHash is the SHA-256 of the reader's MQTT password. Only the
+	// hash is stored; the token is shown once when it is issued.
+	TokenHash string `json:"token_hash,omitempty"`
+	// SigningKey is the secret the reader signs its taps with. Unlike the
+	// token it is kept in the clear, since the hub needs it to verify.
+	SigningKey string `json:"signing_key,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Firmware   string `json:"firmware,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	Name       string `json:"name,omitempty"`
+	// Labels describe where the reader is, such as its room or table
+	Labels      map[string]string `json:"labels,omitempty"`
+	FirstSeen   time.Time         `json:"first_seen,omitempty"`
+	LastSeen    time.Time         `json:"last_seen,omitempty"`
+	RequestedAt time.Time         `json:"requested_at,omitempty"`
+	ApprovedAt  time.Time         `json:"approved_at,omitempty"`
+	RevokedAt   time.Time         `json:"revoked_at,omitempty"`
+}
+
+// DeviceStore persists reader approvals, revocations and metadata
+type DeviceStore struct {
+	path    string
+	mutex   sync.Mutex
+	devices map[string]*DeviceRecord
+}
+
+// NewDeviceStore opens the device store in dir, loading any saved records
+func NewDeviceStore(dir string) (*DeviceStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create device store directory: %w", err)
+	}
+
+	s := &DeviceStore{
+		path:    filepath.Join(dir, deviceFileName),
+		devices: make(map[string]*DeviceRecord),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Request records a reader asking to join. Unknown readers are added as
+// pending; the metadata of known readers is refreshed.
+func (s *DeviceStore) Request(device ReaderDevice) (DeviceRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[device.DeviceID]
+	if !ok {
+		record = &DeviceRecord{
+			DeviceID:    device.DeviceID,
+			State:       DevicePending,
+			RequestedAt: time.Now(),
+		}
+		s.devices[device.DeviceID] = record
+	}
+	record.Type = device.Type
+	record.Firmware = device.Firmware
+	record.IP = device.IP
+	return *record, s.save()
+}
+
+// Seen records a registered reader's metadata and last contact, adding it
+// to the registry the first time
+func (s *DeviceStore) Seen(device ReaderDevice) (DeviceRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[device.DeviceID]
+	if !ok {
+		record = &DeviceRecord{DeviceID: device.DeviceID}
+		s.devices[device.DeviceID] = record
+	}
+	if record.FirstSeen.IsZero() {
+		record.FirstSeen = device.LastSeen
+	}
+	record.LastSeen = device.LastSeen
+	record.Type = device.Type
+	record.Firmware = device.Firmware
+	record.IP = device.IP
+	return *record, s.save()
+}
+
+// Update sets the operator-assigned name and labels of a reader
+func (s *DeviceStore) Update(deviceID, name string, labels map[string]string) (DeviceRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[deviceID]
+	if !ok {
+		return DeviceRecord{}, ErrUnknownDevice
+	}
+	record.Name = name
+	record.Labels = labels
+	return *record, s.save()
+}
+
+// Delete forgets a reader, including its approval
+func (s *DeviceStore) Delete(deviceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.devices[deviceID]; !ok {
+		return ErrUnknownDevice
+	}
+	delete(s.devices, deviceID)
+	return s.save()
+}
+
+// Approve trusts a reader and issues it a new token, replacing any earlier
+// one. Readers that never asked to join can be approved ahead of time.
+func (s *DeviceStore) Approve(deviceID string) (string, error) {
+	if deviceID == "" {
+		return "", errors.New("device ID is required")
+	}
+
+	token, err := newDeviceToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[deviceID]
+	if !ok {
+		record = &DeviceRecord{DeviceID: deviceID}
+		s.devices[deviceID] = record
+	}
+	record.State = DeviceApproved
+	record.TokenHash = hashDeviceToken(token)
+	record.ApprovedAt = time.Now()
+	record.RevokedAt = time.Time{}
+	if err := s.save(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Revoke withdraws a reader's credentials
+func (s *DeviceStore) Revoke(deviceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[deviceID]
+	if !ok {
+		return ErrUnknownDevice
+	}
+	record.State = DeviceRevoked
+	record.TokenHash = ""
+	record.SigningKey = ""
+	record.RevokedAt = time.Now()
+	return s.save()
+}
+
+// Authenticate reports whether token belongs to an approved reader
+func (s *DeviceStore) Authenticate(deviceID, token string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[deviceID]
+	if !ok || record.State != DeviceApproved || record.TokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeviceToken(token)), []byte(record.TokenHash)) == 1
+}
+
+// IssueSigningKey gives a reader a new tap signing key, replacing any
+// earlier one. Keys can be issued ahead of the reader's first connection.
+func (s *DeviceStore) IssueSigningKey(deviceID string) (string, error) {
+	if deviceID == "" {
+		return "", errors.New("device ID is required")
+	}
+
+	key, err := newDeviceToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[deviceID]
+	if !ok {
+		record = &DeviceRecord{DeviceID: deviceID}
+		s.devices[deviceID] = record
+	}
+	record.SigningKey = key
+	if err := s.save(); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// RemoveSigningKey lets a reader send unsigned taps again
+func (s *DeviceStore) RemoveSigningKey(deviceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[deviceID]
+	if !ok || record.SigningKey == "" {
+		return ErrUnknownDevice
+	}
+	record.SigningKey = ""
+	return s.save()
+}
+
+// SigningKey returns a reader's tap signing key, or "" when it has none
+func (s *DeviceStore) SigningKey(deviceID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if record, ok := s.devices[deviceID]; ok {
+		return record.SigningKey
+	}
+	return ""
+}
+
+// IsApproved reports whether a reader is currently trusted
+func (s *DeviceStore) IsApproved(deviceID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.devices[deviceID]
+	return ok && record.State == DeviceApproved
+}
+
+// List returns every record sorted by device ID, without token hashes or
+// signing keys
+func (s *DeviceStore) List() []DeviceRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records := make([]DeviceRecord, 0, len(s.devices))
+	for _, record := range s.devices {
+		snapshot := *record
+		snapshot.TokenHash = ""
+		snapshot.SigningKey = ""
+		records = append(records, snapshot)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DeviceID < records[j].DeviceID
+	})
+	return records
+}
+
+// load reads the store file if it exists
+func (s *DeviceStore) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read device store: %w", err)
+	}
+	var records []*DeviceRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("failed to decode device store: %w", err)
+	}
+	for _, record := range records {
+		s.devices[record.DeviceID] = record
+	}
+	return nil
+}
+
+// save atomically rewrites the store file. Callers must hold the mutex.
+func (s *DeviceStore) save() error {
+	records := make([]*DeviceRecord, 0, len(s.devices))
+	for _, record := range s.devices {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DeviceID < records[j].DeviceID
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode device store: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// newDeviceToken creates a random reader password
+func newDeviceToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate device token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashDeviceToken returns the stored form of a token
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openDeviceStore opens the device store in dir and fails the test on error
+func openDeviceStore(t *testing.T, dir string) *DeviceStore {
+	t.Helper()
+	store, err := NewDeviceStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestDeviceStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := openDeviceStore(t, dir)
+
+	first := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := store.Seen(ReaderDevice{DeviceID: "FIZR001", Type: "fiz_reader", Firmware: "1.0.0", IP: "10.0.0.5", LastSeen: first}); err != nil {
+		t.Fatal(err)
+	}
+	last := first.Add(time.Hour)
+	if _, err := store.Seen(ReaderDevice{DeviceID: "FIZR001", Type: "fiz_reader", Firmware: "1.1.0", IP: "10.0.0.6", LastSeen: last}); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"room": "hall"}
+	if _, err := store.Update("FIZR001", "Front door", labels); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Seen(ReaderDevice{DeviceID: "FIZR002", LastSeen: first}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("FIZR002"); err != nil {
+		t.Fatal(err)
+	}
+
+	records := openDeviceStore(t, dir).List()
+	if len(records) != 1 {
+		t.Fatalf("reopened store has %d devices, want 1", len(records))
+	}
+	want := DeviceRecord{
+		DeviceID:  "FIZR001",
+		Type:      "fiz_reader",
+		Firmware:  "1.1.0",
+		IP:        "10.0.0.6",
+		Name:      "Front door",
+		Labels:    labels,
+		FirstSeen: first,
+		LastSeen:  last,
+	}
+	if !reflect.DeepEqual(records[0], want) {
+		t.Fatalf("got %+v\nwant %+v", records[0], want)
+	}
+}
+
+func TestDeviceStoreUnknownDevice(t *testing.T) {
+	store := openDeviceStore(t, t.TempDir())
+	if _, err := store.Update("FIZR404", "Nowhere", nil); err != ErrUnknownDevice {
+		t.Fatalf("Update error %v, want %v", err, ErrUnknownDevice)
+	}
+	if err := store.Delete("FIZR404"); err != ErrUnknownDevice {
+		t.Fatalf("Delete error %v, want %v", err, ErrUnknownDevice)
+	}
+}
+
+func TestDeviceStoreRejectsCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, deviceFileName), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDeviceStore(dir); err == nil {
+		t.Fatal("corrupt device store was loaded")
+	}
+}
+
+func TestRestartLoadsDevicesOffline(t *testing.T) {
+	dir := t.TempDir()
+	b := NewMQTTBroker(MQTTConfig{})
+	b.SetDeviceStore(openDeviceStore(t, dir))
+	addr := startTestBroker(t, b)
+	registerReader(t, b, addr, "FIZR001")
+	if _, err := b.UpdateDevice("FIZR001", "Front door", map[string]string{"room": "hall"}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewMQTTBroker(MQTTConfig{})
+	restarted.SetDeviceStore(openDeviceStore(t, dir))
+	restarted.loadDevices()
+	devices := restarted.GetDevices()
+	if len(devices) != 1 {
+		t.Fatalf("loaded %d devices, want 1", len(devices))
+	}
+	device := devices[0]
+	if device.DeviceID != "FIZR001" || device.Status != StatusOffline || device.Firmware != "1.0.0" {
+		t.Fatalf("loaded %+v", device)
+	}
+	if device.Name != "Front door" || device.Labels["room"] != "hall" || device.FirstSeen.IsZero() {
+		t.Fatalf("metadata lost: %+v", device)
+	}
+}
+
+func TestRegisterSurvivesStoreFailure(t *testing.T) {
+	dir := t.TempDir()
+	b := NewMQTTBroker(MQTTConfig{})
+	b.SetDeviceStore(openDeviceStore(t, dir))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	b.registerDevice(&ReaderDevice{DeviceID: "FIZR001"})
+	devices := b.GetDevices()
+	if len(devices) != 1 || devices[0].Status != StatusOnline {
+		t.Fatalf("devices %+v, want FIZR001 online", devices)
+	}
+	if !devices[0].FirstSeen.IsZero() {
+		t.Fatalf("first seen %v taken from an unsaved record", devices[0].FirstSeen)
+	}
+}
@@ -0,0 +1,270 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firmware images are kept in this directory inside the data directory,
+// next to the manifest describing them
+const (
+	firmwareDirName      = "firmware"
+	firmwareManifestName = "firmware.json"
+)
+
+// ErrUnknownFirmware is returned for a version that was never uploaded
+var ErrUnknownFirmware = errors.New("unknown firmware version")
+
+// firmwareVersionPattern limits versions to characters that are safe in
+// file names and URLs
+var firmwareVersionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+_-]*$`)
+
+// FirmwareImage describes a reader firmware image hosted by the hub
+type FirmwareImage struct {
+	Version string `json:"version"`
+	// DeviceType limits the image to readers registered with this type.
+	// Empty images are for every reader.
+	DeviceType string    `json:"device_type,omitempty"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Notes      string    `json:"notes,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// FirmwareStore keeps uploaded firmware images and their metadata
+type FirmwareStore struct {
+	dir    string
+	mutex  sync.Mutex
+	images map[string]*FirmwareImage
+}
+
+// NewFirmwareStore opens the firmware store in dir, loading the manifest of
+// earlier uploads
+func NewFirmwareStore(dir string) (*FirmwareStore, error) {
+	dir = filepath.Join(dir, firmwareDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create firmware directory: %w", err)
+	}
+
+	s := &FirmwareStore{
+		dir:    dir,
+		images: make(map[string]*FirmwareImage),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add stores the image read from r. When checksum is set it must match the
+// SHA-256 of the image. Uploading a version again replaces it.
+func (s *FirmwareStore) Add(image FirmwareImage, r io.Reader, checksum string) (FirmwareImage, error) {
+	if !firmwareVersionPattern.MatchString(image.Version) {
+		return FirmwareImage{}, fmt.Errorf("invalid firmware version %q", image.Version)
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, image.Version+".tmp")
+	if err != nil {
+		return FirmwareImage{}, fmt.Errorf("failed to create firmware file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return FirmwareImage{}, fmt.Errorf("failed to write firmware file: %w", err)
+	}
+	if size == 0 {
+		return FirmwareImage{}, errors.New("firmware image is empty")
+	}
+
+	image.Size = size
+	image.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if checksum != "" && !strings.EqualFold(checksum, image.SHA256) {
+		return FirmwareImage{}, fmt.Errorf("firmware checksum mismatch: got %s", image.SHA256)
+	}
+	image.UploadedAt = time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Rename(tmp.Name(), s.imagePath(image.Version)); err != nil {
+		return FirmwareImage{}, fmt.Errorf("failed to store firmware file: %w", err)
+	}
+	s.images[image.Version] = &image
+	return image, s.save()
+}
+
+// Get returns the metadata of a version
+func (s *FirmwareStore) Get(version string) (FirmwareImage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	image, ok := s.images[version]
+	if !ok {
+		return FirmwareImage{}, ErrUnknownFirmware
+	}
+	return *image, nil
+}
+
+// Open returns the image file of a version for readers to download
+func (s *FirmwareStore) Open(version string) (*os.File, FirmwareImage, error) {
+	image, err := s.Get(version)
+	if err != nil {
+		return nil, FirmwareImage{}, err
+	}
+	file, err := os.Open(s.imagePath(version))
+	if err != nil {
+		return nil, FirmwareImage{}, fmt.Errorf("failed to open firmware file: %w", err)
+	}
+	return file, image, nil
+}
+
+// Delete removes a version and its image file
+func (s *FirmwareStore) Delete(version string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.images[version]; !ok {
+		return ErrUnknownFirmware
+	}
+	delete(s.images, version)
+	if err := os.Remove(s.imagePath(version)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove firmware file: %w", err)
+	}
+	return s.save()
+}
+
+// List returns every image, newest version first
+func (s *FirmwareStore) List() []FirmwareImage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	images := make([]FirmwareImage, 0, len(s.images))
+	for _, image := range s.images {
+		images = append(images, *image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return CompareVersions(images[i].Version, images[j].Version) > 0
+	})
+	return images
+}
+
+// imagePath returns the file an image version is stored in
+func (s *FirmwareStore) imagePath(version string) string {
+	return filepath.Join(s.dir, version+".bin")
+}
+
+// load reads the manifest if it exists
+func (s *FirmwareStore) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, firmwareManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read firmware manifest: %w", err)
+	}
+	var images []*FirmwareImage
+	if err := json.Unmarshal(data, &images); err != nil {
+		return fmt.Errorf("failed to decode firmware manifest: %w", err)
+	}
+	for _, image := range images {
+		s.images[image.Version] = image
+	}
+	return nil
+}
+
+// save atomically rewrites the manifest. Callers must hold the mutex.
+func (s *FirmwareStore) save() error {
+	images := make([]*FirmwareImage, 0, len(s.images))
+	for _, image := range s.images {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Version < images[j].Version
+	})
+	data, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode firmware manifest: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(s.dir, firmwareManifestName), data)
+}
+
+// CompareVersions compares dotted firmware versions such as "1.10.2" and
+// returns -1, 0 or 1. Numeric parts compare as numbers, others as text,
+// and a leading "v" is ignored. An empty version is older than any other.
+func CompareVersions(a, b string) int {
+	a = strings.TrimPrefix(a, "v")
+	b = strings.TrimPrefix(b, "v")
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	case b == "":
+		return 1
+	}
+
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var ap, bp string
+		if i < len(as) {
+			ap = as[i]
+		}
+		if i < len(bs) {
+			bp = bs[i]
+		}
+		if c := compareVersionPart(ap, bp); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareVersionPart compares one dotted part of a version. A missing part
+// counts as zero.
+func compareVersionPart(a, b string) int {
+	if a == "" {
+		a = "0"
+	}
+	if b == "" {
+		b = "0"
+	}
+	an, aerr := strconv.ParseUint(a, 10, 64)
+	bn, berr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil:
+		if an < bn {
+			return -1
+		}
+		if an > bn {
+			return 1
+		}
+		return 0
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
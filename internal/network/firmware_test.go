@@ -0,0 +1,137 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// openFirmwareStore opens the firmware store in dir and fails the test on
+// error
+func openFirmwareStore(t *testing.T, dir string) *FirmwareStore {
+	t.Helper()
+	store, err := NewFirmwareStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// addFirmware uploads data as version and fails the test on error
+func addFirmware(t *testing.T, store *FirmwareStore, version, data string) FirmwareImage {
+	t.Helper()
+	image, err := store.Add(FirmwareImage{Version: version, DeviceType: "fiz_reader"}, strings.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func checksum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFirmwareStore(t *testing.T) {
+	dir := t.TempDir()
+	store := openFirmwareStore(t, dir)
+	image := addFirmware(t, store, "1.2.0", "image 1.2.0")
+	if image.Size != 11 || image.SHA256 != checksum("image 1.2.0") || image.UploadedAt.IsZero() {
+		t.Fatalf("stored %+v", image)
+	}
+	addFirmware(t, store, "1.10.0", "image 1.10.0")
+	addFirmware(t, store, "1.9.0", "image 1.9.0")
+
+	// Uploading a version again replaces it
+	addFirmware(t, store, "1.9.0", "image 1.9.0 fixed")
+
+	reopened := openFirmwareStore(t, dir)
+	var versions []string
+	for _, image := range reopened.List() {
+		versions = append(versions, image.Version)
+	}
+	if got := strings.Join(versions, " "); got != "1.10.0 1.9.0 1.2.0" {
+		t.Fatalf("versions %s, want newest first", got)
+	}
+
+	file, image, err := reopened.Open("1.9.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "image 1.9.0 fixed" || image.SHA256 != checksum("image 1.9.0 fixed") {
+		t.Fatalf("opened %q with %+v", data, image)
+	}
+
+	if err := reopened.Delete("1.9.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reopened.Open("1.9.0"); err != ErrUnknownFirmware {
+		t.Fatalf("Open error %v after Delete, want %v", err, ErrUnknownFirmware)
+	}
+	if err := reopened.Delete("1.9.0"); err != ErrUnknownFirmware {
+		t.Fatalf("Delete error %v, want %v", err, ErrUnknownFirmware)
+	}
+}
+
+func TestFirmwareStoreRejectsBadUploads(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  string
+		data     string
+		checksum string
+	}{
+		{"checksum mismatch", "1.0.0", "image", checksum("other image")},
+		{"empty image", "1.0.0", "", ""},
+		{"path in version", "../1.0.0", "image", ""},
+		{"empty version", "", "image", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openFirmwareStore(t, t.TempDir())
+			if _, err := store.Add(FirmwareImage{Version: tt.version}, strings.NewReader(tt.data), tt.checksum); err == nil {
+				t.Fatal("upload was stored")
+			}
+			if images := store.List(); len(images) != 0 {
+				t.Fatalf("store has %+v", images)
+			}
+		})
+	}
+}
+
+func TestFirmwareStoreChecksumIgnoresCase(t *testing.T) {
+	store := openFirmwareStore(t, t.TempDir())
+	if _, err := store.Add(FirmwareImage{Version: "1.0.0"}, strings.NewReader("image"), strings.ToUpper(checksum("image"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.2.0", "1.10.0", -1},
+		{"1.10.2", "1.9.9", 1},
+		{"v1.2", "1.2.0", 0},
+		{"1.2", "1.2.1", -1},
+		{"", "0.0.1", -1},
+		{"1.0.0", "", 1},
+		{"1.0.0-beta", "1.0.0-alpha", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
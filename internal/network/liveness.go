@@ -0,0 +1,166 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Reader statuses. A reader that misses heartbeats is stale before it is
+// considered offline.
+const (
+	StatusOnline  = "online"
+	StatusStale   = "stale"
+	StatusOffline = "offline"
+)
+
+// Topics of the liveness protocol. Readers publish fiz/heartbeat every
+// heartbeat interval and set fiz/lwt/<device_id> as their last will. The
+// hub keeps its settings for readers retained on fiz/config.
+const (
+	heartbeatTopic = "fiz/heartbeat"
+	lwtTopicPrefix = "fiz/lwt/"
+	configTopic    = "fiz/config"
+)
+
+// Defaults used when the MQTTConfig liveness settings are unset
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultStaleAfter        = 45 * time.Second
+	defaultOfflineAfter      = 90 * time.Second
+)
+
+// heartbeat is published by readers on fiz/heartbeat
+type heartbeat struct {
+	DeviceID string `json:"device_id"`
+	RSSI     int    `json:"rssi"`
+}
+
+// readerConfig is the retained message readers read from fiz/config
+type readerConfig struct {
+	// HeartbeatInterval is in seconds
+	HeartbeatInterval int `json:"heartbeat_interval"`
+}
+
+// livenessDefaults fills in unset liveness settings
+func livenessDefaults(config MQTTConfig) MQTTConfig {
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if config.StaleAfter <= 0 {
+		config.StaleAfter = defaultStaleAfter
+	}
+	if config.OfflineAfter <= 0 {
+		config.OfflineAfter = defaultOfflineAfter
+	}
+	if config.OfflineAfter < config.StaleAfter {
+		config.OfflineAfter = config.StaleAfter
+	}
+	return config
+}
+
+// publishReaderConfig retains the heartbeat interval for readers
+func (b *MQTTBroker) publishReaderConfig() error {
+	payload, err := json.Marshal(readerConfig{
+		HeartbeatInterval: int(b.config.HeartbeatInterval / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	return b.server.Publish(configTopic, payload, 1, true)
+}
+
+// handleHeartbeat refreshes a reader and brings it back online
+func (b *MQTTBroker) handleHeartbeat(beat heartbeat) {
+	b.devicesMux.Lock()
+	defer b.devicesMux.Unlock()
+
+	device, ok := b.devices[beat.DeviceID]
+	if !ok {
+		logger.Debug("Heartbeat from unregistered device", "device_id", beat.DeviceID)
+		return
+	}
+	device.LastSeen = b.now()
+	device.RSSI = beat.RSSI
+	b.setStatus(device, StatusOnline)
+}
+
+// handleLastWill marks a reader offline as soon as its connection drops
+func (b *MQTTBroker) handleLastWill(topic string) {
+	deviceID := strings.TrimPrefix(topic, lwtTopicPrefix)
+
+	b.devicesMux.Lock()
+	defer b.devicesMux.Unlock()
+
+	if device, ok := b.devices[deviceID]; ok {
+		logger.Warn("Device disconnected unexpectedly", "device_id", deviceID)
+		b.setStatus(device, StatusOffline)
+	}
+}
+
+// touch records that a registered reader was heard from, bringing it back
+// online
+func (b *MQTTBroker) touch(deviceID string) {
+	b.devicesMux.Lock()
+	defer b.devicesMux.Unlock()
+
+	if device, ok := b.devices[deviceID]; ok {
+		device.LastSeen = b.now()
+		b.setStatus(device, StatusOnline)
+	}
+}
+
+// setStatus changes a reader's status, saving and publishing transitions.
+// Callers must hold devicesMux.
+func (b *MQTTBroker) setStatus(device *ReaderDevice, status string) {
+	previous := device.Status
+	if previous == status {
+		return
+	}
+	device.Status = status
+	logger.Info("Device status changed", "device_id", device.DeviceID, "status", status, "previous", previous)
+	b.persistDevice(device)
+	b.publishReader(device, previous)
+}
+
+// monitorDevices checks for readers that stopped sending heartbeats
+func (b *MQTTBroker) monitorDevices(ctx context.Context) {
+	interval := b.config.HeartbeatInterval / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.checkInactiveDevices()
+			b.advanceRollout()
+		}
+	}
+}
+
+// checkInactiveDevices marks readers stale, then offline, when they have
+// not been heard from
+func (b *MQTTBroker) checkInactiveDevices() {
+	b.devicesMux.Lock()
+	defer b.devicesMux.Unlock()
+
+	now := b.now()
+	for _, device := range b.devices {
+		if device.Status == StatusOffline {
+			continue
+		}
+		silent := now.Sub(device.LastSeen)
+		switch {
+		case silent > b.config.OfflineAfter:
+			b.setStatus(device, StatusOffline)
+		case silent > b.config.StaleAfter:
+			b.setStatus(device, StatusStale)
+		}
+	}
+}
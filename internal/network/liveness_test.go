@@ -0,0 +1,168 @@
+package network
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"fizhub/internal/mqtt"
+)
+
+// fakeClock is a broker clock that only moves when the test advances it
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newLivenessBroker returns a broker on a fake clock with FIZR001
+// registered
+func newLivenessBroker(config MQTTConfig) (*MQTTBroker, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)}
+	b := NewMQTTBroker(config)
+	b.now = clock.Now
+	b.registerDevice(&ReaderDevice{DeviceID: "FIZR001"})
+	return b, clock
+}
+
+func TestCheckInactiveDevices(t *testing.T) {
+	tests := []struct {
+		silent time.Duration
+		want   string
+	}{
+		{0, StatusOnline},
+		{10 * time.Second, StatusOnline},
+		{10*time.Second + time.Millisecond, StatusStale},
+		{30 * time.Second, StatusStale},
+		{30*time.Second + time.Millisecond, StatusOffline},
+		{time.Hour, StatusOffline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.silent.String(), func(t *testing.T) {
+			b, clock := newLivenessBroker(MQTTConfig{StaleAfter: 10 * time.Second, OfflineAfter: 30 * time.Second})
+			clock.Advance(tt.silent)
+			b.checkInactiveDevices()
+			if got := deviceStatus(b, "FIZR001"); got != tt.want {
+				t.Fatalf("status %s after %v, want %s", got, tt.silent, tt.want)
+			}
+		})
+	}
+}
+
+func TestLivenessDefaults(t *testing.T) {
+	config := livenessDefaults(MQTTConfig{})
+	if config.HeartbeatInterval != defaultHeartbeatInterval || config.StaleAfter != defaultStaleAfter || config.OfflineAfter != defaultOfflineAfter {
+		t.Fatalf("defaults %v %v %v", config.HeartbeatInterval, config.StaleAfter, config.OfflineAfter)
+	}
+	// A reader is never offline before it is stale
+	if config := livenessDefaults(MQTTConfig{StaleAfter: time.Minute, OfflineAfter: time.Second}); config.OfflineAfter != time.Minute {
+		t.Fatalf("offline after %v, want %v", config.OfflineAfter, time.Minute)
+	}
+}
+
+func TestHeartbeatKeepsReaderOnline(t *testing.T) {
+	b, clock := newLivenessBroker(MQTTConfig{StaleAfter: 10 * time.Second, OfflineAfter: 30 * time.Second})
+
+	// Heartbeats inside the stale threshold keep the reader online for
+	// longer than the offline threshold
+	for i := 0; i < 5; i++ {
+		clock.Advance(8 * time.Second)
+		b.handleHeartbeat(heartbeat{DeviceID: "FIZR001", RSSI: -50 - i})
+		b.checkInactiveDevices()
+		if got := deviceStatus(b, "FIZR001"); got != StatusOnline {
+			t.Fatalf("status %s after heartbeat %d", got, i)
+		}
+	}
+	if rssi := b.deviceRSSI("FIZR001"); rssi != -54 {
+		t.Fatalf("RSSI %d, want the last heartbeat's", rssi)
+	}
+
+	// A heartbeat brings back a stale reader
+	clock.Advance(20 * time.Second)
+	b.checkInactiveDevices()
+	if got := deviceStatus(b, "FIZR001"); got != StatusStale {
+		t.Fatalf("status %s without heartbeats", got)
+	}
+	b.handleHeartbeat(heartbeat{DeviceID: "FIZR001"})
+	if got := deviceStatus(b, "FIZR001"); got != StatusOnline {
+		t.Fatalf("status %s after heartbeat", got)
+	}
+
+	// Heartbeats do not register readers
+	b.handleHeartbeat(heartbeat{DeviceID: "FIZR002"})
+	if got := deviceStatus(b, "FIZR002"); got != "" {
+		t.Fatalf("unregistered reader is %s", got)
+	}
+}
+
+func TestForgedTapDoesNotTouchReader(t *testing.T) {
+	store, err := NewDeviceStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.IssueSigningKey("FIZR001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, clock := newLivenessBroker(MQTTConfig{StaleAfter: 10 * time.Second, OfflineAfter: 30 * time.Second})
+	b.store = store
+	b.SetUIDHandler(func(UIDMessage) {})
+	clock.Advance(20 * time.Second)
+	b.checkInactiveDevices()
+
+	tap := func(msg UIDMessage) {
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.messageHandler(mqtt.Message{Topic: "fiz/uid", Payload: payload, ClientID: "FIZR001"})
+	}
+	msg := UIDMessage{DeviceID: "FIZR001", UID: "04a1b2c3", Timestamp: time.Now().UnixNano() / int64(time.Millisecond)}
+
+	tap(msg)
+	msg.Signature = SignTap("wrong key", msg)
+	tap(msg)
+	if got := deviceStatus(b, "FIZR001"); got != StatusStale {
+		t.Fatalf("status %s after forged taps, want %s", got, StatusStale)
+	}
+
+	msg.Signature = SignTap(key, msg)
+	tap(msg)
+	if got := deviceStatus(b, "FIZR001"); got != StatusOnline {
+		t.Fatalf("status %s after a signed tap, want %s", got, StatusOnline)
+	}
+}
+
+func TestLastWillMarksReaderOffline(t *testing.T) {
+	b := NewMQTTBroker(MQTTConfig{})
+	addr := startTestBroker(t, b)
+	r := registerReader(t, b, addr, "FIZR001")
+
+	// Dropping the connection without DISCONNECT publishes the will
+	r.conn.Close()
+	waitFor(t, "FIZR001 to go offline", func() bool { return deviceStatus(b, "FIZR001") == StatusOffline })
+}
+
+func TestReaderConfigIsRetained(t *testing.T) {
+	b := NewMQTTBroker(MQTTConfig{HeartbeatInterval: 20 * time.Second})
+	addr := startTestBroker(t, b)
+	r := dialReader(t, addr).mustConnect("FIZR001", "", "")
+	if !r.subscribe(configTopic) {
+		t.Fatal("subscription refused")
+	}
+
+	topic, payload := r.readPublish()
+	var config readerConfig
+	if err := json.Unmarshal(payload, &config); err != nil {
+		t.Fatal(err)
+	}
+	if topic != configTopic || config.HeartbeatInterval != 20 {
+		t.Fatalf("got %s %+v", topic, config)
+	}
+}
@@ -2,99 +2,301 @@ package network
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"fizhub/internal/events"
+	"fizhub/internal/logging"
+	"fizhub/internal/mqtt"
+	"fizhub/internal/nfc"
 )
 
+// logger is the mqtt component logger of the broker, provisioning and
+// firmware rollouts
+var logger = logging.For("mqtt")
+
 // ReaderDevice represents a connected Fiz Reader
 type ReaderDevice struct {
-	DeviceID  string    `json:"device_id"`
-	Type      string    `json:"type"`
-	Firmware  string    `json:"firmware"`
-	IP        string    `json:"ip"`
-	LastSeen  time.Time `json:"last_seen"`
-	Status    string    `json:"status"`
-	RSSI      int       `json:"rssi"`
+	DeviceID string    `json:"device_id"`
+	Type     string    `json:"type"`
+	Firmware string    `json:"firmware"`
+	IP       string    `json:"ip"`
+	LastSeen time.Time `json:"last_seen"`
+	Status   string    `json:"status"`
+	RSSI     int       `json:"rssi"`
+	// FirstSeen, Name and Labels are kept in the device store
+	FirstSeen time.Time         `json:"first_seen"`
+	Name      string            `json:"name,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
 }
 
 // UIDMessage represents an NFC tag read from a reader
 type UIDMessage struct {
-	DeviceID  string `json:"device_id"`
-	UID       string `json:"uid"`
-	Timestamp int64  `json:"timestamp"`
+	DeviceID string `json:"device_id"`
+	UID      string `json:"uid"`
+	// Timestamp is when the reader read the tag, in milliseconds. It is
+	// Unix time in signed messages, which are checked against the hub's
+	// clock, and the reader's uptime otherwise. Duplicate and stale taps
+	// are found by comparing timestamps in the same domain only.
+	Timestamp int64 `json:"timestamp"`
+	// Signature is set by readers with a signing key, see SignTap
+	Signature string `json:"signature,omitempty"`
+	// Tag metadata, sent by readers that can read it, in the format of
+	// nfc.Tap
+	TagType string `json:"tag_type,omitempty"`
+	ATQA    string `json:"atqa,omitempty"`
+	SAK     string `json:"sak,omitempty"`
+	NDEF    string `json:"ndef,omitempty"`
+	// RSSI is the reader's signal strength, its last reported one when
+	// the message has none
+	RSSI int `json:"rssi,omitempty"`
+	// SUN is sent by readers that read the tap URL of NTAG 424 DNA tags
+	nfc.SUN
+}
+
+// Tap describes the message as a tap received at the given time. Readers
+// that send an ATQA and SAK but no tag type get one from nfc.ClassifyTag.
+func (m UIDMessage) Tap(received time.Time) nfc.Tap {
+	tagType := m.TagType
+	if tagType == "" {
+		atqa, errA := strconv.ParseUint(m.ATQA, 16, 16)
+		sak, errS := strconv.ParseUint(m.SAK, 16, 8)
+		if errA == nil && errS == nil {
+			tagType = nfc.ClassifyTag(uint16(atqa), byte(sak))
+		}
+	}
+	return nfc.Tap{
+		UID:      m.UID,
+		TagType:  tagType,
+		ATQA:     strings.ToLower(m.ATQA),
+		SAK:      strings.ToLower(m.SAK),
+		NDEF:     strings.ToLower(m.NDEF),
+		SUN:      m.SUN,
+		ReaderID: m.DeviceID,
+		RSSI:     m.RSSI,
+		Time:     received,
+	}
 }
 
-// MQTTBroker handles MQTT communication with Fiz Readers
+// MQTTBroker runs the embedded MQTT broker that Fiz Readers connect to
 type MQTTBroker struct {
-	client     mqtt.Client
-	devices    map[string]*ReaderDevice
-	devicesMux sync.RWMutex
-	uidHandler func(UIDMessage)
+	config        MQTTConfig
+	server        *mqtt.Server
+	devices       map[string]*ReaderDevice
+	devicesMux    sync.RWMutex
+	uidHandler    func(UIDMessage)
+	commitHandler func(deviceID string)
+	events        *events.Bus
+	pendingAcks   map[ackKey]chan CommandAck
+	acksMux       sync.Mutex
+	taps          *tapFilter
+	store         *DeviceStore
+	// pairing is the open pairing window, if any
+	pairing        *pairing
+	pairingMux     sync.Mutex
+	pairingHandler func(deviceID string)
+	firmware       *FirmwareStore
+	// rollout is the current or last firmware rollout
+	rollout    *rollout
+	rolloutMux sync.Mutex
+	// now is the clock of reader liveness and firmware update timeouts
+	now func() time.Time
 }
 
 // MQTTConfig holds MQTT broker configuration
 type MQTTConfig struct {
+	// Port is the plain tcp:// listener. It may be 0 when TLSPort is set.
 	Port     int    `json:"port"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// CommandTimeout is how long SendCommand waits for an acknowledgement
+	CommandTimeout time.Duration `json:"command_timeout"`
+	// TapHoldOff is how long a tag must be away from a reader before
+	// reading it again counts as a new tap
+	TapHoldOff time.Duration `json:"tap_hold_off"`
+	// TapMaxAge drops UID messages older than this by the reader's clock
+	TapMaxAge time.Duration `json:"tap_max_age"`
+	// RequireSignedTaps rejects unsigned UID messages from every reader,
+	// not only from those with a signing key
+	RequireSignedTaps bool `json:"require_signed_taps"`
+	// SignatureWindow is how far the timestamp of a signed UID message may
+	// be from the hub's clock
+	SignatureWindow time.Duration `json:"signature_window"`
+	// Provisioning restricts the shared username and password to asking to
+	// join. Readers are quarantined until approved and then connect with
+	// their device ID and issued token.
+	Provisioning bool `json:"provisioning"`
+	// HeartbeatInterval is how often readers are asked to publish on
+	// fiz/heartbeat
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	// StaleAfter marks a silent reader stale, and OfflineAfter offline
+	StaleAfter   time.Duration `json:"stale_after"`
+	OfflineAfter time.Duration `json:"offline_after"`
+	// FirmwareURL is the base URL of the hub's HTTP server that readers
+	// download firmware images from
+	FirmwareURL string `json:"firmware_url"`
+	// MaxConcurrentUpdates is how many readers a rollout updates at once
+	MaxConcurrentUpdates int `json:"max_concurrent_updates"`
+	// UpdateTimeout fails an update that has not reported progress for
+	// this long
+	UpdateTimeout time.Duration `json:"update_timeout"`
+	// TLSPort is the ssl:// listener, served with CertFile and KeyFile
+	TLSPort  int    `json:"tls_port"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CAFile verifies reader client certificates
+	CAFile string `json:"ca_file"`
+	// RequireClientCert enables mutual TLS. Every reader must present a
+	// certificate from CAFile whose common name is its device ID, so plain
+	// connections are refused.
+	RequireClientCert bool `json:"require_client_cert"`
 }
 
 // NewMQTTBroker creates a new MQTT broker instance
 func NewMQTTBroker(config MQTTConfig) *MQTTBroker {
+	config = livenessDefaults(config)
+	if config.MaxConcurrentUpdates <= 0 {
+		config.MaxConcurrentUpdates = defaultMaxConcurrentUpdates
+	}
+	if config.UpdateTimeout <= 0 {
+		config.UpdateTimeout = defaultUpdateTimeout
+	}
+	if config.SignatureWindow <= 0 {
+		config.SignatureWindow = defaultSignatureWindow
+	}
 	broker := &MQTTBroker{
-		devices: make(map[string]*ReaderDevice),
+		config:      config,
+		devices:     make(map[string]*ReaderDevice),
+		pendingAcks: make(map[ackKey]chan CommandAck),
+		taps:        newTapFilter(config.TapHoldOff, config.TapMaxAge),
+		now:         time.Now,
 	}
 
-	// Configure MQTT client
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://localhost:%d", config.Port))
-	opts.SetClientID("fizhub")
-	opts.SetUsername(config.Username)
-	opts.SetPassword(config.Password)
-	opts.SetDefaultPublishHandler(broker.messageHandler)
-	opts.SetOnConnectHandler(broker.connectHandler)
-	opts.SetConnectionLostHandler(broker.connectionLostHandler)
-
-	broker.client = mqtt.NewClient(opts)
+	broker.server = mqtt.NewServer(mqtt.Config{
+		Auth:               broker.authenticate,
+		AuthorizePublish:   broker.authorizePublish,
+		AuthorizeSubscribe: broker.authorizeSubscribe,
+		OnConnect:          broker.connectHandler,
+		OnDisconnect:       broker.connectionLostHandler,
+	})
 	return broker
 }
 
-// Start initializes the MQTT broker
+// Start listens for reader connections on the configured port
 func (b *MQTTBroker) Start(ctx context.Context) error {
-	log.Println("Starting MQTT broker...")
-	
-	if token := b.client.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+	logger.Info("Starting MQTT broker")
+	if b.config.Provisioning && b.store == nil {
+		return fmt.Errorf("provisioning requires a device store")
 	}
+	if b.config.Username == "" && !b.config.RequireClientCert {
+		logger.Warn("MQTT broker accepts readers without credentials, set a username and password to require them")
+	}
+
+	listeners, err := b.listen()
+	if err != nil {
+		return err
+	}
+	return b.serve(ctx, listeners)
+}
+
+// serve subscribes to the reader topics and accepts connections on
+// listeners until the broker is stopped
+func (b *MQTTBroker) serve(ctx context.Context, listeners []net.Listener) error {
+	b.loadDevices()
 
 	// Subscribe to topics
-	topics := map[string]byte{
-		"fiz/register": 1,
-		"fiz/status":   1,
-		"fiz/uid":      1,
+	topics := []string{
+		"fiz/register",
+		"fiz/status",
+		"fiz/uid",
+		"fiz/commit",
+		heartbeatTopic,
+		pairTopic,
+		ackTopicPrefix + "+",
+		lwtTopicPrefix + "+",
+		otaTopicPrefix + "+",
 	}
 
-	for topic, qos := range topics {
-		if token := b.client.Subscribe(topic, qos, nil); token.Wait() && token.Error() != nil {
-			return fmt.Errorf("failed to subscribe to %s: %w", topic, token.Error())
+	for _, topic := range topics {
+		if err := b.server.Subscribe(topic, b.messageHandler); err != nil {
+			closeListeners(listeners)
+			return fmt.Errorf("failed to subscribe to %s: %w", topic, err)
 		}
-		log.Printf("Subscribed to topic: %s", topic)
+		logger.Debug("Subscribed to topic", "topic", topic)
+	}
+	if err := b.publishReaderConfig(); err != nil {
+		closeListeners(listeners)
+		return fmt.Errorf("failed to publish reader config: %w", err)
+	}
+
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := b.server.Serve(listener); err != nil && err != mqtt.ErrServerClosed {
+				logger.Error("MQTT broker error", "error", err)
+			}
+		}(listener)
 	}
 
 	go b.monitorDevices(ctx)
 	return nil
 }
 
+// closeListeners closes listeners that will not be served
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// listen opens the tcp:// and ssl:// listeners that are configured
+func (b *MQTTBroker) listen() ([]net.Listener, error) {
+	var tlsConfig *tls.Config
+	if b.config.TLSPort > 0 {
+		var err error
+		tlsConfig, err = loadTLSConfig(b.config.CertFile, b.config.KeyFile, b.config.CAFile, b.config.RequireClientCert)
+		if err != nil {
+			return nil, err
+		}
+	} else if b.config.RequireClientCert {
+		return nil, errors.New("client certificates require a TLS port")
+	}
+	if b.config.Port <= 0 && tlsConfig == nil {
+		return nil, errors.New("no MQTT port configured")
+	}
+
+	var listeners []net.Listener
+	if b.config.Port > 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", b.config.Port))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on MQTT port %d: %w", b.config.Port, err)
+		}
+		logger.Info("MQTT broker listening", "url", "tcp://"+listener.Addr().String())
+		listeners = append(listeners, listener)
+	}
+	if tlsConfig != nil {
+		listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", b.config.TLSPort), tlsConfig)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("failed to listen on MQTT TLS port %d: %w", b.config.TLSPort, err)
+		}
+		logger.Info("MQTT broker listening", "url", "ssl://"+listener.Addr().String(), "client_certs", b.config.RequireClientCert)
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
 // Stop shuts down the MQTT broker
 func (b *MQTTBroker) Stop() error {
-	log.Println("Stopping MQTT broker...")
-	b.client.Disconnect(250)
-	return nil
+	logger.Info("Stopping MQTT broker")
+	return b.server.Close()
 }
 
 // SetUIDHandler sets the callback for handling UID messages
@@ -102,18 +304,45 @@ func (b *MQTTBroker) SetUIDHandler(handler func(UIDMessage)) {
 	b.uidHandler = handler
 }
 
+// authenticate checks reader credentials against the configured account,
+// or with provisioning enabled against the tokens of approved readers,
+// which must connect with their device ID as client ID. An empty username
+// lets readers connect without credentials. With mutual TLS a verified
+// client certificate is required as well.
+func (b *MQTTBroker) authenticate(clientID, username, password, commonName string) bool {
+	if b.config.RequireClientCert && commonName == "" {
+		return false
+	}
+	if b.config.Provisioning && !b.isProvisioningClient(username) {
+		return clientID == username && b.store.Authenticate(username, password)
+	}
+	if b.config.Username == "" {
+		return true
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(b.config.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(b.config.Password)) == 1
+	return userOK && passOK
+}
+
+// SetCommitHandler sets the callback for readers asking to close the
+// current group, for example after a long-press
+func (b *MQTTBroker) SetCommitHandler(handler func(deviceID string)) {
+	b.commitHandler = handler
+}
+
 // messageHandler processes incoming MQTT messages
-func (b *MQTTBroker) messageHandler(_ mqtt.Client, msg mqtt.Message) {
-	log.Printf("Received message on topic: %s", msg.Topic())
+func (b *MQTTBroker) messageHandler(msg mqtt.Message) {
+	logger.Debug("Received message", "topic", msg.Topic, "client_id", msg.ClientID)
 
-	switch msg.Topic() {
+	switch msg.Topic {
 	case "fiz/register":
 		var device ReaderDevice
-		if err := json.Unmarshal(msg.Payload(), &device); err != nil {
-			log.Printf("Error unmarshaling device registration: %v", err)
+		if err := json.Unmarshal(msg.Payload, &device); err != nil {
+			logger.Warn("Error unmarshaling device registration", "client_id", msg.ClientID, "error", err)
 			return
 		}
-		b.registerDevice(&device)
+		b.handleRegister(msg, &device)
+		b.firmwareReported(&device)
 
 	case "fiz/status":
 		var status struct {
@@ -121,32 +350,98 @@ func (b *MQTTBroker) messageHandler(_ mqtt.Client, msg mqtt.Message) {
 			Status   string `json:"status"`
 			RSSI     int    `json:"rssi"`
 		}
-		if err := json.Unmarshal(msg.Payload(), &status); err != nil {
-			log.Printf("Error unmarshaling status update: %v", err)
+		if err := json.Unmarshal(msg.Payload, &status); err != nil {
+			logger.Warn("Error unmarshaling status update", "client_id", msg.ClientID, "error", err)
+			return
+		}
+		if !b.trusted(msg, status.DeviceID) {
 			return
 		}
 		b.updateDeviceStatus(status.DeviceID, status.Status, status.RSSI)
 
 	case "fiz/uid":
 		var uidMsg UIDMessage
-		if err := json.Unmarshal(msg.Payload(), &uidMsg); err != nil {
-			log.Printf("Error unmarshaling UID message: %v", err)
+		if err := json.Unmarshal(msg.Payload, &uidMsg); err != nil {
+			logger.Warn("Error unmarshaling UID message", "client_id", msg.ClientID, "error", err)
 			return
 		}
+		if !b.trusted(msg, uidMsg.DeviceID) {
+			return
+		}
+		if reason := b.verifyTap(uidMsg, time.Now()); reason != "" {
+			b.taps.reject(reason)
+			logger.Warn("Rejected UID message", "reason", reason, "uid", uidMsg.UID, "device_id", uidMsg.DeviceID, "timestamp", uidMsg.Timestamp)
+			return
+		}
+		// Only a message the reader really sent shows that it is alive
+		b.touch(uidMsg.DeviceID)
+		if reason := b.taps.check(uidMsg, time.Now()); reason != "" {
+			logger.Debug("Dropped UID message", "reason", reason, "uid", uidMsg.UID, "device_id", uidMsg.DeviceID, "timestamp", uidMsg.Timestamp)
+			return
+		}
+		if uidMsg.RSSI == 0 {
+			uidMsg.RSSI = b.deviceRSSI(uidMsg.DeviceID)
+		}
 		if b.uidHandler != nil {
 			b.uidHandler(uidMsg)
 		}
+
+	case "fiz/commit":
+		var commit struct {
+			DeviceID string `json:"device_id"`
+		}
+		if err := json.Unmarshal(msg.Payload, &commit); err != nil {
+			logger.Warn("Error unmarshaling commit request", "client_id", msg.ClientID, "error", err)
+			return
+		}
+		if !b.trusted(msg, commit.DeviceID) {
+			return
+		}
+		if b.commitHandler != nil {
+			b.commitHandler(commit.DeviceID)
+		}
+
+	case heartbeatTopic:
+		var beat heartbeat
+		if err := json.Unmarshal(msg.Payload, &beat); err != nil {
+			logger.Warn("Error unmarshaling heartbeat", "client_id", msg.ClientID, "error", err)
+			return
+		}
+		if !b.trusted(msg, beat.DeviceID) {
+			return
+		}
+		b.handleHeartbeat(beat)
+
+	case pairTopic:
+		b.handlePair(msg)
+
+	default:
+		if !b.certified(msg, msg.Topic[strings.LastIndex(msg.Topic, "/")+1:]) {
+			return
+		}
+		switch {
+		case strings.HasPrefix(msg.Topic, ackTopicPrefix):
+			b.handleAck(msg.Topic, msg.Payload)
+		case strings.HasPrefix(msg.Topic, lwtTopicPrefix):
+			b.handleLastWill(msg.Topic)
+		case strings.HasPrefix(msg.Topic, otaTopicPrefix):
+			b.handleOTAProgress(msg.Topic, msg.Payload)
+		}
 	}
 }
 
-// connectHandler is called when MQTT client connects
-func (b *MQTTBroker) connectHandler(client mqtt.Client) {
-	log.Println("Connected to MQTT broker")
+// connectHandler is called when a reader connects to the broker
+func (b *MQTTBroker) connectHandler(clientID string) {
+	logger.Info("Client connected", "client_id", clientID)
 }
 
-// connectionLostHandler is called when MQTT client loses connection
-func (b *MQTTBroker) connectionLostHandler(client mqtt.Client, err error) {
-	log.Printf("Connection lost to MQTT broker: %v", err)
+// connectionLostHandler is called when a reader's connection ends
+func (b *MQTTBroker) connectionLostHandler(clientID string, err error) {
+	if err != nil {
+		logger.Warn("Connection lost", "client_id", clientID, "error", err)
+		return
+	}
+	logger.Info("Client disconnected", "client_id", clientID)
 }
 
 // registerDevice registers a new reader device
@@ -154,10 +449,21 @@ func (b *MQTTBroker) registerDevice(device *ReaderDevice) {
 	b.devicesMux.Lock()
 	defer b.devicesMux.Unlock()
 
-	device.LastSeen = time.Now()
-	device.Status = "online"
+	previous := ""
+	if existing, ok := b.devices[device.DeviceID]; ok {
+		previous = existing.Status
+	}
+	device.LastSeen = b.now()
+	device.Status = StatusOnline
+	if record, ok := b.persistDevice(device); ok {
+		device.FirstSeen = record.FirstSeen
+		device.Name = record.Name
+		device.Labels = record.Labels
+	}
 	b.devices[device.DeviceID] = device
-	log.Printf("Registered device: %s (%s)", device.DeviceID, device.IP)
+	b.taps.restart(device.DeviceID)
+	logger.Info("Registered device", "device_id", device.DeviceID, "ip", device.IP, "firmware", device.Firmware)
+	b.publishReader(device, previous)
 }
 
 // updateDeviceStatus updates a device's status
@@ -166,49 +472,154 @@ func (b *MQTTBroker) updateDeviceStatus(deviceID, status string, rssi int) {
 	defer b.devicesMux.Unlock()
 
 	if device, ok := b.devices[deviceID]; ok {
-		device.Status = status
 		device.RSSI = rssi
-		device.LastSeen = time.Now()
+		device.LastSeen = b.now()
+		b.setStatus(device, status)
 	}
 }
 
-// GetDevices returns a list of all registered devices
-func (b *MQTTBroker) GetDevices() []*ReaderDevice {
+// deviceRSSI returns the last signal strength a reader reported
+func (b *MQTTBroker) deviceRSSI(deviceID string) int {
 	b.devicesMux.RLock()
 	defer b.devicesMux.RUnlock()
 
-	devices := make([]*ReaderDevice, 0, len(b.devices))
-	for _, device := range b.devices {
-		devices = append(devices, device)
+	if device, ok := b.devices[deviceID]; ok {
+		return device.RSSI
 	}
-	return devices
+	return 0
 }
 
-// monitorDevices checks for inactive devices
-func (b *MQTTBroker) monitorDevices(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// SetEventBus sets the bus that reader status changes are published to
+func (b *MQTTBroker) SetEventBus(bus *events.Bus) {
+	b.devicesMux.Lock()
+	defer b.devicesMux.Unlock()
+	b.events = bus
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			b.checkInactiveDevices()
+// publishReader publishes a reader status change. Callers must hold
+// devicesMux.
+func (b *MQTTBroker) publishReader(device *ReaderDevice, previous string) {
+	b.events.Publish(events.TypeReader, events.ReaderData{
+		DeviceID: device.DeviceID,
+		Status:   device.Status,
+		Previous: previous,
+		RSSI:     device.RSSI,
+	})
+}
+
+// loadDevices adds the readers kept in the device store as offline, so they
+// are listed before they reconnect. With provisioning enabled only approved
+// readers are loaded.
+func (b *MQTTBroker) loadDevices() {
+	if b.store == nil {
+		return
+	}
+
+	b.devicesMux.Lock()
+	defer b.devicesMux.Unlock()
+
+	for _, record := range b.store.List() {
+		if record.FirstSeen.IsZero() {
+			continue
+		}
+		if b.config.Provisioning && record.State != DeviceApproved {
+			continue
+		}
+		if _, ok := b.devices[record.DeviceID]; ok {
+			continue
 		}
+		b.devices[record.DeviceID] = &ReaderDevice{
+			DeviceID:  record.DeviceID,
+			Type:      record.Type,
+			Firmware:  record.Firmware,
+			IP:        record.IP,
+			LastSeen:  record.LastSeen,
+			Status:    StatusOffline,
+			FirstSeen: record.FirstSeen,
+			Name:      record.Name,
+			Labels:    record.Labels,
+		}
+	}
+	if len(b.devices) > 0 {
+		logger.Info("Loaded devices", "count", len(b.devices))
+	}
+}
+
+// persistDevice saves a reader to the device store. Callers must hold
+// devicesMux.
+func (b *MQTTBroker) persistDevice(device *ReaderDevice) (DeviceRecord, bool) {
+	if b.store == nil {
+		return DeviceRecord{}, false
+	}
+	record, err := b.store.Seen(*device)
+	if err != nil {
+		logger.Error("Failed to save device", "device_id", device.DeviceID, "error", err)
+		return DeviceRecord{}, false
 	}
+	return record, true
 }
 
-// checkInactiveDevices marks devices as offline if they haven't sent updates
-func (b *MQTTBroker) checkInactiveDevices() {
+// UpdateDevice sets the name and labels of a known reader
+func (b *MQTTBroker) UpdateDevice(deviceID, name string, labels map[string]string) (*ReaderDevice, error) {
+	if b.store == nil {
+		return nil, errors.New("no device store")
+	}
+
 	b.devicesMux.Lock()
 	defer b.devicesMux.Unlock()
 
-	now := time.Now()
-	for _, device := range b.devices {
-		if device.Status == "online" && now.Sub(device.LastSeen) > 60*time.Second {
-			device.Status = "offline"
-			log.Printf("Device %s marked as offline", device.DeviceID)
+	device, ok := b.devices[deviceID]
+	if !ok {
+		return nil, ErrUnknownDevice
+	}
+	record, err := b.store.Update(deviceID, name, labels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update device: %w", err)
+	}
+	device.Name = record.Name
+	device.Labels = record.Labels
+	snapshot := *device
+	return &snapshot, nil
+}
+
+// ForgetDevice removes a reader from the registry and the device store,
+// along with any approval, and disconnects it
+func (b *MQTTBroker) ForgetDevice(deviceID string) error {
+	b.devicesMux.Lock()
+	_, known := b.devices[deviceID]
+	delete(b.devices, deviceID)
+	b.devicesMux.Unlock()
+
+	if b.store != nil {
+		if err := b.store.Delete(deviceID); err == nil {
+			known = true
+		} else if !errors.Is(err, ErrUnknownDevice) {
+			return fmt.Errorf("failed to forget device: %w", err)
 		}
 	}
+	if !known {
+		return ErrUnknownDevice
+	}
+	b.server.Disconnect(deviceID)
+	logger.Info("Device forgotten", "device_id", deviceID)
+	return nil
+}
+
+// GetDroppedTaps returns the number of UID messages dropped before the UID
+// handler, by reason
+func (b *MQTTBroker) GetDroppedTaps() map[string]uint64 {
+	return b.taps.counts()
+}
+
+// GetDevices returns a snapshot of all registered devices
+func (b *MQTTBroker) GetDevices() []*ReaderDevice {
+	b.devicesMux.RLock()
+	defer b.devicesMux.RUnlock()
+
+	devices := make([]*ReaderDevice, 0, len(b.devices))
+	for _, device := range b.devices {
+		snapshot := *device
+		devices = append(devices, &snapshot)
+	}
+	return devices
 }
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"fizhub/internal/nfc"
+)
+
+func TestUIDMessageTap(t *testing.T) {
+	received := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		msg  UIDMessage
+		want nfc.Tap
+	}{
+		{
+			name: "reported tag type",
+			msg:  UIDMessage{DeviceID: "FIZR001", UID: "04a23b1a5c6180", TagType: nfc.TagNTAG215, ATQA: "0044", SAK: "00", RSSI: -60},
+			want: nfc.Tap{UID: "04a23b1a5c6180", TagType: nfc.TagNTAG215, ATQA: "0044", SAK: "00", ReaderID: "FIZR001", RSSI: -60},
+		},
+		{
+			name: "classified from ATQA and SAK",
+			msg:  UIDMessage{DeviceID: "FIZR001", UID: "deadbeef", ATQA: "0004", SAK: "08"},
+			want: nfc.Tap{UID: "deadbeef", TagType: nfc.TagMifareClassic, ATQA: "0004", SAK: "08", ReaderID: "FIZR001"},
+		},
+		{
+			name: "upper case hex",
+			msg:  UIDMessage{DeviceID: "FIZR001", UID: "04de5f1eacc040", ATQA: "0344", SAK: "20", NDEF: "D1010755046669"},
+			want: nfc.Tap{UID: "04de5f1eacc040", TagType: nfc.TagDESFire, ATQA: "0344", SAK: "20", NDEF: "d1010755046669", ReaderID: "FIZR001"},
+		},
+		{
+			name: "unclassified tag",
+			msg:  UIDMessage{DeviceID: "FIZR001", UID: "04a23b1a5c6180", ATQA: "0044", SAK: "00"},
+			want: nfc.Tap{UID: "04a23b1a5c6180", ATQA: "0044", SAK: "00", ReaderID: "FIZR001"},
+		},
+		{
+			name: "bad SAK",
+			msg:  UIDMessage{DeviceID: "FIZR001", UID: "deadbeef", ATQA: "0004", SAK: "108"},
+			want: nfc.Tap{UID: "deadbeef", ATQA: "0004", SAK: "108", ReaderID: "FIZR001"},
+		},
+		{
+			name: "no metadata",
+			msg:  UIDMessage{DeviceID: "FIZR001", UID: "deadbeef", SUN: exampleSUN},
+			want: nfc.Tap{UID: "deadbeef", SUN: exampleSUN, ReaderID: "FIZR001"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.Time = received
+			if got := tt.msg.Tap(received); got != tt.want {
+				t.Fatalf("Tap = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
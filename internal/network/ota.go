@@ -0,0 +1,455 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"fizhub/internal/events"
+)
+
+// CommandOTA asks a reader to download and install a firmware image. Its
+// args are an otaArgs.
+const CommandOTA = "ota"
+
+// otaTopicPrefix is where readers report update progress. The device ID is
+// appended.
+const otaTopicPrefix = "fiz/ota/"
+
+// Statuses of a reader's firmware update
+const (
+	// UpdateQueued updates wait for a free rollout slot and for the reader
+	// to be online
+	UpdateQueued = "queued"
+	// UpdateSent readers were sent the ota command
+	UpdateSent        = "sent"
+	UpdateDownloading = "downloading"
+	UpdateInstalling  = "installing"
+	// UpdateSucceeded readers registered again with the new version
+	UpdateSucceeded = "succeeded"
+	UpdateFailed    = "failed"
+	// UpdateCancelled updates were still queued when the rollout was
+	// cancelled
+	UpdateCancelled = "cancelled"
+)
+
+// Defaults used when the MQTTConfig update settings are unset
+const (
+	defaultMaxConcurrentUpdates = 1
+	defaultUpdateTimeout        = 10 * time.Minute
+)
+
+// ErrRolloutActive is returned by StartRollout while another rollout has
+// updates that have not finished
+var ErrRolloutActive = errors.New("firmware rollout already in progress")
+
+// FirmwareUpdate is the progress of one reader in a rollout
+type FirmwareUpdate struct {
+	DeviceID string `json:"device_id"`
+	// From is the firmware the reader reported when the rollout started
+	From    string `json:"from"`
+	Version string `json:"version"`
+	Status  string `json:"status"`
+	// Progress is the percentage downloaded, as reported by the reader
+	Progress  int       `json:"progress"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Rollout updates readers to one firmware version, at most MaxConcurrent at
+// a time
+type Rollout struct {
+	Version       string           `json:"version"`
+	MaxConcurrent int              `json:"max_concurrent"`
+	StartedAt     time.Time        `json:"started_at"`
+	FinishedAt    time.Time        `json:"finished_at,omitempty"`
+	Cancelled     bool             `json:"cancelled,omitempty"`
+	Updates       []FirmwareUpdate `json:"updates"`
+}
+
+// otaArgs are the args of an ota command
+type otaArgs struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// otaProgress is published by readers on fiz/ota/<device_id>
+type otaProgress struct {
+	Version  string `json:"version"`
+	Status   string `json:"status"`
+	Progress int    `json:"progress"`
+	Error    string `json:"error,omitempty"`
+}
+
+// rollout is the broker's state of the current rollout. Access is guarded
+// by rolloutMux.
+type rollout struct {
+	image         FirmwareImage
+	maxConcurrent int
+	startedAt     time.Time
+	finishedAt    time.Time
+	cancelled     bool
+	updates       map[string]*FirmwareUpdate
+}
+
+// SetFirmwareStore sets the store of firmware images that rollouts send
+func (b *MQTTBroker) SetFirmwareStore(store *FirmwareStore) {
+	b.firmware = store
+}
+
+// StartRollout updates readers running firmware older than version. With
+// deviceIDs empty every registered reader of the image's device type is
+// considered. maxConcurrent overrides the configured number of readers
+// updating at once when positive.
+func (b *MQTTBroker) StartRollout(version string, deviceIDs []string, maxConcurrent int) (*Rollout, error) {
+	if b.firmware == nil {
+		return nil, errors.New("no firmware store")
+	}
+	image, err := b.firmware.Get(version)
+	if err != nil {
+		return nil, err
+	}
+	if maxConcurrent <= 0 {
+		maxConcurrent = b.config.MaxConcurrentUpdates
+	}
+
+	devices := make(map[string]ReaderDevice)
+	for _, device := range b.GetDevices() {
+		devices[device.DeviceID] = *device
+	}
+	if len(deviceIDs) == 0 {
+		for deviceID := range devices {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+
+	now := b.now()
+	r := &rollout{
+		image:         image,
+		maxConcurrent: maxConcurrent,
+		startedAt:     now,
+		updates:       make(map[string]*FirmwareUpdate),
+	}
+	for _, deviceID := range deviceIDs {
+		device, ok := devices[deviceID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownDevice, deviceID)
+		}
+		if image.DeviceType != "" && device.Type != image.DeviceType {
+			continue
+		}
+		if CompareVersions(device.Firmware, image.Version) >= 0 {
+			continue
+		}
+		r.updates[deviceID] = &FirmwareUpdate{
+			DeviceID:  deviceID,
+			From:      device.Firmware,
+			Version:   image.Version,
+			Status:    UpdateQueued,
+			UpdatedAt: now,
+		}
+	}
+
+	b.rolloutMux.Lock()
+	if b.rollout != nil && b.rollout.finishedAt.IsZero() {
+		b.rolloutMux.Unlock()
+		return nil, ErrRolloutActive
+	}
+	b.rollout = r
+	b.rolloutMux.Unlock()
+
+	logger.Info("Firmware rollout started", "version", image.Version, "readers", len(r.updates), "max_concurrent", maxConcurrent)
+	b.advanceRollout()
+	snapshot, _ := b.GetRollout()
+	return snapshot, nil
+}
+
+// CancelRollout stops queued updates from starting. Readers already
+// updating are left to finish.
+func (b *MQTTBroker) CancelRollout() error {
+	b.rolloutMux.Lock()
+	r := b.rollout
+	if r == nil || !r.finishedAt.IsZero() {
+		b.rolloutMux.Unlock()
+		return errors.New("no firmware rollout in progress")
+	}
+	r.cancelled = true
+	var cancelled []FirmwareUpdate
+	now := b.now()
+	for _, update := range r.updates {
+		if update.Status == UpdateQueued {
+			update.Status = UpdateCancelled
+			update.UpdatedAt = now
+			cancelled = append(cancelled, *update)
+		}
+	}
+	b.rolloutMux.Unlock()
+
+	logger.Info("Firmware rollout cancelled", "version", r.image.Version)
+	for _, update := range cancelled {
+		b.publishUpdate(update)
+	}
+	b.advanceRollout()
+	return nil
+}
+
+// GetRollout returns a snapshot of the current or last rollout
+func (b *MQTTBroker) GetRollout() (*Rollout, bool) {
+	b.rolloutMux.Lock()
+	defer b.rolloutMux.Unlock()
+
+	r := b.rollout
+	if r == nil {
+		return nil, false
+	}
+	snapshot := &Rollout{
+		Version:       r.image.Version,
+		MaxConcurrent: r.maxConcurrent,
+		StartedAt:     r.startedAt,
+		FinishedAt:    r.finishedAt,
+		Cancelled:     r.cancelled,
+		Updates:       make([]FirmwareUpdate, 0, len(r.updates)),
+	}
+	for _, update := range r.updates {
+		snapshot.Updates = append(snapshot.Updates, *update)
+	}
+	sort.Slice(snapshot.Updates, func(i, j int) bool {
+		return snapshot.Updates[i].DeviceID < snapshot.Updates[j].DeviceID
+	})
+	return snapshot, true
+}
+
+// advanceRollout fails updates that stopped reporting and sends the ota
+// command to queued readers that are online while rollout slots are free
+func (b *MQTTBroker) advanceRollout() {
+	online := make(map[string]bool)
+	for _, device := range b.GetDevices() {
+		online[device.DeviceID] = device.Status == StatusOnline
+	}
+
+	b.rolloutMux.Lock()
+	r := b.rollout
+	if r == nil || !r.finishedAt.IsZero() {
+		b.rolloutMux.Unlock()
+		return
+	}
+
+	now := b.now()
+	var changed, starting []FirmwareUpdate
+	inFlight := 0
+	for _, update := range r.updates {
+		if !updateInFlight(update.Status) {
+			continue
+		}
+		if now.Sub(update.UpdatedAt) > b.config.UpdateTimeout {
+			update.Status = UpdateFailed
+			update.Error = "timed out"
+			update.UpdatedAt = now
+			changed = append(changed, *update)
+			continue
+		}
+		inFlight++
+	}
+
+	if !r.cancelled {
+		queued := make([]*FirmwareUpdate, 0, len(r.updates))
+		for _, update := range r.updates {
+			if update.Status == UpdateQueued && online[update.DeviceID] {
+				queued = append(queued, update)
+			}
+		}
+		sort.Slice(queued, func(i, j int) bool {
+			return queued[i].DeviceID < queued[j].DeviceID
+		})
+		for _, update := range queued {
+			if inFlight >= r.maxConcurrent {
+				break
+			}
+			update.Status = UpdateSent
+			update.StartedAt = now
+			update.UpdatedAt = now
+			starting = append(starting, *update)
+			inFlight++
+		}
+	}
+
+	b.finishRollout(r, now)
+	image := r.image
+	b.rolloutMux.Unlock()
+
+	for _, update := range changed {
+		logger.Warn("Firmware update failed", "device_id", update.DeviceID, "version", update.Version, "error", update.Error)
+		b.publishUpdate(update)
+	}
+	for _, update := range starting {
+		b.sendUpdate(image, update)
+	}
+}
+
+// sendUpdate sends the ota command for an update that was just started
+func (b *MQTTBroker) sendUpdate(image FirmwareImage, update FirmwareUpdate) {
+	args, err := json.Marshal(otaArgs{
+		Version: image.Version,
+		URL:     b.firmwareURL(image.Version),
+		Size:    image.Size,
+		SHA256:  image.SHA256,
+	})
+	if err == nil {
+		err = b.NotifyDevice(update.DeviceID, Command{Name: CommandOTA, Args: args})
+	}
+	if err != nil {
+		logger.Warn("Failed to send firmware", "device_id", update.DeviceID, "version", image.Version, "error", err)
+		b.reportUpdate(update.DeviceID, otaProgress{
+			Version: image.Version,
+			Status:  UpdateFailed,
+			Error:   err.Error(),
+		})
+		return
+	}
+	logger.Info("Sent firmware", "device_id", update.DeviceID, "version", image.Version)
+	b.publishUpdate(update)
+}
+
+// handleOTAProgress records a reader's report on its update
+func (b *MQTTBroker) handleOTAProgress(topic string, payload []byte) {
+	var progress otaProgress
+	if err := json.Unmarshal(payload, &progress); err != nil {
+		logger.Warn("Error unmarshaling firmware progress", "error", err)
+		return
+	}
+	switch progress.Status {
+	case UpdateDownloading, UpdateInstalling, UpdateFailed:
+	default:
+		logger.Debug("Ignoring firmware progress", "device_id", strings.TrimPrefix(topic, otaTopicPrefix), "status", progress.Status)
+		return
+	}
+	b.reportUpdate(strings.TrimPrefix(topic, otaTopicPrefix), progress)
+}
+
+// firmwareReported completes the update of a reader that registered with
+// its new firmware, and fails one that came back from installing on its
+// old firmware
+func (b *MQTTBroker) firmwareReported(device *ReaderDevice) {
+	// Only registrations that were accepted replace the registry entry
+	b.devicesMux.RLock()
+	registered := b.devices[device.DeviceID] == device
+	b.devicesMux.RUnlock()
+	if !registered {
+		return
+	}
+
+	b.rolloutMux.Lock()
+	r := b.rollout
+	if r == nil {
+		b.rolloutMux.Unlock()
+		return
+	}
+	update, ok := r.updates[device.DeviceID]
+	if !ok || (update.Status != UpdateQueued && !updateInFlight(update.Status)) {
+		b.rolloutMux.Unlock()
+		return
+	}
+	version := r.image.Version
+	previous := update.Status
+	b.rolloutMux.Unlock()
+
+	switch {
+	case CompareVersions(device.Firmware, version) >= 0:
+		b.reportUpdate(device.DeviceID, otaProgress{Version: version, Status: UpdateSucceeded, Progress: 100})
+	case previous == UpdateInstalling:
+		b.reportUpdate(device.DeviceID, otaProgress{
+			Version: version,
+			Status:  UpdateFailed,
+			Error:   fmt.Sprintf("restarted with firmware %s", device.Firmware),
+		})
+	default:
+		// Reconnecting readers may be ready for their update now
+		b.advanceRollout()
+	}
+}
+
+// reportUpdate applies a progress report to a reader's update and moves
+// the rollout on once it has finished
+func (b *MQTTBroker) reportUpdate(deviceID string, progress otaProgress) {
+	b.rolloutMux.Lock()
+	r := b.rollout
+	var update *FirmwareUpdate
+	if r != nil {
+		update = r.updates[deviceID]
+	}
+	if update == nil || update.Version != progress.Version {
+		b.rolloutMux.Unlock()
+		logger.Debug("Ignoring firmware progress", "device_id", deviceID, "version", progress.Version)
+		return
+	}
+	if update.Status == UpdateSucceeded || update.Status == UpdateFailed {
+		b.rolloutMux.Unlock()
+		return
+	}
+	update.Status = progress.Status
+	update.Progress = progress.Progress
+	update.Error = progress.Error
+	update.UpdatedAt = b.now()
+	snapshot := *update
+	b.rolloutMux.Unlock()
+
+	switch snapshot.Status {
+	case UpdateSucceeded:
+		logger.Info("Device updated", "device_id", deviceID, "version", snapshot.Version)
+	case UpdateFailed:
+		logger.Warn("Firmware update failed", "device_id", deviceID, "version", snapshot.Version, "error", snapshot.Error)
+	}
+	b.publishUpdate(snapshot)
+	if !updateInFlight(snapshot.Status) {
+		b.advanceRollout()
+	}
+}
+
+// finishRollout marks r finished once no update is queued or in flight.
+// Callers must hold rolloutMux.
+func (b *MQTTBroker) finishRollout(r *rollout, now time.Time) {
+	counts := make(map[string]int)
+	for _, update := range r.updates {
+		if update.Status == UpdateQueued || updateInFlight(update.Status) {
+			return
+		}
+		counts[update.Status]++
+	}
+	r.finishedAt = now
+	logger.Info("Firmware rollout finished", "version", r.image.Version,
+		"succeeded", counts[UpdateSucceeded], "failed", counts[UpdateFailed], "cancelled", counts[UpdateCancelled])
+}
+
+// publishUpdate publishes a change of a reader's update status
+func (b *MQTTBroker) publishUpdate(update FirmwareUpdate) {
+	b.devicesMux.RLock()
+	bus := b.events
+	b.devicesMux.RUnlock()
+	bus.Publish(events.TypeFirmware, events.FirmwareData{
+		DeviceID: update.DeviceID,
+		Version:  update.Version,
+		Status:   update.Status,
+		Progress: update.Progress,
+		Error:    update.Error,
+	})
+}
+
+// firmwareURL returns where readers download a firmware version
+func (b *MQTTBroker) firmwareURL(version string) string {
+	return strings.TrimSuffix(b.config.FirmwareURL, "/") + "/api/firmware/" + version + "/image"
+}
+
+// updateInFlight reports whether an update holds a rollout slot
+func updateInFlight(status string) bool {
+	switch status {
+	case UpdateSent, UpdateDownloading, UpdateInstalling:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package network
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"fizhub/internal/mqtt"
+)
+
+// otaRecorder captures the ota commands the broker sends to readers
+type otaRecorder struct {
+	mutex sync.Mutex
+	sent  map[string]otaArgs
+	order []string
+}
+
+// newRolloutBroker returns a broker on a fake clock with readers on the
+// given firmware versions and image 2.0.0 in its firmware store
+func newRolloutBroker(t *testing.T, config MQTTConfig, readers map[string]string) (*MQTTBroker, *fakeClock, *otaRecorder) {
+	t.Helper()
+	config.FirmwareURL = "http://fiznode.local:8080/"
+	b, clock := newLivenessBroker(config)
+	for deviceID, firmware := range readers {
+		b.registerDevice(&ReaderDevice{DeviceID: deviceID, Type: "fiz_reader", Firmware: firmware})
+	}
+
+	store := openFirmwareStore(t, t.TempDir())
+	addFirmware(t, store, "2.0.0", "image 2.0.0")
+	b.SetFirmwareStore(store)
+
+	recorder := &otaRecorder{sent: make(map[string]otaArgs)}
+	b.server.Subscribe(commandTopicPrefix+"+", func(msg mqtt.Message) {
+		var cmd Command
+		var args otaArgs
+		if err := json.Unmarshal(msg.Payload, &cmd); err != nil || cmd.Name != CommandOTA {
+			t.Errorf("unexpected command %s", msg.Payload)
+			return
+		}
+		if err := json.Unmarshal(cmd.Args, &args); err != nil {
+			t.Error(err)
+			return
+		}
+		deviceID := strings.TrimPrefix(msg.Topic, commandTopicPrefix)
+		recorder.mutex.Lock()
+		recorder.sent[deviceID] = args
+		recorder.order = append(recorder.order, deviceID)
+		recorder.mutex.Unlock()
+	})
+	return b, clock, recorder
+}
+
+// sentTo returns the readers sent the ota command so far, in order
+func (r *otaRecorder) sentTo() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return strings.Join(r.order, " ")
+}
+
+// updateStatus returns the rollout status of a reader's update
+func updateStatus(t *testing.T, b *MQTTBroker, deviceID string) string {
+	t.Helper()
+	rollout, ok := b.GetRollout()
+	if !ok {
+		t.Fatal("no rollout")
+	}
+	for _, update := range rollout.Updates {
+		if update.DeviceID == deviceID {
+			return update.Status
+		}
+	}
+	return ""
+}
+
+// reportOTA publishes a reader's progress report
+func reportOTA(b *MQTTBroker, deviceID string, progress otaProgress) {
+	payload, _ := json.Marshal(progress)
+	b.handleOTAProgress(otaTopicPrefix+deviceID, payload)
+}
+
+// reregister registers a reader again after an update
+func reregister(b *MQTTBroker, deviceID, firmware string) {
+	device := &ReaderDevice{DeviceID: deviceID, Type: "fiz_reader", Firmware: firmware}
+	b.registerDevice(device)
+	b.firmwareReported(device)
+}
+
+func TestRolloutSendsImage(t *testing.T) {
+	b, _, recorder := newRolloutBroker(t, MQTTConfig{}, map[string]string{"FIZR001": "1.0.0"})
+	if _, err := b.StartRollout("2.0.0", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	args, ok := recorder.sent["FIZR001"]
+	if !ok {
+		t.Fatal("ota command not sent")
+	}
+	want := otaArgs{
+		Version: "2.0.0",
+		URL:     "http://fiznode.local:8080/api/firmware/2.0.0/image",
+		Size:    int64(len("image 2.0.0")),
+		SHA256:  checksum("image 2.0.0"),
+	}
+	if args != want {
+		t.Fatalf("args %+v, want %+v", args, want)
+	}
+}
+
+func TestRolloutSkipsCurrentReaders(t *testing.T) {
+	b, _, recorder := newRolloutBroker(t, MQTTConfig{}, map[string]string{"FIZR001": "2.0.0", "FIZR002": "2.1.0", "FIZR003": "1.0.0"})
+	rollout, err := b.StartRollout("2.0.0", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollout.Updates) != 1 || rollout.Updates[0].DeviceID != "FIZR003" || rollout.Updates[0].From != "1.0.0" {
+		t.Fatalf("updates %+v, want only FIZR003", rollout.Updates)
+	}
+	if got := recorder.sentTo(); got != "FIZR003" {
+		t.Fatalf("sent to %q", got)
+	}
+
+	if _, err := b.StartRollout("2.0.0", []string{"FIZR404"}, 0); err == nil {
+		t.Fatal("rollout to an unknown reader started")
+	}
+	if _, err := b.StartRollout("9.9.9", nil, 0); err != ErrUnknownFirmware {
+		t.Fatalf("error %v, want %v", err, ErrUnknownFirmware)
+	}
+}
+
+func TestRolloutMaxConcurrent(t *testing.T) {
+	b, _, recorder := newRolloutBroker(t, MQTTConfig{MaxConcurrentUpdates: 2}, map[string]string{"FIZR001": "1.0.0", "FIZR002": "1.0.0", "FIZR003": "1.0.0"})
+	if _, err := b.StartRollout("2.0.0", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.sentTo(); got != "FIZR001 FIZR002" {
+		t.Fatalf("sent to %q, want two readers", got)
+	}
+	if _, err := b.StartRollout("2.0.0", nil, 0); err != ErrRolloutActive {
+		t.Fatalf("error %v, want %v", err, ErrRolloutActive)
+	}
+
+	// Progress does not free a slot, finishing does
+	reportOTA(b, "FIZR001", otaProgress{Version: "2.0.0", Status: UpdateDownloading, Progress: 50})
+	reportOTA(b, "FIZR001", otaProgress{Version: "2.0.0", Status: UpdateInstalling, Progress: 100})
+	if got := recorder.sentTo(); got != "FIZR001 FIZR002" {
+		t.Fatalf("sent to %q while both slots are busy", got)
+	}
+	reregister(b, "FIZR001", "2.0.0")
+	if got := updateStatus(t, b, "FIZR001"); got != UpdateSucceeded {
+		t.Fatalf("FIZR001 is %s", got)
+	}
+	if got := recorder.sentTo(); got != "FIZR001 FIZR002 FIZR003" {
+		t.Fatalf("sent to %q after a slot was freed", got)
+	}
+
+	reportOTA(b, "FIZR002", otaProgress{Version: "2.0.0", Status: UpdateInstalling})
+	reregister(b, "FIZR002", "1.0.0")
+	if got := updateStatus(t, b, "FIZR002"); got != UpdateFailed {
+		t.Fatalf("FIZR002 restarted on its old firmware and is %s", got)
+	}
+	reportOTA(b, "FIZR003", otaProgress{Version: "2.0.0", Status: UpdateFailed, Error: "checksum mismatch"})
+
+	rollout, _ := b.GetRollout()
+	if rollout.FinishedAt.IsZero() {
+		t.Fatal("rollout did not finish")
+	}
+}
+
+func TestRolloutMaxConcurrentOverride(t *testing.T) {
+	b, _, recorder := newRolloutBroker(t, MQTTConfig{MaxConcurrentUpdates: 1}, map[string]string{"FIZR001": "1.0.0", "FIZR002": "1.0.0", "FIZR003": "1.0.0"})
+	if _, err := b.StartRollout("2.0.0", nil, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.sentTo(); got != "FIZR001 FIZR002 FIZR003" {
+		t.Fatalf("sent to %q", got)
+	}
+}
+
+func TestRolloutUpdateTimeout(t *testing.T) {
+	b, clock, recorder := newRolloutBroker(t, MQTTConfig{UpdateTimeout: time.Minute}, map[string]string{"FIZR001": "1.0.0", "FIZR002": "1.0.0"})
+	if _, err := b.StartRollout("2.0.0", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each report restarts the timeout
+	clock.Advance(50 * time.Second)
+	reportOTA(b, "FIZR001", otaProgress{Version: "2.0.0", Status: UpdateDownloading, Progress: 10})
+	clock.Advance(50 * time.Second)
+	b.advanceRollout()
+	if got := updateStatus(t, b, "FIZR001"); got != UpdateDownloading {
+		t.Fatalf("FIZR001 is %s before the timeout", got)
+	}
+
+	clock.Advance(10*time.Second + time.Millisecond)
+	b.advanceRollout()
+	rollout, _ := b.GetRollout()
+	if update := rollout.Updates[0]; update.Status != UpdateFailed || update.Error != "timed out" {
+		t.Fatalf("FIZR001 update %+v, want timed out", update)
+	}
+	if got := recorder.sentTo(); got != "FIZR001 FIZR002" {
+		t.Fatalf("sent to %q, want FIZR002 after the timeout", got)
+	}
+}
+
+func TestRolloutWaitsForOfflineReaders(t *testing.T) {
+	b, _, recorder := newRolloutBroker(t, MQTTConfig{}, map[string]string{"FIZR001": "1.0.0"})
+	b.handleLastWill(lwtTopicPrefix + "FIZR001")
+	if _, err := b.StartRollout("2.0.0", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.sentTo(); got != "" {
+		t.Fatalf("sent to offline reader %q", got)
+	}
+
+	reregister(b, "FIZR001", "1.0.0")
+	if got := recorder.sentTo(); got != "FIZR001" {
+		t.Fatalf("sent to %q after the reader reconnected", got)
+	}
+}
+
+func TestCancelRollout(t *testing.T) {
+	b, _, recorder := newRolloutBroker(t, MQTTConfig{}, map[string]string{"FIZR001": "1.0.0", "FIZR002": "1.0.0"})
+	if _, err := b.StartRollout("2.0.0", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CancelRollout(); err != nil {
+		t.Fatal(err)
+	}
+	if got := updateStatus(t, b, "FIZR002"); got != UpdateCancelled {
+		t.Fatalf("queued update is %s", got)
+	}
+
+	// The update already sent may still finish
+	reregister(b, "FIZR001", "2.0.0")
+	if got := updateStatus(t, b, "FIZR001"); got != UpdateSucceeded {
+		t.Fatalf("FIZR001 is %s", got)
+	}
+	if got := recorder.sentTo(); got != "FIZR001" {
+		t.Fatalf("sent to %q after cancelling", got)
+	}
+	if rollout, _ := b.GetRollout(); !rollout.Cancelled || rollout.FinishedAt.IsZero() {
+		t.Fatalf("rollout %+v", rollout)
+	}
+}
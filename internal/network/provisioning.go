@@ -0,0 +1,340 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"fizhub/internal/events"
+	"fizhub/internal/mqtt"
+)
+
+// Topics used while a reader pairs. The reader publishes the code shown on
+// the LED ring to fiz/pair and receives its token on fiz/pair/<device_id>.
+const (
+	pairTopic       = "fiz/pair"
+	pairReplyPrefix = "fiz/pair/"
+)
+
+// Pairing code settings
+const (
+	pairingCodeLength  = 4
+	maxPairingAttempts = 5
+)
+
+// ErrPairingActive is returned by StartPairing while a code is still valid
+var ErrPairingActive = errors.New("pairing already in progress")
+
+// pairing is an active pairing window
+type pairing struct {
+	code     string
+	expires  time.Time
+	attempts int
+	timer    *time.Timer
+}
+
+// pairRequest is published by a reader on fiz/pair
+type pairRequest struct {
+	DeviceID string `json:"device_id"`
+	Code     string `json:"code"`
+}
+
+// pairReply is sent back on fiz/pair/<device_id>
+type pairReply struct {
+	DeviceID string `json:"device_id"`
+	Token    string `json:"token,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SetDeviceStore sets the store of reader approvals. It is required when
+// provisioning is enabled.
+func (b *MQTTBroker) SetDeviceStore(store *DeviceStore) {
+	b.store = store
+}
+
+// SetPairingHandler sets the callback for the end of a pairing window. It
+// receives the paired device ID, or an empty ID when the window expired or
+// too many wrong codes were tried.
+func (b *MQTTBroker) SetPairingHandler(handler func(deviceID string)) {
+	b.pairingHandler = handler
+}
+
+// StartPairing opens a pairing window of ttl and returns its one-time code
+func (b *MQTTBroker) StartPairing(ttl time.Duration) (string, time.Time, error) {
+	if !b.config.Provisioning {
+		return "", time.Time{}, errors.New("provisioning is disabled")
+	}
+
+	code, err := newPairingCode()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	b.pairingMux.Lock()
+	defer b.pairingMux.Unlock()
+
+	if b.pairing != nil {
+		return "", time.Time{}, ErrPairingActive
+	}
+	p := &pairing{code: code, expires: time.Now().Add(ttl)}
+	p.timer = time.AfterFunc(ttl, func() {
+		if b.endPairing(p) {
+			logger.Info("Pairing window expired")
+			b.notifyPairing("")
+		}
+	})
+	b.pairing = p
+	logger.Info("Pairing window open", "expires", p.expires)
+	return code, p.expires, nil
+}
+
+// ApproveDevice trusts a reader and returns its new token
+func (b *MQTTBroker) ApproveDevice(deviceID string) (string, error) {
+	if b.store == nil {
+		return "", errors.New("no device store")
+	}
+	token, err := b.store.Approve(deviceID)
+	if err != nil {
+		return "", fmt.Errorf("failed to approve device: %w", err)
+	}
+	logger.Info("Device approved", "device_id", deviceID)
+	b.publishProvisioning(deviceID, DeviceApproved)
+	return token, nil
+}
+
+// RevokeDevice withdraws a reader's credentials and disconnects it
+func (b *MQTTBroker) RevokeDevice(deviceID string) error {
+	if b.store == nil {
+		return errors.New("no device store")
+	}
+	if err := b.store.Revoke(deviceID); err != nil {
+		return err
+	}
+	b.server.Disconnect(deviceID)
+
+	b.devicesMux.Lock()
+	delete(b.devices, deviceID)
+	b.devicesMux.Unlock()
+
+	logger.Info("Device revoked", "device_id", deviceID)
+	b.publishProvisioning(deviceID, DeviceRevoked)
+	return nil
+}
+
+// authorizePublish limits provisioning clients to asking to join, and
+// approved readers to their own topics
+func (b *MQTTBroker) authorizePublish(clientID, username, topic string) bool {
+	if !b.config.Provisioning {
+		return true
+	}
+	if b.isProvisioningClient(username) {
+		return topic == "fiz/register" || topic == pairTopic
+	}
+	if !b.store.IsApproved(username) {
+		return false
+	}
+	switch topic {
+	case "fiz/register", "fiz/status", "fiz/uid", "fiz/commit", heartbeatTopic:
+		return true
+	}
+	return topic == ackTopicPrefix+username || topic == lwtTopicPrefix+username || topic == otaTopicPrefix+username
+}
+
+// authorizeSubscribe lets provisioning clients wait for their pairing reply
+// and approved readers receive their commands and settings
+func (b *MQTTBroker) authorizeSubscribe(clientID, username, filter string) bool {
+	if !b.config.Provisioning {
+		return true
+	}
+	if b.isProvisioningClient(username) {
+		return filter == pairReplyPrefix+clientID
+	}
+	return filter == commandTopicPrefix+username || filter == configTopic
+}
+
+// isProvisioningClient reports whether username is the shared account
+// that unprovisioned readers connect with
+func (b *MQTTBroker) isProvisioningClient(username string) bool {
+	return username == b.config.Username
+}
+
+// trusted reports whether msg may speak for deviceID. With provisioning
+// enabled it must come from that reader's own approved credentials.
+func (b *MQTTBroker) trusted(msg mqtt.Message, deviceID string) bool {
+	if !b.certified(msg, deviceID) {
+		return false
+	}
+	if !b.config.Provisioning {
+		return true
+	}
+	if msg.Username != deviceID || b.isProvisioningClient(msg.Username) {
+		logger.Warn("Ignoring message for another device", "topic", msg.Topic, "device_id", deviceID, "client_id", msg.ClientID)
+		return false
+	}
+	return b.store.IsApproved(deviceID)
+}
+
+// certified reports whether msg may speak for deviceID under mutual TLS,
+// where the common name of the client certificate is the device ID
+func (b *MQTTBroker) certified(msg mqtt.Message, deviceID string) bool {
+	if !b.config.RequireClientCert {
+		return true
+	}
+	if msg.CommonName == "" || msg.CommonName != deviceID {
+		logger.Warn("Ignoring message for another certificate", "topic", msg.Topic, "device_id", deviceID, "common_name", msg.CommonName, "client_id", msg.ClientID)
+		return false
+	}
+	return true
+}
+
+// handleRegister registers trusted readers and quarantines the rest
+func (b *MQTTBroker) handleRegister(msg mqtt.Message, device *ReaderDevice) {
+	if !b.certified(msg, device.DeviceID) {
+		return
+	}
+	if !b.config.Provisioning {
+		b.registerDevice(device)
+		return
+	}
+
+	if b.isProvisioningClient(msg.Username) {
+		if device.DeviceID == "" || device.DeviceID != msg.ClientID {
+			logger.Warn("Ignoring registration for another device", "device_id", device.DeviceID, "client_id", msg.ClientID)
+			return
+		}
+		if _, err := b.store.Request(*device); err != nil {
+			logger.Error("Failed to record device", "device_id", device.DeviceID, "error", err)
+			return
+		}
+		logger.Info("Device quarantined until approved", "device_id", device.DeviceID)
+		b.publishProvisioning(device.DeviceID, DevicePending)
+		return
+	}
+
+	if !b.trusted(msg, device.DeviceID) {
+		return
+	}
+	b.registerDevice(device)
+}
+
+// handlePair checks a pairing code and answers with a token
+func (b *MQTTBroker) handlePair(msg mqtt.Message) {
+	if !b.config.Provisioning {
+		return
+	}
+
+	var req pairRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		logger.Warn("Error unmarshaling pairing request", "client_id", msg.ClientID, "error", err)
+		return
+	}
+	if req.DeviceID == "" || req.DeviceID != msg.ClientID {
+		logger.Warn("Ignoring pairing request for another device", "device_id", req.DeviceID, "client_id", msg.ClientID)
+		return
+	}
+	if !b.certified(msg, req.DeviceID) {
+		return
+	}
+
+	if err := b.checkPairingCode(req.Code); err != nil {
+		logger.Warn("Pairing refused", "device_id", req.DeviceID, "error", err)
+		b.replyPairing(pairReply{DeviceID: req.DeviceID, Error: err.Error()})
+		return
+	}
+
+	token, err := b.ApproveDevice(req.DeviceID)
+	if err != nil {
+		logger.Error("Pairing failed", "device_id", req.DeviceID, "error", err)
+		b.replyPairing(pairReply{DeviceID: req.DeviceID, Error: "pairing failed"})
+		b.notifyPairing("")
+		return
+	}
+	logger.Info("Device paired", "device_id", req.DeviceID)
+	b.replyPairing(pairReply{DeviceID: req.DeviceID, Token: token})
+	b.notifyPairing(req.DeviceID)
+}
+
+// checkPairingCode consumes the pairing window if code matches it. Too
+// many wrong codes close the window.
+func (b *MQTTBroker) checkPairingCode(code string) error {
+	b.pairingMux.Lock()
+	p := b.pairing
+	if p == nil || time.Now().After(p.expires) {
+		b.pairingMux.Unlock()
+		return errors.New("pairing is not active")
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(p.code)) == 1 {
+		b.pairingMux.Unlock()
+		if !b.endPairing(p) {
+			return errors.New("pairing is not active")
+		}
+		return nil
+	}
+	p.attempts++
+	exhausted := p.attempts >= maxPairingAttempts
+	b.pairingMux.Unlock()
+
+	if exhausted && b.endPairing(p) {
+		logger.Warn("Pairing window closed after too many wrong codes")
+		b.notifyPairing("")
+	}
+	return errors.New("invalid pairing code")
+}
+
+// endPairing closes p if it is still the active window
+func (b *MQTTBroker) endPairing(p *pairing) bool {
+	b.pairingMux.Lock()
+	defer b.pairingMux.Unlock()
+
+	if b.pairing != p {
+		return false
+	}
+	p.timer.Stop()
+	b.pairing = nil
+	return true
+}
+
+// notifyPairing calls the pairing handler
+func (b *MQTTBroker) notifyPairing(deviceID string) {
+	if b.pairingHandler != nil {
+		b.pairingHandler(deviceID)
+	}
+}
+
+// replyPairing publishes the outcome of a pairing request to the reader
+func (b *MQTTBroker) replyPairing(reply pairReply) {
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		logger.Error("Failed to encode pairing reply", "error", err)
+		return
+	}
+	if err := b.server.Publish(pairReplyPrefix+reply.DeviceID, payload, 1, false); err != nil {
+		logger.Error("Failed to send pairing reply", "device_id", reply.DeviceID, "error", err)
+	}
+}
+
+// publishProvisioning publishes a change of a reader's provisioning state
+func (b *MQTTBroker) publishProvisioning(deviceID, state string) {
+	b.devicesMux.RLock()
+	bus := b.events
+	b.devicesMux.RUnlock()
+	bus.Publish(events.TypeReader, events.ReaderData{DeviceID: deviceID, Status: state})
+}
+
+// newPairingCode returns a code of digits 1 to 9, so each digit can be
+// shown as a number of lit LEDs
+func newPairingCode() (string, error) {
+	code := make([]byte, pairingCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(9))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate pairing code: %w", err)
+		}
+		code[i] = byte('1' + n.Int64())
+	}
+	return string(code), nil
+}
@@ -0,0 +1,323 @@
+package network
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newProvisioningBroker serves a broker with provisioning enabled, the
+// shared account fizhub and FIZR001 approved, and returns FIZR001's token
+func newProvisioningBroker(t *testing.T, pairings chan<- string) (*MQTTBroker, string, string) {
+	t.Helper()
+	b := NewMQTTBroker(MQTTConfig{Username: "fizhub", Password: "secret", Provisioning: true})
+	b.SetDeviceStore(openDeviceStore(t, t.TempDir()))
+	token, err := b.ApproveDevice("FIZR001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairings != nil {
+		b.SetPairingHandler(func(deviceID string) { pairings <- deviceID })
+	}
+	return b, startTestBroker(t, b), token
+}
+
+// deviceState returns the provisioning state of a reader in the store
+func deviceState(b *MQTTBroker, deviceID string) string {
+	for _, record := range b.store.List() {
+		if record.DeviceID == deviceID {
+			return record.State
+		}
+	}
+	return ""
+}
+
+// pair publishes a pairing code as deviceID and returns the reply
+func pair(t *testing.T, r *testReader, deviceID, code string) pairReply {
+	t.Helper()
+	r.publish(pairTopic, pairRequest{DeviceID: deviceID, Code: code})
+	topic, payload := r.readPublish()
+	var reply pairReply
+	if err := json.Unmarshal(payload, &reply); err != nil || topic != pairReplyPrefix+deviceID {
+		t.Fatalf("bad pairing reply on %s: %s", topic, payload)
+	}
+	return reply
+}
+
+// joinReader connects deviceID with the shared account and waits for its
+// pairing replies
+func joinReader(t *testing.T, b *MQTTBroker, addr, deviceID string) *testReader {
+	t.Helper()
+	r := dialReader(t, addr).mustConnect(deviceID, b.config.Username, b.config.Password)
+	if !r.subscribe(pairReplyPrefix + deviceID) {
+		t.Fatalf("%s may not wait for its pairing reply", deviceID)
+	}
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := openDeviceStore(t, t.TempDir())
+	token, err := store.Approve("FIZR001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Request(ReaderDevice{DeviceID: "FIZR002"}); err != nil {
+		t.Fatal(err)
+	}
+
+	anonymous := MQTTConfig{}
+	shared := MQTTConfig{Username: "fizhub", Password: "secret"}
+	provisioning := MQTTConfig{Username: "fizhub", Password: "secret", Provisioning: true}
+	certs := MQTTConfig{RequireClientCert: true}
+	tests := []struct {
+		name       string
+		config     MQTTConfig
+		clientID   string
+		username   string
+		password   string
+		commonName string
+		want       bool
+	}{
+		{"anonymous broker", anonymous, "FIZR001", "", "", "", true},
+		{"anonymous broker with credentials", anonymous, "FIZR001", "anyone", "anything", "", true},
+		{"shared account", shared, "FIZR001", "fizhub", "secret", "", true},
+		{"wrong password", shared, "FIZR001", "fizhub", "wrong", "", false},
+		{"wrong username", shared, "FIZR001", "admin", "secret", "", false},
+		{"no credentials", shared, "FIZR001", "", "", "", false},
+		{"provisioning shared account", provisioning, "FIZR009", "fizhub", "secret", "", true},
+		{"provisioning wrong password", provisioning, "FIZR009", "fizhub", "wrong", "", false},
+		{"approved reader", provisioning, "FIZR001", "FIZR001", token, "", true},
+		{"approved reader wrong token", provisioning, "FIZR001", "FIZR001", "wrong", "", false},
+		{"approved reader wrong client ID", provisioning, "FIZR002", "FIZR001", token, "", false},
+		{"pending reader", provisioning, "FIZR002", "FIZR002", token, "", false},
+		{"unknown reader", provisioning, "FIZR404", "FIZR404", token, "", false},
+		{"certificate", certs, "FIZR001", "", "", "FIZR001", true},
+		{"no certificate", certs, "FIZR001", "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMQTTBroker(tt.config)
+			b.SetDeviceStore(store)
+			if got := b.authenticate(tt.clientID, tt.username, tt.password, tt.commonName); got != tt.want {
+				t.Fatalf("authenticate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisioningConnect(t *testing.T) {
+	_, addr, token := newProvisioningBroker(t, nil)
+	tests := []struct {
+		name     string
+		clientID string
+		username string
+		password string
+		want     byte
+	}{
+		{"shared account", "FIZR002", "fizhub", "secret", 0},
+		{"shared account wrong password", "FIZR002", "fizhub", "wrong", 4},
+		{"approved reader", "FIZR001", "FIZR001", token, 0},
+		{"approved reader wrong token", "FIZR001", "FIZR001", "wrong", 4},
+		{"wrong client ID", "FIZR002", "FIZR001", token, 4},
+		{"anonymous", "FIZR002", "", "", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dialReader(t, addr).connect(tt.clientID, tt.username, tt.password); got != tt.want {
+				t.Fatalf("CONNACK code %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharedAccountCanOnlyAskToJoin(t *testing.T) {
+	b, addr, _ := newProvisioningBroker(t, nil)
+	taps := make(chan UIDMessage, 1)
+	b.SetUIDHandler(func(msg UIDMessage) { taps <- msg })
+
+	r := joinReader(t, b, addr, "FIZR002")
+	for _, filter := range []string{pairReplyPrefix + "FIZR003", commandTopicPrefix + "FIZR002", configTopic, "fiz/#"} {
+		if r.subscribe(filter) {
+			t.Errorf("shared account subscribed to %s", filter)
+		}
+	}
+
+	// Registering quarantines the reader
+	r.publish("fiz/register", ReaderDevice{DeviceID: "FIZR002", Type: "fiz_reader"})
+	waitFor(t, "FIZR002 to be pending", func() bool { return deviceState(b, "FIZR002") == DevicePending })
+	if got := deviceStatus(b, "FIZR002"); got != "" {
+		t.Fatalf("pending reader is %s", got)
+	}
+
+	// Nothing else gets through, and the reader cannot register another
+	r.publish("fiz/uid", UIDMessage{DeviceID: "FIZR002", UID: "04a1b2c3", Timestamp: time.Now().UnixNano() / int64(time.Millisecond)})
+	r.publish("fiz/register", ReaderDevice{DeviceID: "FIZR003", Type: "fiz_reader"})
+	r.publish(heartbeatTopic, heartbeat{DeviceID: "FIZR001"})
+	select {
+	case msg := <-taps:
+		t.Fatalf("tap from the shared account accepted: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := deviceState(b, "FIZR003"); got != "" {
+		t.Fatalf("FIZR003 registered by FIZR002 is %s", got)
+	}
+}
+
+func TestApprovedReaderTopics(t *testing.T) {
+	b, addr, token := newProvisioningBroker(t, nil)
+	token2, err := b.ApproveDevice("FIZR002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taps := make(chan UIDMessage, 2)
+	b.SetUIDHandler(func(msg UIDMessage) { taps <- msg })
+
+	r := dialReader(t, addr).mustConnect("FIZR001", "FIZR001", token)
+	for _, filter := range []string{commandTopicPrefix + "FIZR002", commandTopicPrefix + "+", pairReplyPrefix + "FIZR001"} {
+		if r.subscribe(filter) {
+			t.Errorf("FIZR001 subscribed to %s", filter)
+		}
+	}
+	if !r.subscribe(commandTopicPrefix+"FIZR001") || !r.subscribe(configTopic) {
+		t.Fatal("FIZR001 may not subscribe to its commands and settings")
+	}
+	if topic, _ := r.readPublish(); topic != configTopic {
+		t.Fatalf("got %s, want the retained settings", topic)
+	}
+
+	r.publish("fiz/register", ReaderDevice{DeviceID: "FIZR001", Type: "fiz_reader"})
+	waitFor(t, "FIZR001 to register", func() bool { return deviceStatus(b, "FIZR001") == StatusOnline })
+
+	// A tap for another approved reader is ignored, the reader's own is not
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	r.publish("fiz/uid", UIDMessage{DeviceID: "FIZR002", UID: "04d4e5f6", Timestamp: now})
+	r.publish("fiz/register", ReaderDevice{DeviceID: "FIZR002", Type: "fiz_reader"})
+	r.publish("fiz/uid", UIDMessage{DeviceID: "FIZR001", UID: "04a1b2c3", Timestamp: now})
+	select {
+	case msg := <-taps:
+		if msg.DeviceID != "FIZR001" {
+			t.Fatalf("tap for %s accepted from FIZR001", msg.DeviceID)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("own tap not received")
+	}
+	if got := deviceStatus(b, "FIZR002"); got != "" {
+		t.Fatalf("FIZR002 registered by FIZR001 is %s", got)
+	}
+
+	// Revoking a reader disconnects it and its token stops working
+	dialReader(t, addr).mustConnect("FIZR002", "FIZR002", token2)
+	if err := b.RevokeDevice("FIZR001"); err != nil {
+		t.Fatal(err)
+	}
+	r.expectClosed()
+	if got := dialReader(t, addr).connect("FIZR001", "FIZR001", token); got != 4 {
+		t.Fatalf("CONNACK code %d with a revoked token", got)
+	}
+}
+
+func TestPairingApproves(t *testing.T) {
+	pairings := make(chan string, 1)
+	b, addr, _ := newProvisioningBroker(t, pairings)
+	code, expires, err := b.StartPairing(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != pairingCodeLength || time.Until(expires) <= 0 {
+		t.Fatalf("code %q expires %v", code, expires)
+	}
+	if _, _, err := b.StartPairing(time.Minute); err != ErrPairingActive {
+		t.Fatalf("second window error %v, want %v", err, ErrPairingActive)
+	}
+
+	r := joinReader(t, b, addr, "FIZR002")
+	r.publish("fiz/register", ReaderDevice{DeviceID: "FIZR002", Type: "fiz_reader"})
+	reply := pair(t, r, "FIZR002", code)
+	if reply.Token == "" || reply.Error != "" {
+		t.Fatalf("reply %+v", reply)
+	}
+	if got := <-pairings; got != "FIZR002" {
+		t.Fatalf("paired %q", got)
+	}
+	if got := deviceState(b, "FIZR002"); got != DeviceApproved {
+		t.Fatalf("FIZR002 is %s", got)
+	}
+
+	// The code works once
+	other := joinReader(t, b, addr, "FIZR003")
+	if reply := pair(t, other, "FIZR003", code); reply.Token != "" || reply.Error != "pairing is not active" {
+		t.Fatalf("reused code gave %+v", reply)
+	}
+
+	// The reader reconnects as itself with the token
+	paired := dialReader(t, addr).mustConnect("FIZR002", "FIZR002", reply.Token)
+	paired.publish("fiz/register", ReaderDevice{DeviceID: "FIZR002", Type: "fiz_reader"})
+	waitFor(t, "FIZR002 to register", func() bool { return deviceStatus(b, "FIZR002") == StatusOnline })
+}
+
+func TestPairingDenies(t *testing.T) {
+	pairings := make(chan string, 1)
+	b, addr, _ := newProvisioningBroker(t, pairings)
+	code, _, err := b.StartPairing(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Codes only use the digits 1 to 9
+	wrong := "0000"
+
+	r := joinReader(t, b, addr, "FIZR002")
+
+	// A request for another reader is not answered
+	r.publish(pairTopic, pairRequest{DeviceID: "FIZR003", Code: code})
+	r.expectNothing()
+
+	for i := 0; i < maxPairingAttempts; i++ {
+		if reply := pair(t, r, "FIZR002", wrong); reply.Token != "" || reply.Error != "invalid pairing code" {
+			t.Fatalf("attempt %d gave %+v", i, reply)
+		}
+	}
+	if got := <-pairings; got != "" {
+		t.Fatalf("window closed with %q", got)
+	}
+	if reply := pair(t, r, "FIZR002", code); reply.Token != "" || reply.Error != "pairing is not active" {
+		t.Fatalf("right code after too many wrong ones gave %+v", reply)
+	}
+	if got := deviceState(b, "FIZR002"); got == DeviceApproved {
+		t.Fatal("FIZR002 approved")
+	}
+}
+
+func TestPairingTimeout(t *testing.T) {
+	pairings := make(chan string, 1)
+	b, addr, _ := newProvisioningBroker(t, pairings)
+	code, _, err := b.StartPairing(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-pairings:
+		if got != "" {
+			t.Fatalf("window ended with %q", got)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("pairing window did not expire")
+	}
+
+	r := joinReader(t, b, addr, "FIZR002")
+	if reply := pair(t, r, "FIZR002", code); reply.Token != "" || reply.Error != "pairing is not active" {
+		t.Fatalf("expired code gave %+v", reply)
+	}
+
+	// A new window can be opened
+	if _, _, err := b.StartPairing(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPairingNeedsProvisioning(t *testing.T) {
+	b := NewMQTTBroker(MQTTConfig{})
+	if _, _, err := b.StartPairing(time.Minute); err == nil {
+		t.Fatal("pairing started without provisioning")
+	}
+}
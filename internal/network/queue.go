@@ -0,0 +1,352 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PendingValidation is a validation request waiting to be sent to Cursive
+type PendingValidation struct {
+	ID          string            `json:"id"`
+	Request     ValidationRequest `json:"request"`
+	QueuedAt    time.Time         `json:"queued_at"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"next_attempt"`
+	LastError   string            `json:"last_error,omitempty"`
+}
+
+// ValidationAudit records the final outcome of a queued validation
+type ValidationAudit struct {
+	PendingValidation
+	CompletedAt time.Time           `json:"completed_at"`
+	Response    *ValidationResponse `json:"response,omitempty"`
+	Expired     bool                `json:"expired,omitempty"`
+	// Dropped marks a request that Cursive refused, which is not retried.
+	// LastError holds the refusal.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// QueueConfig holds configuration for the offline validation queue
+type QueueConfig struct {
+	// Dir holds the queue file and the audit log
+	Dir          string
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	MaxAge       time.Duration
+	PollInterval time.Duration
+}
+
+const (
+	queueFileName = "pending_validations.json"
+	auditFileName = "validation_audit.jsonl"
+)
+
+// ValidationQueue persists validation requests that could not be sent and
+// retries them in the background with exponential backoff
+type ValidationQueue struct {
+	config        QueueConfig
+	client        *Client
+	mutex         sync.Mutex
+	pending       []*PendingValidation
+	resultHandler func(ValidationAudit)
+	wake          chan struct{}
+}
+
+// NewValidationQueue creates a queue and loads any requests left over from
+// a previous run
+func NewValidationQueue(client *Client, config QueueConfig) (*ValidationQueue, error) {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 5 * time.Second
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 5 * time.Minute
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = 72 * time.Hour
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	q := &ValidationQueue{
+		config: config,
+		client: client,
+		wake:   make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if len(q.pending) > 0 {
+		cursiveLogger.Info("Loaded pending validations", "count", len(q.pending))
+	}
+	return q, nil
+}
+
+// Start begins retrying queued requests
+func (q *ValidationQueue) Start(ctx context.Context) error {
+	go q.run(ctx)
+	return nil
+}
+
+// SetResultHandler sets the callback for completed or expired requests
+func (q *ValidationQueue) SetResultHandler(handler func(ValidationAudit)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.resultHandler = handler
+}
+
+// Enqueue stores a request for later delivery
+func (q *ValidationQueue) Enqueue(request ValidationRequest) (*PendingValidation, error) {
+	now := time.Now()
+	entry := &PendingValidation{
+		ID:          newQueueID(),
+		Request:     request,
+		QueuedAt:    now,
+		NextAttempt: now.Add(q.config.MinBackoff),
+	}
+
+	q.mutex.Lock()
+	q.pending = append(q.pending, entry)
+	err := q.save()
+	q.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cursiveLogger.Info("Queued validation", "id", entry.ID, "uids", request.UIDs)
+	return entry, nil
+}
+
+// Pending returns a snapshot of the queued requests
+func (q *ValidationQueue) Pending() []PendingValidation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pending := make([]PendingValidation, len(q.pending))
+	for i, entry := range q.pending {
+		pending[i] = *entry
+	}
+	return pending
+}
+
+// RetryNow schedules every queued request for an immediate attempt
+func (q *ValidationQueue) RetryNow() {
+	q.mutex.Lock()
+	now := time.Now()
+	for _, entry := range q.pending {
+		entry.NextAttempt = now
+	}
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run retries due requests until ctx is cancelled
+func (q *ValidationQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(q.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+		q.processDue(ctx)
+	}
+}
+
+// processDue attempts every request whose backoff has elapsed. A failure
+// stops the pass so an outage costs one request per tick, not the queue.
+func (q *ValidationQueue) processDue(ctx context.Context) {
+	for {
+		entry := q.nextDue()
+		if entry == nil {
+			return
+		}
+
+		if time.Since(entry.QueuedAt) > q.config.MaxAge {
+			cursiveLogger.Warn("Validation expired before it could be sent", "id", entry.ID)
+			q.complete(entry, nil)
+			continue
+		}
+
+		resp, err := q.client.Validate(ctx, entry.Request)
+		if err != nil && !IsRetryable(err) {
+			cursiveLogger.Warn("Queued validation refused, dropping it", "id", entry.ID, "error", err)
+			q.drop(entry, err)
+			continue
+		}
+		if err != nil {
+			q.fail(entry, err)
+			return
+		}
+
+		cursiveLogger.Info("Queued validation completed", "id", entry.ID, "valid", resp.Valid)
+		q.complete(entry, resp)
+	}
+}
+
+// nextDue returns the oldest request that is ready to be retried
+func (q *ValidationQueue) nextDue() *PendingValidation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	for _, entry := range q.pending {
+		if !entry.NextAttempt.After(now) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// fail records a failed attempt and doubles the backoff
+func (q *ValidationQueue) fail(entry *PendingValidation, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+	backoff := retryBackoff(q.config, entry.Attempts)
+	entry.NextAttempt = time.Now().Add(backoff)
+	cursiveLogger.Warn("Validation retry failed", "id", entry.ID, "attempt", entry.Attempts, "next_in", backoff, "error", err)
+
+	if err := q.save(); err != nil {
+		cursiveLogger.Error("Failed to save validation queue", "error", err)
+	}
+}
+
+// complete removes entry from the queue and writes its audit record. A nil
+// response marks the request as expired.
+func (q *ValidationQueue) complete(entry *PendingValidation, resp *ValidationResponse) {
+	q.mutex.Lock()
+	if resp != nil {
+		entry.Attempts++
+	}
+	q.finish(entry, ValidationAudit{Response: resp, Expired: resp == nil})
+}
+
+// drop removes a request that Cursive refused and writes its audit record
+func (q *ValidationQueue) drop(entry *PendingValidation, err error) {
+	q.mutex.Lock()
+	entry.Attempts++
+	entry.LastError = err.Error()
+	q.finish(entry, ValidationAudit{Dropped: true})
+}
+
+// finish removes entry from the queue, writes audit and notifies the result
+// handler. Callers must hold the mutex, which finish releases.
+func (q *ValidationQueue) finish(entry *PendingValidation, audit ValidationAudit) {
+	audit.PendingValidation = *entry
+	audit.CompletedAt = time.Now()
+	for i, e := range q.pending {
+		if e == entry {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	if err := q.save(); err != nil {
+		cursiveLogger.Error("Failed to save validation queue", "error", err)
+	}
+	if err := q.appendAudit(audit); err != nil {
+		cursiveLogger.Error("Failed to write validation audit", "error", err)
+	}
+	handler := q.resultHandler
+	q.mutex.Unlock()
+
+	if handler != nil {
+		handler(audit)
+	}
+}
+
+// load reads the queue file if it exists
+func (q *ValidationQueue) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(q.config.Dir, queueFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read validation queue: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.pending); err != nil {
+		return fmt.Errorf("failed to decode validation queue: %w", err)
+	}
+	return nil
+}
+
+// save atomically rewrites the queue file. Callers must hold the mutex.
+func (q *ValidationQueue) save() error {
+	data, err := json.MarshalIndent(q.pending, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode validation queue: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(q.config.Dir, queueFileName), data)
+}
+
+// appendAudit appends a record to the audit log. Callers must hold the mutex.
+func (q *ValidationQueue) appendAudit(audit ValidationAudit) error {
+	file, err := os.OpenFile(filepath.Join(q.config.Dir, auditFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(audit)
+}
+
+// retryBackoff returns the delay before the next attempt, doubling from
+// MinBackoff up to MaxBackoff
+func retryBackoff(config QueueConfig, attempts int) time.Duration {
+	backoff := config.MinBackoff << uint(attempts)
+	if backoff <= 0 || backoff > config.MaxBackoff {
+		backoff = config.MaxBackoff
+	}
+	return backoff
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// newQueueID creates a random identifier for a queued request
+func newQueueID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestQueue returns a queue whose requests are answered with status
+func newTestQueue(t *testing.T, status int) *ValidationQueue {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			json.NewEncoder(w).Encode(ValidationResponse{Valid: true})
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(ClientConfig{BaseURL: server.URL, Timeout: time.Second})
+	q, err := NewValidationQueue(client, QueueConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// retryOnce makes every queued request due and attempts them
+func retryOnce(q *ValidationQueue) {
+	q.RetryNow()
+	<-q.wake
+	q.processDue(context.Background())
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{StatusCode: http.StatusBadRequest}, false},
+		{&StatusError{StatusCode: http.StatusUnprocessableEntity}, false},
+		{&StatusError{StatusCode: http.StatusRequestTimeout}, true},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&StatusError{StatusCode: http.StatusBadGateway}, true},
+		{context.DeadlineExceeded, true},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestQueueDropsRefusedRequests(t *testing.T) {
+	q := newTestQueue(t, http.StatusBadRequest)
+	audits := make(chan ValidationAudit, 1)
+	q.SetResultHandler(func(audit ValidationAudit) { audits <- audit })
+
+	if _, err := q.Enqueue(ValidationRequest{UIDs: []string{"04a1"}}); err != nil {
+		t.Fatal(err)
+	}
+	retryOnce(q)
+
+	if n := len(q.Pending()); n != 0 {
+		t.Fatalf("%d requests still queued", n)
+	}
+	audit := <-audits
+	if !audit.Dropped || audit.Expired || audit.Attempts != 1 || !strings.Contains(audit.LastError, "400") {
+		t.Fatalf("unexpected audit %+v", audit)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(q.config.Dir, auditFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"dropped":true`) {
+		t.Fatalf("audit log does not record the drop: %s", data)
+	}
+}
+
+func TestQueueRetriesServerErrors(t *testing.T) {
+	q := newTestQueue(t, http.StatusServiceUnavailable)
+	if _, err := q.Enqueue(ValidationRequest{UIDs: []string{"04a1"}}); err != nil {
+		t.Fatal(err)
+	}
+	retryOnce(q)
+
+	pending := q.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 {
+		t.Fatalf("unexpected queue %+v", pending)
+	}
+	if !pending[0].NextAttempt.After(time.Now()) {
+		t.Fatal("failed request was not backed off")
+	}
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"fizhub/internal/nfc"
+)
+
+func TestSignedTapCoversEveryField(t *testing.T) {
+	msg := UIDMessage{
+		DeviceID:  "FIZR001",
+		UID:       "04de5f1eacc040",
+		Timestamp: 1700000000000,
+		TagType:   "ntag424",
+		ATQA:      "0344",
+		SAK:       "20",
+		NDEF:      "d1010f55",
+		RSSI:      -60,
+		SUN:       nfc.SUN{PICCData: "EF963FF7828658A599F3041510671E88", CMAC: "94EED9EE65337086"},
+	}
+	want := "FIZR001\n04de5f1eacc040\n1700000000000\nntag424\n0344\n20\nd1010f55\n-60\nEF963FF7828658A599F3041510671E88\n94EED9EE65337086"
+	if got := signedTap(msg); got != want {
+		t.Fatalf("signedTap = %q, want %q", got, want)
+	}
+
+	signature := SignTap("key", msg)
+	tampered := []func(*UIDMessage){
+		func(m *UIDMessage) { m.DeviceID = "FIZR002" },
+		func(m *UIDMessage) { m.UID = "04de5f1eacc041" },
+		func(m *UIDMessage) { m.Timestamp++ },
+		func(m *UIDMessage) { m.TagType = "mifare_classic" },
+		func(m *UIDMessage) { m.ATQA = "0004" },
+		func(m *UIDMessage) { m.SAK = "08" },
+		func(m *UIDMessage) { m.NDEF = "" },
+		func(m *UIDMessage) { m.RSSI = 0 },
+		func(m *UIDMessage) { m.PICCData = "" },
+		func(m *UIDMessage) { m.CMAC = "0000000000000000" },
+	}
+	for i, tamper := range tampered {
+		changed := msg
+		tamper(&changed)
+		if SignTap("key", changed) == signature {
+			t.Errorf("change %d does not alter the signature", i)
+		}
+	}
+}
+
+func TestSignedTapOfBareMessage(t *testing.T) {
+	// The encoding the reader sketch signs for a tap without metadata
+	msg := UIDMessage{DeviceID: "FIZR001", UID: "ec586341127a6414", Timestamp: 1700000000000}
+	want := "FIZR001\nec586341127a6414\n1700000000000\n\n\n\n\n0\n\n"
+	if got := signedTap(msg); got != want {
+		t.Fatalf("signedTap = %q, want %q", got, want)
+	}
+}
+
+func TestCanonicalRejectsNewlines(t *testing.T) {
+	// Moving a newline between fields would keep the encoding
+	a := UIDMessage{DeviceID: "FIZR001", UID: "04a1", TagType: "ntag\n0344"}
+	b := UIDMessage{DeviceID: "FIZR001", UID: "04a1", TagType: "ntag", ATQA: "0344\n"}
+	if canonical(a) || canonical(b) {
+		t.Fatal("message with a newline taken as canonical")
+	}
+	if !canonical(UIDMessage{DeviceID: "FIZR001", UID: "04a1"}) {
+		t.Fatal("plain message not canonical")
+	}
+}
+
+func TestVerifyTap(t *testing.T) {
+	store, err := NewDeviceStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.IssueSigningKey("FIZR001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewMQTTBroker(MQTTConfig{})
+	b.store = store
+
+	now := time.Unix(1700000000, 0)
+	signed := func(msg UIDMessage) UIDMessage {
+		msg.Signature = SignTap(key, msg)
+		return msg
+	}
+	base := UIDMessage{DeviceID: "FIZR001", UID: "04a1", Timestamp: now.UnixNano() / int64(time.Millisecond), RSSI: -50}
+
+	tests := []struct {
+		name string
+		msg  UIDMessage
+		want string
+	}{
+		{"valid", signed(base), ""},
+		{"unsigned", base, TapDropUnsigned},
+		{"expired", signed(UIDMessage{DeviceID: "FIZR001", UID: "04a1", Timestamp: base.Timestamp - 60000}), TapDropExpired},
+		{"rssi changed", func() UIDMessage { m := signed(base); m.RSSI = -20; return m }(), TapDropBadSignature},
+		{"sun added", func() UIDMessage { m := signed(base); m.CMAC = "94EED9EE65337086"; return m }(), TapDropBadSignature},
+		{"newline", signed(UIDMessage{DeviceID: "FIZR001", UID: "04a1", NDEF: "d1\n", Timestamp: base.Timestamp}), TapDropBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.verifyTap(tt.msg, now); got != tt.want {
+				t.Fatalf("verifyTap = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"fizhub/internal/logging"
+	"fizhub/internal/nfc"
+)
+
+// tagLogger is the component logger of the tag verifier
+var tagLogger = logging.For("tags")
+
+// tagCounterFileName is the read counter file inside the data directory
+const tagCounterFileName = "tag_counters.json"
+
+// maxSeenPICCData bounds the PICC data remembered per tag when the read
+// counter cannot be decrypted
+const maxSeenPICCData = 64
+
+// SUN verification modes
+const (
+	// SUNVerifyOff passes SUN data on to Cursive unchecked
+	SUNVerifyOff = ""
+	// SUNVerifyLocal checks SUN data with the keys in the tag key file
+	SUNVerifyLocal = "local"
+	// SUNVerifyCursive leaves checking SUN data to Cursive. The read
+	// counter is encrypted, so the hub only rejects PICC data it has
+	// seen among a tag's recent taps.
+	SUNVerifyCursive = "cursive"
+)
+
+var (
+	ErrSUNRequired = errors.New("tag did not present SUN data")
+	ErrSUNInvalid  = errors.New("tag SUN data is not genuine")
+	ErrSUNReplayed = errors.New("tag SUN data was replayed")
+)
+
+// TagKeys are the NTAG 424 DNA keys that SUN data is verified with
+type TagKeys struct {
+	// MetaReadKey decrypts the PICC data of every tag
+	MetaReadKey string `json:"meta_read_key"`
+	// FileReadKeys are the per-tag CMAC keys by UID
+	FileReadKeys map[string]string `json:"file_read_keys"`
+}
+
+// TagVerifierConfig holds SUN verification configuration
+type TagVerifierConfig struct {
+	// Mode is SUNVerifyOff, SUNVerifyLocal or SUNVerifyCursive
+	Mode string
+	// KeyFile holds the TagKeys for SUNVerifyLocal
+	KeyFile string
+	// Require rejects taps without SUN data
+	Require bool
+	// Dir is where read counters are kept
+	Dir string
+}
+
+// tagCounter is the last SUN data accepted from a tag
+type tagCounter struct {
+	Counter  uint32 `json:"counter,omitempty"`
+	PICCData string `json:"picc_data,omitempty"`
+	// EarlierPICCData holds the PICC data of the tag's taps before the
+	// last, oldest first
+	EarlierPICCData []string  `json:"earlier_picc_data,omitempty"`
+	SeenAt          time.Time `json:"seen_at"`
+}
+
+// seen reports whether piccData was accepted from the tag before
+func (c *tagCounter) seen(piccData string) bool {
+	if piccData == c.PICCData {
+		return true
+	}
+	for _, earlier := range c.EarlierPICCData {
+		if piccData == earlier {
+			return true
+		}
+	}
+	return false
+}
+
+// TagVerifier checks that taps come from genuine NTAG 424 DNA tags and
+// rejects replayed SUN data
+type TagVerifier struct {
+	config       TagVerifierConfig
+	metaReadKey  []byte
+	fileReadKeys map[string][]byte
+	path         string
+	mutex        sync.Mutex
+	counters     map[string]*tagCounter
+}
+
+// ReadTagKeys reads a tag key file and checks that its keys decode
+func ReadTagKeys(path string) (TagKeys, error) {
+	var keys TagKeys
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return keys, fmt.Errorf("failed to read tag key file: %w", err)
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return keys, fmt.Errorf("failed to decode tag key file: %w", err)
+	}
+	if _, _, err := keys.decode(); err != nil {
+		return keys, err
+	}
+	return keys, nil
+}
+
+// decode returns the meta read key and the file read keys by lowercase UID
+func (k TagKeys) decode() ([]byte, map[string][]byte, error) {
+	metaReadKey, err := nfc.ParseKey(k.MetaReadKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("meta_read_key: %w", err)
+	}
+	fileReadKeys := make(map[string][]byte, len(k.FileReadKeys))
+	for uid, s := range k.FileReadKeys {
+		key, err := nfc.ParseKey(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("file_read_keys.%s: %w", uid, err)
+		}
+		fileReadKeys[strings.ToLower(uid)] = key
+	}
+	return metaReadKey, fileReadKeys, nil
+}
+
+// NewTagVerifier loads the tag keys and the read counters saved in
+// config.Dir
+func NewTagVerifier(config TagVerifierConfig) (*TagVerifier, error) {
+	v := &TagVerifier{
+		config:   config,
+		path:     filepath.Join(config.Dir, tagCounterFileName),
+		counters: make(map[string]*tagCounter),
+	}
+	if config.Mode == SUNVerifyOff {
+		return v, nil
+	}
+
+	if config.Mode == SUNVerifyLocal {
+		keys, err := ReadTagKeys(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.metaReadKey, v.fileReadKeys, _ = keys.decode()
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tag counter directory: %w", err)
+	}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	tagLogger.Info("SUN verification enabled", "mode", config.Mode, "keys", len(v.fileReadKeys), "require", config.Require)
+	return v, nil
+}
+
+// Verify checks the SUN data of a tap and returns the UID to use for it.
+// Locally verified taps take the UID from their PICC data, since tags
+// with random IDs report a different UID on every tap.
+func (v *TagVerifier) Verify(uid string, sun nfc.SUN) (string, error) {
+	if !sun.Present() {
+		if v.config.Require {
+			return "", ErrSUNRequired
+		}
+		return uid, nil
+	}
+
+	switch v.config.Mode {
+	case SUNVerifyLocal:
+		data, err := nfc.DecryptPICCData(v.metaReadKey, sun.PICCData)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrSUNInvalid, err)
+		}
+		tagUID := data.UIDString()
+		key, ok := v.fileReadKeys[tagUID]
+		if !ok {
+			return "", fmt.Errorf("%w: no file read key for the tag", ErrSUNInvalid)
+		}
+		if err := nfc.VerifySUNMAC(key, data, sun.CMAC); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrSUNInvalid, err)
+		}
+		if uid != "" && uid != tagUID {
+			tagLogger.Debug("Tag reported a random UID", "uid", tagUID)
+		}
+		return tagUID, v.accept(tagUID, tagCounter{Counter: data.Counter})
+
+	case SUNVerifyCursive:
+		return uid, v.accept(uid, tagCounter{PICCData: sun.PICCData})
+
+	default:
+		return uid, nil
+	}
+}
+
+// accept records the SUN data of a tag unless it was seen before. Local
+// verification requires the read counter to go up; otherwise the PICC
+// data must differ from the tag's last maxSeenPICCData taps.
+func (v *TagVerifier) accept(uid string, next tagCounter) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if last, ok := v.counters[uid]; ok {
+		if v.config.Mode == SUNVerifyLocal && next.Counter <= last.Counter {
+			return fmt.Errorf("%w: read counter %d is not above %d", ErrSUNReplayed, next.Counter, last.Counter)
+		}
+		if v.config.Mode == SUNVerifyCursive {
+			if last.seen(next.PICCData) {
+				return ErrSUNReplayed
+			}
+			next.EarlierPICCData = append(last.EarlierPICCData, last.PICCData)
+			if n := len(next.EarlierPICCData) - (maxSeenPICCData - 1); n > 0 {
+				next.EarlierPICCData = append([]string{}, next.EarlierPICCData[n:]...)
+			}
+		}
+	}
+	next.SeenAt = time.Now()
+	v.counters[uid] = &next
+	return v.save()
+}
+
+// load reads the counter file if it exists
+func (v *TagVerifier) load() error {
+	data, err := ioutil.ReadFile(v.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tag counters: %w", err)
+	}
+	if err := json.Unmarshal(data, &v.counters); err != nil {
+		return fmt.Errorf("failed to decode tag counters: %w", err)
+	}
+	return nil
+}
+
+// save atomically rewrites the counter file. Callers must hold the mutex.
+func (v *TagVerifier) save() error {
+	data, err := json.MarshalIndent(v.counters, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tag counters: %w", err)
+	}
+	return writeFileAtomic(v.path, data)
+}
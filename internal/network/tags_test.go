@@ -0,0 +1,169 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fizhub/internal/nfc"
+)
+
+// The SUN example of NXP AN12196, made with all-zero SDM keys
+var exampleSUN = nfc.SUN{PICCData: "ef963ff7828658a599f3041510671e88", CMAC: "94eed9ee65337086"}
+
+const zeroKeyHex = "00000000000000000000000000000000"
+
+// newTagVerifier returns a verifier keeping its counters in dir. Local
+// verification knows the file read key of the AN12196 example tag.
+func newTagVerifier(t *testing.T, mode, dir string, require bool) *TagVerifier {
+	t.Helper()
+	config := TagVerifierConfig{Mode: mode, Require: require, Dir: dir}
+	if mode == SUNVerifyLocal {
+		config.KeyFile = filepath.Join(t.TempDir(), "tag_keys.json")
+		keys := `{"meta_read_key": "` + zeroKeyHex + `", "file_read_keys": {"04DE5F1EACC040": "` + zeroKeyHex + `"}}`
+		if err := os.WriteFile(config.KeyFile, []byte(keys), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := NewTagVerifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// piccData returns distinct made-up PICC data for Cursive verification
+func piccData(n int) string {
+	return fmt.Sprintf("%032x", n)
+}
+
+func TestLocalSUNVerification(t *testing.T) {
+	v := newTagVerifier(t, SUNVerifyLocal, t.TempDir(), true)
+
+	// The UID comes from the PICC data, not the reported one
+	uid, err := v.Verify("08a1b2c3", exampleSUN)
+	if err != nil || uid != "04de5f1eacc040" {
+		t.Fatalf("Verify = %q, %v", uid, err)
+	}
+	if _, err := v.Verify("04de5f1eacc040", exampleSUN); !errors.Is(err, ErrSUNReplayed) {
+		t.Fatalf("replayed tap error %v, want %v", err, ErrSUNReplayed)
+	}
+
+	tests := []struct {
+		name string
+		sun  nfc.SUN
+		want error
+	}{
+		{"wrong MAC", nfc.SUN{PICCData: exampleSUN.PICCData, CMAC: "94eed9ee65337087"}, ErrSUNInvalid},
+		{"no MAC", nfc.SUN{PICCData: exampleSUN.PICCData}, ErrSUNInvalid},
+		{"no PICC data", nfc.SUN{CMAC: exampleSUN.CMAC}, ErrSUNInvalid},
+		{"PICC data under another key", nfc.SUN{PICCData: piccData(1), CMAC: exampleSUN.CMAC}, ErrSUNInvalid},
+		{"no SUN data", nfc.SUN{}, ErrSUNRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTagVerifier(t, SUNVerifyLocal, t.TempDir(), true)
+			if _, err := v.Verify("04de5f1eacc040", tt.sun); !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalSUNCounter(t *testing.T) {
+	dir := t.TempDir()
+	v := newTagVerifier(t, SUNVerifyLocal, dir, false)
+	if _, err := v.Verify("", exampleSUN); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		counter uint32
+		want    error
+	}{
+		{61, ErrSUNReplayed},
+		{60, ErrSUNReplayed},
+		{62, nil},
+		{62, ErrSUNReplayed},
+		{100, nil},
+		{99, ErrSUNReplayed},
+	}
+	for _, tt := range tests {
+		if err := v.accept("04de5f1eacc040", tagCounter{Counter: tt.counter}); !errors.Is(err, tt.want) {
+			t.Errorf("counter %d error %v, want %v", tt.counter, err, tt.want)
+		}
+	}
+
+	// Counters survive a restart
+	restarted := newTagVerifier(t, SUNVerifyLocal, dir, false)
+	if err := restarted.accept("04de5f1eacc040", tagCounter{Counter: 100}); !errors.Is(err, ErrSUNReplayed) {
+		t.Fatalf("error %v after a restart, want %v", err, ErrSUNReplayed)
+	}
+}
+
+func TestCursiveSUNReplay(t *testing.T) {
+	dir := t.TempDir()
+	v := newTagVerifier(t, SUNVerifyCursive, dir, false)
+	tap := func(v *TagVerifier, uid string, n int) error {
+		_, err := v.Verify(uid, nfc.SUN{PICCData: piccData(n), CMAC: exampleSUN.CMAC})
+		return err
+	}
+
+	for n := 1; n <= 3; n++ {
+		if err := tap(v, "04a1b2c3d4e5f6", n); err != nil {
+			t.Fatalf("tap %d: %v", n, err)
+		}
+	}
+	// Any earlier tap is rejected, not only the last one
+	for n := 1; n <= 3; n++ {
+		if err := tap(v, "04a1b2c3d4e5f6", n); !errors.Is(err, ErrSUNReplayed) {
+			t.Fatalf("replayed tap %d error %v, want %v", n, err, ErrSUNReplayed)
+		}
+	}
+	// Other tags keep their own history
+	if err := tap(v, "04d4e5f6a1b2c3", 1); err != nil {
+		t.Fatalf("other tag: %v", err)
+	}
+
+	// Only the last maxSeenPICCData taps are remembered
+	for n := 4; n <= maxSeenPICCData+1; n++ {
+		if err := tap(v, "04a1b2c3d4e5f6", n); err != nil {
+			t.Fatalf("tap %d: %v", n, err)
+		}
+	}
+	if got := len(v.counters["04a1b2c3d4e5f6"].EarlierPICCData); got != maxSeenPICCData-1 {
+		t.Fatalf("%d earlier taps kept, want %d", got, maxSeenPICCData-1)
+	}
+
+	// The history survives a restart
+	restarted := newTagVerifier(t, SUNVerifyCursive, dir, false)
+	if err := tap(restarted, "04a1b2c3d4e5f6", 2); !errors.Is(err, ErrSUNReplayed) {
+		t.Fatalf("replayed tap error %v after a restart, want %v", err, ErrSUNReplayed)
+	}
+	if err := tap(restarted, "04a1b2c3d4e5f6", 1); err != nil {
+		t.Fatalf("forgotten tap: %v", err)
+	}
+}
+
+func TestCursiveSUNReadsOldCounters(t *testing.T) {
+	dir := t.TempDir()
+	old := `{"04a1b2c3d4e5f6": {"picc_data": "` + piccData(1) + `", "seen_at": "2026-05-01T12:00:00Z"}}`
+	if err := os.WriteFile(filepath.Join(dir, tagCounterFileName), []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v := newTagVerifier(t, SUNVerifyCursive, dir, false)
+	if _, err := v.Verify("04a1b2c3d4e5f6", nfc.SUN{PICCData: piccData(1)}); !errors.Is(err, ErrSUNReplayed) {
+		t.Fatalf("error %v, want %v", err, ErrSUNReplayed)
+	}
+}
+
+func TestSUNVerificationOff(t *testing.T) {
+	v := newTagVerifier(t, SUNVerifyOff, t.TempDir(), false)
+	for i := 0; i < 2; i++ {
+		if uid, err := v.Verify("04a1b2c3", exampleSUN); err != nil || uid != "04a1b2c3" {
+			t.Fatalf("Verify = %q, %v", uid, err)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordingUpload describes a bond message recording sent to Cursive.
+// UploadID and Offset track the server-side upload session so an
+// interrupted upload can be resumed.
+type RecordingUpload struct {
+	BondID      string   `json:"bond_id"`
+	Accounts    []string `json:"accounts,omitempty"`
+	UIDs        []string `json:"uids"`
+	Filename    string   `json:"filename"`
+	ContentType string   `json:"content_type"`
+	Size        int64    `json:"size"`
+	SHA256      string   `json:"sha256"`
+	UploadID    string   `json:"upload_id,omitempty"`
+	Offset      int64    `json:"offset"`
+}
+
+// uploadStatus is the server's view of an upload session
+type uploadStatus struct {
+	UploadID string `json:"upload_id"`
+	Offset   int64  `json:"offset"`
+}
+
+// UploadRecording uploads the file at path in chunks. The upload session is
+// created on the first call and resumed from the server's offset when
+// upload.UploadID is already set. progress is called after every chunk with
+// the updated upload so the caller can persist it.
+func (c *Client) UploadRecording(ctx context.Context, path string, upload *RecordingUpload, progress func(RecordingUpload)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	if upload.SHA256 == "" {
+		if err := describeRecording(file, upload); err != nil {
+			return err
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat recording: %w", err)
+	}
+	if info.Size() != upload.Size {
+		return fmt.Errorf("recording changed size from %d to %d bytes", upload.Size, info.Size())
+	}
+
+	if err := c.resumeUpload(ctx, upload); err != nil {
+		return err
+	}
+
+	buf := make([]byte, c.uploadChunkSize)
+	for upload.Offset < upload.Size {
+		n, err := file.ReadAt(buf, upload.Offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read recording: %w", err)
+		}
+		if n == 0 {
+			return errors.New("recording is shorter than expected")
+		}
+
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", upload.Offset, upload.Offset+int64(n)-1, upload.Size))
+
+		var status uploadStatus
+		if err := c.send(ctx, "PUT", "/api/recordings/uploads/"+upload.UploadID, bytes.NewReader(buf[:n]), header, &status); err != nil {
+			return fmt.Errorf("failed to upload chunk at offset %d: %w", upload.Offset, err)
+		}
+		if status.Offset <= upload.Offset || status.Offset > upload.Size {
+			return fmt.Errorf("server returned invalid offset %d", status.Offset)
+		}
+		upload.Offset = status.Offset
+
+		if progress != nil {
+			progress(*upload)
+		}
+	}
+
+	return nil
+}
+
+// resumeUpload creates an upload session, or asks the server how much of an
+// existing session it has received. A session the server no longer knows
+// about is replaced with a new one.
+func (c *Client) resumeUpload(ctx context.Context, upload *RecordingUpload) error {
+	if upload.UploadID != "" {
+		var status uploadStatus
+		err := c.doWithRetry(ctx, "GET", "/api/recordings/uploads/"+upload.UploadID, nil, &status)
+		var statusErr *StatusError
+		switch {
+		case err == nil:
+			upload.Offset = status.Offset
+			return nil
+		case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound:
+			cursiveLogger.Info("Upload session expired, starting over", "upload_id", upload.UploadID)
+			upload.UploadID = ""
+			upload.Offset = 0
+		default:
+			return fmt.Errorf("failed to resume upload: %w", err)
+		}
+	}
+
+	var status uploadStatus
+	if err := c.doWithRetry(ctx, "POST", "/api/recordings", upload, &status); err != nil {
+		return fmt.Errorf("failed to create upload: %w", err)
+	}
+	if status.UploadID == "" {
+		return errors.New("server did not return an upload ID")
+	}
+	upload.UploadID = status.UploadID
+	upload.Offset = status.Offset
+	return nil
+}
+
+// describeRecording fills in the file name, content type, size and checksum
+func describeRecording(file *os.File, upload *RecordingUpload) error {
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("failed to hash recording: %w", err)
+	}
+
+	upload.Filename = filepath.Base(file.Name())
+	upload.Size = size
+	upload.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	switch strings.ToLower(filepath.Ext(upload.Filename)) {
+	case ".opus", ".ogg":
+		upload.ContentType = "audio/ogg"
+	case ".wav":
+		upload.ContentType = "audio/wav"
+	default:
+		upload.ContentType = "application/octet-stream"
+	}
+	return nil
+}
+
+// PendingUpload is a recording waiting in the outbox
+type PendingUpload struct {
+	ID          string          `json:"id"`
+	Path        string          `json:"path"`
+	Upload      RecordingUpload `json:"upload"`
+	QueuedAt    time.Time       `json:"queued_at"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// UploadAudit records the final outcome of a queued upload
+type UploadAudit struct {
+	PendingUpload
+	CompletedAt time.Time `json:"completed_at"`
+	Uploaded    bool      `json:"uploaded,omitempty"`
+	Expired     bool      `json:"expired,omitempty"`
+	// Dropped marks an upload that Cursive refused, or whose recording is
+	// gone, which is not retried. LastError holds the reason.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+const (
+	outboxFileName      = "pending_uploads.json"
+	uploadAuditFileName = "upload_audit.jsonl"
+)
+
+// UploadOutbox persists recordings that still have to be uploaded and sends
+// them in the background, retrying with exponential backoff
+type UploadOutbox struct {
+	config  QueueConfig
+	client  *Client
+	mutex   sync.Mutex
+	pending []*PendingUpload
+	wake    chan struct{}
+}
+
+// NewUploadOutbox creates an outbox and loads any uploads left over from a
+// previous run
+func NewUploadOutbox(client *Client, config QueueConfig) (*UploadOutbox, error) {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 5 * time.Second
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 5 * time.Minute
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = 7 * 24 * time.Hour
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	o := &UploadOutbox{
+		config: config,
+		client: client,
+		wake:   make(chan struct{}, 1),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	if len(o.pending) > 0 {
+		cursiveLogger.Info("Loaded pending uploads", "count", len(o.pending))
+	}
+	return o, nil
+}
+
+// Start begins uploading queued recordings
+func (o *UploadOutbox) Start(ctx context.Context) error {
+	go o.run(ctx)
+	return nil
+}
+
+// Enqueue stores a recording for upload and wakes the uploader
+func (o *UploadOutbox) Enqueue(path string, upload RecordingUpload) (*PendingUpload, error) {
+	now := time.Now()
+	entry := &PendingUpload{
+		ID:          newQueueID(),
+		Path:        path,
+		Upload:      upload,
+		QueuedAt:    now,
+		NextAttempt: now,
+	}
+
+	o.mutex.Lock()
+	o.pending = append(o.pending, entry)
+	err := o.save()
+	o.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cursiveLogger.Info("Queued upload", "id", entry.ID, "path", path, "bond_id", upload.BondID)
+	o.notify()
+	return entry, nil
+}
+
+// Pending returns a snapshot of the queued uploads
+func (o *UploadOutbox) Pending() []PendingUpload {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	pending := make([]PendingUpload, len(o.pending))
+	for i, entry := range o.pending {
+		pending[i] = *entry
+	}
+	return pending
+}
+
+// notify wakes the uploader without blocking
+func (o *UploadOutbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run uploads due recordings until ctx is cancelled
+func (o *UploadOutbox) run(ctx context.Context) {
+	ticker := time.NewTicker(o.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+		o.processDue(ctx)
+	}
+}
+
+// processDue uploads every recording whose backoff has elapsed. A failure
+// stops the pass so an outage costs one attempt per tick, while an upload
+// Cursive refuses is dropped and the pass moves on to the next.
+func (o *UploadOutbox) processDue(ctx context.Context) {
+	for {
+		entry := o.nextDue()
+		if entry == nil {
+			return
+		}
+
+		if time.Since(entry.QueuedAt) > o.config.MaxAge {
+			cursiveLogger.Warn("Upload expired, recording kept on disk", "id", entry.ID, "path", entry.Path)
+			o.finish(entry, UploadAudit{Expired: true})
+			continue
+		}
+		if _, err := os.Stat(entry.Path); errors.Is(err, os.ErrNotExist) {
+			cursiveLogger.Warn("Upload dropped, recording no longer exists", "id", entry.ID, "path", entry.Path)
+			o.drop(entry, errors.New("recording no longer exists"))
+			continue
+		}
+
+		o.mutex.Lock()
+		upload := entry.Upload
+		o.mutex.Unlock()
+
+		err := o.client.UploadRecording(ctx, entry.Path, &upload, func(progress RecordingUpload) {
+			o.mutex.Lock()
+			defer o.mutex.Unlock()
+			entry.Upload = progress
+			if err := o.save(); err != nil {
+				cursiveLogger.Error("Failed to save upload outbox", "error", err)
+			}
+		})
+		if err != nil && !IsRetryable(err) {
+			cursiveLogger.Warn("Upload refused, dropping it", "id", entry.ID, "path", entry.Path, "error", err)
+			o.mutex.Lock()
+			entry.Upload = upload
+			entry.Attempts++
+			o.mutex.Unlock()
+			o.drop(entry, err)
+			continue
+		}
+		if err != nil {
+			o.fail(entry, upload, err)
+			return
+		}
+
+		cursiveLogger.Info("Uploaded recording", "path", entry.Path, "bond_id", upload.BondID)
+		o.mutex.Lock()
+		entry.Upload = upload
+		entry.Attempts++
+		o.mutex.Unlock()
+		o.finish(entry, UploadAudit{Uploaded: true})
+	}
+}
+
+// nextDue returns the oldest upload that is ready to be attempted
+func (o *UploadOutbox) nextDue() *PendingUpload {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := time.Now()
+	for _, entry := range o.pending {
+		if !entry.NextAttempt.After(now) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// fail records a failed attempt, keeping any session and checksum the
+// attempt established, and doubles the backoff
+func (o *UploadOutbox) fail(entry *PendingUpload, upload RecordingUpload, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry.Upload = upload
+	entry.Attempts++
+	entry.LastError = err.Error()
+	backoff := retryBackoff(o.config, entry.Attempts)
+	entry.NextAttempt = time.Now().Add(backoff)
+	cursiveLogger.Warn("Upload failed", "id", entry.ID, "attempt", entry.Attempts, "next_in", backoff, "error", err)
+
+	if err := o.save(); err != nil {
+		cursiveLogger.Error("Failed to save upload outbox", "error", err)
+	}
+}
+
+// drop removes an upload that cannot succeed and writes its audit record
+func (o *UploadOutbox) drop(entry *PendingUpload, err error) {
+	o.mutex.Lock()
+	entry.LastError = err.Error()
+	o.mutex.Unlock()
+	o.finish(entry, UploadAudit{Dropped: true})
+}
+
+// finish removes entry from the outbox and writes audit
+func (o *UploadOutbox) finish(entry *PendingUpload, audit UploadAudit) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	audit.PendingUpload = *entry
+	audit.CompletedAt = time.Now()
+	for i, e := range o.pending {
+		if e == entry {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			break
+		}
+	}
+	if err := o.save(); err != nil {
+		cursiveLogger.Error("Failed to save upload outbox", "error", err)
+	}
+	if err := o.appendAudit(audit); err != nil {
+		cursiveLogger.Error("Failed to write upload audit", "error", err)
+	}
+}
+
+// load reads the outbox file if it exists
+func (o *UploadOutbox) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(o.config.Dir, outboxFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload outbox: %w", err)
+	}
+	if err := json.Unmarshal(data, &o.pending); err != nil {
+		return fmt.Errorf("failed to decode upload outbox: %w", err)
+	}
+	return nil
+}
+
+// save atomically rewrites the outbox file. Callers must hold the mutex.
+func (o *UploadOutbox) save() error {
+	data, err := json.MarshalIndent(o.pending, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload outbox: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(o.config.Dir, outboxFileName), data)
+}
+
+// appendAudit appends a record to the upload audit log. Callers must hold
+// the mutex.
+func (o *UploadOutbox) appendAudit(audit UploadAudit) error {
+	file, err := os.OpenFile(filepath.Join(o.config.Dir, uploadAuditFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(audit)
+}
@@ -0,0 +1,402 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCursive implements the resumable recording upload API
+type fakeCursive struct {
+	mutex   sync.Mutex
+	uploads map[string]*fakeUpload
+	creates int
+	puts    int
+	// failPut answers the PUT with this number with a server error
+	failPut int
+	// refuse answers creates for this bond ID with 400
+	refuse string
+	// down answers every request with 503
+	down bool
+}
+
+type fakeUpload struct {
+	meta RecordingUpload
+	data []byte
+}
+
+func newFakeCursive(t *testing.T) (*fakeCursive, *Client) {
+	t.Helper()
+	f := &fakeCursive{uploads: make(map[string]*fakeUpload)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	client := NewClient(ClientConfig{BaseURL: server.URL, Timeout: time.Second, UploadChunkSize: 4})
+	return f, client
+}
+
+func (f *fakeCursive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/recordings/uploads/")
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/api/recordings":
+		var meta RecordingUpload
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if meta.BondID == f.refuse {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.creates++
+		id = fmt.Sprintf("upload-%d", f.creates)
+		f.uploads[id] = &fakeUpload{meta: meta}
+		json.NewEncoder(w).Encode(uploadStatus{UploadID: id})
+
+	case r.Method == "GET":
+		upload, ok := f.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(uploadStatus{UploadID: id, Offset: int64(len(upload.data))})
+
+	case r.Method == "PUT":
+		f.puts++
+		upload, ok := f.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f.puts == f.failPut {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var start, end, size int64
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil || start != int64(len(upload.data)) || size != upload.meta.Size {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		chunk, _ := ioutil.ReadAll(r.Body)
+		if int64(len(chunk)) != end-start+1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		upload.data = append(upload.data, chunk...)
+		json.NewEncoder(w).Encode(uploadStatus{UploadID: id, Offset: int64(len(upload.data))})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// received returns what the server holds for upload id
+func (f *fakeCursive) received(id string) *fakeUpload {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.uploads[id]
+}
+
+// writeRecording creates a recording with content in dir
+func writeRecording(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const recording = "RIFF0123456789"
+
+func TestUploadRecordingInChunks(t *testing.T) {
+	f, client := newFakeCursive(t)
+	path := writeRecording(t, t.TempDir(), "bond.wav", recording)
+
+	upload := RecordingUpload{BondID: "bond-1", UIDs: []string{"04a1", "04b2"}, Accounts: []string{"acct"}}
+	var offsets []int64
+	err := client.UploadRecording(context.Background(), path, &upload, func(progress RecordingUpload) {
+		offsets = append(offsets, progress.Offset)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(offsets) != "[4 8 12 14]" {
+		t.Fatalf("progress offsets %v, want [4 8 12 14]", offsets)
+	}
+	got := f.received(upload.UploadID)
+	if got == nil || string(got.data) != recording {
+		t.Fatalf("server received %+v", got)
+	}
+	sum := sha256.Sum256([]byte(recording))
+	meta := got.meta
+	if meta.BondID != "bond-1" || meta.Filename != "bond.wav" || meta.ContentType != "audio/wav" ||
+		meta.Size != int64(len(recording)) || meta.SHA256 != hex.EncodeToString(sum[:]) || len(meta.UIDs) != 2 || len(meta.Accounts) != 1 {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+}
+
+func TestUploadRecordingResumes(t *testing.T) {
+	f, client := newFakeCursive(t)
+	f.failPut = 2
+	path := writeRecording(t, t.TempDir(), "bond.wav", recording)
+
+	upload := RecordingUpload{BondID: "bond-1"}
+	if err := client.UploadRecording(context.Background(), path, &upload, nil); err == nil {
+		t.Fatal("upload succeeded through a failed chunk")
+	}
+	if upload.UploadID == "" || upload.Offset != 4 {
+		t.Fatalf("interrupted upload at %q offset %d, want offset 4", upload.UploadID, upload.Offset)
+	}
+
+	if err := client.UploadRecording(context.Background(), path, &upload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if f.creates != 1 {
+		t.Fatalf("%d upload sessions created, want 1", f.creates)
+	}
+	if got := f.received(upload.UploadID); string(got.data) != recording {
+		t.Fatalf("server received %q", got.data)
+	}
+}
+
+func TestUploadSessionExpired(t *testing.T) {
+	f, client := newFakeCursive(t)
+	path := writeRecording(t, t.TempDir(), "bond.wav", recording)
+
+	// The server has forgotten a session the hub started before
+	upload := RecordingUpload{BondID: "bond-1", UploadID: "forgotten", Offset: 8}
+	if err := client.UploadRecording(context.Background(), path, &upload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if upload.UploadID == "forgotten" || f.creates != 1 {
+		t.Fatalf("upload %q after %d creates, want a new session", upload.UploadID, f.creates)
+	}
+	if got := f.received(upload.UploadID); string(got.data) != recording {
+		t.Fatalf("server received %q", got.data)
+	}
+}
+
+func TestUploadRecordingChangedSize(t *testing.T) {
+	_, client := newFakeCursive(t)
+	path := writeRecording(t, t.TempDir(), "bond.wav", recording)
+
+	upload := RecordingUpload{BondID: "bond-1", SHA256: "known", Size: 3}
+	err := client.UploadRecording(context.Background(), path, &upload, nil)
+	if err == nil || !strings.Contains(err.Error(), "changed size") {
+		t.Fatalf("error %v, want changed size", err)
+	}
+}
+
+// newTestOutbox returns an outbox in dir that is only driven by the test
+func newTestOutbox(t *testing.T, client *Client, dir string) *UploadOutbox {
+	t.Helper()
+	o, err := NewUploadOutbox(client, QueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// readUploadAudit returns the records in the upload audit log
+func readUploadAudit(t *testing.T, dir string) []UploadAudit {
+	t.Helper()
+	file, err := os.Open(filepath.Join(dir, uploadAuditFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var audits []UploadAudit
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var audit UploadAudit
+		if err := json.Unmarshal(scanner.Bytes(), &audit); err != nil {
+			t.Fatal(err)
+		}
+		audits = append(audits, audit)
+	}
+	return audits
+}
+
+func TestOutboxResumesAfterRestart(t *testing.T) {
+	f, client := newFakeCursive(t)
+	dir := t.TempDir()
+	path := writeRecording(t, dir, "bond.wav", recording)
+
+	o := newTestOutbox(t, client, dir)
+	if _, err := o.Enqueue(path, RecordingUpload{BondID: "bond-1"}); err != nil {
+		t.Fatal(err)
+	}
+	f.failPut = 3
+	o.processDue(context.Background())
+
+	pending := o.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].Upload.Offset != 8 || pending[0].LastError == "" {
+		t.Fatalf("unexpected outbox after a failed chunk: %+v", pending)
+	}
+
+	// A new outbox picks the upload up where the old one stopped
+	restarted := newTestOutbox(t, client, dir)
+	pending = restarted.Pending()
+	if len(pending) != 1 || pending[0].Upload.UploadID == "" || pending[0].Upload.Offset != 8 {
+		t.Fatalf("outbox did not survive the restart: %+v", pending)
+	}
+	restarted.pending[0].NextAttempt = time.Time{}
+	restarted.processDue(context.Background())
+
+	if n := len(restarted.Pending()); n != 0 {
+		t.Fatalf("%d uploads left", n)
+	}
+	if f.creates != 1 {
+		t.Fatalf("%d upload sessions created, want 1", f.creates)
+	}
+	if got := f.received(pending[0].Upload.UploadID); string(got.data) != recording {
+		t.Fatalf("server received %q", got.data)
+	}
+	audits := readUploadAudit(t, dir)
+	if len(audits) != 1 || !audits[0].Uploaded || audits[0].Attempts != 2 {
+		t.Fatalf("unexpected audit %+v", audits)
+	}
+}
+
+func TestOutboxDropsRefusedUploads(t *testing.T) {
+	f, client := newFakeCursive(t)
+	f.refuse = "bad-bond"
+	dir := t.TempDir()
+	o := newTestOutbox(t, client, dir)
+
+	for _, bond := range []string{"bad-bond", "bond-2"} {
+		path := writeRecording(t, dir, bond+".wav", recording)
+		if _, err := o.Enqueue(path, RecordingUpload{BondID: bond}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.processDue(context.Background())
+
+	// The refused upload does not hold up the one behind it
+	if n := len(o.Pending()); n != 0 {
+		t.Fatalf("%d uploads left", n)
+	}
+	audits := readUploadAudit(t, dir)
+	if len(audits) != 2 {
+		t.Fatalf("%d audit records, want 2", len(audits))
+	}
+	if !audits[0].Dropped || audits[0].Upload.BondID != "bad-bond" || !strings.Contains(audits[0].LastError, "400") {
+		t.Fatalf("unexpected audit for the refused upload %+v", audits[0])
+	}
+	if !audits[1].Uploaded || audits[1].Upload.BondID != "bond-2" {
+		t.Fatalf("unexpected audit for the second upload %+v", audits[1])
+	}
+}
+
+func TestOutboxStopsOnOutage(t *testing.T) {
+	f, client := newFakeCursive(t)
+	f.down = true
+	dir := t.TempDir()
+	o := newTestOutbox(t, client, dir)
+
+	for _, bond := range []string{"bond-1", "bond-2"} {
+		path := writeRecording(t, dir, bond+".wav", recording)
+		if _, err := o.Enqueue(path, RecordingUpload{BondID: bond}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.processDue(context.Background())
+
+	// One failed attempt per pass, the second upload is left for later
+	pending := o.Pending()
+	if len(pending) != 2 || pending[0].Attempts != 1 || pending[1].Attempts != 0 {
+		t.Fatalf("unexpected outbox %+v", pending)
+	}
+	if !pending[0].NextAttempt.After(time.Now()) {
+		t.Fatal("failed upload is not backed off")
+	}
+	if audits := readUploadAudit(t, dir); len(audits) != 0 {
+		t.Fatalf("outage audited as final: %+v", audits)
+	}
+}
+
+func TestOutboxExpiresOldUploads(t *testing.T) {
+	f, client := newFakeCursive(t)
+	dir := t.TempDir()
+	o := newTestOutbox(t, client, dir)
+
+	path := writeRecording(t, dir, "bond.wav", recording)
+	entry, err := o.Enqueue(path, RecordingUpload{BondID: "bond-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.QueuedAt = time.Now().Add(-o.config.MaxAge - time.Minute)
+	o.processDue(context.Background())
+
+	if n := len(o.Pending()); n != 0 {
+		t.Fatalf("%d uploads left", n)
+	}
+	if f.creates != 0 {
+		t.Fatal("expired upload was sent")
+	}
+	audits := readUploadAudit(t, dir)
+	if len(audits) != 1 || !audits[0].Expired {
+		t.Fatalf("unexpected audit %+v", audits)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expired recording removed: %v", err)
+	}
+}
+
+func TestOutboxDropsMissingRecording(t *testing.T) {
+	_, client := newFakeCursive(t)
+	dir := t.TempDir()
+	o := newTestOutbox(t, client, dir)
+
+	if _, err := o.Enqueue(filepath.Join(dir, "gone.wav"), RecordingUpload{BondID: "bond-1"}); err != nil {
+		t.Fatal(err)
+	}
+	o.processDue(context.Background())
+
+	audits := readUploadAudit(t, dir)
+	if len(audits) != 1 || !audits[0].Dropped || audits[0].LastError != "recording no longer exists" {
+		t.Fatalf("unexpected audit %+v", audits)
+	}
+}
+
+func TestOutboxFile(t *testing.T) {
+	_, client := newFakeCursive(t)
+	dir := t.TempDir()
+	o := newTestOutbox(t, client, dir)
+	if _, err := o.Enqueue(filepath.Join(dir, "bond.wav"), RecordingUpload{BondID: "bond-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, outboxFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"bond_id": "bond-1"`)) {
+		t.Fatalf("outbox file does not hold the upload: %s", data)
+	}
+}
@@ -0,0 +1,92 @@
+package nfc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// GET_VERSION commands. Type 2 tags take the native command directly,
+// ISO-DEP tags take it wrapped in an APDU and answer in three frames.
+var (
+	getVersionType2  = []byte{0x60}
+	getVersionISODEP = []byte{0x90, 0x60, 0x00, 0x00, 0x00}
+	additionalFrame  = []byte{0x90, 0xaf, 0x00, 0x00, 0x00}
+	statusMoreFrames = []byte{0x91, 0xaf}
+)
+
+// Product types in a GET_VERSION response
+const (
+	desfireProductType byte = 0x01
+	ntagProductType    byte = 0x04
+)
+
+// ntag21xTypes maps the storage size byte of an NTAG21x version to its type
+var ntag21xTypes = map[byte]string{0x0f: TagNTAG213, 0x11: TagNTAG215, 0x13: TagNTAG216}
+
+// Identify returns the type of a selected target. NTAG and DESFire tags
+// are asked for their version, since their ATQA and SAK are shared by
+// several types; others are classified by ClassifyTag.
+func (d *PN532) Identify(target *Target) string {
+	switch {
+	case target.SupportsISODEP():
+		version, err := d.isoDEPVersion(target)
+		if err != nil {
+			logger.Debug("Failed to get tag version", "error", err)
+			break
+		}
+		if version[0] == nxpVendorID {
+			switch version[1] {
+			case ntagProductType:
+				return TagNTAG424
+			case desfireProductType:
+				return TagDESFire
+			}
+		}
+
+	case target.IsType2():
+		// InDataExchange would take 0x60 for a MIFARE Classic
+		// authentication, so the command is sent as is
+		resp, err := d.command(cmdInCommunicateThru, getVersionType2)
+		if err != nil || len(resp) < 1 || resp[0]&0x3f != 0 {
+			logger.Debug("Failed to get tag version", "response", fmt.Sprintf("% x", resp), "error", err)
+			break
+		}
+		// Header, vendor, product type, subtype, major, minor, storage size
+		version := resp[1:]
+		if len(version) >= 7 && version[1] == nxpVendorID && version[2] == ntagProductType {
+			if tagType, ok := ntag21xTypes[version[6]]; ok {
+				return tagType
+			}
+		}
+	}
+	return ClassifyTag(target.ATQA, target.SAK)
+}
+
+// isoDEPVersion returns the hardware version frame of a DESFire or NTAG
+// 424 DNA: vendor, product type, subtype, major, minor, storage size and
+// protocol. The other frames are read so the tag accepts new commands.
+func (d *PN532) isoDEPVersion(target *Target) ([]byte, error) {
+	resp, err := d.transceive(target, getVersionISODEP)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 9 || !hasStatus(resp, statusMoreFrames) {
+		return nil, fmt.Errorf("unexpected GetVersion response: % x", resp)
+	}
+	version := resp[:len(resp)-2]
+
+	for i := 0; i < 2 && hasStatus(resp, statusMoreFrames); i++ {
+		if resp, err = d.transceive(target, additionalFrame); err != nil {
+			return nil, err
+		}
+		if len(resp) < 2 {
+			return nil, errors.New("empty GetVersion frame")
+		}
+	}
+	return version, nil
+}
+
+// hasStatus reports whether resp ends with the status word sw
+func hasStatus(resp, sw []byte) bool {
+	return len(resp) >= 2 && resp[len(resp)-2] == sw[0] && resp[len(resp)-1] == sw[1]
+}
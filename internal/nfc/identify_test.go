@@ -0,0 +1,69 @@
+package nfc
+
+import "testing"
+
+// Recorded GET_VERSION exchanges
+var (
+	// getVersionThru sends GET_VERSION to a Type 2 tag
+	getVersionThru = frame(">", hostToPN532, cmdInCommunicateThru, 0x60)
+	// getVersionAPDU and getAdditionalFrame send GET_VERSION to target 1
+	getVersionAPDU     = frame(">", hostToPN532, cmdInDataExchange, 0x01, 0x90, 0x60, 0x00, 0x00, 0x00)
+	getAdditionalFrame = frame(">", hostToPN532, cmdInDataExchange, 0x01, 0x90, 0xaf, 0x00, 0x00, 0x00)
+)
+
+// ntag21xVersion answers GET_VERSION for an NTAG21x of the given size
+func ntag21xVersion(size byte) string {
+	return frame("<", pn532ToHost, cmdInCommunicateThru+1, 0x00, 0x00, 0x04, 0x04, 0x02, 0x01, 0x00, size, 0x03)
+}
+
+// isoDEPVersion answers GET_VERSION for an ISO-DEP tag of the given product
+// type, in three frames
+func isoDEPVersion(productType byte) []string {
+	return []string{
+		getVersionAPDU, ack,
+		frame("<", pn532ToHost, cmdInDataExchange+1, 0x00, 0x04, productType, 0x02, 0x30, 0x00, 0x11, 0x05, 0x91, 0xaf),
+		getAdditionalFrame, ack,
+		frame("<", pn532ToHost, cmdInDataExchange+1, 0x00, 0x04, productType, 0x02, 0x01, 0x00, 0x11, 0x05, 0x91, 0xaf),
+		getAdditionalFrame, ack,
+		frame("<", pn532ToHost, cmdInDataExchange+1, 0x00, 0x04, 0xde, 0x5f, 0x1e, 0xac, 0xc0, 0x40, 0xcf, 0x39, 0xa4, 0x36, 0x10, 0x40, 0x21, 0x91, 0x00),
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	tests := []struct {
+		name  string
+		atqa  uint16
+		sak   byte
+		lines []string
+		want  string
+	}{
+		{"NTAG213", 0x0044, 0x00, []string{getVersionThru, ack, ntag21xVersion(0x0f)}, TagNTAG213},
+		{"NTAG215", 0x0044, 0x00, []string{getVersionThru, ack, ntag21xVersion(0x11)}, TagNTAG215},
+		{"NTAG216", 0x0044, 0x00, []string{getVersionThru, ack, ntag21xVersion(0x13)}, TagNTAG216},
+		{"NTAG21x of unknown size", 0x0044, 0x00, []string{getVersionThru, ack, ntag21xVersion(0x0b)}, ""},
+		{
+			// A MIFARE Ultralight without GET_VERSION times out
+			name: "Type 2 tag without GET_VERSION", atqa: 0x0044, sak: 0x00,
+			lines: []string{getVersionThru, ack, frame("<", pn532ToHost, cmdInCommunicateThru+1, 0x01)},
+		},
+		{"NTAG 424 DNA", 0x0344, 0x20, isoDEPVersion(ntagProductType), TagNTAG424},
+		{"DESFire", 0x0344, 0x20, isoDEPVersion(desfireProductType), TagDESFire},
+		{
+			// The DESFire ATQA still gives the type
+			name: "ISO-DEP tag rejecting GET_VERSION", atqa: 0x0344, sak: 0x20,
+			lines: []string{getVersionAPDU, ack, frame("<", pn532ToHost, cmdInDataExchange+1, 0x00, 0x6e, 0x00)},
+			want:  TagDESFire,
+		},
+		{"MIFARE Classic", 0x0004, 0x08, nil, TagMifareClassic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := replay(t, tt.lines...)
+			target := &Target{ATQA: tt.atqa, SAK: tt.sak, number: 1}
+			if got := NewPN532(transport).Identify(target); got != tt.want {
+				t.Fatalf("Identify = %q, want %q", got, tt.want)
+			}
+			checkReplayed(t, transport)
+		})
+	}
+}
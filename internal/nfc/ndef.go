@@ -0,0 +1,211 @@
+package nfc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Type 4 tag APDUs (NFC Forum Type 4 Tag specification)
+var (
+	// selectNDEFApp selects the NDEF application D2760000850101
+	selectNDEFApp = []byte{0x00, 0xa4, 0x04, 0x00, 0x07, 0xd2, 0x76, 0x00, 0x00, 0x85, 0x01, 0x01, 0x00}
+	// selectNDEFFile selects the NDEF file E104
+	selectNDEFFile = []byte{0x00, 0xa4, 0x00, 0x0c, 0x02, 0xe1, 0x04}
+)
+
+const (
+	// ndefReadChunk keeps each ReadBinary response within one PN532 frame
+	ndefReadChunk = 48
+	// maxNDEFLength bounds the NDEF file read from a tag
+	maxNDEFLength = 1024
+)
+
+// uriPrefixes are the abbreviations of a URI record's first byte
+var uriPrefixes = []string{"", "http://www.", "https://www.", "http://", "https://"}
+
+// ReadNDEF reads the NDEF message of a selected Type 2 tag such as an
+// NTAG21x, or Type 4 tag such as the NTAG 424 DNA. Each read makes an NTAG
+// 424 DNA count up and mirror new SUN data, so a tag is read once per tap.
+func (d *PN532) ReadNDEF(target *Target) ([]byte, error) {
+	switch {
+	case target.SupportsISODEP():
+		return d.readType4NDEF(target)
+	case target.IsType2():
+		return d.readType2NDEF(target)
+	default:
+		return nil, errors.New("tag has no NDEF support")
+	}
+}
+
+// readType4NDEF reads the NDEF file of a Type 4 tag
+func (d *PN532) readType4NDEF(target *Target) ([]byte, error) {
+	if _, err := d.exchange(target, selectNDEFApp); err != nil {
+		return nil, fmt.Errorf("failed to select NDEF application: %w", err)
+	}
+	if _, err := d.exchange(target, selectNDEFFile); err != nil {
+		return nil, fmt.Errorf("failed to select NDEF file: %w", err)
+	}
+
+	// The file starts with the two byte NDEF message length
+	nlen, err := d.readBinary(target, 0, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(nlen) != 2 {
+		return nil, fmt.Errorf("short NDEF length: % x", nlen)
+	}
+	length := int(nlen[0])<<8 | int(nlen[1])
+	if length > maxNDEFLength {
+		return nil, fmt.Errorf("NDEF message of %d bytes is too long", length)
+	}
+
+	message := make([]byte, 0, length)
+	for len(message) < length {
+		n := length - len(message)
+		if n > ndefReadChunk {
+			n = ndefReadChunk
+		}
+		chunk, err := d.readBinary(target, 2+len(message), n)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			return nil, errors.New("empty ReadBinary response")
+		}
+		message = append(message, chunk...)
+	}
+	return message[:length], nil
+}
+
+// readType2NDEF reads the NDEF message TLV from the data area of a Type 2
+// tag, four pages at a time
+func (d *PN532) readType2NDEF(target *Target) ([]byte, error) {
+	// The capability container in page 3 gives the data area size
+	cc, err := d.readPages(target, 3)
+	if err != nil {
+		return nil, err
+	}
+	if cc[0] != 0xe1 {
+		return nil, fmt.Errorf("no NDEF capability container: % x", cc[:4])
+	}
+	size := int(cc[2]) * 8
+
+	var data []byte
+	for page := 4; len(data) < size; page += 4 {
+		chunk, err := d.readPages(target, page)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if message, complete, err := parseNDEFTLV(data); err != nil || complete {
+			return message, err
+		}
+	}
+	return nil, errors.New("NDEF message TLV not found")
+}
+
+// readPages reads the 16 bytes starting at page of a Type 2 tag
+func (d *PN532) readPages(target *Target, page int) ([]byte, error) {
+	data, err := d.transceive(target, []byte{0x30, byte(page)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %w", page, err)
+	}
+	if len(data) != 16 {
+		return nil, fmt.Errorf("short read of page %d: % x", page, data)
+	}
+	return data, nil
+}
+
+// parseNDEFTLV finds the NDEF message TLV in the start of a Type 2 data
+// area. complete is false while more data is needed.
+func parseNDEFTLV(data []byte) (message []byte, complete bool, err error) {
+	for pos := 0; pos < len(data); {
+		tlvType := data[pos]
+		switch tlvType {
+		case 0x00:
+			// NULL TLV
+			pos++
+			continue
+		case 0xfe:
+			return nil, true, errors.New("no NDEF message TLV")
+		}
+
+		if pos+1 >= len(data) {
+			return nil, false, nil
+		}
+		length, header := int(data[pos+1]), 2
+		if length == 0xff {
+			if pos+3 >= len(data) {
+				return nil, false, nil
+			}
+			length, header = int(data[pos+2])<<8|int(data[pos+3]), 4
+		}
+		if tlvType == 0x03 {
+			if pos+header+length > len(data) {
+				return nil, false, nil
+			}
+			return data[pos+header : pos+header+length], true, nil
+		}
+		pos += header + length
+	}
+	return nil, false, nil
+}
+
+// readBinary reads n bytes at offset of the selected file
+func (d *PN532) readBinary(target *Target, offset, n int) ([]byte, error) {
+	data, err := d.exchange(target, []byte{0x00, 0xb0, byte(offset >> 8), byte(offset), byte(n)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NDEF file: %w", err)
+	}
+	return data, nil
+}
+
+// NDEFURI returns the first URI record of an NDEF message
+func NDEFURI(message []byte) (string, bool) {
+	for len(message) >= 3 {
+		header := message[0]
+		typeLen := int(message[1])
+		pos := 2
+
+		var payloadLen int
+		if header&0x10 != 0 {
+			// Short record
+			payloadLen = int(message[pos])
+			pos++
+		} else {
+			if len(message) < pos+4 {
+				return "", false
+			}
+			payloadLen = int(message[pos])<<24 | int(message[pos+1])<<16 | int(message[pos+2])<<8 | int(message[pos+3])
+			pos += 4
+		}
+		idLen := 0
+		if header&0x08 != 0 {
+			if len(message) <= pos {
+				return "", false
+			}
+			idLen = int(message[pos])
+			pos++
+		}
+		if payloadLen < 0 || len(message) < pos+typeLen+idLen+payloadLen {
+			return "", false
+		}
+		recordType := message[pos : pos+typeLen]
+		payload := message[pos+typeLen+idLen : pos+typeLen+idLen+payloadLen]
+
+		// Well-known type "U"
+		if header&0x07 == 0x01 && string(recordType) == "U" && len(payload) > 0 {
+			prefix := ""
+			if int(payload[0]) < len(uriPrefixes) {
+				prefix = uriPrefixes[payload[0]]
+			}
+			return prefix + string(payload[1:]), true
+		}
+		if header&0x40 != 0 {
+			// Message end
+			break
+		}
+		message = message[pos+typeLen+idLen+payloadLen:]
+	}
+	return "", false
+}
@@ -0,0 +1,151 @@
+package nfc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// fizURI is an NDEF message holding the URI https://fiz.io
+var fizURI = uriRecord(0x04, "fiz.io")
+
+func TestParseNDEFTLV(t *testing.T) {
+	long := bytes.Repeat([]byte{0xaa}, 300)
+	tests := []struct {
+		name     string
+		data     []byte
+		message  []byte
+		complete bool
+		wantErr  bool
+	}{
+		{"NDEF TLV", append(append([]byte{0x03, byte(len(fizURI))}, fizURI...), 0xfe), fizURI, true, false},
+		{"after NULL TLVs", append(append([]byte{0x00, 0x00, 0x03, byte(len(fizURI))}, fizURI...), 0xfe), fizURI, true, false},
+		{"after a lock control TLV", append(append([]byte{0x01, 0x03, 0xa0, 0x0c, 0x34, 0x03, byte(len(fizURI))}, fizURI...), 0xfe), fizURI, true, false},
+		{"three byte length", append([]byte{0x03, 0xff, 0x01, 0x2c}, long...), long, true, false},
+		{"empty NDEF message", []byte{0x03, 0x00, 0xfe}, []byte{}, true, false},
+		{"terminator only", []byte{0xfe, 0x00, 0x00}, nil, true, true},
+		{"truncated value", append([]byte{0x03, byte(len(fizURI))}, fizURI[:4]...), nil, false, false},
+		{"truncated length", []byte{0x00, 0x03}, nil, false, false},
+		{"truncated three byte length", []byte{0x03, 0xff, 0x01}, nil, false, false},
+		{"past another TLV", []byte{0x01, 0x03, 0xa0}, nil, false, false},
+		{"empty", nil, nil, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, complete, err := parseNDEFTLV(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v", err)
+			}
+			if complete != tt.complete || !bytes.Equal(message, tt.message) {
+				t.Fatalf("parseNDEFTLV = % x, %v, want % x, %v", message, complete, tt.message, tt.complete)
+			}
+		})
+	}
+}
+
+func TestNDEFURI(t *testing.T) {
+	// A text record "en" "hi" without the message end flag
+	text := []byte{0x91, 0x01, 0x05, 'T', 0x02, 'e', 'n', 'h', 'i'}
+	lastURI := append([]byte(nil), fizURI...)
+	lastURI[0] = 0x51
+	tests := []struct {
+		name    string
+		message []byte
+		want    string
+		ok      bool
+	}{
+		{"https prefix", fizURI, "https://fiz.io", true},
+		{"http www prefix", uriRecord(0x01, "fiz.io"), "http://www.fiz.io", true},
+		{"no prefix", uriRecord(0x00, "mailto:hi@fiz.io"), "mailto:hi@fiz.io", true},
+		{"unknown prefix", uriRecord(0x23, "urn:nfc:fiz"), "urn:nfc:fiz", true},
+		{"long record", []byte{0xc1, 0x01, 0x00, 0x00, 0x00, 0x07, 'U', 0x04, 'f', 'i', 'z', '.', 'i', 'o'}, "https://fiz.io", true},
+		{"record with an ID", []byte{0xd9, 0x01, 0x07, 0x02, 'U', 'i', 'd', 0x04, 'f', 'i', 'z', '.', 'i', 'o'}, "https://fiz.io", true},
+		{"after a text record", append(append([]byte(nil), text...), lastURI...), "https://fiz.io", true},
+		{"text record only", append([]byte{0xd1}, text[1:]...), "", false},
+		{"URI after the message end", append(append([]byte{0xd1}, text[1:]...), fizURI...), "", false},
+		{"empty URI payload", []byte{0xd1, 0x01, 0x00, 'U'}, "", false},
+		{"truncated payload", fizURI[:len(fizURI)-1], "", false},
+		{"truncated long length", []byte{0xc1, 0x01, 0x00, 0x00}, "", false},
+		{"empty", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := NDEFURI(tt.message)
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("NDEFURI = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadType2NDEF(t *testing.T) {
+	// Page 3 holds the capability container of a 144 byte data area. The
+	// data area starts with a lock control TLV, so the NDEF TLV only ends
+	// in the second read.
+	cc := []byte{0xe1, 0x10, 0x12, 0x00}
+	area := append([]byte{0x01, 0x03, 0xa0, 0x0c, 0x34, 0x03, byte(len(fizURI))}, fizURI...)
+	area = append(area, 0xfe)
+	area = append(area, make([]byte, 32-len(area))...)
+
+	page3 := append(append([]byte(nil), cc...), make([]byte, 12)...)
+	transport := replay(t,
+		frame(">", hostToPN532, cmdInDataExchange, 0x01, 0x30, 0x03), ack,
+		frame("<", append([]byte{pn532ToHost, cmdInDataExchange + 1, 0x00}, page3...)...),
+		frame(">", hostToPN532, cmdInDataExchange, 0x01, 0x30, 0x04), ack,
+		frame("<", append([]byte{pn532ToHost, cmdInDataExchange + 1, 0x00}, area[:16]...)...),
+		frame(">", hostToPN532, cmdInDataExchange, 0x01, 0x30, 0x08), ack,
+		frame("<", append([]byte{pn532ToHost, cmdInDataExchange + 1, 0x00}, area[16:]...)...),
+	)
+	target := &Target{UID: mustHex(t, "04a23b1a5c6180"), ATQA: 0x0044, number: 1}
+	message, err := NewPN532(transport).ReadNDEF(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, fizURI) {
+		t.Fatalf("NDEF % x, want % x", message, fizURI)
+	}
+	checkReplayed(t, transport)
+}
+
+func TestReadType2NDEFWithoutCapabilityContainer(t *testing.T) {
+	transport := replay(t,
+		frame(">", hostToPN532, cmdInDataExchange, 0x01, 0x30, 0x03), ack,
+		frame("<", append([]byte{pn532ToHost, cmdInDataExchange + 1, 0x00}, make([]byte, 16)...)...),
+	)
+	target := &Target{ATQA: 0x0044, number: 1}
+	_, err := NewPN532(transport).ReadNDEF(target)
+	if err == nil || !strings.Contains(err.Error(), "no NDEF capability container") {
+		t.Fatalf("error %v, want no capability container", err)
+	}
+}
+
+func TestReadType4NDEF(t *testing.T) {
+	exchange := func(apdu ...byte) string {
+		return frame(">", append([]byte{hostToPN532, cmdInDataExchange, 0x01}, apdu...)...)
+	}
+	response := func(data ...byte) string {
+		return frame("<", append([]byte{pn532ToHost, cmdInDataExchange + 1, 0x00}, data...)...)
+	}
+	transport := replay(t,
+		exchange(selectNDEFApp...), ack, response(0x90, 0x00),
+		exchange(selectNDEFFile...), ack, response(0x90, 0x00),
+		exchange(0x00, 0xb0, 0x00, 0x00, 0x02), ack, response(0x00, byte(len(fizURI)), 0x90, 0x00),
+		exchange(0x00, 0xb0, 0x00, 0x02, byte(len(fizURI))), ack, response(append(append([]byte(nil), fizURI...), 0x90, 0x00)...),
+	)
+	target := &Target{ATQA: 0x0344, SAK: 0x20, number: 1}
+	message, err := NewPN532(transport).ReadNDEF(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, fizURI) {
+		t.Fatalf("NDEF % x, want % x", message, fizURI)
+	}
+	checkReplayed(t, transport)
+}
+
+func TestReadNDEFUnsupportedTag(t *testing.T) {
+	target := &Target{ATQA: 0x0004, SAK: 0x08, number: 1}
+	if _, err := NewPN532(replay(t)).ReadNDEF(target); err == nil {
+		t.Fatal("read NDEF from a MIFARE Classic")
+	}
+}
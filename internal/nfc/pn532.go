@@ -0,0 +1,279 @@
+package nfc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PN532 command codes (PN532 user manual section 7)
+const (
+	cmdGetFirmwareVersion    byte = 0x02
+	cmdSAMConfiguration      byte = 0x14
+	cmdPowerDown             byte = 0x16
+	cmdRFConfiguration       byte = 0x32
+	cmdInDataExchange        byte = 0x40
+	cmdInCommunicateThru     byte = 0x42
+	cmdInListPassiveTarget   byte = 0x4a
+	cmdInRelease             byte = 0x52
+	hostToPN532              byte = 0xd4
+	pn532ToHost              byte = 0xd5
+	defaultCommandTimeout         = time.Second
+	passiveActivationRetries byte = 0x10
+)
+
+// ackFrame is sent by the PN532 after every valid command frame
+var ackFrame = []byte{0x00, 0x00, 0xff, 0x00, 0xff, 0x00}
+
+// Target describes an ISO14443A tag found by InListPassiveTarget
+type Target struct {
+	UID  []byte
+	ATQA uint16
+	SAK  byte
+	// Type is the tag type found by Identify
+	Type string
+	// NDEF is the tag's NDEF message, when it was read
+	NDEF []byte
+	// number is the PN532's logical number for the selected target
+	number byte
+}
+
+// sakISO14443_4 is set in the SAK of tags that speak ISO-DEP, such as the
+// NTAG 424 DNA and DESFire
+const sakISO14443_4 byte = 0x20
+
+// SupportsISODEP reports whether the tag accepts ISO 7816-4 APDUs
+func (t *Target) SupportsISODEP() bool {
+	return t.SAK&sakISO14443_4 != 0
+}
+
+// IsType2 reports whether the tag looks like an NFC Forum Type 2 tag, such
+// as an NTAG21x or MIFARE Ultralight
+func (t *Target) IsType2() bool {
+	return t.SAK == 0x00 && t.ATQA == 0x0044
+}
+
+// UIDString returns the tag UID as lowercase hex
+func (t *Target) UIDString() string {
+	return hex.EncodeToString(t.UID)
+}
+
+// PN532 drives an NXP PN532 NFC controller over a Transport
+type PN532 struct {
+	transport Transport
+	timeout   time.Duration
+}
+
+// NewPN532 creates a driver for a PN532 attached to transport
+func NewPN532(transport Transport) *PN532 {
+	return &PN532{
+		transport: transport,
+		timeout:   defaultCommandTimeout,
+	}
+}
+
+// Init wakes the PN532, checks that it responds and configures it for
+// reading ISO14443A tags
+func (d *PN532) Init() error {
+	if err := d.transport.Wakeup(); err != nil {
+		return fmt.Errorf("failed to wake PN532: %w", err)
+	}
+
+	version, err := d.command(cmdGetFirmwareVersion, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get PN532 firmware version: %w", err)
+	}
+	if len(version) < 4 {
+		return fmt.Errorf("short firmware version response: % x", version)
+	}
+	if version[0] != 0x32 {
+		return fmt.Errorf("unexpected IC 0x%02x, not a PN532", version[0])
+	}
+
+	return d.configure()
+}
+
+// configure enables normal SAM mode and bounds the passive activation
+// retries so that polling returns promptly when no tag is present
+func (d *PN532) configure() error {
+	// Normal mode, 1s virtual card timeout, use IRQ pin
+	if _, err := d.command(cmdSAMConfiguration, []byte{0x01, 0x14, 0x01}); err != nil {
+		return fmt.Errorf("SAM configuration failed: %w", err)
+	}
+
+	// CfgItem 5: MxRtyATR, MxRtyPSL, MxRtyPassiveActivation
+	if _, err := d.command(cmdRFConfiguration, []byte{0x05, 0xff, 0x01, passiveActivationRetries}); err != nil {
+		return fmt.Errorf("RF configuration failed: %w", err)
+	}
+	return nil
+}
+
+// ReadPassiveTarget looks for a single ISO14443A tag at 106 kbps. It
+// returns nil without error when no tag is in the field. The tag stays
+// selected until Release, so that ReadNDEF can talk to it.
+func (d *PN532) ReadPassiveTarget() (*Target, error) {
+	resp, err := d.command(cmdInListPassiveTarget, []byte{0x01, 0x00})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 1 {
+		return nil, errors.New("empty InListPassiveTarget response")
+	}
+	if resp[0] == 0 {
+		return nil, nil
+	}
+
+	// NbTg, Tg, SENS_RES (2), SEL_RES, NFCIDLength, NFCID1...
+	if len(resp) < 6 {
+		return nil, fmt.Errorf("short InListPassiveTarget response: % x", resp)
+	}
+	uidLen := int(resp[5])
+	if len(resp) < 6+uidLen {
+		return nil, fmt.Errorf("truncated UID in response: % x", resp)
+	}
+	return &Target{
+		ATQA:   uint16(resp[2])<<8 | uint16(resp[3]),
+		SAK:    resp[4],
+		UID:    append([]byte{}, resp[6:6+uidLen]...),
+		number: resp[1],
+	}, nil
+}
+
+// Release deselects target so the next poll starts a fresh activation
+func (d *PN532) Release(target *Target) error {
+	if _, err := d.command(cmdInRelease, []byte{target.number}); err != nil {
+		return fmt.Errorf("failed to release target: %w", err)
+	}
+	return nil
+}
+
+// transceive sends data to a selected target and returns its response
+func (d *PN532) transceive(target *Target, data []byte) ([]byte, error) {
+	resp, err := d.command(cmdInDataExchange, append([]byte{target.number}, data...))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 1 || resp[0]&0x3f != 0 {
+		return nil, fmt.Errorf("InDataExchange failed: % x", resp)
+	}
+	return resp[1:], nil
+}
+
+// exchange sends an APDU to a selected ISO-DEP target and returns the
+// response data without its status word, which must be 90 00
+func (d *PN532) exchange(target *Target, apdu []byte) ([]byte, error) {
+	resp, err := d.transceive(target, apdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 {
+		return nil, fmt.Errorf("short APDU response: % x", resp)
+	}
+	sw := resp[len(resp)-2:]
+	if sw[0] != 0x90 || sw[1] != 0x00 {
+		return nil, fmt.Errorf("APDU %02x %02x failed with status %02x %02x", apdu[0], apdu[1], sw[0], sw[1])
+	}
+	return resp[:len(resp)-2], nil
+}
+
+// PowerDown puts the PN532 into its low power mode. Any host interface
+// activity wakes it up again.
+func (d *PN532) PowerDown() error {
+	// Wake up on HSU, SPI or I2C activity
+	_, err := d.command(cmdPowerDown, []byte{0xb0})
+	return err
+}
+
+// Wake brings the PN532 out of power down and restores its configuration
+func (d *PN532) Wake() error {
+	if err := d.transport.Wakeup(); err != nil {
+		return fmt.Errorf("failed to wake PN532: %w", err)
+	}
+	return d.configure()
+}
+
+// Close releases the underlying transport
+func (d *PN532) Close() error {
+	return d.transport.Close()
+}
+
+// command sends a command frame and returns the response payload that
+// follows the response code
+func (d *PN532) command(cmd byte, params []byte) ([]byte, error) {
+	if err := d.transport.WriteFrame(buildFrame(append([]byte{hostToPN532, cmd}, params...))); err != nil {
+		return nil, fmt.Errorf("write failed: %w", err)
+	}
+
+	ack, err := d.transport.ReadFrame(d.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("no ACK for command 0x%02x: %w", cmd, err)
+	}
+	if !isAck(ack) {
+		return nil, fmt.Errorf("invalid ACK for command 0x%02x: % x", cmd, ack)
+	}
+
+	frame, err := d.transport.ReadFrame(d.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("no response for command 0x%02x: %w", cmd, err)
+	}
+	data, err := parseFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != pn532ToHost || data[1] != cmd+1 {
+		return nil, fmt.Errorf("unexpected response to command 0x%02x: % x", cmd, data)
+	}
+	return data[2:], nil
+}
+
+// buildFrame wraps data (TFI and payload) in a normal information frame
+func buildFrame(data []byte) []byte {
+	frame := []byte{0x00, 0x00, 0xff, byte(len(data)), byte(-len(data))}
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	frame = append(frame, data...)
+	return append(frame, -sum, 0x00)
+}
+
+// isAck reports whether raw begins with an ACK frame
+func isAck(raw []byte) bool {
+	start := bytes.Index(raw, []byte{0x00, 0xff})
+	return start >= 0 && len(raw) >= start+4 && raw[start+2] == 0x00 && raw[start+3] == 0xff
+}
+
+// parseFrame validates an information frame and returns its TFI and payload
+func parseFrame(raw []byte) ([]byte, error) {
+	start := bytes.Index(raw, []byte{0x00, 0xff})
+	if start < 0 || len(raw) < start+4 {
+		return nil, fmt.Errorf("no frame start code: % x", raw)
+	}
+	raw = raw[start+2:]
+
+	length := raw[0]
+	if length+raw[1] != 0 {
+		return nil, fmt.Errorf("bad length checksum: % x", raw)
+	}
+	if length == 0xff {
+		return nil, errors.New("extended frames are not supported")
+	}
+	if len(raw) < 2+int(length)+1 {
+		return nil, fmt.Errorf("truncated frame: % x", raw)
+	}
+
+	data := raw[2 : 2+int(length)]
+	sum := raw[2+int(length)]
+	for _, b := range data {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("bad data checksum: % x", raw)
+	}
+	if len(data) == 1 && data[0] == 0x7f {
+		return nil, errors.New("PN532 reported a syntax error")
+	}
+	return data, nil
+}
@@ -0,0 +1,283 @@
+package nfc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Recorded frames shared by the tests below
+const (
+	ack  = "< 00 00 ff 00 ff 00"
+	nack = "< 00 00 ff ff 00 00"
+
+	getFirmwareVersion = "> 00 00 ff 02 fe d4 02 2a 00"
+	firmwareVersion    = "< 00 00 ff 06 fa d5 03 32 01 06 07 e8 00"
+	samConfiguration   = "> 00 00 ff 05 fb d4 14 01 14 01 02 00"
+	samConfigured      = "< 00 00 ff 02 fe d5 15 16 00"
+	rfConfiguration    = "> 00 00 ff 06 fa d4 32 05 ff 01 10 e5 00"
+	rfConfigured       = "< 00 00 ff 02 fe d5 33 f8 00"
+	inListPassive      = "> 00 00 ff 04 fc d4 4a 01 00 e1 00"
+)
+
+// replay loads a recording in the replay file format
+func replay(t *testing.T, lines ...string) *ReplayTransport {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pn532.replay")
+	recording := "# test recording\n\n" + strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(path, []byte(recording), 0644); err != nil {
+		t.Fatal(err)
+	}
+	transport, err := LoadReplayTransport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+// frame formats a frame carrying data as a recording line, sent by the
+// host for ">" and by the PN532 for "<"
+func frame(direction string, data ...byte) string {
+	return fmt.Sprintf("%s % x", direction, buildFrame(data))
+}
+
+// checkReplayed fails the test if the driver skipped recorded frames
+func checkReplayed(t *testing.T, transport *ReplayTransport) {
+	t.Helper()
+	if n := transport.Remaining(); n != 0 {
+		t.Fatalf("%d recorded frames were not replayed", n)
+	}
+}
+
+func TestBuildFrame(t *testing.T) {
+	got := buildFrame([]byte{hostToPN532, cmdGetFirmwareVersion})
+	want := []byte{0x00, 0x00, 0xff, 0x02, 0xfe, 0xd4, 0x02, 0x2a, 0x00}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("buildFrame = % x, want % x", got, want)
+	}
+
+	data, err := parseFrame(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{hostToPN532, cmdGetFirmwareVersion}) {
+		t.Fatalf("parseFrame round trip = % x", data)
+	}
+}
+
+func TestParseFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    []byte
+		wantErr string
+	}{
+		{
+			name: "valid",
+			raw:  []byte{0x00, 0x00, 0xff, 0x02, 0xfe, 0xd5, 0x15, 0x16, 0x00},
+			want: []byte{0xd5, 0x15},
+		},
+		{
+			name: "leading padding",
+			raw:  []byte{0x01, 0x00, 0x00, 0xff, 0x02, 0xfe, 0xd5, 0x15, 0x16, 0x00},
+			want: []byte{0xd5, 0x15},
+		},
+		{
+			name:    "no start code",
+			raw:     []byte{0x01, 0x02, 0x03, 0x04},
+			wantErr: "no frame start code",
+		},
+		{
+			name:    "bad length checksum",
+			raw:     []byte{0x00, 0x00, 0xff, 0x02, 0xfd, 0xd5, 0x15, 0x16, 0x00},
+			wantErr: "bad length checksum",
+		},
+		{
+			name:    "bad data checksum",
+			raw:     []byte{0x00, 0x00, 0xff, 0x02, 0xfe, 0xd5, 0x15, 0x17, 0x00},
+			wantErr: "bad data checksum",
+		},
+		{
+			name:    "truncated",
+			raw:     []byte{0x00, 0x00, 0xff, 0x04, 0xfc, 0xd5, 0x15},
+			wantErr: "truncated frame",
+		},
+		{
+			name:    "syntax error",
+			raw:     []byte{0x00, 0x00, 0xff, 0x01, 0xff, 0x7f, 0x81, 0x00},
+			wantErr: "syntax error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := parseFrame(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.want) {
+				t.Fatalf("data % x, want % x", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAck(t *testing.T) {
+	if !isAck([]byte{0x00, 0x00, 0xff, 0x00, 0xff, 0x00}) {
+		t.Error("ACK not recognised")
+	}
+	if !isAck([]byte{0x01, 0x00, 0x00, 0xff, 0x00, 0xff, 0x00}) {
+		t.Error("ACK after a ready byte not recognised")
+	}
+	if isAck([]byte{0x00, 0x00, 0xff, 0xff, 0x00, 0x00}) {
+		t.Error("NACK taken for an ACK")
+	}
+}
+
+func TestInit(t *testing.T) {
+	transport := replay(t,
+		getFirmwareVersion, ack, firmwareVersion,
+		samConfiguration, ack, samConfigured,
+		rfConfiguration, ack, rfConfigured,
+	)
+	if err := NewPN532(transport).Init(); err != nil {
+		t.Fatal(err)
+	}
+	checkReplayed(t, transport)
+}
+
+func TestInitRejectsOtherIC(t *testing.T) {
+	transport := replay(t,
+		getFirmwareVersion, ack, "< 00 00 ff 06 fa d5 03 31 01 06 07 e9 00",
+	)
+	err := NewPN532(transport).Init()
+	if err == nil || !strings.Contains(err.Error(), "not a PN532") {
+		t.Fatalf("error %v, want IC mismatch", err)
+	}
+}
+
+func TestSAMConfigurationNack(t *testing.T) {
+	transport := replay(t,
+		getFirmwareVersion, ack, firmwareVersion,
+		samConfiguration, nack,
+	)
+	err := NewPN532(transport).Init()
+	if err == nil || !strings.Contains(err.Error(), "SAM configuration failed") || !strings.Contains(err.Error(), "invalid ACK") {
+		t.Fatalf("error %v, want SAM configuration NACK", err)
+	}
+	checkReplayed(t, transport)
+}
+
+func TestResponseChecksumError(t *testing.T) {
+	transport := replay(t,
+		getFirmwareVersion, ack, "< 00 00 ff 06 fa d5 03 32 01 06 07 e7 00",
+	)
+	err := NewPN532(transport).Init()
+	if err == nil || !strings.Contains(err.Error(), "bad data checksum") {
+		t.Fatalf("error %v, want checksum error", err)
+	}
+}
+
+func TestUnexpectedResponseCode(t *testing.T) {
+	// A response to a different command is not taken as the answer
+	transport := replay(t,
+		getFirmwareVersion, ack, samConfigured,
+	)
+	err := NewPN532(transport).Init()
+	if err == nil || !strings.Contains(err.Error(), "unexpected response") {
+		t.Fatalf("error %v, want unexpected response", err)
+	}
+}
+
+func TestReadPassiveTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		uid      string
+		atqa     uint16
+		sak      byte
+	}{
+		{
+			name:     "7 byte UID",
+			response: "< 00 00 ff 0f f1 d5 4b 01 01 00 44 00 07 04 a2 3b 1a 5c 61 80 5b 00",
+			uid:      "04a23b1a5c6180",
+			atqa:     0x0044,
+			sak:      0x00,
+		},
+		{
+			name:     "4 byte UID",
+			response: "< 00 00 ff 0c f4 d5 4b 01 01 00 04 08 04 de ad be ef 96 00",
+			uid:      "deadbeef",
+			atqa:     0x0004,
+			sak:      0x08,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := replay(t, inListPassive, ack, tt.response)
+			target, err := NewPN532(transport).ReadPassiveTarget()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target == nil {
+				t.Fatal("no target found")
+			}
+			if got := target.UIDString(); got != tt.uid {
+				t.Errorf("UID %s, want %s", got, tt.uid)
+			}
+			if target.ATQA != tt.atqa || target.SAK != tt.sak {
+				t.Errorf("ATQA %04x SAK %02x, want %04x %02x", target.ATQA, target.SAK, tt.atqa, tt.sak)
+			}
+			if target.number != 1 {
+				t.Errorf("target number %d, want 1", target.number)
+			}
+			checkReplayed(t, transport)
+		})
+	}
+}
+
+func TestReadPassiveTargetNoTag(t *testing.T) {
+	transport := replay(t, inListPassive, ack, "< 00 00 ff 03 fd d5 4b 00 e0 00")
+	target, err := NewPN532(transport).ReadPassiveTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != nil {
+		t.Fatalf("found target %+v in an empty field", target)
+	}
+}
+
+func TestReadPassiveTargetTruncatedUID(t *testing.T) {
+	transport := replay(t, inListPassive, ack, "< 00 00 ff 0a f6 d5 4b 01 01 00 44 00 07 04 a2 ed 00")
+	_, err := NewPN532(transport).ReadPassiveTarget()
+	if err == nil || !strings.Contains(err.Error(), "truncated UID") {
+		t.Fatalf("error %v, want truncated UID", err)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	// The driver sent InListPassiveTarget where GetFirmwareVersion was recorded
+	transport := replay(t, getFirmwareVersion, ack, firmwareVersion)
+	_, err := NewPN532(transport).ReadPassiveTarget()
+	if err == nil || !strings.Contains(err.Error(), "replay mismatch") {
+		t.Fatalf("error %v, want replay mismatch", err)
+	}
+}
+
+func TestLoadReplayTransportRejectsBadLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.replay")
+	if err := ioutil.WriteFile(path, []byte("> 00 00 ff\n? 00\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadReplayTransport(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("error %v, want line 2 rejected", err)
+	}
+}
@@ -2,22 +2,59 @@ package nfc
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"time"
+
+	"fizhub/internal/logging"
 )
 
+// logger is the nfc component logger
+var logger = logging.For("nfc")
+
 // Config holds NFC reader configuration
 type Config struct {
 	PowerTimeout time.Duration
+	// Transport selects the PN532 host interface: "i2c", "spi", "uart" or
+	// "replay". An empty transport disables the local reader.
+	Transport string
+	// Device is the device node, or the recording file for "replay"
+	Device string
+	// Address is the I2C address of the PN532
+	Address int
+	// Speed is the SPI clock in Hz or the UART baud rate
+	Speed int
+	// PollInterval is the delay between tag polls while the reader is awake
+	PollInterval time.Duration
+	// SleepPollInterval is the delay between polls while powered down
+	SleepPollInterval time.Duration
 }
 
+const (
+	defaultPollInterval      = 100 * time.Millisecond
+	defaultSleepPollInterval = time.Second
+)
+
 // Reader manages NFC tag reading functionality
 type Reader struct {
 	config     Config
-	tapHandler func(string) error
+	mutex      sync.RWMutex
+	tapHandler func(Tap) error
+	device     *PN532
+	stop       chan struct{}
+	done       chan struct{}
 }
 
 // NewReader creates a new NFC reader instance
 func NewReader(config Config) *Reader {
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.SleepPollInterval <= 0 {
+		config.SleepPollInterval = defaultSleepPollInterval
+	}
 	return &Reader{
 		config: config,
 	}
@@ -25,24 +62,146 @@ func NewReader(config Config) *Reader {
 
 // Start initializes the NFC reader
 func (r *Reader) Start(ctx context.Context) error {
-	// TODO: Implement actual NFC hardware initialization
+	if r.config.Transport == "" {
+		logger.Info("No NFC transport configured, local reader disabled")
+		return nil
+	}
+
+	transport, err := OpenTransport(r.config)
+	if err != nil {
+		return err
+	}
+	return r.StartWithTransport(ctx, transport)
+}
+
+// StartWithTransport initializes the PN532 on transport and begins polling
+func (r *Reader) StartWithTransport(ctx context.Context, transport Transport) error {
+	device := NewPN532(transport)
+	if err := device.Init(); err != nil {
+		transport.Close()
+		return fmt.Errorf("failed to initialize PN532: %w", err)
+	}
+
+	r.device = device
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(ctx)
 	return nil
 }
 
 // Stop shuts down the NFC reader
 func (r *Reader) Stop() error {
-	// TODO: Implement actual NFC hardware shutdown
-	return nil
+	if r.device == nil {
+		return nil
+	}
+
+	close(r.stop)
+	<-r.done
+	r.device.PowerDown()
+	err := r.device.Close()
+	r.device = nil
+	return err
 }
 
-// SetTapHandler sets the callback for NFC tag taps
-func (r *Reader) SetTapHandler(handler func(string) error) {
+// SetTapHandler sets the callback for NFC tag taps. Taps carry the tag's
+// type, NDEF message and SUN data where they could be read.
+func (r *Reader) SetTapHandler(handler func(Tap) error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	r.tapHandler = handler
 }
 
+// run polls for tags and powers the PN532 down after PowerTimeout
+// without a tap. While powered down it wakes briefly at
+// SleepPollInterval to check for a tag.
+func (r *Reader) run(ctx context.Context) {
+	defer close(r.done)
+
+	lastActivity := time.Now()
+	lastUID := ""
+	asleep := false
+
+	timer := time.NewTimer(r.config.PollInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.stop:
+			return
+		case <-timer.C:
+		}
+
+		if asleep {
+			if err := r.device.Wake(); err != nil {
+				logger.Warn("Failed to wake NFC reader", "error", err)
+			}
+		}
+
+		target, err := r.device.ReadPassiveTarget()
+		switch {
+		case errors.Is(err, io.EOF):
+			logger.Warn("NFC transport closed, stopping reader")
+			return
+		case err != nil:
+			logger.Error("NFC poll error", "error", err)
+		case target == nil:
+			lastUID = ""
+		default:
+			// A tag resting on the antenna is reported once, and only read
+			// then since reading advances an NTAG 424 DNA's counter
+			uid := target.UIDString()
+			detected := uid != lastUID
+			if detected {
+				target.Type = r.device.Identify(target)
+				if target.SupportsISODEP() || target.IsType2() {
+					ndef, err := r.device.ReadNDEF(target)
+					if err != nil {
+						logger.Debug("Failed to read NDEF message", "uid", uid, "error", err)
+					}
+					target.NDEF = ndef
+				}
+			}
+			if err := r.device.Release(target); err != nil {
+				logger.Warn("NFC release error", "error", err)
+			}
+			if detected {
+				lastUID = uid
+				r.handleTagDetected(target)
+			}
+			lastActivity = time.Now()
+			asleep = false
+		}
+
+		if r.config.PowerTimeout > 0 && time.Since(lastActivity) >= r.config.PowerTimeout {
+			if !asleep {
+				logger.Debug("NFC reader idle, powering down")
+			}
+			if err := r.device.PowerDown(); err != nil {
+				logger.Warn("Failed to power down NFC reader", "error", err)
+			}
+			asleep = true
+		}
+
+		if asleep {
+			timer.Reset(r.config.SleepPollInterval)
+		} else {
+			timer.Reset(r.config.PollInterval)
+		}
+	}
+}
+
 // handleTagDetected is called when an NFC tag is detected
-func (r *Reader) handleTagDetected(uid string) {
-	if r.tapHandler != nil {
-		r.tapHandler(uid)
+func (r *Reader) handleTagDetected(target *Target) {
+	r.mutex.RLock()
+	handler := r.tapHandler
+	r.mutex.RUnlock()
+
+	if handler != nil {
+		tap := target.Tap()
+		if err := handler(tap); err != nil {
+			logger.Info("NFC tap rejected", "uid", tap.UID, "tag_type", tap.TagType, "error", err)
+		}
 	}
 }
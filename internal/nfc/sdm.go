@@ -0,0 +1,199 @@
+package nfc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SUN is the Secure Unique NFC data an NTAG 424 DNA mirrors into its tap
+// URL on every read (NXP AN12196). PICCData is encrypted with the tag's
+// SDM meta read key and CMAC is keyed with its SDM file read key.
+type SUN struct {
+	PICCData string `json:"picc_data,omitempty"`
+	CMAC     string `json:"cmac,omitempty"`
+}
+
+// Present reports whether the tap carried SUN data
+func (s SUN) Present() bool {
+	return s.PICCData != "" || s.CMAC != ""
+}
+
+// PICCData is the decrypted content of SUN.PICCData
+type PICCData struct {
+	UID []byte
+	// Counter is the SDM read counter, which the tag increments on every
+	// read
+	Counter uint32
+}
+
+// UIDString returns the tag UID as lowercase hex
+func (d PICCData) UIDString() string {
+	return hex.EncodeToString(d.UID)
+}
+
+// ErrSUNMismatch is returned when the CMAC does not match the PICC data
+var ErrSUNMismatch = errors.New("SUN CMAC does not match")
+
+// PICCDataTag bits (NT4H2421Gx section 9.3.4)
+const (
+	piccUIDMirrored     byte = 0x80
+	piccCounterMirrored byte = 0x40
+	piccUIDLengthMask   byte = 0x0f
+)
+
+// sv2Prefix starts the session vector of the SDM file read MAC key
+var sv2Prefix = []byte{0x3c, 0xc3, 0x00, 0x01, 0x00, 0x80}
+
+// ParseKey decodes a 16 byte AES key from hex
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("key must be %d hex bytes", aes.BlockSize)
+	}
+	return key, nil
+}
+
+// ParseTapURL returns the uid, picc_data and cmac parameters of a tap URL
+// such as https://nfc.cursive.team/tap?uid=...&picc_data=...&cmac=...
+func ParseTapURL(raw string) (string, SUN, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// url.Error repeats the URL, which carries the UID
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", SUN{}, fmt.Errorf("invalid tap URL: %w", err)
+	}
+	query := u.Query()
+	sun := SUN{
+		PICCData: strings.ToLower(query.Get("picc_data")),
+		CMAC:     strings.ToLower(query.Get("cmac")),
+	}
+	return strings.ToLower(query.Get("uid")), sun, nil
+}
+
+// DecryptPICCData decrypts the PICC data of a tap with the SDM meta read
+// key. The tag must mirror both its UID and its read counter.
+func DecryptPICCData(metaReadKey []byte, piccData string) (PICCData, error) {
+	encrypted, err := hex.DecodeString(piccData)
+	if err != nil || len(encrypted) != aes.BlockSize {
+		return PICCData{}, fmt.Errorf("PICC data must be %d hex bytes", aes.BlockSize)
+	}
+	block, err := aes.NewCipher(metaReadKey)
+	if err != nil {
+		return PICCData{}, err
+	}
+	plain := make([]byte, aes.BlockSize)
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plain, encrypted)
+
+	tag := plain[0]
+	uidLen := int(tag & piccUIDLengthMask)
+	if tag&piccUIDMirrored == 0 || tag&piccCounterMirrored == 0 || uidLen != 7 {
+		return PICCData{}, fmt.Errorf("PICC data does not hold a UID and read counter (tag 0x%02x), wrong key?", tag)
+	}
+	counter := plain[1+uidLen : 1+uidLen+3]
+	return PICCData{
+		UID:     append([]byte{}, plain[1:1+uidLen]...),
+		Counter: uint32(counter[0]) | uint32(counter[1])<<8 | uint32(counter[2])<<16,
+	}, nil
+}
+
+// VerifySUNMAC checks the CMAC of a tap with the SDM file read key. Tags
+// are expected to MAC an empty input, which is the case when the URL
+// mirrors no encrypted file data.
+func VerifySUNMAC(fileReadKey []byte, data PICCData, mac string) error {
+	expected, err := hex.DecodeString(mac)
+	if err != nil || len(expected) != 8 {
+		return errors.New("CMAC must be 8 hex bytes")
+	}
+
+	sv2 := make([]byte, aes.BlockSize)
+	n := copy(sv2, sv2Prefix)
+	n += copy(sv2[n:], data.UID)
+	sv2[n] = byte(data.Counter)
+	sv2[n+1] = byte(data.Counter >> 8)
+	sv2[n+2] = byte(data.Counter >> 16)
+
+	sessionKey, err := aesCMAC(fileReadKey, sv2)
+	if err != nil {
+		return err
+	}
+	full, err := aesCMAC(sessionKey, nil)
+	if err != nil {
+		return err
+	}
+	// The tag sends the odd-numbered bytes of the full MAC
+	truncated := make([]byte, 8)
+	for i := range truncated {
+		truncated[i] = full[2*i+1]
+	}
+	if subtle.ConstantTimeCompare(truncated, expected) != 1 {
+		return ErrSUNMismatch
+	}
+	return nil
+}
+
+// aesCMAC computes the AES-CMAC of msg (RFC 4493)
+func aesCMAC(key, msg []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	k1 = cmacSubkey(k1)
+	k2 := cmacSubkey(k1)
+
+	blocks := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	complete := blocks > 0 && len(msg)%aes.BlockSize == 0
+	if blocks == 0 {
+		blocks = 1
+	}
+
+	last := make([]byte, aes.BlockSize)
+	rest := msg[(blocks-1)*aes.BlockSize:]
+	copy(last, rest)
+	subkey := k1
+	if !complete {
+		last[len(rest)] = 0x80
+		subkey = k2
+	}
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < blocks-1; i++ {
+		xorBlock(x, msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(x, x)
+	}
+	xorBlock(last, subkey)
+	xorBlock(x, last)
+	block.Encrypt(x, x)
+	return x, nil
+}
+
+// xorBlock XORs src into dst
+func xorBlock(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// cmacSubkey derives the next CMAC subkey by doubling in GF(2^128)
+func cmacSubkey(in []byte) []byte {
+	out := make([]byte, len(in))
+	var carry byte
+	for i := len(in) - 1; i >= 0; i-- {
+		out[i] = in[i]<<1 | carry
+		carry = in[i] >> 7
+	}
+	if carry != 0 {
+		out[len(out)-1] ^= 0x87
+	}
+	return out
+}
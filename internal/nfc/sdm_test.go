@@ -0,0 +1,182 @@
+package nfc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The SUN example of NXP AN12196, made with all-zero SDM keys
+const (
+	exampleUID      = "04de5f1eacc040"
+	exampleCounter  = 61
+	examplePICCData = "EF963FF7828658A599F3041510671E88"
+	exampleCMAC     = "94EED9EE65337086"
+)
+
+var zeroKey = make([]byte, 16)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAESCMAC(t *testing.T) {
+	// RFC 4493 section 4
+	key := "2b7e1516 28aed2a6 abf71588 09cf4f3c"
+	msg := "6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51 30c81c46 a35ce411 e5fbc119 1a0a52ef f69f2445 df4f9b17 ad2b417b e66c3710"
+	tests := []struct {
+		length int
+		want   string
+	}{
+		{0, "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{16, "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{40, "dfa66747 de9ae630 30ca3261 1497c827"},
+		{64, "51f0bebf 7e3b9d92 fc497417 79363cfe"},
+	}
+	for _, tt := range tests {
+		got, err := aesCMAC(mustHex(t, key), mustHex(t, msg)[:tt.length])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := mustHex(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("CMAC of %d bytes = %x, want %x", tt.length, got, want)
+		}
+	}
+
+	if _, err := aesCMAC([]byte("short"), nil); err == nil {
+		t.Fatal("CMAC with a bad key succeeded")
+	}
+}
+
+func TestCMACSubkeys(t *testing.T) {
+	// RFC 4493 section 4, subkey generation
+	l := mustHex(t, "7df76b0c 1ab899b3 3e42f047 b91b546f")
+	k1 := cmacSubkey(l)
+	k2 := cmacSubkey(k1)
+	if want := mustHex(t, "fbeed618 35713366 7c85e08f 7236a8de"); !bytes.Equal(k1, want) {
+		t.Errorf("K1 = %x, want %x", k1, want)
+	}
+	if want := mustHex(t, "f7ddac30 6ae266cc f90bc11e e46d513b"); !bytes.Equal(k2, want) {
+		t.Errorf("K2 = %x, want %x", k2, want)
+	}
+}
+
+func TestDecryptPICCData(t *testing.T) {
+	data, err := DecryptPICCData(zeroKey, strings.ToLower(examplePICCData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.UIDString() != exampleUID || data.Counter != exampleCounter {
+		t.Fatalf("decrypted UID %s counter %d", data.UIDString(), data.Counter)
+	}
+
+	otherKey := bytes.Repeat([]byte{0x01}, 16)
+	tests := []struct {
+		name     string
+		key      []byte
+		piccData string
+	}{
+		{"wrong key", otherKey, examplePICCData},
+		{"bad key", []byte("short"), examplePICCData},
+		{"missing", zeroKey, ""},
+		{"not hex", zeroKey, "zz963ff7828658a599f3041510671e88"},
+		{"too short", zeroKey, examplePICCData[:30]},
+		{"too long", zeroKey, examplePICCData + "00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if data, err := DecryptPICCData(tt.key, tt.piccData); err == nil {
+				t.Fatalf("decrypted %+v", data)
+			}
+		})
+	}
+}
+
+func TestVerifySUNMAC(t *testing.T) {
+	data := PICCData{UID: mustHex(t, exampleUID), Counter: exampleCounter}
+	if err := VerifySUNMAC(zeroKey, data, exampleCMAC); err != nil {
+		t.Fatal(err)
+	}
+
+	nextRead := data
+	nextRead.Counter++
+	otherUID := PICCData{UID: mustHex(t, "04de5f1eacc041"), Counter: exampleCounter}
+	tests := []struct {
+		name    string
+		key     []byte
+		data    PICCData
+		mac     string
+		wantErr error
+	}{
+		{"wrong MAC", zeroKey, data, "94EED9EE65337087", ErrSUNMismatch},
+		{"wrong key", bytes.Repeat([]byte{0x01}, 16), data, exampleCMAC, ErrSUNMismatch},
+		{"other counter", zeroKey, nextRead, exampleCMAC, ErrSUNMismatch},
+		{"other UID", zeroKey, otherUID, exampleCMAC, ErrSUNMismatch},
+		{"missing MAC", zeroKey, data, "", nil},
+		{"short MAC", zeroKey, data, exampleCMAC[:14], nil},
+		{"not hex", zeroKey, data, "zzEED9EE65337086", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySUNMAC(tt.key, tt.data, tt.mac)
+			if err == nil {
+				t.Fatal("MAC accepted")
+			}
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTapURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		uid     string
+		sun     SUN
+		wantErr bool
+	}{
+		{
+			name: "AN12196 example",
+			url:  "https://nfc.cursive.team/tap?uid=04DE5F1EACC040&picc_data=" + examplePICCData + "&cmac=" + exampleCMAC,
+			uid:  exampleUID,
+			sun:  SUN{PICCData: strings.ToLower(examplePICCData), CMAC: strings.ToLower(exampleCMAC)},
+		},
+		{name: "uid only", url: "https://nfc.cursive.team/tap?uid=04de5f1eacc040", uid: exampleUID},
+		{name: "no parameters", url: "https://nfc.cursive.team/tap"},
+		{name: "cmac only", url: "https://nfc.cursive.team/tap?cmac=" + exampleCMAC, sun: SUN{CMAC: strings.ToLower(exampleCMAC)}},
+		{name: "bad escape", url: "https://nfc.cursive.team/%zz?uid=04de5f1eacc040", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, sun, err := ParseTapURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v", err)
+			}
+			if uid != tt.uid || sun != tt.sun {
+				t.Fatalf("got %q %+v, want %q %+v", uid, sun, tt.uid, tt.sun)
+			}
+			if sun.Present() != (tt.sun.PICCData != "" || tt.sun.CMAC != "") {
+				t.Fatalf("Present() = %v", sun.Present())
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	if key, err := ParseKey("00000000000000000000000000000000"); err != nil || !bytes.Equal(key, zeroKey) {
+		t.Fatalf("ParseKey = %x, %v", key, err)
+	}
+	for _, s := range []string{"", "00", "zz000000000000000000000000000000", "0000000000000000000000000000000000"} {
+		if _, err := ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q) succeeded", s)
+		}
+	}
+}
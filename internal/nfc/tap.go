@@ -0,0 +1,80 @@
+package nfc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Tag types reported in Tap.TagType. Tags that cannot be told apart are
+// left untyped.
+const (
+	TagNTAG213       = "ntag213"
+	TagNTAG215       = "ntag215"
+	TagNTAG216       = "ntag216"
+	TagNTAG424       = "ntag424"
+	TagMifareClassic = "mifare_classic"
+	TagDESFire       = "desfire"
+)
+
+// Tap is a single tag read, from the hub's own reader or a Fiz Reader
+type Tap struct {
+	UID     string `json:"uid"`
+	TagType string `json:"tag_type,omitempty"`
+	// ATQA and SAK are the tag's anticollision answers as hex, such as
+	// "0044" and "00" for an NTAG21x
+	ATQA string `json:"atqa,omitempty"`
+	SAK  string `json:"sak,omitempty"`
+	// NDEF is the tag's NDEF message as hex, when it was read
+	NDEF string `json:"ndef,omitempty"`
+	// SUN is the tap's NTAG 424 DNA SUN data
+	SUN
+	ReaderID string `json:"reader_id"`
+	// RSSI is the Wi-Fi signal strength of the reader in dBm, 0 for the
+	// hub's own reader
+	RSSI int `json:"rssi,omitempty"`
+	// Time is when the hub received the tap
+	Time time.Time `json:"time"`
+}
+
+// mifareClassicSAKs are the SAKs of MIFARE Classic Mini, 1K, 4K and 1K
+// emulated by SmartMX chips
+var mifareClassicSAKs = map[byte]bool{0x08: true, 0x09: true, 0x18: true, 0x88: true}
+
+// desfireATQA is shared by MIFARE DESFire and NTAG 424 DNA, which only
+// their version tells apart
+const desfireATQA uint16 = 0x0344
+
+// nxpVendorID starts the version of NXP tags
+const nxpVendorID byte = 0x04
+
+// ClassifyTag returns the tag type that the ATQA and SAK alone imply. An
+// NTAG 424 DNA is reported as DESFire and NTAG21x tags are left untyped.
+func ClassifyTag(atqa uint16, sak byte) string {
+	switch {
+	case mifareClassicSAKs[sak]:
+		return TagMifareClassic
+	case sak&sakISO14443_4 != 0 && atqa == desfireATQA:
+		return TagDESFire
+	default:
+		return ""
+	}
+}
+
+// Tap describes a read of target as a tap received now
+func (t *Target) Tap() Tap {
+	tap := Tap{
+		UID:     t.UIDString(),
+		TagType: t.Type,
+		ATQA:    fmt.Sprintf("%04x", t.ATQA),
+		SAK:     fmt.Sprintf("%02x", t.SAK),
+		NDEF:    hex.EncodeToString(t.NDEF),
+		Time:    time.Now(),
+	}
+	if uri, ok := NDEFURI(t.NDEF); ok {
+		if _, sun, err := ParseTapURL(uri); err == nil {
+			tap.SUN = sun
+		}
+	}
+	return tap
+}
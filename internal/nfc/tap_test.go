@@ -0,0 +1,71 @@
+package nfc
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// uriRecord returns an NDEF message of one short URI record with the
+// given prefix code
+func uriRecord(prefix byte, uri string) []byte {
+	payload := append([]byte{prefix}, uri...)
+	return append([]byte{0xd1, 0x01, byte(len(payload)), 'U'}, payload...)
+}
+
+func TestClassifyTag(t *testing.T) {
+	tests := []struct {
+		name string
+		atqa uint16
+		sak  byte
+		want string
+	}{
+		{"MIFARE Classic 1K", 0x0004, 0x08, TagMifareClassic},
+		{"MIFARE Classic 4K", 0x0002, 0x18, TagMifareClassic},
+		{"MIFARE Classic Mini", 0x0004, 0x09, TagMifareClassic},
+		{"SmartMX with MIFARE Classic", 0x0004, 0x88, TagMifareClassic},
+		{"DESFire", 0x0344, 0x20, TagDESFire},
+		{"DESFire with more SAK bits", 0x0344, 0x24, TagDESFire},
+		{"NTAG21x", 0x0044, 0x00, ""},
+		{"other ISO-DEP tag", 0x0004, 0x20, ""},
+		{"DESFire ATQA without ISO-DEP", 0x0344, 0x00, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyTag(tt.atqa, tt.sak); got != tt.want {
+				t.Fatalf("ClassifyTag(%04x, %02x) = %q, want %q", tt.atqa, tt.sak, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetTap(t *testing.T) {
+	url := "nfc.cursive.team/tap?uid=04DE5F1EACC040&picc_data=" + examplePICCData + "&cmac=" + exampleCMAC
+	target := &Target{
+		UID:  mustHex(t, exampleUID),
+		ATQA: 0x0344,
+		SAK:  0x20,
+		Type: TagNTAG424,
+		NDEF: uriRecord(0x04, url),
+	}
+	tap := target.Tap()
+	if tap.UID != exampleUID || tap.TagType != TagNTAG424 || tap.ATQA != "0344" || tap.SAK != "20" {
+		t.Fatalf("tap %+v", tap)
+	}
+	if tap.NDEF != hex.EncodeToString(target.NDEF) {
+		t.Fatalf("NDEF %s", tap.NDEF)
+	}
+	want := SUN{PICCData: strings.ToLower(examplePICCData), CMAC: strings.ToLower(exampleCMAC)}
+	if tap.SUN != want {
+		t.Fatalf("SUN %+v, want %+v", tap.SUN, want)
+	}
+	if tap.Time.IsZero() {
+		t.Fatal("tap has no time")
+	}
+
+	// A tag without NDEF has no SUN data
+	plain := (&Target{UID: []byte{0xde, 0xad, 0xbe, 0xef}, ATQA: 0x0004, SAK: 0x08}).Tap()
+	if plain.UID != "deadbeef" || plain.ATQA != "0004" || plain.SAK != "08" || plain.NDEF != "" || plain.SUN.Present() {
+		t.Fatalf("tap %+v", plain)
+	}
+}
@@ -0,0 +1,170 @@
+package nfc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport moves PN532 frames over a host interface
+type Transport interface {
+	// WriteFrame sends a complete frame to the PN532
+	WriteFrame(frame []byte) error
+	// ReadFrame waits up to timeout for the PN532 to become ready and
+	// returns the next frame. Trailing padding may follow the frame.
+	ReadFrame(timeout time.Duration) ([]byte, error)
+	// Wakeup brings the PN532 out of power down
+	Wakeup() error
+	// Close releases the interface
+	Close() error
+}
+
+// Transport names accepted in Config.Transport
+const (
+	TransportI2C    = "i2c"
+	TransportSPI    = "spi"
+	TransportUART   = "uart"
+	TransportReplay = "replay"
+)
+
+// ErrTimeout is returned when the PN532 does not become ready in time
+var ErrTimeout = errors.New("timed out waiting for PN532")
+
+// maxFrameSize covers the largest normal information frame
+const maxFrameSize = 262
+
+// OpenTransport opens the transport selected in config
+func OpenTransport(config Config) (Transport, error) {
+	switch config.Transport {
+	case TransportI2C:
+		return openI2C(config.Device, config.Address)
+	case TransportSPI:
+		return openSPI(config.Device, config.Speed)
+	case TransportUART:
+		return openUART(config.Device, config.Speed)
+	case TransportReplay:
+		return LoadReplayTransport(config.Device)
+	default:
+		return nil, fmt.Errorf("unknown NFC transport: %q", config.Transport)
+	}
+}
+
+// ReplayTransport is a fake transport that replays a recorded PN532
+// conversation. It lets the driver run without hardware.
+type ReplayTransport struct {
+	mutex sync.Mutex
+	steps []ReplayStep
+}
+
+// ReplayStep is a single recorded frame. Out frames are expected from the
+// host, in frames are returned by ReadFrame.
+type ReplayStep struct {
+	Out   bool
+	Frame []byte
+}
+
+// NewReplayTransport creates a transport that replays steps in order
+func NewReplayTransport(steps []ReplayStep) *ReplayTransport {
+	return &ReplayTransport{steps: steps}
+}
+
+// LoadReplayTransport reads a recording from path. Each line holds one
+// frame in hex, prefixed with ">" for host to PN532 or "<" for PN532 to
+// host. Blank lines and lines starting with "#" are ignored.
+func LoadReplayTransport(path string) (*ReplayTransport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay file: %w", err)
+	}
+	defer file.Close()
+
+	var steps []ReplayStep
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var step ReplayStep
+		switch text[0] {
+		case '>':
+			step.Out = true
+		case '<':
+		default:
+			return nil, fmt.Errorf("replay line %d: expected '>' or '<'", line)
+		}
+		frame, err := hex.DecodeString(strings.Join(strings.Fields(text[1:]), ""))
+		if err != nil {
+			return nil, fmt.Errorf("replay line %d: %w", line, err)
+		}
+		step.Frame = frame
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read replay file: %w", err)
+	}
+	return NewReplayTransport(steps), nil
+}
+
+// WriteFrame checks frame against the next recorded host frame
+func (t *ReplayTransport) WriteFrame(frame []byte) error {
+	step, err := t.next(true)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(step.Frame, frame) {
+		return fmt.Errorf("replay mismatch: wrote % x, expected % x", frame, step.Frame)
+	}
+	return nil
+}
+
+// ReadFrame returns the next recorded PN532 frame
+func (t *ReplayTransport) ReadFrame(timeout time.Duration) ([]byte, error) {
+	step, err := t.next(false)
+	if err != nil {
+		return nil, err
+	}
+	return step.Frame, nil
+}
+
+// Wakeup is a no-op for recordings
+func (t *ReplayTransport) Wakeup() error {
+	return nil
+}
+
+// Close is a no-op for recordings
+func (t *ReplayTransport) Close() error {
+	return nil
+}
+
+// Remaining returns the number of steps not yet replayed
+func (t *ReplayTransport) Remaining() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.steps)
+}
+
+// next pops the next step, which must travel in the given direction.
+// io.EOF is returned once the recording is exhausted.
+func (t *ReplayTransport) next(out bool) (ReplayStep, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.steps) == 0 {
+		return ReplayStep{}, io.EOF
+	}
+	step := t.steps[0]
+	if step.Out != out {
+		return ReplayStep{}, fmt.Errorf("replay out of order: next recorded frame is % x", step.Frame)
+	}
+	t.steps = t.steps[1:]
+	return step, nil
+}
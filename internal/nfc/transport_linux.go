@@ -0,0 +1,383 @@
+package nfc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Linux ioctl requests for i2c-dev and spidev
+const (
+	i2cSlave           = 0x0703
+	spiIOCWrMode       = 0x40016b01
+	spiIOCWrMaxSpeedHz = 0x40046b04
+	spiIOCMessage1     = 0x40206b00
+)
+
+// Defaults for each host interface
+const (
+	defaultI2CDevice  = "/dev/i2c-1"
+	defaultI2CAddress = 0x24
+	defaultSPIDevice  = "/dev/spidev0.0"
+	defaultSPISpeed   = 1000000
+	defaultUARTDevice = "/dev/serial0"
+	defaultUARTSpeed  = 115200
+	readySize         = 128
+	readyPollInterval = 2 * time.Millisecond
+)
+
+// PN532 SPI data direction bytes
+const (
+	spiDataWrite  byte = 0x01
+	spiStatusRead byte = 0x02
+	spiDataRead   byte = 0x03
+)
+
+// i2cTransport talks to a PN532 through /dev/i2c-N
+type i2cTransport struct {
+	file *os.File
+}
+
+func openI2C(device string, address int) (Transport, error) {
+	if device == "" {
+		device = defaultI2CDevice
+	}
+	if address == 0 {
+		address = defaultI2CAddress
+	}
+
+	file, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", device, err)
+	}
+	if err := ioctl(file, i2cSlave, uintptr(address)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to select I2C address 0x%02x: %w", address, err)
+	}
+	return &i2cTransport{file: file}, nil
+}
+
+func (t *i2cTransport) WriteFrame(frame []byte) error {
+	_, err := t.file.Write(frame)
+	return err
+}
+
+// ReadFrame polls the status byte that precedes every I2C read until the
+// PN532 reports ready, then reads the frame
+func (t *i2cTransport) ReadFrame(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	status := make([]byte, 1)
+	for {
+		if _, err := t.file.Read(status); err == nil && status[0]&0x01 == 0x01 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+		time.Sleep(readyPollInterval)
+	}
+
+	buf := make([]byte, readySize+1)
+	n, err := t.file.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[1:n], nil
+}
+
+// Wakeup addresses the PN532, which wakes it. The first transfer may be
+// NACKed while the oscillator starts.
+func (t *i2cTransport) Wakeup() error {
+	t.file.Write([]byte{0x00})
+	time.Sleep(2 * time.Millisecond)
+	return nil
+}
+
+func (t *i2cTransport) Close() error {
+	return t.file.Close()
+}
+
+// spiTransport talks to a PN532 through /dev/spidevB.C. The PN532 sends
+// LSB first, so bytes are bit-reversed in software.
+type spiTransport struct {
+	file  *os.File
+	speed uint32
+}
+
+// spiIOCTransfer mirrors struct spi_ioc_transfer from linux/spi/spidev.h
+type spiIOCTransfer struct {
+	txBuf          uint64
+	rxBuf          uint64
+	length         uint32
+	speedHz        uint32
+	delayUsecs     uint16
+	bitsPerWord    uint8
+	csChange       uint8
+	txNbits        uint8
+	rxNbits        uint8
+	wordDelayUsecs uint8
+	pad            uint8
+}
+
+func openSPI(device string, speed int) (Transport, error) {
+	if device == "" {
+		device = defaultSPIDevice
+	}
+	if speed == 0 {
+		speed = defaultSPISpeed
+	}
+
+	file, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", device, err)
+	}
+
+	mode := uint8(0)
+	if err := ioctlPtr(file, spiIOCWrMode, unsafe.Pointer(&mode)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to set SPI mode: %w", err)
+	}
+	maxSpeed := uint32(speed)
+	if err := ioctlPtr(file, spiIOCWrMaxSpeedHz, unsafe.Pointer(&maxSpeed)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to set SPI speed: %w", err)
+	}
+	return &spiTransport{file: file, speed: maxSpeed}, nil
+}
+
+func (t *spiTransport) WriteFrame(frame []byte) error {
+	_, err := t.transfer(append([]byte{spiDataWrite}, frame...))
+	return err
+}
+
+func (t *spiTransport) ReadFrame(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := t.transfer([]byte{spiStatusRead, 0x00})
+		if err != nil {
+			return nil, err
+		}
+		if status[1]&0x01 == 0x01 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+		time.Sleep(readyPollInterval)
+	}
+
+	tx := make([]byte, readySize+1)
+	tx[0] = spiDataRead
+	rx, err := t.transfer(tx)
+	if err != nil {
+		return nil, err
+	}
+	return rx[1:], nil
+}
+
+// Wakeup toggles chip select, which wakes the PN532
+func (t *spiTransport) Wakeup() error {
+	if _, err := t.transfer([]byte{0x00}); err != nil {
+		return err
+	}
+	time.Sleep(2 * time.Millisecond)
+	return nil
+}
+
+func (t *spiTransport) Close() error {
+	return t.file.Close()
+}
+
+// transfer performs one full-duplex transfer with chip select held
+func (t *spiTransport) transfer(tx []byte) ([]byte, error) {
+	out := make([]byte, len(tx))
+	for i, b := range tx {
+		out[i] = reverseBits(b)
+	}
+	in := make([]byte, len(tx))
+
+	xfer := spiIOCTransfer{
+		txBuf:       uint64(uintptr(unsafe.Pointer(&out[0]))),
+		rxBuf:       uint64(uintptr(unsafe.Pointer(&in[0]))),
+		length:      uint32(len(tx)),
+		speedHz:     t.speed,
+		bitsPerWord: 8,
+	}
+	if err := ioctlPtr(t.file, spiIOCMessage1, unsafe.Pointer(&xfer)); err != nil {
+		return nil, err
+	}
+	runtime.KeepAlive(out)
+
+	for i, b := range in {
+		in[i] = reverseBits(b)
+	}
+	return in, nil
+}
+
+// uartTransport talks to a PN532 in HSU mode through a serial port
+type uartTransport struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// uartSpeeds maps supported baud rates to termios speed flags
+var uartSpeeds = map[int]uint32{
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+	230400: syscall.B230400,
+	460800: syscall.B460800,
+	921600: syscall.B921600,
+}
+
+func openUART(device string, speed int) (Transport, error) {
+	if device == "" {
+		device = defaultUARTDevice
+	}
+	if speed == 0 {
+		speed = defaultUARTSpeed
+	}
+	baud, ok := uartSpeeds[speed]
+	if !ok {
+		return nil, fmt.Errorf("unsupported UART speed: %d", speed)
+	}
+
+	file, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", device, err)
+	}
+
+	// Raw 8N1 at the requested speed
+	termios := syscall.Termios{
+		Cflag:  baud | syscall.CS8 | syscall.CREAD | syscall.CLOCAL,
+		Ispeed: baud,
+		Ospeed: baud,
+	}
+	termios.Cc[syscall.VMIN] = 1
+	if err := ioctlPtr(file, syscall.TCSETS, unsafe.Pointer(&termios)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to configure %s: %w", device, err)
+	}
+
+	return &uartTransport{file: file, reader: bufio.NewReader(file)}, nil
+}
+
+func (t *uartTransport) WriteFrame(frame []byte) error {
+	_, err := t.file.Write(frame)
+	return err
+}
+
+// ReadFrame scans the byte stream for a start code and reads one frame
+func (t *uartTransport) ReadFrame(timeout time.Duration) ([]byte, error) {
+	if err := t.file.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var prev byte = 0xff
+	for {
+		b, err := t.reader.ReadByte()
+		if err != nil {
+			return nil, uartError(err)
+		}
+		if prev == 0x00 && b == 0xff {
+			break
+		}
+		prev = b
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(t.reader, header); err != nil {
+		return nil, uartError(err)
+	}
+	length, lcs := header[0], header[1]
+	if length == 0x00 && lcs == 0xff {
+		t.reader.ReadByte()
+		return append([]byte{}, ackFrame...), nil
+	}
+	if length+lcs != 0 {
+		return nil, fmt.Errorf("bad length checksum: %02x %02x", length, lcs)
+	}
+
+	rest := make([]byte, int(length)+2)
+	if _, err := io.ReadFull(t.reader, rest); err != nil {
+		return nil, uartError(err)
+	}
+	return append([]byte{0x00, 0x00, 0xff, length, lcs}, rest...), nil
+}
+
+// Wakeup sends the HSU wake-up preamble and drops any stale input
+func (t *uartTransport) Wakeup() error {
+	preamble := make([]byte, 16)
+	preamble[0], preamble[1] = 0x55, 0x55
+	if _, err := t.file.Write(preamble); err != nil {
+		return err
+	}
+	time.Sleep(2 * time.Millisecond)
+	t.reader.Reset(t.file)
+	return nil
+}
+
+func (t *uartTransport) Close() error {
+	return t.file.Close()
+}
+
+// uartError maps deadline errors to ErrTimeout
+func uartError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrTimeout
+	}
+	return err
+}
+
+// ioctl issues an ioctl on file without switching it to blocking mode
+func ioctl(file *os.File, request, arg uintptr) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ioctlPtr issues an ioctl whose argument points to a kernel structure
+func ioctlPtr(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// reverseBits mirrors the bit order of b
+func reverseBits(b byte) byte {
+	b = b>>4 | b<<4
+	b = (b&0xcc)>>2 | (b&0x33)<<2
+	return (b&0xaa)>>1 | (b&0x55)<<1
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package nfc
+
+import "fmt"
+
+func openI2C(device string, address int) (Transport, error) {
+	return nil, fmt.Errorf("NFC transport %s is only supported on Linux", TransportI2C)
+}
+
+func openSPI(device string, speed int) (Transport, error) {
+	return nil, fmt.Errorf("NFC transport %s is only supported on Linux", TransportSPI)
+}
+
+func openUART(device string, speed int) (Transport, error) {
+	return nil, fmt.Errorf("NFC transport %s is only supported on Linux", TransportUART)
+}
@@ -2,10 +2,17 @@ package power
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
+
+	"fizhub/internal/events"
+	"fizhub/internal/logging"
 )
 
+// logger is the power component logger
+var logger = logging.For("power")
+
 // State represents the power state
 type State int
 
@@ -15,6 +22,20 @@ const (
 	StateDeepSleep
 )
 
+// String returns a readable name for the power state
+func (s State) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateDeepSleep:
+		return "deep_sleep"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
 // Config holds power management configuration
 type Config struct {
 	IdleTimeout    time.Duration
@@ -28,6 +49,7 @@ type Manager struct {
 	currentState  State
 	lastActivity  time.Time
 	stateHandler  func(State)
+	events        *events.Bus
 }
 
 // NewManager creates a new power manager instance
@@ -51,10 +73,7 @@ func (m *Manager) Stop() error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	
-	m.currentState = StateDeepSleep
-	if m.stateHandler != nil {
-		m.stateHandler(m.currentState)
-	}
+	m.setState(StateDeepSleep)
 	return nil
 }
 
@@ -65,10 +84,7 @@ func (m *Manager) RecordActivity() {
 
 	m.lastActivity = time.Now()
 	if m.currentState != StateActive {
-		m.currentState = StateActive
-		if m.stateHandler != nil {
-			m.stateHandler(m.currentState)
-		}
+		m.setState(StateActive)
 	}
 }
 
@@ -79,6 +95,28 @@ func (m *Manager) SetOnStateChange(handler func(State)) {
 	m.stateHandler = handler
 }
 
+// SetEventBus sets the bus that power state changes are published to
+func (m *Manager) SetEventBus(bus *events.Bus) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.events = bus
+}
+
+// setState changes the power state and notifies the handler. Callers must
+// hold the mutex.
+func (m *Manager) setState(state State) {
+	previous := m.currentState
+	m.currentState = state
+	logger.Info("Power state changed", "state", state, "previous", previous)
+	m.events.Publish(events.TypePower, events.PowerData{
+		State:    state.String(),
+		Previous: previous.String(),
+	})
+	if m.stateHandler != nil {
+		m.stateHandler(m.currentState)
+	}
+}
+
 // GetState returns the current power state
 func (m *Manager) GetState() State {
 	m.mutex.RLock()
@@ -118,17 +156,11 @@ func (m *Manager) updatePowerState() {
 	switch {
 	case inactiveTime >= m.config.DeepSleepDelay:
 		if m.currentState != StateDeepSleep {
-			m.currentState = StateDeepSleep
-			if m.stateHandler != nil {
-				m.stateHandler(m.currentState)
-			}
+			m.setState(StateDeepSleep)
 		}
 	case inactiveTime >= m.config.IdleTimeout:
 		if m.currentState != StateIdle {
-			m.currentState = StateIdle
-			if m.stateHandler != nil {
-				m.stateHandler(m.currentState)
-			}
+			m.setState(StateIdle)
 		}
 	}
 }
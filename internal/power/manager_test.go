@@ -0,0 +1,46 @@
+package power
+
+import (
+	"testing"
+	"time"
+
+	"fizhub/internal/events"
+)
+
+func TestStateChangesArePublished(t *testing.T) {
+	m := NewManager(Config{IdleTimeout: time.Minute, DeepSleepDelay: 5 * time.Minute})
+	bus := events.NewBus(events.Config{})
+	m.SetEventBus(bus)
+	sub := bus.Subscribe(0)
+
+	var handled []State
+	m.SetOnStateChange(func(state State) { handled = append(handled, state) })
+
+	m.lastActivity = time.Now().Add(-2 * time.Minute)
+	m.updatePowerState()
+	m.updatePowerState()
+	m.lastActivity = time.Now().Add(-10 * time.Minute)
+	m.updatePowerState()
+	m.RecordActivity()
+	m.RecordActivity()
+
+	want := []events.PowerData{
+		{State: "idle", Previous: "active"},
+		{State: "deep_sleep", Previous: "idle"},
+		{State: "active", Previous: "deep_sleep"},
+	}
+	for _, w := range want {
+		event := <-sub.Events()
+		if event.Type != events.TypePower || event.Data.(events.PowerData) != w {
+			t.Fatalf("event %+v, want %+v", event, w)
+		}
+	}
+	select {
+	case event := <-sub.Events():
+		t.Fatalf("unexpected event %+v", event)
+	default:
+	}
+	if len(handled) != 3 || handled[2] != StateActive {
+		t.Fatalf("handler saw %v", handled)
+	}
+}
@@ -8,8 +8,15 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"fizhub/internal/events"
+	"fizhub/internal/logging"
+	"fizhub/internal/nfc"
 )
 
+// logger is the state component logger
+var logger = logging.For("state")
+
 // Phase represents different system phases
 type Phase int
 
@@ -21,6 +28,24 @@ const (
 	PhaseComplete
 )
 
+// String returns a readable name for the phase
+func (p Phase) String() string {
+	switch p {
+	case PhaseInitial:
+		return "initial"
+	case PhaseCollectingUIDs:
+		return "collecting_uids"
+	case PhaseValidating:
+		return "validating"
+	case PhaseRecordingMessage:
+		return "recording_message"
+	case PhaseComplete:
+		return "complete"
+	default:
+		return fmt.Sprintf("phase(%d)", int(p))
+	}
+}
+
 // Event represents different system events
 type Event int
 
@@ -30,25 +55,136 @@ const (
 	EventRecordingStarted
 	EventRecordingComplete
 	EventError
+	EventCommit
+	EventRecordingFailed
 )
 
+// Round identifies one group's pass through validation. Validation
+// results carry the round they were started in, so that a result arriving
+// after the session has moved on is not applied to another group.
+type Round uint64
+
+// ValidationResult is the data of EventUIDValidated, and of EventError
+// when a validation fails
+type ValidationResult struct {
+	Round    Round
+	Accounts []string
+	Err      error
+}
+
+// ErrStaleRound is returned for a validation result or reset of a group
+// that the session no longer holds
+var ErrStaleRound = errors.New("session has moved on to another group")
+
+// DefaultBondSize is the number of UIDs in a bond when none is configured
+const DefaultBondSize = 3
+
+// Config holds state manager configuration. A zero timeout disables it.
+type Config struct {
+	// Name identifies the session in published events
+	Name string
+	// MinBondSize is the fewest UIDs that EventCommit will validate
+	MinBondSize int
+	// MaxBondSize is the number of UIDs that starts validation on its own
+	MaxBondSize int
+	// CollectingTimeout abandons a partial tap set after this long
+	// without a new tap
+	CollectingTimeout time.Duration
+	// ValidatingTimeout bounds the wait for a Cursive validation result
+	ValidatingTimeout time.Duration
+	// RecordingTimeout bounds the message recording phase
+	RecordingTimeout time.Duration
+	// CompleteCooldown is how long the complete phase is shown before
+	// the hub starts collecting again
+	CompleteCooldown time.Duration
+	// Clock provides the time source, defaulting to the system clock
+	Clock Clock
+}
+
+// Timeout describes a phase that was ended because it ran too long
+type Timeout struct {
+	Phase Phase         `json:"phase"`
+	After time.Duration `json:"after"`
+	Taps  []nfc.Tap     `json:"taps,omitempty"`
+}
+
+// Reason explains why the session was reset
+func (t Timeout) Reason() string {
+	switch t.Phase {
+	case PhaseCollectingUIDs:
+		return "tap set abandoned"
+	case PhaseValidating:
+		return "validation timed out"
+	case PhaseRecordingMessage:
+		return "recording timed out"
+	case PhaseComplete:
+		return "cooldown finished"
+	default:
+		return "timed out"
+	}
+}
+
+// Clock abstracts time so that phase timeouts can be driven by tests
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending AfterFunc call
+type Timer interface {
+	Stop() bool
+}
+
+// systemClock implements Clock with the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
 // Manager handles system state and phase transitions
 type Manager struct {
-	mutex           sync.RWMutex
-	currentPhase    Phase
-	collectedUIDs   []string
-	validAccounts   []string
-	bondID          string
-	lastEvent       time.Time
-	subscribers     map[Phase][]func(Phase)
-	errorHandlers   []func(error)
+	mutex              sync.RWMutex
+	config             Config
+	clock              Clock
+	currentPhase       Phase
+	collectedTaps      []nfc.Tap
+	validAccounts      []string
+	bondID             string
+	lastEvent          time.Time
+	phaseTimer         Timer
+	timerGeneration    uint64
+	round              Round
+	subscribers        map[Phase][]func(Phase)
+	errorHandlers      []func(error)
+	timeoutHandlers    []func(Timeout)
+	tapHandlers        []func(nfc.Tap, int)
+	validationHandlers []func(Round, []nfc.Tap)
+	notifications      []func()
+	events             *events.Bus
 }
 
 // NewManager creates a new state manager instance
-func NewManager() *Manager {
+func NewManager(config Config) *Manager {
+	clock := config.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	if config.MaxBondSize <= 0 {
+		config.MaxBondSize = DefaultBondSize
+	}
+	if config.MinBondSize <= 0 || config.MinBondSize > config.MaxBondSize {
+		config.MinBondSize = config.MaxBondSize
+	}
 	return &Manager{
+		config:        config,
+		clock:         clock,
 		currentPhase:  PhaseInitial,
-		collectedUIDs: make([]string, 0),
+		collectedTaps: make([]nfc.Tap, 0),
 		subscribers:   make(map[Phase][]func(Phase)),
 		errorHandlers: make([]func(error), 0),
 	}
@@ -57,75 +193,195 @@ func NewManager() *Manager {
 // Start initializes the state manager
 func (m *Manager) Start(ctx context.Context) error {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	m.currentPhase = PhaseCollectingUIDs
-	m.notifySubscribers()
+	m.setPhase(PhaseCollectingUIDs, "")
+	m.unlockAndNotify()
 	return nil
 }
 
 // HandleEvent processes system events and updates state accordingly
 func (m *Manager) HandleEvent(event Event, data interface{}) error {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	defer m.unlockAndNotify()
 
-	m.lastEvent = time.Now()
+	m.lastEvent = m.clock.Now()
 
 	switch event {
 	case EventNFCTap:
-		return m.handleNFCTap(data.(string))
+		// data is an nfc.Tap, or a bare UID
+		var tap nfc.Tap
+		switch data := data.(type) {
+		case nfc.Tap:
+			tap = data
+		case string:
+			tap = nfc.Tap{UID: data, Time: m.lastEvent}
+		default:
+			return errors.New("invalid tap data")
+		}
+		_, err := m.tap(tap)
+		return err
 	case EventUIDValidated:
-		return m.handleUIDValidated(data.([]string))
+		result, ok := data.(ValidationResult)
+		if !ok {
+			return errors.New("invalid validation data")
+		}
+		return m.handleUIDValidated(result)
 	case EventRecordingStarted:
 		return m.handleRecordingStarted()
 	case EventRecordingComplete:
 		return m.handleRecordingComplete()
+	case EventRecordingFailed:
+		return m.handleRecordingFailed()
 	case EventError:
-		return m.handleError(data.(error))
+		// data is an error, or the ValidationResult of a failed validation
+		switch data := data.(type) {
+		case ValidationResult:
+			return m.handleValidationFailed(data)
+		case error:
+			return m.handleError(data)
+		default:
+			return errors.New("invalid error data")
+		}
+	case EventCommit:
+		return m.handleCommit()
 	default:
 		return errors.New("unknown event")
 	}
 }
 
+// Errors returned for taps and commits that cannot be accepted
+var (
+	ErrNotCollecting = errors.New("not collecting UIDs")
+	ErrDuplicateUID  = errors.New("duplicate UID")
+)
+
+// TapResult describes what happened to a tap
+type TapResult string
+
+const (
+	TapAccepted     TapResult = "accepted"
+	TapBondComplete TapResult = "bond_complete"
+	TapDuplicate    TapResult = "duplicate"
+	TapWrongPhase   TapResult = "rejected_wrong_phase"
+	TapRejected     TapResult = "rejected"
+)
+
+// HandleTap processes a tap like HandleEvent and also reports its result,
+// which readers use to give feedback
+func (m *Manager) HandleTap(tap nfc.Tap) (TapResult, error) {
+	m.mutex.Lock()
+	defer m.unlockAndNotify()
+
+	m.lastEvent = m.clock.Now()
+	return m.tap(tap)
+}
+
+// tap handles a tap and publishes rejections. Callers must hold the mutex.
+func (m *Manager) tap(tap nfc.Tap) (TapResult, error) {
+	err := m.handleNFCTap(tap)
+	if err != nil {
+		m.publishTap(tap, err)
+	}
+	return m.tapResult(err), err
+}
+
+// tapResult classifies the outcome of the latest tap. Callers must hold
+// the mutex.
+func (m *Manager) tapResult(err error) TapResult {
+	switch {
+	case errors.Is(err, ErrDuplicateUID):
+		return TapDuplicate
+	case errors.Is(err, ErrNotCollecting):
+		return TapWrongPhase
+	case err != nil:
+		return TapRejected
+	case len(m.collectedTaps) >= m.config.MaxBondSize:
+		return TapBondComplete
+	default:
+		return TapAccepted
+	}
+}
+
 // handleNFCTap processes an NFC tap event
-func (m *Manager) handleNFCTap(uid string) error {
+func (m *Manager) handleNFCTap(tap nfc.Tap) error {
 	if m.currentPhase != PhaseCollectingUIDs {
-		return errors.New("not collecting UIDs")
+		return ErrNotCollecting
 	}
 
 	// Check for duplicate UID
-	for _, existingUID := range m.collectedUIDs {
-		if existingUID == uid {
-			return errors.New("duplicate UID")
+	for _, existing := range m.collectedTaps {
+		if existing.UID == tap.UID {
+			return ErrDuplicateUID
 		}
 	}
 
-	// Store the raw UID
-	m.collectedUIDs = append(m.collectedUIDs, uid)
+	// Store the raw UID along with where and when it was tapped
+	if tap.Time.IsZero() {
+		tap.Time = m.lastEvent
+	}
+	m.collectedTaps = append(m.collectedTaps, tap)
+	logger.Debug("Tap collected", "session", m.config.Name, "uid", tap.UID, "tag_type", tap.TagType, "reader_id", tap.ReaderID, "collected", len(m.collectedTaps))
+	m.publishTap(tap, nil)
+	for _, handler := range m.tapHandlers {
+		handler, count := handler, len(m.collectedTaps)
+		m.notifications = append(m.notifications, func() { handler(tap, count) })
+	}
 
-	// If we have three UIDs, transition to validation phase
-	if len(m.collectedUIDs) == 3 {
-		m.currentPhase = PhaseValidating
-		m.notifySubscribers()
+	// A full bond goes straight to validation
+	if len(m.collectedTaps) >= m.config.MaxBondSize {
+		m.setPhase(PhaseValidating, "")
+		return nil
 	}
 
+	// Every tap gives the group a fresh collecting timeout
+	m.armTimer(m.config.CollectingTimeout)
+	return nil
+}
+
+// handleCommit closes an open-ended group and validates the UIDs
+// collected so far
+func (m *Manager) handleCommit() error {
+	if m.currentPhase != PhaseCollectingUIDs {
+		return ErrNotCollecting
+	}
+	if len(m.collectedTaps) < m.config.MinBondSize {
+		return fmt.Errorf("need at least %d UIDs, have %d", m.config.MinBondSize, len(m.collectedTaps))
+	}
+
+	m.setPhase(PhaseValidating, "")
 	return nil
 }
 
 // handleUIDValidated processes successful UID validation
-func (m *Manager) handleUIDValidated(accounts []string) error {
-	if m.currentPhase != PhaseValidating {
-		return errors.New("not in validation phase")
+func (m *Manager) handleUIDValidated(result ValidationResult) error {
+	if !m.holdsRound(result.Round) {
+		return ErrStaleRound
 	}
 
-	m.validAccounts = accounts
-	m.bondID = generateBondID(m.collectedUIDs)
-	m.currentPhase = PhaseRecordingMessage
-	m.notifySubscribers()
+	m.validAccounts = result.Accounts
+	m.bondID = generateBondID(m.uids(), m.lastEvent)
+	m.setPhase(PhaseRecordingMessage, "")
 
 	return nil
 }
 
+// handleValidationFailed ends the round of a group that Cursive rejected
+// or could not validate, freeing the session for the next group
+func (m *Manager) handleValidationFailed(result ValidationResult) error {
+	if !m.holdsRound(result.Round) {
+		return ErrStaleRound
+	}
+
+	logger.Warn("Validation failed, resetting session", "session", m.config.Name, "uids", m.uids(), "error", result.Err)
+	m.reset(result.Err.Error())
+	return m.handleError(result.Err)
+}
+
+// holdsRound reports whether the session is still validating the group
+// of round. Callers must hold the mutex.
+func (m *Manager) holdsRound(round Round) bool {
+	return m.currentPhase == PhaseValidating && m.round == round
+}
+
 // handleRecordingStarted processes the start of message recording
 func (m *Manager) handleRecordingStarted() error {
 	if m.currentPhase != PhaseRecordingMessage {
@@ -141,20 +397,123 @@ func (m *Manager) handleRecordingComplete() error {
 		return errors.New("not in recording phase")
 	}
 
-	m.currentPhase = PhaseComplete
-	m.notifySubscribers()
+	m.setPhase(PhaseComplete, "")
+
+	return nil
+}
+
+// handleRecordingFailed resets a session whose recording captured nothing,
+// rather than completing the bond without a message
+func (m *Manager) handleRecordingFailed() error {
+	if m.currentPhase != PhaseRecordingMessage {
+		return errors.New("not in recording phase")
+	}
 
+	m.reset("recording failed")
 	return nil
 }
 
 // handleError processes system errors
 func (m *Manager) handleError(err error) error {
 	for _, handler := range m.errorHandlers {
-		handler(err)
+		handler := handler
+		m.notifications = append(m.notifications, func() { handler(err) })
 	}
 	return nil
 }
 
+// handleTimeout resets the session if the phase timer for generation is
+// still the active one
+func (m *Manager) handleTimeout(generation uint64, after time.Duration) {
+	m.mutex.Lock()
+	defer m.unlockAndNotify()
+
+	if generation != m.timerGeneration {
+		return
+	}
+
+	timeout := Timeout{
+		Phase: m.currentPhase,
+		After: after,
+		Taps:  append([]nfc.Tap{}, m.collectedTaps...),
+	}
+	m.lastEvent = m.clock.Now()
+	logger.Warn("Phase timed out, resetting session", "session", m.config.Name, "phase", timeout.Phase, "after", after, "uids", m.uids())
+	m.events.Publish(events.TypeTimeout, events.TimeoutData{
+		Session: m.config.Name,
+		Phase:   timeout.Phase.String(),
+		After:   timeout.After.String(),
+		UIDs:    m.uids(),
+	})
+	m.reset(timeout.Reason())
+
+	for _, handler := range m.timeoutHandlers {
+		handler := handler
+		m.notifications = append(m.notifications, func() { handler(timeout) })
+	}
+}
+
+// setPhase moves to phase, queues subscriber notifications and arms the
+// phase timeout. reason explains a reset. Callers must hold the mutex.
+func (m *Manager) setPhase(phase Phase, reason string) {
+	previous := m.currentPhase
+	m.currentPhase = phase
+	logger.Info("Phase changed", "session", m.config.Name, "phase", phase, "previous", previous, "taps", len(m.collectedTaps))
+	m.notifySubscribers()
+	m.events.Publish(events.TypePhase, events.PhaseData{
+		Session:  m.config.Name,
+		Phase:    phase.String(),
+		Previous: previous.String(),
+		BondID:   m.bondID,
+		Taps:     len(m.collectedTaps),
+		Reason:   reason,
+	})
+
+	switch phase {
+	case PhaseCollectingUIDs:
+		// Only a partial tap set can be abandoned
+		if len(m.collectedTaps) > 0 {
+			m.armTimer(m.config.CollectingTimeout)
+		} else {
+			m.stopTimer()
+		}
+	case PhaseValidating:
+		m.round++
+		m.notifyValidation()
+		m.armTimer(m.config.ValidatingTimeout)
+	case PhaseRecordingMessage:
+		m.armTimer(m.config.RecordingTimeout)
+	case PhaseComplete:
+		m.armTimer(m.config.CompleteCooldown)
+	default:
+		m.stopTimer()
+	}
+}
+
+// armTimer replaces the phase timer. A zero duration only cancels it.
+// Callers must hold the mutex.
+func (m *Manager) armTimer(d time.Duration) {
+	m.stopTimer()
+	if d <= 0 {
+		return
+	}
+
+	generation := m.timerGeneration
+	m.phaseTimer = m.clock.AfterFunc(d, func() {
+		m.handleTimeout(generation, d)
+	})
+}
+
+// stopTimer cancels the phase timer. Bumping the generation also defeats
+// a timer that already fired and is waiting for the mutex.
+func (m *Manager) stopTimer() {
+	m.timerGeneration++
+	if m.phaseTimer != nil {
+		m.phaseTimer.Stop()
+		m.phaseTimer = nil
+	}
+}
+
 // Subscribe registers a callback for phase changes
 func (m *Manager) Subscribe(phase Phase, callback func(Phase)) {
 	m.mutex.Lock()
@@ -174,15 +533,95 @@ func (m *Manager) SubscribeError(handler func(error)) {
 	m.errorHandlers = append(m.errorHandlers, handler)
 }
 
-// notifySubscribers notifies all subscribers of the current phase
+// SubscribeTimeout registers a callback for sessions reset by a phase
+// timeout. Phase subscribers for PhaseCollectingUIDs are notified as well.
+func (m *Manager) SubscribeTimeout(handler func(Timeout)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.timeoutHandlers = append(m.timeoutHandlers, handler)
+}
+
+// SetEventBus sets the bus that phase changes, taps and timeouts are
+// published to
+func (m *Manager) SetEventBus(bus *events.Bus) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.events = bus
+}
+
+// publishTap publishes the outcome of a tap. Callers must hold the mutex.
+func (m *Manager) publishTap(tap nfc.Tap, err error) {
+	data := events.TapData{
+		Session:   m.config.Name,
+		UID:       tap.UID,
+		TagType:   tap.TagType,
+		ReaderID:  tap.ReaderID,
+		RSSI:      tap.RSSI,
+		TappedAt:  tap.Time,
+		Accepted:  err == nil,
+		Result:    string(m.tapResult(err)),
+		Collected: len(m.collectedTaps),
+	}
+	if err != nil {
+		data.Reason = err.Error()
+	}
+	m.events.Publish(events.TypeTap, data)
+}
+
+// SubscribeTap registers a callback for accepted taps. It receives the tap
+// and the number of taps collected so far.
+func (m *Manager) SubscribeTap(handler func(nfc.Tap, int)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.tapHandlers = append(m.tapHandlers, handler)
+}
+
+// SubscribeValidation registers a callback for groups that are ready to
+// be validated. It receives the round that the result must carry and the
+// group's taps.
+func (m *Manager) SubscribeValidation(handler func(Round, []nfc.Tap)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.validationHandlers = append(m.validationHandlers, handler)
+}
+
+// notifyValidation queues notifications for validation subscribers.
+// Callers must hold the mutex.
+func (m *Manager) notifyValidation() {
+	round := m.round
+	for _, handler := range m.validationHandlers {
+		handler, taps := handler, append([]nfc.Tap{}, m.collectedTaps...)
+		m.notifications = append(m.notifications, func() { handler(round, taps) })
+	}
+}
+
+// notifySubscribers queues notifications for subscribers of the current
+// phase. Callers must hold the mutex.
 func (m *Manager) notifySubscribers() {
-	if callbacks, ok := m.subscribers[m.currentPhase]; ok {
+	phase := m.currentPhase
+	if callbacks, ok := m.subscribers[phase]; ok {
 		for _, callback := range callbacks {
-			callback(m.currentPhase)
+			callback := callback
+			m.notifications = append(m.notifications, func() { callback(phase) })
 		}
 	}
 }
 
+// unlockAndNotify releases the mutex and then runs queued notifications,
+// so callbacks are free to call back into the manager
+func (m *Manager) unlockAndNotify() {
+	notifications := m.notifications
+	m.notifications = nil
+	m.mutex.Unlock()
+
+	for _, notify := range notifications {
+		notify()
+	}
+}
+
 // GetPhase returns the current system phase
 func (m *Manager) GetPhase() Phase {
 	m.mutex.RLock()
@@ -194,21 +633,35 @@ func (m *Manager) GetPhase() Phase {
 func (m *Manager) GetCollectedUIDs() []string {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	return append([]string{}, m.collectedUIDs...)
+	return m.uids()
+}
+
+// uids returns the UIDs of the collected taps
+func (m *Manager) uids() []string {
+	uids := make([]string, len(m.collectedTaps))
+	for i, tap := range m.collectedTaps {
+		uids[i] = tap.UID
+	}
+	return uids
 }
 
 // GetFormattedUIDs returns the UIDs in the Cursive URL format
 func (m *Manager) GetFormattedUIDs() []string {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	
-	formatted := make([]string, len(m.collectedUIDs))
-	for i, uid := range m.collectedUIDs {
-		formatted[i] = fmt.Sprintf("https://nfc.cursive.team/tap?uid=%s", uid)
+
+	formatted := make([]string, len(m.collectedTaps))
+	for i, tap := range m.collectedTaps {
+		formatted[i] = fmt.Sprintf("https://nfc.cursive.team/tap?uid=%s", tap.UID)
 	}
 	return formatted
 }
 
+// GetBondSize returns the minimum and maximum number of UIDs in a bond
+func (m *Manager) GetBondSize() (min, max int) {
+	return m.config.MinBondSize, m.config.MaxBondSize
+}
+
 // GetBondID returns the current bond ID
 func (m *Manager) GetBondID() string {
 	m.mutex.RLock()
@@ -216,28 +669,39 @@ func (m *Manager) GetBondID() string {
 	return m.bondID
 }
 
+// GetValidAccounts returns the accounts Cursive returned for the bond
+func (m *Manager) GetValidAccounts() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return append([]string{}, m.validAccounts...)
+}
+
 // Reset resets the state manager to initial conditions
 func (m *Manager) Reset() {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.reset("reset")
+	m.unlockAndNotify()
+}
 
-	m.currentPhase = PhaseCollectingUIDs
-	m.collectedUIDs = make([]string, 0)
+// reset clears the session and returns to collecting for reason. Callers
+// must hold the mutex.
+func (m *Manager) reset(reason string) {
+	m.collectedTaps = make([]nfc.Tap, 0)
 	m.validAccounts = nil
 	m.bondID = ""
-	m.notifySubscribers()
+	m.setPhase(PhaseCollectingUIDs, reason)
 }
 
 // generateBondID creates a unique bond ID from UIDs
-func generateBondID(uids []string) string {
+func generateBondID(uids []string, now time.Time) string {
 	// Create a unique identifier by combining UIDs and timestamp
-	timestamp := time.Now().UTC().Format(time.RFC3339)
+	timestamp := now.UTC().Format(time.RFC3339)
 	combined := fmt.Sprintf("%s-%s", timestamp, uids)
-	
+
 	// Generate SHA-256 hash
 	hash := sha256.New()
 	hash.Write([]byte(combined))
-	
+
 	// Return first 16 characters of the hex-encoded hash
 	return hex.EncodeToString(hash.Sum(nil))[:16]
 }
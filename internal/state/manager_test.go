@@ -0,0 +1,539 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"fizhub/internal/events"
+	"fizhub/internal/nfc"
+)
+
+// fakeClock is a Clock whose timers only fire when the test advances it
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a pending fakeClock.AfterFunc call
+type fakeTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+	fired   bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	active := !t.stopped && !t.fired
+	t.stopped = true
+	return active
+}
+
+// Advance moves the clock forward and runs the timers that became due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if !t.stopped && !t.fired && !t.at.After(c.now) {
+			t.fired = true
+			due = append(due, t)
+		}
+	}
+	c.mutex.Unlock()
+
+	// Timers call back into the manager, which creates new timers
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// lastTimer returns the most recently created timer
+func (c *fakeClock) lastTimer() *fakeTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.timers[len(c.timers)-1]
+}
+
+var testConfig = Config{
+	Name:              "test",
+	MaxBondSize:       2,
+	CollectingTimeout: 30 * time.Second,
+	ValidatingTimeout: 20 * time.Second,
+	RecordingTimeout:  2 * time.Minute,
+	CompleteCooldown:  5 * time.Second,
+}
+
+// testManager is a started manager with a fake clock that records the
+// timeouts and validation rounds it reports
+type testManager struct {
+	*Manager
+	t        *testing.T
+	clock    *fakeClock
+	events   *events.Subscription
+	timeouts []Timeout
+	rounds   []Round
+}
+
+func newTestManager(t *testing.T) *testManager {
+	t.Helper()
+	return newTestManagerWith(t, testConfig)
+}
+
+func newTestManagerWith(t *testing.T, config Config) *testManager {
+	t.Helper()
+	clock := newFakeClock()
+	config.Clock = clock
+	bus := events.NewBus(events.Config{})
+
+	tm := &testManager{Manager: NewManager(config), t: t, clock: clock, events: bus.Subscribe(0)}
+	tm.SetEventBus(bus)
+	tm.SubscribeTimeout(func(timeout Timeout) { tm.timeouts = append(tm.timeouts, timeout) })
+	tm.SubscribeValidation(func(round Round, taps []nfc.Tap) { tm.rounds = append(tm.rounds, round) })
+	if err := tm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+// tap taps uid and fails the test if it is not accepted
+func (tm *testManager) tap(uid string) {
+	tm.t.Helper()
+	if _, err := tm.HandleTap(nfc.Tap{UID: uid}); err != nil {
+		tm.t.Fatalf("tap %s: %v", uid, err)
+	}
+}
+
+// round returns the round of the latest validation
+func (tm *testManager) round() Round {
+	tm.t.Helper()
+	if len(tm.rounds) == 0 {
+		tm.t.Fatal("no validation was started")
+	}
+	return tm.rounds[len(tm.rounds)-1]
+}
+
+// advanceTo drives a fresh session into phase
+func (tm *testManager) advanceTo(phase Phase) {
+	tm.t.Helper()
+	if phase == PhaseCollectingUIDs {
+		tm.tap("04a1")
+		return
+	}
+	tm.tap("04a1")
+	tm.tap("04b2")
+	if phase == PhaseValidating {
+		return
+	}
+	if err := tm.HandleEvent(EventUIDValidated, ValidationResult{Round: tm.round(), Accounts: []string{"acct"}}); err != nil {
+		tm.t.Fatal(err)
+	}
+	if phase == PhaseRecordingMessage {
+		return
+	}
+	if err := tm.HandleEvent(EventRecordingComplete, nil); err != nil {
+		tm.t.Fatal(err)
+	}
+}
+
+// expectPhase fails the test unless the session is in phase with n taps
+func (tm *testManager) expectPhase(phase Phase, n int) {
+	tm.t.Helper()
+	if got := tm.GetPhase(); got != phase {
+		tm.t.Fatalf("phase %s, want %s", got, phase)
+	}
+	if got := len(tm.GetCollectedUIDs()); got != n {
+		tm.t.Fatalf("%d taps collected, want %d", got, n)
+	}
+}
+
+// timeoutEvent returns the TimeoutData published since the last call, if
+// any
+func (tm *testManager) timeoutEvent() (events.TimeoutData, bool) {
+	for {
+		select {
+		case event := <-tm.events.Events():
+			if event.Type == events.TypeTimeout {
+				return event.Data.(events.TimeoutData), true
+			}
+		default:
+			return events.TimeoutData{}, false
+		}
+	}
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	tests := []struct {
+		phase  Phase
+		after  time.Duration
+		reason string
+		uids   int
+	}{
+		{PhaseCollectingUIDs, testConfig.CollectingTimeout, "tap set abandoned", 1},
+		{PhaseValidating, testConfig.ValidatingTimeout, "validation timed out", 2},
+		{PhaseRecordingMessage, testConfig.RecordingTimeout, "recording timed out", 2},
+		{PhaseComplete, testConfig.CompleteCooldown, "cooldown finished", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phase.String(), func(t *testing.T) {
+			tm := newTestManager(t)
+			tm.advanceTo(tt.phase)
+			tm.timeoutEvent()
+
+			tm.clock.Advance(tt.after - time.Millisecond)
+			if got := tm.GetPhase(); got != tt.phase {
+				t.Fatalf("left %s early for %s", tt.phase, got)
+			}
+			if len(tm.timeouts) != 0 {
+				t.Fatalf("timed out early: %+v", tm.timeouts)
+			}
+
+			tm.clock.Advance(time.Millisecond)
+			tm.expectPhase(PhaseCollectingUIDs, 0)
+			if tm.GetBondID() != "" {
+				t.Fatal("bond ID survived the reset")
+			}
+
+			if len(tm.timeouts) != 1 {
+				t.Fatalf("%d timeouts reported, want 1", len(tm.timeouts))
+			}
+			timeout := tm.timeouts[0]
+			if timeout.Phase != tt.phase || timeout.After != tt.after || timeout.Reason() != tt.reason {
+				t.Fatalf("timeout %s after %s (%s), want %s after %s (%s)",
+					timeout.Phase, timeout.After, timeout.Reason(), tt.phase, tt.after, tt.reason)
+			}
+			if len(timeout.Taps) != tt.uids {
+				t.Fatalf("timeout carries %d taps, want %d", len(timeout.Taps), tt.uids)
+			}
+
+			event, ok := tm.timeoutEvent()
+			if !ok {
+				t.Fatal("no timeout event published")
+			}
+			if event.Session != "test" || event.Phase != tt.phase.String() || event.After != tt.after.String() || len(event.UIDs) != tt.uids {
+				t.Fatalf("unexpected timeout event %+v", event)
+			}
+		})
+	}
+}
+
+func TestCollectingTimeoutRestartsOnTap(t *testing.T) {
+	config := testConfig
+	config.MaxBondSize = 3
+	tm := newTestManagerWith(t, config)
+
+	tm.tap("04a1")
+	tm.clock.Advance(config.CollectingTimeout - time.Second)
+	tm.tap("04b2")
+	tm.clock.Advance(config.CollectingTimeout - time.Second)
+	tm.expectPhase(PhaseCollectingUIDs, 2)
+	if len(tm.timeouts) != 0 {
+		t.Fatalf("timed out before the window ended: %+v", tm.timeouts)
+	}
+
+	tm.clock.Advance(time.Second)
+	tm.expectPhase(PhaseCollectingUIDs, 0)
+	if len(tm.timeouts) != 1 || len(tm.timeouts[0].Taps) != 2 {
+		t.Fatalf("unexpected timeouts %+v", tm.timeouts)
+	}
+}
+
+func TestNoCollectingTimeoutWithoutTaps(t *testing.T) {
+	tm := newTestManager(t)
+	tm.clock.Advance(time.Hour)
+	tm.expectPhase(PhaseCollectingUIDs, 0)
+	if len(tm.timeouts) != 0 {
+		t.Fatalf("empty session timed out: %+v", tm.timeouts)
+	}
+}
+
+func TestStaleTimerAfterReset(t *testing.T) {
+	tm := newTestManager(t)
+	tm.tap("04a1")
+	timer := tm.clock.lastTimer()
+	tm.Reset()
+
+	// A timer that fired just before the reset runs once the reset
+	// releases the mutex, and must find its generation superseded
+	timer.f()
+	tm.expectPhase(PhaseCollectingUIDs, 0)
+	if len(tm.timeouts) != 0 {
+		t.Fatalf("stale timer reset the session: %+v", tm.timeouts)
+	}
+	if _, ok := tm.timeoutEvent(); ok {
+		t.Fatal("stale timer published a timeout")
+	}
+}
+
+func TestStaleTimerAfterTap(t *testing.T) {
+	config := testConfig
+	config.MaxBondSize = 3
+	tm := newTestManagerWith(t, config)
+
+	tm.tap("04a1")
+	first := tm.clock.lastTimer()
+	tm.tap("04b2")
+
+	// The second tap re-armed the collecting timeout, so the first
+	// timer's generation is superseded even if it already fired
+	first.f()
+	tm.expectPhase(PhaseCollectingUIDs, 2)
+	if len(tm.timeouts) != 0 {
+		t.Fatalf("stale timer reset the session: %+v", tm.timeouts)
+	}
+}
+
+func TestStaleValidationResult(t *testing.T) {
+	tm := newTestManager(t)
+	tm.advanceTo(PhaseValidating)
+	stale := tm.round()
+
+	// The validating timeout frees the session and the next group starts
+	// validating before Cursive answers the first
+	tm.clock.Advance(testConfig.ValidatingTimeout)
+	tm.tap("04c3")
+	tm.tap("04d4")
+	current := tm.round()
+	if current == stale {
+		t.Fatal("new group validated in the same round")
+	}
+
+	if err := tm.HandleEvent(EventUIDValidated, ValidationResult{Round: stale, Accounts: []string{"old"}}); !errors.Is(err, ErrStaleRound) {
+		t.Fatalf("stale result returned %v, want ErrStaleRound", err)
+	}
+	if err := tm.HandleEvent(EventError, ValidationResult{Round: stale, Err: errors.New("unreachable")}); !errors.Is(err, ErrStaleRound) {
+		t.Fatalf("stale error returned %v, want ErrStaleRound", err)
+	}
+	tm.expectPhase(PhaseValidating, 2)
+
+	if err := tm.HandleEvent(EventUIDValidated, ValidationResult{Round: current, Accounts: []string{"acct"}}); err != nil {
+		t.Fatal(err)
+	}
+	tm.expectPhase(PhaseRecordingMessage, 2)
+	if accounts := tm.GetValidAccounts(); len(accounts) != 1 || accounts[0] != "acct" {
+		t.Fatalf("accounts %v, want [acct]", accounts)
+	}
+}
+
+func TestValidationFailureCancelsTimeout(t *testing.T) {
+	tm := newTestManager(t)
+	tm.advanceTo(PhaseValidating)
+	if err := tm.HandleEvent(EventError, ValidationResult{Round: tm.round(), Err: errors.New("unreachable")}); err != nil {
+		t.Fatal(err)
+	}
+	tm.expectPhase(PhaseCollectingUIDs, 0)
+
+	// The validating timeout was cancelled with the round
+	tm.clock.Advance(testConfig.ValidatingTimeout)
+	if len(tm.timeouts) != 0 {
+		t.Fatalf("reset round timed out: %+v", tm.timeouts)
+	}
+}
+
+func TestValidationFailureResets(t *testing.T) {
+	tm := newTestManager(t)
+	var errs []error
+	tm.SubscribeError(func(err error) { errs = append(errs, err) })
+	tm.advanceTo(PhaseValidating)
+	for len(tm.events.Events()) > 0 {
+		<-tm.events.Events()
+	}
+
+	rejection := errors.New("tag not registered")
+	if err := tm.HandleEvent(EventError, ValidationResult{Round: tm.round(), Err: rejection}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session is free at once rather than after the validating timeout
+	tm.expectPhase(PhaseCollectingUIDs, 0)
+	if len(errs) != 1 || errs[0] != rejection {
+		t.Fatalf("error handlers got %v", errs)
+	}
+	event := <-tm.events.Events()
+	phase, ok := event.Data.(events.PhaseData)
+	if !ok || phase.Phase != "collecting_uids" || phase.Previous != "validating" || phase.Reason != "tag not registered" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	tm.clock.Advance(testConfig.ValidatingTimeout)
+	if len(tm.timeouts) != 0 {
+		t.Fatalf("rejected bond later timed out: %+v", tm.timeouts)
+	}
+	tm.tap("04c3")
+}
+
+func TestRecordingFailureResets(t *testing.T) {
+	tm := newTestManager(t)
+	tm.advanceTo(PhaseRecordingMessage)
+	if err := tm.HandleEvent(EventRecordingFailed, nil); err != nil {
+		t.Fatal(err)
+	}
+	tm.expectPhase(PhaseCollectingUIDs, 0)
+
+	// A failure reported after the session moved on is ignored
+	tm.tap("04c3")
+	if err := tm.HandleEvent(EventRecordingFailed, nil); err == nil {
+		t.Fatal("late recording failure was applied")
+	}
+	tm.expectPhase(PhaseCollectingUIDs, 1)
+}
+
+func TestBondSizeDefaults(t *testing.T) {
+	tests := []struct {
+		name             string
+		minSize, maxSize int
+		wantMin, wantMax int
+	}{
+		{"unset", 0, 0, DefaultBondSize, DefaultBondSize},
+		{"fixed", 0, 4, 4, 4},
+		{"range", 2, 5, 2, 5},
+		{"min above max", 6, 4, 4, 4},
+		{"negative min", -1, 3, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(Config{MinBondSize: tt.minSize, MaxBondSize: tt.maxSize})
+			if min, max := m.GetBondSize(); min != tt.wantMin || max != tt.wantMax {
+				t.Fatalf("bond size %d-%d, want %d-%d", min, max, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestCommit(t *testing.T) {
+	config := testConfig
+	config.MinBondSize = 2
+	config.MaxBondSize = 4
+
+	tests := []struct {
+		name     string
+		taps     int
+		wantErr  bool
+		wantTaps int
+	}{
+		{"empty", 0, true, 0},
+		{"below minimum", 1, true, 1},
+		{"at minimum", 2, false, 2},
+		{"between minimum and maximum", 3, false, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestManagerWith(t, config)
+			for i := 0; i < tt.taps; i++ {
+				tm.tap(string(rune('a' + i)))
+			}
+
+			err := tm.HandleEvent(EventCommit, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("commit accepted")
+				}
+				// A refused commit leaves the group collecting
+				tm.expectPhase(PhaseCollectingUIDs, tt.wantTaps)
+				if len(tm.rounds) != 0 {
+					t.Fatal("refused commit started a validation")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tm.expectPhase(PhaseValidating, tt.wantTaps)
+			if len(tm.rounds) != 1 {
+				t.Fatalf("%d validations started, want 1", len(tm.rounds))
+			}
+		})
+	}
+}
+
+func TestCommitOutsideCollecting(t *testing.T) {
+	for _, phase := range []Phase{PhaseValidating, PhaseRecordingMessage, PhaseComplete} {
+		t.Run(phase.String(), func(t *testing.T) {
+			tm := newTestManager(t)
+			tm.advanceTo(phase)
+			if err := tm.HandleEvent(EventCommit, nil); !errors.Is(err, ErrNotCollecting) {
+				t.Fatalf("commit returned %v, want ErrNotCollecting", err)
+			}
+			if got := tm.GetPhase(); got != phase {
+				t.Fatalf("commit moved the session to %s", got)
+			}
+		})
+	}
+}
+
+func TestMaximumBondValidatesWithoutCommit(t *testing.T) {
+	config := testConfig
+	config.MinBondSize = 2
+	config.MaxBondSize = 3
+	tm := newTestManagerWith(t, config)
+
+	results := []TapResult{TapAccepted, TapAccepted, TapBondComplete}
+	for i, want := range results {
+		result, err := tm.HandleTap(nfc.Tap{UID: string(rune('a' + i))})
+		if err != nil || result != want {
+			t.Fatalf("tap %d: %s %v, want %s", i, result, err, want)
+		}
+	}
+	tm.expectPhase(PhaseValidating, 3)
+
+	// The full bond is already validating, so neither a commit nor a
+	// fourth tap changes it
+	if err := tm.HandleEvent(EventCommit, nil); !errors.Is(err, ErrNotCollecting) {
+		t.Fatalf("commit returned %v, want ErrNotCollecting", err)
+	}
+	if result, err := tm.HandleTap(nfc.Tap{UID: "d"}); result != TapWrongPhase || !errors.Is(err, ErrNotCollecting) {
+		t.Fatalf("fourth tap: %s %v, want %s", result, err, TapWrongPhase)
+	}
+	tm.expectPhase(PhaseValidating, 3)
+	if len(tm.rounds) != 1 {
+		t.Fatalf("%d validations started, want 1", len(tm.rounds))
+	}
+}
+
+func TestSingleTapBond(t *testing.T) {
+	config := testConfig
+	config.MaxBondSize = 1
+	tm := newTestManagerWith(t, config)
+
+	result, err := tm.HandleTap(nfc.Tap{UID: "04a1"})
+	if err != nil || result != TapBondComplete {
+		t.Fatalf("tap: %s %v, want %s", result, err, TapBondComplete)
+	}
+	tm.expectPhase(PhaseValidating, 1)
+}
+
+func TestDuplicateTapDoesNotCount(t *testing.T) {
+	tm := newTestManager(t)
+	tm.tap("04a1")
+	result, err := tm.HandleTap(nfc.Tap{UID: "04a1"})
+	if result != TapDuplicate || !errors.Is(err, ErrDuplicateUID) {
+		t.Fatalf("duplicate tap: %s %v", result, err)
+	}
+	tm.expectPhase(PhaseCollectingUIDs, 1)
+
+	// A minimum of the full bond size still needs a second tag
+	if err := tm.HandleEvent(EventCommit, nil); err == nil {
+		t.Fatal("commit accepted one UID for a bond of two")
+	}
+}
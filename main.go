@@ -2,13 +2,14 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"fizhub/cmd/fizhub"
 )
 
 func main() {
 	log.Println("Starting FizHub application...")
-	if err := fizhub.Run(); err != nil {
+	if err := fizhub.Run(os.Args[1:]); err != nil {
 		log.Fatalf("Application error: %v", err)
 	}
 }